@@ -0,0 +1,234 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// Add is the equivalent of `apk add packages...` against an existing root. It resolves packages with
+// the installed packages as the baseline, installs only what is not installed yet, and then adds
+// packages to world. Installed packages are never upgraded, reinstalled or removed; if a package or
+// dependency can only be satisfied by a different version of an installed package, it fails instead.
+// Unlike FixateWorld, the rest of world is not re-resolved.
+func (a *APK) Add(ctx context.Context, packages []string, sourceDateEpoch *time.Time) error {
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading repository indexes: %w", err)
+	}
+	return a.AddWithIndexes(ctx, indexes, packages, sourceDateEpoch)
+}
+
+// AddWithIndexes is like Add, but resolves packages from indexes instead of the configured repositories.
+func (a *APK) AddWithIndexes(ctx context.Context, indexes []NamedIndex, packages []string, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Add")
+	defer span.End()
+
+	a.logger.Infof("adding %s", strings.Join(packages, " "))
+
+	toInstall, conflicts, err := a.resolveAdd(ctx, indexes, packages)
+	if err != nil {
+		return err
+	}
+	if a.resolveValidator != nil {
+		if err := a.resolveValidator(toInstall); err != nil {
+			return fmt.Errorf("resolved packages rejected: %w", err)
+		}
+	}
+	for _, pkg := range conflicts {
+		isInstalled, err := a.isInstalledPackage(pkg)
+		if err != nil {
+			return fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
+		}
+		if isInstalled {
+			return fmt.Errorf("cannot install due to conflict with %s", pkg)
+		}
+	}
+	// and the other way around, installed packages that conflict with what is added
+	installed, err := a.GetInstalled()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error getting installed packages: %w", err)
+	}
+	if err := conflictsWithInstalled(installed, toInstall); err != nil {
+		return err
+	}
+
+	// the packages installed before any failure keep their scripts and triggers
+	hooks, err := a.installPackages(ctx, toInstall, signedRepositories(indexes), sourceDateEpoch)
+	if recordErr := a.recordHooks(hooks); recordErr != nil {
+		return errors.Join(err, recordErr)
+	}
+	added := packages
+	if err != nil {
+		// world only lists what actually was added
+		if added = a.installedOf(ctx, packages); len(added) == 0 {
+			return err
+		}
+	}
+
+	world, worldErr := a.GetWorld()
+	if worldErr != nil && !errors.Is(worldErr, fs.ErrNotExist) {
+		return errors.Join(err, fmt.Errorf("error getting world packages: %w", worldErr))
+	}
+	return errors.Join(err, a.SetWorld(addToWorld(world, added)))
+}
+
+// conflictsWithInstalled returns an error if any of the installed packages declares a conflict,
+// i.e. a !name dependency, with one of the packages in toInstall.
+func conflictsWithInstalled(installed []*InstalledPackage, toInstall []*repository.RepositoryPackage) error {
+	adding := make(map[string]bool, len(toInstall))
+	for _, pkg := range toInstall {
+		adding[pkg.Name] = true
+	}
+	for _, pkg := range installed {
+		for _, dep := range pkg.Dependencies {
+			if !strings.HasPrefix(dep, "!") {
+				continue
+			}
+			if name := resolvePackageNameVersionPin(dep[1:]).name; adding[name] {
+				return fmt.Errorf("cannot install %s due to conflict with installed %s", name, pkg.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// installedOf returns the packages, as given to Add, that the installed packages satisfy along
+// with their dependencies, e.g. after installing them only partly succeeded.
+func (a *APK) installedOf(ctx context.Context, packages []string) []string {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil
+	}
+	resolver := NewPkgResolver(ctx, []NamedIndex{installedIndex(installed)})
+	var satisfied []string
+	for _, pkg := range packages {
+		if _, _, err := resolver.GetPackagesWithDependencies(ctx, []string{pkg}); err == nil {
+			satisfied = append(satisfied, pkg)
+		}
+	}
+	return satisfied
+}
+
+// resolveAdd resolves packages and their dependencies from indexes, preferring the installed
+// packages, and returns the ones that are not installed yet in install order, along with the
+// packages they conflict with.
+func (a *APK) resolveAdd(ctx context.Context, indexes []NamedIndex, packages []string) ([]*repository.RepositoryPackage, []string, error) {
+	installed, err := a.GetInstalled()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	indexes, err = a.applyHolds(indexes)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the installed packages are candidates too, so they can be kept even if the repositories
+	// no longer have the installed version, and they are preferred as they are in existing
+	installedIdx := installedIndex(installed)
+	resolver := NewPkgResolver(ctx, append(indexes[:len(indexes):len(indexes)], installedIdx), a.resolverOptions()...)
+	existing := make(map[string]*repository.RepositoryPackage, len(installed))
+	for _, pkg := range installedIdx.Packages() {
+		existing[pkg.Name] = pkg
+	}
+
+	toInstall, conflicts, err := a.resolveOnBaseline(resolver, existing, packages, "installed")
+	var conflict baselineConflictError
+	if errors.As(err, &conflict) {
+		if downgrade := a.checkDowngrade(conflict.required, conflict.current.Version); downgrade != nil {
+			return nil, nil, downgrade
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return toInstall, conflicts, nil
+}
+
+// baselineConflictError is returned by resolveOnBaseline when resolving name requires a different
+// version of a package than the one in the baseline.
+type baselineConflictError struct {
+	name     string
+	current  *repository.RepositoryPackage
+	required *repository.RepositoryPackage
+	baseline string
+}
+
+func (b baselineConflictError) Error() string {
+	return fmt.Sprintf("cannot add %s: it requires %s %s, but %s is %s", b.name, b.required.Name, b.required.Version, b.current.Version, b.baseline)
+}
+
+// resolveOnBaseline resolves packages and their dependencies with resolver, preferring the packages
+// in existing, which is what they are resolved on top of, and returns the ones that are not in
+// existing yet in install order, along with the packages they conflict with. It fails if anything
+// requires a different version of a package in existing; baseline describes how those packages are
+// fixed, e.g. "installed", for the error. New packages are added to existing.
+func (a *APK) resolveOnBaseline(resolver *PkgResolver, existing map[string]*repository.RepositoryPackage, packages []string, baseline string) ([]*repository.RepositoryPackage, []string, error) {
+	var (
+		toInstall []*repository.RepositoryPackage
+		conflicts []string
+	)
+	for _, name := range packages {
+		pkg, deps, confs, err := resolver.GetPackageWithDependencies(name, existing)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, dep := range append(deps, pkg) {
+			if current, ok := existing[dep.Name]; ok {
+				if current.Version != dep.Version {
+					return nil, nil, baselineConflictError{name: name, current: current, required: dep, baseline: baseline}
+				}
+				continue
+			}
+			toInstall = append(toInstall, dep)
+			existing[dep.Name] = dep
+		}
+		conflicts = append(conflicts, confs...)
+	}
+	for _, invalid := range resolver.InvalidVersions() {
+		a.logger.Warnf("%v, ranking it lowest", invalid)
+	}
+	return toInstall, uniqify(conflicts), nil
+}
+
+// addToWorld returns world with packages added, replacing any entry for the same package, so that
+// adding a package with a different version constraint updates the constraint.
+func addToWorld(world, packages []string) []string {
+	added := make(map[string]bool, len(packages))
+	for _, pkg := range packages {
+		added[resolvePackageNameVersionPin(pkg).name] = true
+	}
+	updated := make([]string, 0, len(world)+len(packages))
+	for _, entry := range world {
+		if !added[resolvePackageNameVersionPin(entry).name] {
+			updated = append(updated, entry)
+		}
+	}
+	for _, pkg := range packages {
+		if added[resolvePackageNameVersionPin(pkg).name] {
+			updated = append(updated, pkg)
+			// only the first entry for a package, like apk does
+			added[resolvePackageNameVersionPin(pkg).name] = false
+		}
+	}
+	return updated
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestAdd(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeAPK := func(name, version string) []byte {
+		b := testCreateAPK(t, "pkgname = "+name+"\npkgver = "+version+"\narch = aarch64\n", []testDirEntry{
+			{path: "usr", perms: 0o755, dir: true},
+			{path: "usr/share", perms: 0o755, dir: true},
+			{path: "usr/share/" + name, perms: 0o755, dir: true},
+			{path: "usr/share/" + name + "/file", perms: 0o644, content: []byte(name + "-" + version)},
+		})
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-"+version+".apk"), b, 0o644))
+		exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+		require.NoError(t, err)
+		defer exp.Close()
+		return exp.ControlHash
+	}
+	repo := repository.Repository{Uri: dir}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "base", Version: "1.0.0-r0", Arch: testArch, Checksum: writeAPK("base", "1.0.0-r0")},
+		{Name: "base", Version: "1.1.0-r0", Arch: testArch, Checksum: writeAPK("base", "1.1.0-r0")},
+		{Name: "app", Version: "1.0.0-r0", Arch: testArch, Checksum: writeAPK("app", "1.0.0-r0"), Dependencies: []string{"base"}},
+		{Name: "rival", Version: "1.0.0-r0", Arch: testArch, Checksum: writeAPK("rival", "1.0.0-r0"), Dependencies: []string{"!app"}},
+		// not in the repository
+		{Name: "missing", Version: "1.0.0-r0", Arch: testArch, Checksum: []byte("missing")},
+	}})})
+	prep := func(t *testing.T) *APK {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.SetWorld([]string{"base=1.0.0-r0"}))
+		require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+		return a
+	}
+	installed := func(t *testing.T, a *APK) map[string]string {
+		pkgs, err := a.GetInstalled()
+		require.NoError(t, err)
+		versions := map[string]string{}
+		for _, pkg := range pkgs {
+			versions[pkg.Name] = pkg.Version
+		}
+		return versions
+	}
+
+	t.Run("keeps installed", func(t *testing.T) {
+		a := prep(t)
+		require.NoError(t, a.AddWithIndexes(ctx, indexes, []string{"app"}, nil))
+
+		versions := installed(t, a)
+		require.Equal(t, "1.0.0-r0", versions["base"])
+		require.Equal(t, "1.0.0-r0", versions["app"])
+		content, err := a.fs.ReadFile("usr/share/base/file")
+		require.NoError(t, err)
+		require.Equal(t, "base-1.0.0-r0", string(content))
+		_, err = a.fs.Stat("usr/share/app/file")
+		require.NoError(t, err)
+
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"app", "base=1.0.0-r0"}, world)
+	})
+	t.Run("partial failure", func(t *testing.T) {
+		a := prep(t)
+		a.continueOnError = true
+		err := a.AddWithIndexes(ctx, indexes, []string{"app", "missing"}, nil)
+		require.ErrorContains(t, err, "missing")
+		require.Equal(t, "1.0.0-r0", installed(t, a)["app"])
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"app", "base=1.0.0-r0"}, world, "only what was added")
+	})
+	t.Run("conflict", func(t *testing.T) {
+		a := prep(t)
+		require.NoError(t, a.AddWithIndexes(ctx, indexes, []string{"app"}, nil))
+		err := a.AddWithIndexes(ctx, indexes, []string{"rival"}, nil)
+		require.ErrorContains(t, err, "cannot install due to conflict with app")
+		_, ok := installed(t, a)["rival"]
+		require.False(t, ok)
+	})
+	t.Run("conflict with installed", func(t *testing.T) {
+		a := prep(t)
+		require.NoError(t, a.AddWithIndexes(ctx, indexes, []string{"rival"}, nil))
+		err := a.AddWithIndexes(ctx, indexes, []string{"app"}, nil)
+		require.ErrorContains(t, err, "cannot install app due to conflict with installed rival")
+		_, ok := installed(t, a)["app"]
+		require.False(t, ok)
+	})
+	t.Run("no upgrade", func(t *testing.T) {
+		a := prep(t)
+		err := a.AddWithIndexes(ctx, indexes, []string{"base>1.0.0-r0"}, nil)
+		require.ErrorContains(t, err, "1.0.0-r0 is installed")
+		require.Equal(t, "1.0.0-r0", installed(t, a)["base"])
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"base=1.0.0-r0"}, world)
+	})
+	t.Run("downgrade", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.SetWorld([]string{"base=1.1.0-r0"}))
+		require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+
+		err := a.AddWithIndexes(ctx, indexes, []string{"base<1.1.0-r0"}, nil)
+		require.ErrorIs(t, err, DowngradeError{})
+		require.ErrorContains(t, err, "resolved to 1.0.0-r0, which is older than the installed 1.1.0-r0")
+
+		a.allowDowngrade = true
+		err = a.AddWithIndexes(ctx, indexes, []string{"base<1.1.0-r0"}, nil)
+		require.NotErrorIs(t, err, DowngradeError{})
+		require.ErrorContains(t, err, "1.1.0-r0 is installed")
+		require.Equal(t, "1.1.0-r0", installed(t, a)["base"])
+	})
+}
+
+func TestFixateWorldDowngrade(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var pkgs []*repository.Package
+	for _, version := range []string{"1.0.0-r0", "1.1.0-r0"} {
+		b := testCreateAPK(t, "pkgname = base\npkgver = "+version+"\narch = aarch64\n", []testDirEntry{
+			{path: "etc", perms: 0o755, dir: true},
+			{path: "etc/base", perms: 0o644, content: []byte(version)},
+		})
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "base-"+version+".apk"), b, 0o644))
+		exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+		require.NoError(t, err)
+		pkgs = append(pkgs, &repository.Package{Name: "base", Version: version, Arch: testArch, Checksum: exp.ControlHash})
+		exp.Close()
+	}
+	repo := repository.Repository{Uri: dir}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: pkgs})})
+
+	a := testGetTestAPKWithRepos(t)
+	require.NoError(t, a.SetWorld([]string{"base"}))
+	require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+
+	// e.g. the index was rolled back
+	rolledBack := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: pkgs[:1]})})
+	err := a.FixateWorldWithIndexes(ctx, rolledBack, nil)
+	require.ErrorIs(t, err, DowngradeError{Package: "base", Installed: "1.1.0-r0", Resolved: "1.0.0-r0"})
+	require.ErrorContains(t, err, "older than the installed 1.1.0-r0")
+
+	a.allowDowngrade = true
+	require.NoError(t, a.FixateWorldWithIndexes(ctx, rolledBack, nil))
+	content, err := a.fs.ReadFile("etc/base")
+	require.NoError(t, err)
+	require.Equal(t, "1.1.0-r0", string(content), "installed packages are kept")
+}
+
+func TestAddToWorld(t *testing.T) {
+	require.Equal(t, []string{"a", "b>2", "c"}, addToWorld([]string{"a", "b"}, []string{"b>2", "c", "c=1"}))
+	require.Equal(t, []string{"a"}, addToWorld(nil, []string{"a"}))
+}
@@ -13,6 +13,8 @@
 // limitations under the License.
 package apk
 
+import "strings"
+
 func ArchToAPK(in string) string {
 	switch in {
 	case "i386", "386":
@@ -29,3 +31,9 @@ func ArchToAPK(in string) string {
 		return in
 	}
 }
+
+// normalizeArch maps the common spellings of an architecture, such as "amd64", "arm64" or
+// "linux/AMD64", to the name apk uses, such as "x86_64" or "aarch64".
+func normalizeArch(in string) string {
+	return ArchToAPK(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(in)), "linux/"))
+}
@@ -0,0 +1,367 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// bundleScheme is the scheme of the repositories of bundles added with WithBundle, followed by the
+// absolute path of the bundle, e.g. bundle:///srv/offline.tar.
+const bundleScheme = "bundle"
+
+type bundleFormat int
+
+const (
+	bundleTar bundleFormat = iota
+	bundleTarGz
+	bundleZip
+)
+
+// bundleEntry is a package in a bundle.
+type bundleEntry struct {
+	name string
+	// index is the position of the entry among the regular files of the bundle
+	index int
+	// offset is where the contents of the entry start in an uncompressed tar bundle
+	offset int64
+	size   int64
+}
+
+// bundleContents are the packages in a bundle, by the hex encoded SHA1 checksum of their control
+// section, so that they are found without reading the bundle again.
+type bundleContents struct {
+	format     bundleFormat
+	byChecksum map[string]bundleEntry
+	byName     map[string]bundleEntry
+}
+
+// bundleCache has the contents of the bundles that were read, by path.
+type bundleCache struct {
+	mu       sync.Mutex
+	contents map[string]*bundleContents
+}
+
+func (c *bundleCache) get(bundlePath string) (*bundleContents, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	contents, ok := c.contents[bundlePath]
+	return contents, ok
+}
+
+func (c *bundleCache) put(bundlePath string, contents *bundleContents) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.contents == nil {
+		c.contents = map[string]*bundleContents{}
+	}
+	c.contents[bundlePath] = contents
+}
+
+// bundleIndex returns an index of the .apk files for arch, or noarch, in the tar or zip bundle at
+// bundlePath. Unless ignoreSignatures is set, every package must be signed by one of keys, as there
+// is no signed index to vouch for them; the index is reported as signed then. Only the signature and
+// control section of each package are read.
+func (a *APK) bundleIndex(ctx context.Context, bundlePath, arch string, keys map[string][]byte, ignoreSignatures bool) (NamedIndex, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "bundleIndex")
+	defer span.End()
+
+	abs, err := filepath.Abs(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []*repository.Package
+	contents, err := a.readBundle(abs, func(entry bundleEntry, control []byte, head io.Reader) error {
+		pkg, err := parsePkgInfo(bytes.NewReader(control))
+		if err != nil {
+			return fmt.Errorf("reading package info of %s: %w", entry.name, err)
+		}
+		if pkg.Arch != "" && pkg.Arch != arch && pkg.Arch != "noarch" {
+			return nil
+		}
+		if !ignoreSignatures {
+			signed, err := VerifyPackageSignature(ctx, head, keys)
+			if err != nil {
+				return fmt.Errorf("verifying %s: %w", entry.name, err)
+			}
+			if !signed {
+				return fmt.Errorf("%s is not signed by a trusted key", entry.name)
+			}
+		}
+		checksum := sha1.Sum(control) //nolint:gosec // this is what apk tools is using
+		pkg.Checksum = checksum[:]
+		pkg.Size = uint64(entry.size)
+		pkgs = append(pkgs, pkg)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("indexing bundle %s: %w", bundlePath, err)
+	}
+	a.bundleCache.put(abs, contents)
+
+	repo := &repository.Repository{Uri: bundleScheme + "://" + abs}
+	return &namedRepositoryWithIndex{
+		repo:   repo.WithIndex(&repository.ApkIndex{Packages: pkgs}),
+		signed: !ignoreSignatures,
+	}, nil
+}
+
+// fetchBundlePackage returns the package at u, in a bundle repository, with the given checksum of
+// its control section. Packages are found by checksum, so they can have any name in the bundle. The
+// package is read from where it is in the bundle, which is only read again to find it if it is a
+// gzipped tar.
+func (a *APK) fetchBundlePackage(u string, checksum []byte) (io.ReadCloser, error) {
+	rest := strings.TrimPrefix(u, bundleScheme+"://")
+	bundlePath, filename := path.Dir(rest), path.Base(rest)
+
+	contents, ok := a.bundleCache.get(bundlePath)
+	if !ok {
+		// e.g. for a package from a plan resolved elsewhere
+		var err error
+		contents, err = a.readBundle(bundlePath, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle %s: %w", bundlePath, err)
+		}
+		a.bundleCache.put(bundlePath, contents)
+	}
+
+	// without a checksum, e.g. for a package from elsewhere, go by the file name
+	entry, ok := contents.byName[filename]
+	if len(checksum) > 0 {
+		entry, ok = contents.byChecksum[hex.EncodeToString(checksum)]
+	}
+	if !ok {
+		return nil, fmt.Errorf("package %s not found in bundle %s", filename, bundlePath)
+	}
+	rc, err := openBundleEntry(bundlePath, contents.format, entry, a.maxDecompressedSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s in bundle %s: %w", entry.name, bundlePath, err)
+	}
+	return rc, nil
+}
+
+// readBundle reads the signature and control section of every .apk file in the tar, optionally
+// gzipped, or zip bundle at bundlePath, and returns where they are by checksum. If fn is set, it is
+// called for each with the control section and a reader of the package from its start, which is
+// only valid until fn returns. No entry may be larger than the maximum decompressed size, if set.
+func (a *APK) readBundle(bundlePath string, fn func(entry bundleEntry, control []byte, head io.Reader) error) (*bundleContents, error) {
+	contents := &bundleContents{byChecksum: map[string]bundleEntry{}, byName: map[string]bundleEntry{}}
+	format, err := walkBundle(bundlePath, a.maxDecompressedSize, func(entry bundleEntry, r io.Reader) error {
+		if !strings.HasSuffix(entry.name, ".apk") {
+			return nil
+		}
+		// keep what the control section is read from, so the package can be read from its start again
+		var head bytes.Buffer
+		control, err := readControlSection(io.TeeReader(r, &head))
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", entry.name, err)
+		}
+		checksum := sha1.Sum(control) //nolint:gosec // this is what apk tools is using
+		contents.byChecksum[hex.EncodeToString(checksum[:])] = entry
+		contents.byName[path.Base(entry.name)] = entry
+		if fn == nil {
+			return nil
+		}
+		return fn(entry, control, io.MultiReader(&head, r))
+	})
+	if err != nil {
+		return nil, err
+	}
+	contents.format = format
+	return contents, nil
+}
+
+// bundleFormatOf returns the format of the bundle in f, by its first bytes.
+func bundleFormatOf(f *os.File) bundleFormat {
+	magic := make([]byte, 4)
+	n, _ := f.ReadAt(magic, 0)
+	magic = magic[:n]
+	switch {
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		return bundleZip
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return bundleTarGz
+	default:
+		return bundleTar
+	}
+}
+
+// walkBundle calls fn with every regular file in the tar, optionally gzipped, or zip bundle at
+// bundlePath, and a reader of its contents, until fn returns an error. It returns the format of the
+// bundle. No entry may be larger than maxSize, if set.
+func walkBundle(bundlePath string, maxSize int64, fn func(entry bundleEntry, r io.Reader) error) (bundleFormat, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	format := bundleFormatOf(f)
+	if format == bundleZip {
+		stat, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		zr, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			return 0, err
+		}
+		for i, zf := range zr.File {
+			if !zf.Mode().IsRegular() {
+				continue
+			}
+			entry := bundleEntry{name: zf.Name, index: i, size: int64(zf.UncompressedSize64)}
+			rc, err := openZipEntry(zf, maxSize)
+			if err != nil {
+				return 0, err
+			}
+			err = fn(entry, rc)
+			rc.Close()
+			if err != nil {
+				return 0, err
+			}
+		}
+		return format, nil
+	}
+
+	var r io.Reader = f
+	if format == bundleTarGz {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	var index int
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return format, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if maxSize > 0 && hdr.Size > maxSize {
+			return 0, fmt.Errorf("%s: %w", hdr.Name, MaxDecompressedSizeError{Limit: maxSize})
+		}
+		entry := bundleEntry{name: hdr.Name, index: index, size: hdr.Size}
+		index++
+		if format == bundleTar {
+			// the tar reader reads no further than the header, so this is where the contents start
+			if entry.offset, err = f.Seek(0, io.SeekCurrent); err != nil {
+				return 0, err
+			}
+		}
+		if err := fn(entry, tr); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// openZipEntry opens zf, which may be no larger than maxSize, if set, once decompressed.
+func openZipEntry(zf *zip.File, maxSize int64) (io.ReadCloser, error) {
+	if maxSize > 0 && zf.UncompressedSize64 > uint64(maxSize) {
+		return nil, fmt.Errorf("%s: %w", zf.Name, MaxDecompressedSizeError{Limit: maxSize})
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &multiReadCloser{r: newMaxSizeReader(rc, maxSize), closers: []io.Closer{rc}}, nil
+}
+
+// openBundleEntry returns a reader of entry in the bundle at bundlePath, which has the given format.
+// Uncompressed tar and zip bundles are read from where the entry is, gzipped tar bundles from their
+// start, but without keeping anything before the entry.
+func openBundleEntry(bundlePath string, format bundleFormat, entry bundleEntry, maxSize int64) (io.ReadCloser, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case bundleTar:
+		return &multiReadCloser{r: io.NewSectionReader(f, entry.offset, entry.size), closers: []io.Closer{f}}, nil
+	case bundleZip:
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// this reads the central directory at the end of the bundle only
+		zr, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if entry.index >= len(zr.File) || zr.File[entry.index].Name != entry.name {
+			f.Close()
+			return nil, fmt.Errorf("%s changed since it was read", bundlePath)
+		}
+		rc, err := openZipEntry(zr.File[entry.index], maxSize)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &multiReadCloser{r: rc, closers: []io.Closer{rc, f}}, nil
+	default:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		tr := tar.NewReader(gz)
+		var index int
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) || (err == nil && index == entry.index && hdr.Typeflag == tar.TypeReg && hdr.Name != entry.name) {
+				err = fmt.Errorf("%s changed since it was read", bundlePath)
+			}
+			if err != nil {
+				gz.Close()
+				f.Close()
+				return nil, err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			if index == entry.index {
+				return &multiReadCloser{r: tr, closers: []io.Closer{gz, f}}, nil
+			}
+			index++
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testWriteBundle writes files, by name, to a tar, tar.gz or zip bundle at path, by its extension.
+func testWriteBundle(t *testing.T, path string, files map[string][]byte) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	if filepath.Ext(path) == ".zip" {
+		zw := zip.NewWriter(f)
+		for name, b := range files {
+			w, err := zw.Create(name)
+			require.NoError(t, err)
+			_, err = w.Write(b)
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+		return
+	}
+	var w io.Writer = f
+	gw := gzip.NewWriter(f)
+	if strings.HasSuffix(path, ".gz") {
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for name, b := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(b))}))
+		_, err := tw.Write(b)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	if w == gw {
+		require.NoError(t, gw.Close())
+	}
+}
+
+func TestBundle(t *testing.T) {
+	ctx := context.Background()
+	apkFile := func(name, arch, depend string) []byte {
+		pkginfo := "pkgname = " + name + "\npkgver = 1.0.0-r0\narch = " + arch + "\n"
+		if depend != "" {
+			pkginfo += "depend = " + depend + "\n"
+		}
+		return testCreateAPK(t, pkginfo, []testDirEntry{
+			{path: "usr", perms: 0o755, dir: true},
+			{path: "usr/share", perms: 0o755, dir: true},
+			{path: "usr/share/" + name, perms: 0o755, dir: true},
+			{path: "usr/share/" + name + "/file", perms: 0o644, content: []byte(name)},
+		})
+	}
+	files := map[string][]byte{
+		"README":                  []byte("offline packages"),
+		"pkgs/app-1.0.0-r0.apk":   apkFile("app", testArch, "base"),
+		"pkgs/renamed.apk":        apkFile("base", testArch, ""),
+		"pkgs/other-1.0.0-r0.apk": apkFile("other", "x86_64", ""),
+	}
+	// where the packages for the arch are in the bundle
+	paths := map[string]string{"app": "pkgs/app-1.0.0-r0.apk", "base": "pkgs/renamed.apk"}
+	prep := func(t *testing.T, bundle string) *APK {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.fs.WriteFile(reposFilePath, nil, 0o644))
+		a.bundles = []string{bundle}
+		return a
+	}
+
+	for _, ext := range []string{".tar", ".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			bundle := filepath.Join(t.TempDir(), "offline"+ext)
+			testWriteBundle(t, bundle, files)
+			a := prep(t, bundle)
+			a.ignoreSignatures = true
+
+			indexes, err := a.LoadIndexes(ctx)
+			require.NoError(t, err)
+			require.Len(t, indexes, 1)
+			var names []string
+			for _, pkg := range indexes[0].Packages() {
+				names = append(names, pkg.Name)
+			}
+			require.ElementsMatch(t, []string{"app", "base"}, names, "only packages for the arch are indexed")
+			for _, pkg := range indexes[0].Packages() {
+				rc, err := a.fetchBundlePackage(pkg.Url(), pkg.Checksum)
+				require.NoError(t, err)
+				b, err := io.ReadAll(rc)
+				require.NoError(t, err)
+				require.NoError(t, rc.Close())
+				require.Equal(t, files[paths[pkg.Name]], b, "read from where it is in the bundle")
+			}
+
+			require.NoError(t, a.SetWorld([]string{"app"}))
+			require.NoError(t, a.FixateWorld(ctx, nil))
+			for _, name := range []string{"app", "base"} {
+				b, err := a.fs.ReadFile("usr/share/" + name + "/file")
+				require.NoError(t, err)
+				require.Equal(t, name, string(b))
+			}
+		})
+	}
+	t.Run("unsigned", func(t *testing.T) {
+		bundle := filepath.Join(t.TempDir(), "offline.tar.gz")
+		testWriteBundle(t, bundle, files)
+		_, err := prep(t, bundle).LoadIndexes(ctx)
+		require.ErrorContains(t, err, "is not signed by a trusted key")
+	})
+	t.Run("signed", func(t *testing.T) {
+		b, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+		require.NoError(t, err)
+		bundle := filepath.Join(t.TempDir(), "offline.zip")
+		testWriteBundle(t, bundle, map[string][]byte{testPkgFilename: b})
+
+		a := prep(t, bundle)
+		indexes, err := a.LoadIndexes(ctx)
+		require.NoError(t, err)
+		require.True(t, IndexSigned(indexes[0]))
+		pkgs := indexes[0].Packages()
+		require.Len(t, pkgs, 1)
+		require.Equal(t, testPkg.Checksum, pkgs[0].Checksum)
+
+		rc, err := a.fetchBundlePackage(pkgs[0].Url(), pkgs[0].Checksum)
+		require.NoError(t, err)
+		rc.Close()
+	})
+	t.Run("max decompressed size", func(t *testing.T) {
+		for _, ext := range []string{".tar.gz", ".zip"} {
+			bundle := filepath.Join(t.TempDir(), "offline"+ext)
+			testWriteBundle(t, bundle, files)
+			a := prep(t, bundle)
+			a.ignoreSignatures = true
+			a.maxDecompressedSize = 64
+			_, err := a.LoadIndexes(ctx)
+			require.ErrorIs(t, err, MaxDecompressedSizeError{}, ext)
+		}
+	})
+}
@@ -15,17 +15,65 @@
 package apk
 
 import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/chainguard-dev/go-apk/pkg/logger"
 	"gitlab.alpinelinux.org/alpine/go/repository"
+	"golang.org/x/sys/unix"
 )
 
+var errNoCache = errors.New("no cache configured")
+
+// rename is os.Rename, replaceable in tests.
+var rename = os.Rename
+
+// renameOrCopy moves src to dst. If they are on different filesystems, which os.Rename cannot
+// handle, it falls back to copying src next to dst, renaming the copy into place and removing src.
+func renameOrCopy(src, dst string) error {
+	err := rename(src, dst)
+	if err == nil || !errors.Is(err, unix.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("copying %s to %s: %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
 // cache
 type cache struct {
 	dir     string
@@ -45,11 +93,21 @@ func (c cache) client(wrapped *http.Client, etagRequired bool) *http.Client {
 	}
 }
 
+// staleClient is like client with etags required, but if the server cannot be reached, it serves
+// the newest cached copy, logging a warning with its age to log.
+func (c cache) staleClient(wrapped *http.Client, log logger.Logger) *http.Client {
+	client := c.client(wrapped, true)
+	client.Transport.(*cacheTransport).staleLogger = log
+	return client
+}
+
 type cacheTransport struct {
 	wrapped      *http.Client
 	root         string
 	offline      bool
 	etagRequired bool
+	// if set, serve stale cached entries when the server cannot be reached, warning here
+	staleLogger logger.Logger
 }
 
 func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -82,45 +140,24 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 	}
 
 	if t.offline {
-		cacheDir := cacheDirFromFile(cacheFile)
-		des, err := os.ReadDir(cacheDir)
-		if err != nil {
-			return nil, fmt.Errorf("listing %q for offline cache: %w", cacheDir, err)
-		}
-
-		if len(des) == 0 {
-			return nil, fmt.Errorf("no offline cached entries for %s", cacheDir)
-		}
+		resp, _, err := newestCached(cacheFile)
+		return resp, err
+	}
 
-		newest, err := des[0].Info()
-		if err != nil {
-			return nil, err
+	resp, err := t.wrapped.Head(request.URL.String())
+	if t.staleLogger != nil && (err != nil || resp.StatusCode >= 500) {
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
 		}
-
-		for _, de := range des[1:] {
-			fi, err := de.Info()
-			if err != nil {
-				return nil, err
-			}
-
-			if fi.ModTime().After(newest.ModTime()) {
-				newest = fi
+		if stale, modTime, serr := newestCached(cacheFile); serr == nil {
+			if resp != nil {
+				resp.Body.Close()
 			}
+			t.staleLogger.Warnf("unable to reach %s (%s), using cached copy from %s ago", request.URL.Redacted(), reason, time.Since(modTime).Round(time.Second))
+			return stale, nil
 		}
-
-		f, err := os.Open(filepath.Join(cacheDir, newest.Name()))
-		if err != nil {
-			return nil, err
-		}
-
-		return &http.Response{
-			StatusCode:    http.StatusOK,
-			Body:          f,
-			ContentLength: newest.Size(),
-		}, nil
 	}
-
-	resp, err := t.wrapped.Head(request.URL.String())
 	if err != nil || resp.StatusCode != 200 {
 		return resp, err
 	}
@@ -153,6 +190,47 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 	}, nil
 }
 
+// newestCached returns a response for the newest of the cached entries for cacheFile, and when it
+// was cached.
+func newestCached(cacheFile string) (*http.Response, time.Time, error) {
+	cacheDir := cacheDirFromFile(cacheFile)
+	des, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("listing %q for offline cache: %w", cacheDir, err)
+	}
+
+	if len(des) == 0 {
+		return nil, time.Time{}, fmt.Errorf("no offline cached entries for %s", cacheDir)
+	}
+
+	newest, err := des[0].Info()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	for _, de := range des[1:] {
+		fi, err := de.Info()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		if fi.ModTime().After(newest.ModTime()) {
+			newest = fi
+		}
+	}
+
+	f, err := os.Open(filepath.Join(cacheDir, newest.Name()))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          f,
+		ContentLength: newest.Size(),
+	}, newest.ModTime(), nil
+}
+
 func cacheDirFromFile(cacheFile string) string {
 	if strings.HasSuffix(cacheFile, "APKINDEX.tar.gz") {
 		return filepath.Join(filepath.Dir(cacheFile), "APKINDEX")
@@ -254,6 +332,120 @@ func cacheDirForPackage(root string, pkg *repository.RepositoryPackage) (string,
 	return strings.TrimSuffix(p, ".apk"), nil
 }
 
+// cachedControlFile returns the name of the cached control section in cacheDir of the package with
+// the SHA1 checksum from the index. With the default cache hash, that is the name the control section
+// is cached by, whether it exists or not. With any other, it is the first control section in cacheDir
+// with checksum, named by its cache hash; one that was cached by SHA1 before is renamed to it.
+func (a *APK) cachedControlFile(cacheDir string, checksum []byte) (string, error) {
+	if a.cacheHash == crypto.SHA1 {
+		return filepath.Join(cacheDir, hex.EncodeToString(checksum)+".ctl.tar.gz"), nil
+	}
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".ctl.tar.gz") {
+			continue
+		}
+		ctl := filepath.Join(cacheDir, entry.Name())
+		sums, err := hashFile(ctl, crypto.SHA1, a.cacheHash)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(sums[0], checksum) {
+			continue
+		}
+		named := filepath.Join(cacheDir, hex.EncodeToString(sums[1])+".ctl.tar.gz")
+		if named != ctl {
+			// the control section goes last, so that the entry never looks complete without its signature
+			if err := os.Rename(cachedSignatureFile(ctl), cachedSignatureFile(named)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return "", fmt.Errorf("unable to rename %s in cache: %w", cachedSignatureFile(ctl), err)
+			}
+			if err := os.Rename(ctl, named); err != nil {
+				return "", fmt.Errorf("unable to rename %s in cache: %w", ctl, err)
+			}
+			a.logger.Debugf("renamed %s to %s in cache", entry.Name(), filepath.Base(named))
+		}
+		return named, nil
+	}
+	return "", fmt.Errorf("no control section with checksum %x in %s: %w", checksum, cacheDir, fs.ErrNotExist)
+}
+
+// cachedSignatureFile returns the name of the cached signature that goes with the cached control section ctl.
+func cachedSignatureFile(ctl string) string {
+	return strings.TrimSuffix(ctl, ".ctl.tar.gz") + ".sig.tar.gz"
+}
+
+// cachedVerifiedFile returns the name of the file that records that the cached data section dat,
+// and the control section that refers to it, were verified, see markCacheVerified.
+func cachedVerifiedFile(dat string) string {
+	return strings.TrimSuffix(dat, ".dat.tar.gz") + ".verified"
+}
+
+// cacheVerifiedRecord is what markCacheVerified records for an entry: the checksum of its control
+// section, and the sizes of the control and data sections.
+func cacheVerifiedRecord(checksum []byte, ctlSize, datSize int64) string {
+	return fmt.Sprintf("%x %d %d\n", checksum, ctlSize, datSize)
+}
+
+// markCacheVerified records that the cache entry with the control section ctl, with checksum, and
+// the data section dat was verified, so that hits on it need not be hashed again. The sizes of the
+// sections are recorded as well, so that a hit on an entry that was truncated since is not trusted.
+func markCacheVerified(checksum []byte, ctl, dat string) error {
+	cf, err := os.Stat(ctl)
+	if err != nil {
+		return err
+	}
+	df, err := os.Stat(dat)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(dat), "verified-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(cacheVerifiedRecord(checksum, cf.Size(), df.Size())); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cachedVerifiedFile(dat))
+}
+
+// cacheVerified reports whether markCacheVerified recorded the cache entry with the control
+// section of checksum and the data section dat, with the sections at the given sizes.
+func cacheVerified(checksum []byte, ctlSize int64, dat string, datSize int64) bool {
+	b, err := os.ReadFile(cachedVerifiedFile(dat))
+	return err == nil && string(b) == cacheVerifiedRecord(checksum, ctlSize, datSize)
+}
+
+// hashFile returns the hashes of the file at path with each of hs, in the same order.
+func hashFile(path string, hs ...crypto.Hash) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes := make([]hash.Hash, len(hs))
+	writers := make([]io.Writer, len(hs))
+	for i, h := range hs {
+		hashes[i] = h.New()
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+	sums := make([][]byte, len(hs))
+	for i, h := range hashes {
+		sums[i] = h.Sum(nil)
+	}
+	return sums, nil
+}
+
 // cachePathFromURL given a URL, figure out what the cache path would be
 func cachePathFromURL(root string, u url.URL) (string, error) {
 	// the last two levels are what we append. For example https://example.com/foo/bar/x86_64/baz.apk
@@ -280,3 +472,136 @@ func cachePathFromURL(root string, u url.URL) (string, error) {
 	}
 	return cacheFile, nil
 }
+
+// PurgeCache removes the cached control, signature and data files for the given package,
+// for example when a rebuilt package reused a version and the cached copy is known to be bad.
+// It is not an error if the package is not in the cache.
+//
+// The control file is removed first, so a concurrent lookup sees either the complete
+// entry or a cache miss, never a partial one. Once it is removed, failing to remove the
+// other files is only logged.
+func (a *APK) PurgeCache(pkg *repository.RepositoryPackage) error {
+	if a.cache == nil {
+		return errNoCache
+	}
+	cacheDir, err := cacheDirForPackage(a.cache.dir, pkg)
+	if err != nil {
+		return err
+	}
+	checksum, err := packageChecksum(pkg)
+	if err != nil {
+		return err
+	}
+	ctl, err := a.cachedControlFile(cacheDir, checksum)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	files := []string{cachedSignatureFile(ctl)}
+	if f, err := os.Open(ctl); err == nil {
+		datahash, err := a.datahash(f)
+		f.Close()
+		if err == nil {
+			dat := filepath.Join(cacheDir, datahash+".dat.tar.gz")
+			files = append(files, dat, strings.TrimSuffix(dat, ".gz"), cachedVerifiedFile(dat))
+		}
+	}
+
+	// Lookups go through the control file, so once it is gone the entry is a miss, and the rest
+	// only takes up space: failing to remove it is not worth failing the purge for.
+	if err := os.Remove(ctl); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to purge %s from cache: %w", ctl, err)
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			a.logger.Warnf("unable to remove %s from cache: %v", f, err)
+		}
+	}
+	a.logger.Debugf("purged %s from cache", pkg.Name)
+	return nil
+}
+
+// CacheStats summarizes the contents of the cache directory.
+type CacheStats struct {
+	// Entries is the total number of files in the cache.
+	Entries int
+	// Bytes is the total size of all files in the cache.
+	Bytes int64
+	// ControlFiles, SignatureFiles and DataFiles count the expanded package sections.
+	// For a healthy cache, every control file has a data file, and signed packages also
+	// have a signature file; mismatched counts point at partial or corrupt entries.
+	ControlFiles   int
+	SignatureFiles int
+	DataFiles      int
+	// IndexFiles counts cached APKINDEX files.
+	IndexFiles int
+}
+
+// CacheStats reports the number and size of the files in the cache directory.
+// Returns an error if no cache is configured.
+func (a *APK) CacheStats() (CacheStats, error) {
+	var stats CacheStats
+	if a.cache == nil {
+		return stats, errNoCache
+	}
+	err := filepath.WalkDir(a.cache.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stats.Entries++
+		stats.Bytes += fi.Size()
+		name := d.Name()
+		switch {
+		case strings.HasSuffix(name, ".ctl.tar.gz"):
+			stats.ControlFiles++
+		case strings.HasSuffix(name, ".sig.tar.gz"):
+			stats.SignatureFiles++
+		case strings.HasSuffix(name, ".dat.tar.gz"):
+			stats.DataFiles++
+		case filepath.Base(filepath.Dir(path)) == "APKINDEX", name == indexFilename:
+			stats.IndexFiles++
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return stats, fmt.Errorf("unable to read cache directory %s: %w", a.cache.dir, err)
+	}
+	return stats, nil
+}
+
+// ClearCache removes everything in the cache directory, leaving the directory itself in place.
+// Returns an error if no cache is configured.
+func (a *APK) ClearCache() error {
+	if a.cache == nil {
+		return errNoCache
+	}
+	dir := filepath.Clean(a.cache.dir)
+	if dir == "" || dir == "." || dir == string(filepath.Separator) {
+		return fmt.Errorf("refusing to clear cache directory %q", a.cache.dir)
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("unable to read cache directory %s: %w", dir, err)
+	}
+	for _, de := range des {
+		// RemoveAll does not follow symlinks, so this cannot escape the cache directory
+		if err := os.RemoveAll(filepath.Join(dir, de.Name())); err != nil {
+			return fmt.Errorf("unable to clear %s from cache: %w", de.Name(), err)
+		}
+	}
+	a.logger.Infof("cleared cache directory %s", dir)
+	return nil
+}
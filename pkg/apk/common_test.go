@@ -15,6 +15,7 @@ package apk
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
@@ -31,6 +32,7 @@ const (
 
 type testLocalTransport struct {
 	fail             bool
+	unreachable      bool
 	root             string
 	basenameOnly     bool
 	headers          map[string][]string
@@ -38,6 +40,9 @@ type testLocalTransport struct {
 }
 
 func (t *testLocalTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.unreachable {
+		return nil, fmt.Errorf("dial %s: connection refused", request.URL.Host)
+	}
 	if t.fail {
 		return &http.Response{
 			StatusCode: 404,
@@ -0,0 +1,175 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Config is the effective configuration of an APK, as returned by APK.Config, for debugging and
+// support. Credentials in URLs are redacted, and of functions, clients and writers set as options
+// only whether they are set is shown.
+type Config struct {
+	Arch              string
+	Version           string
+	IgnoreSignatures  bool
+	IgnoreMknodErrors bool
+	// CacheDir is the cache directory, or empty if there is no cache.
+	CacheDir     string
+	CacheOffline bool
+	CacheHash    string
+	// ClientSet is whether a client was set with SetClient, in which case it is used instead of the
+	// internal one, and MaxConnsPerHost, IdleConnTimeout and HTTP2 do not apply.
+	ClientSet             bool
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	HTTP2                 bool
+	RequestTimeout        time.Duration
+	BreakerFailures       int
+	BreakerWindow         time.Duration
+	ReleasesCacheTTL      time.Duration
+	MaxDecompressedSize   int64
+	Mirrors               map[string][]Mirror
+	FlatRepositories      []string
+	StaleIndexOK          bool
+	AllowUnsignedIndexes  bool
+	BlockedChecksums      []string
+	Holds                 []string
+	LicenseAllowlist      []string
+	ExcludedSubpackages   []string
+	PreferredRepositories []string
+	AlternativeDeps       bool
+	ResolveTracerSet      bool
+	AllowedPaths          []string
+	CompressedInstalledDB bool
+	StrictArchFile        bool
+	SkipScripts           bool
+	SkipTriggers          bool
+	ContinueOnError       bool
+	DeltaUpgrades         bool
+	DeltaFetcherSet       bool
+	BaseLayout            bool
+	KeysTime              time.Time
+	RepositoriesFile      string
+	ArchFile              string
+	WorldFile             string
+	KeysDir               string
+	ExecutorSet           bool
+	OCIPullerSet          bool
+	ManifestWriterSet     bool
+	DeviceOwners          map[string]DeviceOwner
+	CompatibleArchs       []string
+	AllowDowngrade        bool
+	Bundles               []string
+	RemoteCacheSet        bool
+	RemoteCachePush       bool
+	ValidateScriptsTar    bool
+}
+
+// Config returns the effective configuration of a, i.e. the options it was created with, after
+// defaults are applied, and the client set with SetClient, if any.
+func (a *APK) Config() Config {
+	c := Config{
+		Arch:                  a.arch,
+		Version:               a.version,
+		IgnoreSignatures:      a.ignoreSignatures,
+		IgnoreMknodErrors:     a.ignoreMknodErrors,
+		CacheHash:             a.cacheHash.String(),
+		ClientSet:             a.client != nil,
+		RequestTimeout:        a.requestTimeout,
+		ReleasesCacheTTL:      a.releasesCacheTTL,
+		MaxDecompressedSize:   a.maxDecompressedSize,
+		StaleIndexOK:          a.staleIndexOK,
+		AllowUnsignedIndexes:  a.allowUnsignedIndexes,
+		Holds:                 append([]string(nil), a.holds...),
+		LicenseAllowlist:      append([]string(nil), a.licenseAllowlist...),
+		ExcludedSubpackages:   append([]string(nil), a.excludeSuffixes...),
+		PreferredRepositories: append([]string(nil), a.repositoryPrefs...),
+		AlternativeDeps:       a.alternativeDeps,
+		ResolveTracerSet:      a.resolveTracer != nil,
+		AllowedPaths:          append([]string(nil), a.allowedPaths...),
+		CompressedInstalledDB: a.compressedInstalledDB,
+		StrictArchFile:        a.strictArchFile,
+		SkipScripts:           a.skipScripts,
+		SkipTriggers:          a.skipTriggers,
+		ContinueOnError:       a.continueOnError,
+		DeltaUpgrades:         a.deltaUpgrades,
+		DeltaFetcherSet:       a.deltaFetcher != nil,
+		BaseLayout:            a.baseLayout,
+		KeysTime:              a.keysTime,
+		RepositoriesFile:      "/" + a.reposFile,
+		ArchFile:              "/" + a.archFile,
+		WorldFile:             "/" + a.worldFile,
+		KeysDir:               "/" + a.keysDir,
+		ExecutorSet:           a.executor != nil,
+		OCIPullerSet:          a.ociPuller != nil,
+		ManifestWriterSet:     a.manifestWriter != nil,
+		CompatibleArchs:       append([]string(nil), a.compatibleArchs...),
+		AllowDowngrade:        a.allowDowngrade,
+		Bundles:               append([]string(nil), a.bundles...),
+		RemoteCacheSet:        a.remoteCache != nil,
+		RemoteCachePush:       a.remoteCachePush,
+		ValidateScriptsTar:    a.validateScriptsTar,
+	}
+	if a.cache != nil {
+		c.CacheDir = a.cache.dir
+		c.CacheOffline = a.cache.offline
+	}
+	if a.breaker != nil {
+		c.BreakerFailures = a.breaker.maxFailures
+		c.BreakerWindow = a.breaker.window
+	}
+	if a.transport != nil {
+		c.MaxConnsPerHost = a.transport.MaxConnsPerHost
+		c.IdleConnTimeout = a.transport.IdleConnTimeout
+		c.HTTP2 = a.transport.ForceAttemptHTTP2
+	}
+	if len(a.deviceOwners) > 0 {
+		c.DeviceOwners = make(map[string]DeviceOwner, len(a.deviceOwners))
+		for path, owner := range a.deviceOwners {
+			c.DeviceOwners[path] = owner
+		}
+	}
+	if len(a.mirrors) > 0 {
+		c.Mirrors = make(map[string][]Mirror, len(a.mirrors))
+		for repo, mirrors := range a.mirrors {
+			redacted := make([]Mirror, 0, len(mirrors))
+			for _, m := range mirrors {
+				redacted = append(redacted, Mirror{URL: redactURL(m.URL), Weight: m.Weight})
+			}
+			c.Mirrors[redactURL(repo)] = redacted
+		}
+	}
+	for _, repo := range a.flatRepositories {
+		c.FlatRepositories = append(c.FlatRepositories, redactURL(repo))
+	}
+	for checksum := range a.blockedChecksums {
+		c.BlockedChecksums = append(c.BlockedChecksums, checksum)
+	}
+	sort.Strings(c.BlockedChecksums)
+	return c
+}
+
+// redactURL returns u with the password, if any, replaced by "xxxxx". Anything that is not a URL
+// is returned as is.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.User == nil {
+		return u
+	}
+	return parsed.Redacted()
+}
@@ -14,6 +14,8 @@
 
 package apk
 
+import "time"
+
 const (
 	DefaultKeyRingPath       = "/etc/apk/keys"
 	DefaultSystemKeyRingPath = "/usr/share/apk/keys/"
@@ -32,6 +34,13 @@ const (
 
 	// for fetching the alpine keys
 	alpineReleasesURL = "https://alpinelinux.org/releases.json"
+	// keys are a few hundred bytes of PEM; anything much larger is not a key
+	maxKeySize = 64 << 10
+	// timeout for fetching a key when no request timeout is set
+	defaultKeyRequestTimeout = 30 * time.Second
 
 	xattrTarPAXRecordsPrefix = "SCHILY.xattr."
+
+	// how many symlinks to follow when resolving a path inside the root, as the Linux kernel does
+	maxSymlinks = 40
 )
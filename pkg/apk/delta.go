@@ -0,0 +1,226 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// deltaCopy is followed by the offset and length, as uvarints, of bytes to copy from the
+	// .apk of the installed version.
+	deltaCopy = 'C'
+	// deltaInsert is followed by a length, as a uvarint, and that many bytes to insert.
+	deltaInsert = 'I'
+)
+
+// DeltaFetcher fetches deltas between two versions of a package, to download less in UpgradeWorld,
+// see WithDeltaUpgrades. A delta turns the .apk file of one version into the .apk file of the other.
+//
+// apk-tools has no delta format, and APKINDEX does not advertise deltas, so both the format and how
+// deltas are found are this library's own. A delta is a sequence of operations, each a single byte
+// for its kind followed by its arguments:
+//
+//   - 'C' offset length: copy length bytes at offset of the .apk file of the installed version
+//   - 'I' length data: insert the length bytes of data
+//
+// where offset and length are unsigned varints, as in encoding/binary.
+type DeltaFetcher interface {
+	// FetchDelta returns the delta from the package from, as installed, to the package to. If the
+	// repository of to has no such delta, the error wraps fs.ErrNotExist. The caller closes the
+	// returned reader.
+	FetchDelta(ctx context.Context, from, to *repository.RepositoryPackage) (io.ReadCloser, error)
+}
+
+// prefetchDelta fills the cache with pkg, which is to replace from, by applying a delta against
+// from, if it is not in the cache yet, so that installing pkg does not fetch the full package. It
+// returns an error if there is no such delta, in which case installing pkg fetches it as usual.
+func (a *APK) prefetchDelta(ctx context.Context, from *InstalledPackage, pkg *repository.RepositoryPackage) error {
+	cacheDir, err := cacheDirForPackage(a.cache.dir, pkg)
+	if err != nil {
+		return err
+	}
+	if exp, err := a.cachedPackage(ctx, pkg, cacheDir); err == nil {
+		return exp.Close()
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return fmt.Errorf("unable to create cache directory %q: %w", cacheDir, err)
+	}
+	exp, err := a.deltaPackage(ctx, from, pkg, cacheDir, a.expandOptions())
+	if err != nil {
+		return err
+	}
+	if exp, err = a.cachePackage(ctx, pkg, exp, cacheDir); err != nil {
+		return err
+	}
+	return exp.Close()
+}
+
+// deltaPackage returns pkg expanded into cacheDir from a delta against from, the installed version
+// of the same package, which has to be in the cache, or an error if there is no such delta. The
+// result is checked against the checksum in the index like any other package, so a bad delta is a
+// miss too.
+func (a *APK) deltaPackage(ctx context.Context, installed *InstalledPackage, pkg *repository.RepositoryPackage, cacheDir string, expandOpts []ExpandApkOption) (*APKExpanded, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "deltaPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
+	defer span.End()
+
+	p := installed.Package
+	from := repository.NewRepositoryPackage(&p, pkg.Repository())
+	fromDir, err := cacheDirForPackage(a.cache.dir, from)
+	if err != nil {
+		return nil, err
+	}
+	base, err := a.cachedPackage(ctx, from, fromDir)
+	if err != nil {
+		return nil, fmt.Errorf("installed %s %s is not in the cache: %w", from.Name, from.Version, err)
+	}
+	defer base.Close()
+
+	rc, err := a.deltaFetcher.FetchDelta(ctx, from, pkg)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmpDir, err := os.MkdirTemp("", "apk-delta")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// the delta copies from anywhere in the installed .apk, so it needs to be in one file
+	baseFile, err := os.CreateTemp(tmpDir, "base")
+	if err != nil {
+		return nil, err
+	}
+	defer baseFile.Close()
+	baseAPK, err := base.APK()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(baseFile, baseAPK)
+	baseAPK.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading installed %s %s from the cache: %w", from.Name, from.Version, err)
+	}
+
+	out, err := os.CreateTemp(tmpDir, "apk")
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	// a delta may not result in more than the package, if its size is known
+	limit := a.maxDecompressedSize
+	if pkg.Size > 0 {
+		limit = int64(pkg.Size)
+	}
+	if err := applyDelta(baseFile, rc, out, limit); err != nil {
+		return nil, fmt.Errorf("applying delta from %s %s to %s: %w", from.Name, from.Version, pkg.Version, err)
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	exp, err := ExpandApk(ctx, out, cacheDir, expandOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s from delta: %w", pkg.Name, err)
+	}
+	checksum, err := packageChecksum(pkg)
+	if err != nil {
+		exp.Close()
+		return nil, err
+	}
+	if err := a.checkExpanded(exp, checksum); err != nil {
+		exp.Close()
+		return nil, fmt.Errorf("package from delta: %w", err)
+	}
+	return exp, nil
+}
+
+// applyDelta writes to w the result of applying delta, in the format described on DeltaFetcher, to base.
+// It fails as soon as the result exceeds max bytes, unless max is 0 or less.
+func applyDelta(base io.ReaderAt, delta io.Reader, w io.Writer, max int64) error {
+	if max > 0 {
+		w = &maxSizeWriter{w: w, max: max}
+	}
+	br := bufio.NewReader(delta)
+	for {
+		op, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case deltaCopy:
+			offset, err := binary.ReadUvarint(br)
+			if err != nil {
+				return fmt.Errorf("reading copy offset: %w", err)
+			}
+			length, err := binary.ReadUvarint(br)
+			if err != nil {
+				return fmt.Errorf("reading copy length: %w", err)
+			}
+			if offset > math.MaxInt64 || length > math.MaxInt64 {
+				return fmt.Errorf("copy of %d bytes at %d is out of range", length, offset)
+			}
+			if _, err := io.CopyN(w, io.NewSectionReader(base, int64(offset), int64(length)), int64(length)); err != nil {
+				return fmt.Errorf("copying %d bytes at %d: %w", length, offset, err)
+			}
+		case deltaInsert:
+			length, err := binary.ReadUvarint(br)
+			if err != nil {
+				return fmt.Errorf("reading insert length: %w", err)
+			}
+			if length > math.MaxInt64 {
+				return fmt.Errorf("insert of %d bytes is out of range", length)
+			}
+			if _, err := io.CopyN(w, br, int64(length)); err != nil {
+				return fmt.Errorf("inserting %d bytes: %w", length, err)
+			}
+		default:
+			return fmt.Errorf("unknown delta operation %q", op)
+		}
+	}
+}
+
+// maxSizeWriter wraps a writer, failing writes that would take it past max bytes in total.
+type maxSizeWriter struct {
+	w       io.Writer
+	max     int64
+	written int64
+}
+
+func (m *maxSizeWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > m.max-m.written {
+		return 0, fmt.Errorf("result exceeds %d bytes", m.max)
+	}
+	n, err := m.w.Write(p)
+	m.written += int64(n)
+	return n, err
+}
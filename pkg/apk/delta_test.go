@@ -0,0 +1,219 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// testDeltaFetcher returns delta for every package, or fs.ErrNotExist if it is nil.
+type testDeltaFetcher struct {
+	delta []byte
+	// endless makes the delta continue with zeros forever
+	endless bool
+	calls   int
+}
+
+func (f *testDeltaFetcher) FetchDelta(_ context.Context, _, _ *repository.RepositoryPackage) (io.ReadCloser, error) {
+	f.calls++
+	if f.delta == nil {
+		return nil, fs.ErrNotExist
+	}
+	if f.endless {
+		return io.NopCloser(io.MultiReader(bytes.NewReader(f.delta), testZeroReader{})), nil
+	}
+	return io.NopCloser(bytes.NewReader(f.delta)), nil
+}
+
+// testZeroReader is an endless stream of zeros.
+type testZeroReader struct{}
+
+func (testZeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// testDelta appends the operations to a delta.
+func testDelta(delta []byte, op byte, args ...uint64) []byte {
+	delta = append(delta, op)
+	for _, arg := range args {
+		delta = binary.AppendUvarint(delta, arg)
+	}
+	return delta
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := strings.NewReader("hello world")
+	delta := testDelta(nil, deltaCopy, 0, 6)
+	delta = append(testDelta(delta, deltaInsert, 5), "there"...)
+
+	var out bytes.Buffer
+	require.NoError(t, applyDelta(base, bytes.NewReader(delta), &out, 0))
+	require.Equal(t, "hello there", out.String())
+
+	require.Error(t, applyDelta(base, bytes.NewReader(testDelta(nil, deltaCopy, 6, 10)), io.Discard, 0), "beyond the end of the base")
+	require.Error(t, applyDelta(base, bytes.NewReader(testDelta(nil, deltaInsert, 10)), io.Discard, 0), "short insert")
+	require.ErrorContains(t, applyDelta(base, bytes.NewReader([]byte("X")), io.Discard, 0), "unknown delta operation")
+
+	// the result may be as large as the limit, but no larger
+	out.Reset()
+	require.NoError(t, applyDelta(base, bytes.NewReader(delta), &out, 11))
+	require.Equal(t, "hello there", out.String())
+	require.ErrorContains(t, applyDelta(base, bytes.NewReader(delta), io.Discard, 10), "result exceeds 10 bytes")
+	endless := io.MultiReader(bytes.NewReader(testDelta(nil, deltaInsert, math.MaxInt64)), testZeroReader{})
+	require.ErrorContains(t, applyDelta(base, endless, io.Discard, 1<<20), "result exceeds 1048576 bytes")
+}
+
+func TestDeltaUpgrades(t *testing.T) {
+	ctx := context.Background()
+
+	// two versions of a package, with a datahash, so they can be cached
+	var (
+		apks [][]byte
+		pkgs []*repository.Package
+	)
+	for _, version := range []string{"1.0.0-r0", "1.1.0-r0"} {
+		var data bytes.Buffer
+		gw := gzip.NewWriter(&data)
+		_, err := io.Copy(gw, testCreateTarForPackage([]testDirEntry{
+			{path: "etc", perms: 0o755, dir: true},
+			{path: "etc/base", perms: 0o644, content: []byte(version)},
+		}))
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+		pkginfo := fmt.Sprintf("pkgname = base\npkgver = %s\narch = aarch64\ndatahash = %x\n", version, sha256.Sum256(data.Bytes()))
+		var control bytes.Buffer
+		gw = gzip.NewWriter(&control)
+		tw := tar.NewWriter(gw)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(pkginfo))}))
+		_, err = tw.Write([]byte(pkginfo))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+		b := append(control.Bytes(), data.Bytes()...)
+		exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+		require.NoError(t, err)
+		apks = append(apks, b)
+		pkgs = append(pkgs, &repository.Package{Name: "base", Version: version, Arch: testArch, Checksum: exp.ControlHash, Size: uint64(len(b))})
+		exp.Close()
+	}
+	// copy what the versions have in common, and insert the rest
+	var common int
+	for common < len(apks[0]) && common < len(apks[1]) && apks[0][common] == apks[1][common] {
+		common++
+	}
+	delta := testDelta(nil, deltaCopy, 0, uint64(common))
+	delta = append(testDelta(delta, deltaInsert, uint64(len(apks[1])-common)), apks[1][common:]...)
+
+	// prep installs the first version into a fresh root and cache, from a repository that has the
+	// file of the second version only if full is set, and then sets world to the latest version
+	prep := func(t *testing.T, fetcher DeltaFetcher, full bool) (*APK, []NamedIndex) {
+		dir := filepath.Join(t.TempDir(), testArch)
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "base-1.0.0-r0.apk"), apks[0], 0o644))
+		repo := repository.Repository{Uri: dir}
+		indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: pkgs})})
+
+		base := testGetTestAPKWithRepos(t)
+		a, err := New(WithFS(base.fs), WithIgnoreMknodErrors(true), WithCache(t.TempDir(), false), WithDeltaUpgrades(true), WithDeltaFetcher(fetcher))
+		require.NoError(t, err)
+		require.NoError(t, a.SetWorld([]string{"base=1.0.0-r0"}))
+		require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+
+		if full {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "base-1.1.0-r0.apk"), apks[1], 0o644))
+		}
+		require.NoError(t, a.SetWorld([]string{"base"}))
+		return a, indexes
+	}
+	installedVersion := func(t *testing.T, a *APK, version string) {
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		var versions []string
+		for _, pkg := range installed {
+			if pkg.Name == "base" {
+				versions = append(versions, pkg.Version)
+			}
+		}
+		require.Equal(t, []string{version}, versions)
+		content, err := a.fs.ReadFile("etc/base")
+		require.NoError(t, err)
+		require.Equal(t, version, string(content))
+	}
+	upgraded := func(t *testing.T, a *APK) {
+		installedVersion(t, a, "1.1.0-r0")
+	}
+
+	t.Run("delta", func(t *testing.T) {
+		fetcher := &testDeltaFetcher{delta: delta}
+		a, indexes := prep(t, fetcher, false)
+		require.NoError(t, a.UpgradeWorldWithIndexes(ctx, indexes, nil), "the full package is not in the repository, so it can only come from the delta")
+		require.Equal(t, 1, fetcher.calls)
+		upgraded(t, a)
+
+		// nothing left to upgrade
+		require.NoError(t, a.UpgradeWorldWithIndexes(ctx, indexes, nil))
+		require.Equal(t, 1, fetcher.calls)
+	})
+	t.Run("only upgrades", func(t *testing.T) {
+		fetcher := &testDeltaFetcher{delta: delta}
+		a, indexes := prep(t, fetcher, true)
+		require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+		require.Zero(t, fetcher.calls, "fixating does not upgrade")
+	})
+	t.Run("no delta", func(t *testing.T) {
+		fetcher := &testDeltaFetcher{}
+		a, indexes := prep(t, fetcher, true)
+		require.NoError(t, a.UpgradeWorldWithIndexes(ctx, indexes, nil), "falls back to the full package")
+		require.Equal(t, 1, fetcher.calls)
+		upgraded(t, a)
+	})
+	t.Run("bad delta", func(t *testing.T) {
+		bad := append(testDelta(nil, deltaInsert, uint64(len(apks[0]))), apks[0]...)
+		a, indexes := prep(t, &testDeltaFetcher{delta: bad}, true)
+		require.NoError(t, a.UpgradeWorldWithIndexes(ctx, indexes, nil), "falls back to the full package")
+		upgraded(t, a)
+
+		a, indexes = prep(t, &testDeltaFetcher{delta: bad}, false)
+		require.Error(t, a.UpgradeWorldWithIndexes(ctx, indexes, nil), "a delta that does not result in the package is not used")
+		installedVersion(t, a, "1.0.0-r0")
+	})
+	t.Run("endless delta", func(t *testing.T) {
+		// applying stops once the result is larger than the package in the index
+		fetcher := &testDeltaFetcher{delta: testDelta(nil, deltaInsert, math.MaxInt64), endless: true}
+		a, indexes := prep(t, fetcher, true)
+		require.NoError(t, a.UpgradeWorldWithIndexes(ctx, indexes, nil), "falls back to the full package")
+		require.Equal(t, 1, fetcher.calls)
+		upgraded(t, a)
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// VersionChange is the difference for a single package between two resolutions of the same world.
+// OldVersion is empty for an added package, and NewVersion is empty for a removed one.
+type VersionChange struct {
+	Name       string
+	OldVersion string
+	NewVersion string
+}
+
+// Added reports whether the package is only in the new resolution.
+func (v VersionChange) Added() bool {
+	return v.OldVersion == ""
+}
+
+// Removed reports whether the package is only in the old resolution.
+func (v VersionChange) Removed() bool {
+	return v.NewVersion == ""
+}
+
+// DiffResolve resolves world against both oldIndexes and newIndexes, and returns the packages that
+// are added, removed or change version between the two, sorted by name. Packages that resolve to the
+// same version in both are omitted. Both resolutions use opts, e.g. WithLicenseAllowlist.
+func DiffResolve(ctx context.Context, oldIndexes, newIndexes []NamedIndex, world []string, opts ...ResolverOption) ([]VersionChange, error) {
+	resolve := func(indexes []NamedIndex) (map[string]string, error) {
+		pkgs, _, err := NewPkgResolver(ctx, indexes, opts...).GetPackagesWithDependencies(ctx, world)
+		if err != nil {
+			return nil, err
+		}
+		versions := make(map[string]string, len(pkgs))
+		for _, pkg := range pkgs {
+			versions[pkg.Name] = pkg.Version
+		}
+		return versions, nil
+	}
+	before, err := resolve(oldIndexes)
+	if err != nil {
+		return nil, fmt.Errorf("resolving against old indexes: %w", err)
+	}
+	after, err := resolve(newIndexes)
+	if err != nil {
+		return nil, fmt.Errorf("resolving against new indexes: %w", err)
+	}
+
+	var changes []VersionChange
+	for name, oldVersion := range before {
+		if newVersion := after[name]; newVersion != oldVersion {
+			changes = append(changes, VersionChange{Name: name, OldVersion: oldVersion, NewVersion: newVersion})
+		}
+	}
+	for name, newVersion := range after {
+		if _, ok := before[name]; !ok {
+			changes = append(changes, VersionChange{Name: name, NewVersion: newVersion})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes, nil
+}
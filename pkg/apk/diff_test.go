@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestDiffResolve(t *testing.T) {
+	index := func(pkgs ...*repository.Package) []NamedIndex {
+		repo := repository.Repository{}
+		return []NamedIndex{NewNamedRepositoryWithIndex("", repo.WithIndex(&repository.ApkIndex{Packages: pkgs}))}
+	}
+	oldIndexes := index(
+		&repository.Package{Name: "app", Version: "1.0.0-r0", Dependencies: []string{"libfoo", "libold"}},
+		&repository.Package{Name: "libfoo", Version: "1.0.0-r0"},
+		&repository.Package{Name: "libold", Version: "0.9.0-r0"},
+		&repository.Package{Name: "stable", Version: "2.0.0-r0"},
+	)
+	newIndexes := index(
+		&repository.Package{Name: "app", Version: "1.1.0-r0", Dependencies: []string{"libfoo", "libnew"}},
+		&repository.Package{Name: "libfoo", Version: "1.0.0-r0"},
+		&repository.Package{Name: "libfoo", Version: "1.2.0-r0"},
+		&repository.Package{Name: "libnew", Version: "0.1.0-r0"},
+		&repository.Package{Name: "stable", Version: "2.0.0-r0"},
+	)
+
+	changes, err := DiffResolve(context.Background(), oldIndexes, newIndexes, []string{"app", "stable"})
+	require.NoError(t, err)
+	require.Equal(t, []VersionChange{
+		{Name: "app", OldVersion: "1.0.0-r0", NewVersion: "1.1.0-r0"},
+		{Name: "libfoo", OldVersion: "1.0.0-r0", NewVersion: "1.2.0-r0"},
+		{Name: "libnew", NewVersion: "0.1.0-r0"},
+		{Name: "libold", OldVersion: "0.9.0-r0"},
+	}, changes)
+	require.True(t, changes[2].Added())
+	require.True(t, changes[3].Removed())
+
+	_, err = DiffResolve(context.Background(), oldIndexes, newIndexes, []string{"missing"})
+	require.Error(t, err)
+
+	// the options apply to both resolutions
+	_, err = DiffResolve(context.Background(), oldIndexes, newIndexes, []string{"stable"}, WithLicenseAllowlist([]string{"MIT"}))
+	require.ErrorContains(t, err, "resolving against old indexes")
+	require.ErrorContains(t, err, `stable-2.0.0-r0 ("")`)
+}
@@ -17,6 +17,8 @@ package apk
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type FileExistsError struct {
@@ -32,3 +34,153 @@ func (f FileExistsError) Is(target error) bool {
 	var targetError FileExistsError
 	return errors.As(target, &targetError)
 }
+
+// MaxDecompressedSizeError is returned when decompressing an index or package would exceed
+// the configured maximum size, e.g. because of a decompression bomb.
+type MaxDecompressedSizeError struct {
+	Limit int64
+}
+
+func (m MaxDecompressedSizeError) Error() string {
+	return fmt.Sprintf("decompressed size exceeds maximum of %d bytes", m.Limit)
+}
+
+func (m MaxDecompressedSizeError) Is(target error) bool {
+	var targetError MaxDecompressedSizeError
+	return errors.As(target, &targetError)
+}
+
+// UnsafePathError is returned when a package contains an entry that would be written outside
+// of the root filesystem, e.g. because of ".." components or a symlink pointing outside of it.
+type UnsafePathError struct {
+	Path   string
+	Reason string
+}
+
+func (u UnsafePathError) Error() string {
+	return fmt.Sprintf("unsafe path in package %s: %s", u.Path, u.Reason)
+}
+
+func (u UnsafePathError) Is(target error) bool {
+	var targetError UnsafePathError
+	return errors.As(target, &targetError)
+}
+
+// DisallowedPathError is returned when a package installs a file outside of the allowed paths.
+type DisallowedPathError struct {
+	Path string
+}
+
+func (d DisallowedPathError) Error() string {
+	return fmt.Sprintf("file %s is outside of the allowed paths", d.Path)
+}
+
+func (d DisallowedPathError) Is(target error) bool {
+	var targetError DisallowedPathError
+	return errors.As(target, &targetError)
+}
+
+// UnsupportedSignatureAlgorithmError is returned when a repository index is signed with an
+// algorithm that cannot be verified, as named in its signature file, e.g. RSA in .SIGN.RSA.<key>.
+type UnsupportedSignatureAlgorithmError struct {
+	Algorithm string
+}
+
+func (u UnsupportedSignatureAlgorithmError) Error() string {
+	return fmt.Sprintf("unsupported signature algorithm %s", u.Algorithm)
+}
+
+func (u UnsupportedSignatureAlgorithmError) Is(target error) bool {
+	var targetError UnsupportedSignatureAlgorithmError
+	return errors.As(target, &targetError)
+}
+
+// InvalidVersionError is reported for a candidate package whose version, or the version of what it
+// provides, cannot be parsed.
+type InvalidVersionError struct {
+	Package string
+	Version string
+	Err     error
+}
+
+func (i InvalidVersionError) Error() string {
+	return fmt.Sprintf("invalid version %q of package %s: %v", i.Version, i.Package, i.Err)
+}
+
+func (i InvalidVersionError) Unwrap() error {
+	return i.Err
+}
+
+func (i InvalidVersionError) Is(target error) bool {
+	var targetError InvalidVersionError
+	return errors.As(target, &targetError)
+}
+
+// DependencyDepthError is returned when resolving the dependencies of a package goes deeper than the
+// maximum depth set with WithMaxDepth. Chain is the path of dependencies from the package being
+// resolved to the one that exceeded it.
+type DependencyDepthError struct {
+	MaxDepth int
+	Chain    []string
+}
+
+func (d DependencyDepthError) Error() string {
+	return fmt.Sprintf("dependency depth exceeds maximum of %d: %s", d.MaxDepth, strings.Join(d.Chain, " -> "))
+}
+
+func (d DependencyDepthError) Is(target error) bool {
+	var targetError DependencyDepthError
+	return errors.As(target, &targetError)
+}
+
+// BlockedPackageError is returned when a package that is blocked by its checksum, with
+// WithBlockedChecksums, is resolved or installed.
+type BlockedPackageError struct {
+	Package  string
+	Version  string
+	Checksum string
+}
+
+func (b BlockedPackageError) Error() string {
+	return fmt.Sprintf("package %s (%s) is blocked by its checksum %s", b.Package, b.Version, b.Checksum)
+}
+
+func (b BlockedPackageError) Is(target error) bool {
+	var targetError BlockedPackageError
+	return errors.As(target, &targetError)
+}
+
+// DowngradeError is returned when a package resolves to an older version than the one installed,
+// e.g. because of a pin or an index that was rolled back, and downgrades are not allowed with
+// WithAllowDowngrade.
+type DowngradeError struct {
+	Package   string
+	Installed string
+	Resolved  string
+}
+
+func (d DowngradeError) Error() string {
+	return fmt.Sprintf("package %s resolved to %s, which is older than the installed %s", d.Package, d.Resolved, d.Installed)
+}
+
+func (d DowngradeError) Is(target error) bool {
+	var targetError DowngradeError
+	return errors.As(target, &targetError)
+}
+
+// CircuitOpenError is returned for requests to a host that failed too often recently, see
+// WithFetchCircuitBreaker.
+type CircuitOpenError struct {
+	Host     string
+	Failures int
+	Window   time.Duration
+}
+
+func (c CircuitOpenError) Error() string {
+	return fmt.Sprintf("not trying %s: %d requests to it failed within %s", c.Host, c.Failures, c.Window)
+}
+
+func (c CircuitOpenError) Is(target error) bool {
+	var targetError CircuitOpenError
+	return errors.As(target, &targetError)
+}
@@ -11,6 +11,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/sha1"
 	"crypto/sha256"
 	"errors"
@@ -57,6 +58,10 @@ type APKExpanded struct {
 
 	ControlHash []byte
 	PackageHash []byte
+
+	// ControlCacheHash is the control section hashed with the hash given to WithExpandControlHash,
+	// which the cache names it by; it is nil without it.
+	ControlCacheHash []byte
 }
 
 const meg = 1 << 20
@@ -290,10 +295,15 @@ func (r *expandApkReader) EnableFastRead() {
 //
 // Returns an APKExpanded struct containing references to the file. You *must* call APKExpanded.Close()
 // when finished to clean up the various files.
-func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpanded, error) {
+func ExpandApk(ctx context.Context, source io.Reader, cacheDir string, options ...ExpandApkOption) (*APKExpanded, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "ExpandApk")
 	defer span.End()
 
+	opts := &expandApkOpts{}
+	for _, opt := range options {
+		opt(opts)
+	}
+
 	dir, err := os.MkdirTemp(cacheDir, "expand-apk")
 	if err != nil {
 		return nil, err
@@ -306,12 +316,21 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	exR := newExpandApkReader(source)
 	tr := io.TeeReader(exR, sw)
 	var gzi *gzip.Reader
+	// the limit applies to the sum of all streams
+	var limitedGzi io.Reader
 	gzipStreams := []string{}
 	hashes := [][]byte{}
+	extraHashes := [][]byte{}
 	maxStreamsReached := false
 	for {
 		// Control section uses sha1.
 		var h hash.Hash = sha1.New() //nolint:gosec // this is what apk tools is using
+		var w io.Writer = h
+		var extra hash.Hash
+		if opts.controlHash != 0 {
+			extra = opts.controlHash.New()
+			w = io.MultiWriter(h, extra)
+		}
 
 		if err := sw.Next(); err != nil {
 			if err == errExpandApkWriterMaxStreams {
@@ -320,15 +339,17 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 
 				// Data section uses sha256.
 				h = sha256.New()
+				w = h
 			} else {
 				return nil, fmt.Errorf("expandApk error 5: %w", err)
 			}
 		}
 
-		hr := io.TeeReader(tr, h)
+		hr := io.TeeReader(tr, w)
 
 		if gzi == nil {
 			gzi, err = gzip.NewReader(hr)
+			limitedGzi = newMaxSizeReader(gzi, opts.maxDecompressedSize)
 		} else {
 			err = gzi.Reset(hr)
 		}
@@ -342,11 +363,14 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		if !maxStreamsReached {
 			gzi.Multistream(false)
 
-			if _, err := io.Copy(io.Discard, gzi); err != nil {
+			if _, err := io.Copy(io.Discard, limitedGzi); err != nil {
 				return nil, fmt.Errorf("expandApk error 3: %w", err)
 			}
 
 			hashes = append(hashes, h.Sum(nil))
+			if extra != nil {
+				extraHashes = append(extraHashes, extra.Sum(nil))
+			}
 			gzipStreams = append(gzipStreams, sw.CurrentName())
 		} else {
 			// While we verify checksums, also tee the tar to a separate file.
@@ -356,7 +380,7 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 				return nil, fmt.Errorf("opening tar file: %w", err)
 			}
 			bw := bufio.NewWriterSize(tarfile, 1<<20)
-			tr := io.TeeReader(gzi, bw)
+			tr := io.TeeReader(limitedGzi, bw)
 
 			if err := checkSums(ctx, tr); err != nil {
 				return nil, fmt.Errorf("checking sums: %w", err)
@@ -397,14 +421,24 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		totalSize += info.Size()
 	}
 
+	// the writer looks at the first stream to tell whether there is a signature
 	var signed bool
 	var controlDataIndex int
-	switch numGzipStreams {
-	case 3:
+	if sw.maxStreams == 3 {
 		signed = true
 		controlDataIndex = 1
+	}
+	switch numGzipStreams - controlDataIndex {
 	case 2:
-		controlDataIndex = 0
+	case 1:
+		// metapackages may have no data section at all, give them an empty one so they install
+		// like any other package
+		name, hash, err := writeEmptyDataSection(dir)
+		if err != nil {
+			return nil, fmt.Errorf("creating empty data section: %w", err)
+		}
+		gzipStreams = append(gzipStreams, name)
+		hashes = append(hashes, hash)
 	default:
 		return nil, fmt.Errorf("invalid number of tar streams: %d", numGzipStreams)
 	}
@@ -421,6 +455,9 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	if signed {
 		expanded.SignatureFile = gzipStreams[0]
 	}
+	if len(extraHashes) > controlDataIndex {
+		expanded.ControlCacheHash = extraHashes[controlDataIndex]
+	}
 
 	expanded.tarFile = strings.TrimSuffix(expanded.PackageFile, ".gz")
 
@@ -433,6 +470,58 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	return &expanded, nil
 }
 
+// writeEmptyDataSection writes a data section with no entries to dir, in both tar.gz and tar
+// format like the ones ExpandApk extracts, and returns the tar.gz filename and its sha256.
+func writeEmptyDataSection(dir string) (string, []byte, error) {
+	var tarBuf bytes.Buffer
+	if err := tar.NewWriter(&tarBuf).Close(); err != nil {
+		return "", nil, err
+	}
+	var gzBuf bytes.Buffer
+	gzw := gzip.NewWriter(&gzBuf)
+	if _, err := gzw.Write(tarBuf.Bytes()); err != nil {
+		return "", nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return "", nil, err
+	}
+
+	name := filepath.Join(dir, "empty-data.tar.gz")
+	if err := os.WriteFile(name, gzBuf.Bytes(), 0o644); err != nil {
+		return "", nil, err
+	}
+	if err := os.WriteFile(strings.TrimSuffix(name, ".gz"), tarBuf.Bytes(), 0o644); err != nil {
+		return "", nil, err
+	}
+	h := sha256.Sum256(gzBuf.Bytes())
+	return name, h[:], nil
+}
+
+type expandApkOpts struct {
+	maxDecompressedSize int64
+	controlHash         crypto.Hash
+}
+
+// ExpandApkOption is an option for ExpandApk.
+type ExpandApkOption func(*expandApkOpts)
+
+// WithExpandMaxDecompressedSize sets the maximum total number of bytes the gzip streams
+// of the package may decompress to. If exceeded, ExpandApk fails with a MaxDecompressedSizeError.
+// If not provided, or zero, there is no limit.
+func WithExpandMaxDecompressedSize(size int64) ExpandApkOption {
+	return func(o *expandApkOpts) {
+		o.maxDecompressedSize = size
+	}
+}
+
+// WithExpandControlHash additionally hashes the control section with h, into
+// APKExpanded.ControlCacheHash. The package still is checked against its SHA1 ControlHash.
+func WithExpandControlHash(h crypto.Hash) ExpandApkOption {
+	return func(o *expandApkOpts) {
+		o.controlHash = h
+	}
+}
+
 func checkSums(ctx context.Context, r io.Reader) error {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "checkSums")
 	defer span.End()
@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// fallbackArchIndexes returns the indexes for compatible archs, in order of preference, without the
+// packages whose name is in native or in an index preferred over theirs, so that a package for a
+// compatible arch is only resolved if there is none of that name for the arch of the root.
+func fallbackArchIndexes(native []NamedIndex, fallback [][]NamedIndex) []NamedIndex {
+	names := map[string]bool{}
+	for _, index := range native {
+		for _, pkg := range index.Packages() {
+			names[pkg.Name] = true
+		}
+	}
+	var kept []NamedIndex
+	for _, indexes := range fallback {
+		added := map[string]bool{}
+		for _, index := range indexes {
+			pkgs := make([]*repository.RepositoryPackage, 0, index.Count())
+			for _, pkg := range index.Packages() {
+				if !names[pkg.Name] {
+					pkgs = append(pkgs, pkg)
+					added[pkg.Name] = true
+				}
+			}
+			kept = append(kept, &heldIndex{NamedIndex: index, packages: pkgs})
+		}
+		// the indexes of one arch are alternatives to each other, like the native ones, but
+		// they all take precedence over the indexes of the archs after it
+		for name := range added {
+			names[name] = true
+		}
+	}
+	return kept
+}
+
+// isFallbackArch reports whether pkg is for one of the compatible archs set with WithCompatibleArchs,
+// rather than for the arch of the root or noarch.
+func (a *APK) isFallbackArch(pkg *repository.RepositoryPackage) bool {
+	for _, arch := range a.compatibleArchs {
+		if pkg.Arch == arch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestFallbackArchIndexes(t *testing.T) {
+	ctx := context.Background()
+	index := func(uri string, pkgs ...*repository.Package) []NamedIndex {
+		repo := repository.Repository{Uri: uri}
+		return testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: pkgs})})
+	}
+	native := index("https://example.com/main/x86_64",
+		&repository.Package{Name: "base", Version: "1.0.0-r0", Arch: "x86_64"},
+		&repository.Package{Name: "docs", Version: "1.0.0-r0", Arch: "noarch"},
+	)
+	x86 := index("https://example.com/main/x86",
+		&repository.Package{Name: "base", Version: "2.0.0-r0", Arch: "x86"},
+		&repository.Package{Name: "legacy", Version: "1.0.0-r0", Arch: "x86", Dependencies: []string{"base", "docs"}},
+	)
+	armhf := index("https://example.com/main/armhf",
+		&repository.Package{Name: "legacy", Version: "3.0.0-r0", Arch: "armhf"},
+		&repository.Package{Name: "other", Version: "1.0.0-r0", Arch: "armhf"},
+	)
+
+	fallback := fallbackArchIndexes(native, [][]NamedIndex{x86, armhf})
+	var names []string
+	for _, idx := range fallback {
+		for _, pkg := range idx.Packages() {
+			names = append(names, pkg.Arch+"/"+pkg.Name)
+		}
+	}
+	require.Equal(t, []string{"x86/legacy", "armhf/other"}, names, "only packages missing for preferred archs are kept")
+
+	a, err := New(WithFS(testGetTestAPKWithRepos(t).fs), WithCompatibleArchs("i386", "armhf"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"x86", "armhf"}, a.compatibleArchs)
+
+	pkgs, _, err := a.resolveWorldList(ctx, append(native, fallback...), []string{"legacy"})
+	require.NoError(t, err)
+	resolved := map[string]string{}
+	for _, pkg := range pkgs {
+		resolved[pkg.Name] = pkg.Version
+		require.Equal(t, pkg.Name == "legacy", a.isFallbackArch(pkg), "fallback arch of %s", pkg.Name)
+	}
+	require.Equal(t, map[string]string{"base": "1.0.0-r0", "docs": "1.0.0-r0", "legacy": "1.0.0-r0"}, resolved)
+}
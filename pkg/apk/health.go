@@ -0,0 +1,166 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// HealthCheck reports whether the configuration is workable, e.g. as a readiness probe before
+// accepting requests to resolve or install: the arch is set, the keys are present and are valid
+// public keys, every repository can be parsed and its index is reachable for the arch, and the
+// cache directory, if any, is writable. Indexes are only checked for existence, not fetched.
+// Everything that is broken is reported together in one error; nil means healthy.
+func (a *APK) HealthCheck(ctx context.Context) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "HealthCheck")
+	defer span.End()
+
+	var errs []error
+
+	arch, err := a.rootArch()
+	switch {
+	case err != nil:
+		errs = append(errs, err)
+	case arch == "":
+		errs = append(errs, errors.New("arch is not set"))
+	}
+
+	if err := a.checkKeys(); err != nil {
+		errs = append(errs, err)
+	}
+
+	// without an arch there is no index to look for
+	if arch != "" {
+		if err := a.checkRepositories(ctx, arch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if a.cache != nil {
+		if err := checkWritableDir(a.cache.dir); err != nil {
+			errs = append(errs, fmt.Errorf("cache directory %s is not writable: %w", a.cache.dir, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkKeys checks that there are keys, and that every key is a PEM encoded public key.
+func (a *APK) checkKeys() error {
+	keys, err := a.readKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys in %s", a.keysDir)
+	}
+	var errs []error
+	for name, key := range keys {
+		block, _ := pem.Decode(key)
+		if block == nil {
+			errs = append(errs, fmt.Errorf("key %s: no PEM block", name))
+			continue
+		}
+		if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			errs = append(errs, fmt.Errorf("key %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkRepositories checks that there are repositories, and that the index of each is reachable for arch.
+func (a *APK) checkRepositories(ctx context.Context, arch string) error {
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return err
+	}
+	client := withAuthStrippingRedirects(a.httpClient())
+	var (
+		errs    []error
+		checked int
+	)
+	for _, repo := range repos {
+		if strings.TrimSpace(repo) == "" || strings.HasPrefix(repo, "#") {
+			continue
+		}
+		checked++
+		if err := a.checkRepository(ctx, client, repo, arch); err != nil {
+			errs = append(errs, fmt.Errorf("repository %s: %w", repo, err))
+		}
+	}
+	if checked == 0 {
+		errs = append(errs, fmt.Errorf("no repositories in %s", a.reposFile))
+	}
+	return errors.Join(errs...)
+}
+
+// checkRepository checks that the index of the repository in line repo of /etc/apk/repositories is reachable.
+func (a *APK) checkRepository(ctx context.Context, client *http.Client, repo, arch string) error {
+	_, repoURL, err := parseRepositoryLine(repo)
+	if err != nil {
+		return err
+	}
+	flat := false
+	for _, r := range a.flatRepositories {
+		flat = flat || r == repoURL
+	}
+	u := fmt.Sprintf("%s/%s", repositoryArchURL(repoURL, arch, flat), indexFilename)
+	asURL, err := parseIndexURL(u)
+	if err != nil {
+		return fmt.Errorf("failed to parse repo as URI: %w", err)
+	}
+	switch asURL.Scheme {
+	case "file":
+		_, err := os.Stat(u)
+		return err
+	case "https":
+		var errs []error
+		for _, candidate := range mirrorCandidates(u, a.mirrors, nil) {
+			err := checkPackageURL(ctx, client, candidate)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	default:
+		return fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+	}
+}
+
+// checkWritableDir checks that a file can be created in dir, creating dir if needed.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".healthcheck-")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
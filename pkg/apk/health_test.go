@@ -0,0 +1,51 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheck(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("healthy", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		a.cache = &cache{dir: t.TempDir()}
+		require.NoError(t, a.HealthCheck(ctx))
+	})
+	t.Run("broken", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.fs.WriteFile(filepath.Join(keysDirPath, "bad.rsa.pub"), []byte("not a key"), 0o644))
+		require.NoError(t, a.fs.WriteFile(reposFilePath, []byte(testAlpineRepos+"\n/nonexistent/alpine\n"), 0o644))
+		a.SetClient(&http.Client{Transport: &testLocalTransport{fail: true}})
+
+		err := a.HealthCheck(ctx)
+		require.ErrorContains(t, err, "key bad.rsa.pub: no PEM block")
+		require.ErrorContains(t, err, "repository "+testAlpineRepos+": ")
+		require.ErrorContains(t, err, "status 404")
+		require.ErrorContains(t, err, "repository /nonexistent/alpine: ")
+	})
+	t.Run("no arch", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.fs.WriteFile(archFilePath, []byte("\n"), 0o644))
+		require.ErrorContains(t, a.HealthCheck(ctx), "arch is not set")
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// heldIndex is a NamedIndex without the package versions excluded by holds.
+type heldIndex struct {
+	NamedIndex
+	packages []*repository.RepositoryPackage
+}
+
+func (h *heldIndex) Packages() []*repository.RepositoryPackage {
+	return h.packages
+}
+
+func (h *heldIndex) Count() int {
+	return len(h.packages)
+}
+
+// applyHolds returns the indexes without the package versions that the configured holds exclude,
+// so that the resolver can never select them.
+func (a *APK) applyHolds(indexes []NamedIndex) ([]NamedIndex, error) {
+	if len(a.holds) == 0 {
+		return indexes, nil
+	}
+
+	holds := make(map[string]pinStuff, len(a.holds))
+	var installed []*InstalledPackage
+	for _, hold := range a.holds {
+		pin := resolvePackageNameVersionPin(hold)
+		if pin.dep == versionNone {
+			// a bare name holds the package at its installed version
+			if installed == nil {
+				var err error
+				if installed, err = a.GetInstalled(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("error getting installed packages: %w", err)
+				}
+			}
+			for _, pkg := range installed {
+				if pkg.Name == pin.name {
+					pin = resolvePackageNameVersionPin(pkg.Name + "=" + pkg.Version)
+					break
+				}
+			}
+			if pin.dep == versionNone {
+				continue
+			}
+		}
+		if _, err := parseVersion(pin.version); err != nil {
+			return nil, fmt.Errorf("invalid version in hold %q: %w", hold, err)
+		}
+		holds[pin.name] = pin
+	}
+
+	held := make([]NamedIndex, 0, len(indexes))
+	for _, index := range indexes {
+		pkgs := index.Packages()
+		kept := make([]*repository.RepositoryPackage, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			pin, ok := holds[pkg.Name]
+			if !ok {
+				kept = append(kept, pkg)
+				continue
+			}
+			actual, err := parseVersion(pkg.Version)
+			if err != nil {
+				continue
+			}
+			required, _ := parseVersion(pin.version)
+			if pin.dep.satisfies(actual, required) {
+				kept = append(kept, pkg)
+			}
+		}
+		held = append(held, &heldIndex{NamedIndex: index, packages: kept})
+	}
+	return held, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestApplyHolds(t *testing.T) {
+	_, index := testGetPackagesAndIndex()
+	indexes := testNamedRepositoryFromIndexes(index)
+
+	for _, tt := range []struct {
+		name    string
+		holds   []string
+		world   string
+		want    string
+		wantErr bool
+	}{
+		{name: "no holds", world: "package5", want: "2.0.0"},
+		{name: "less than", holds: []string{"package5<2.0.0"}, world: "package5", want: "1.5.1"},
+		{name: "tilde", holds: []string{"package5~1.5"}, world: "package5", want: "1.5.1"},
+		{name: "installed version", holds: []string{"package5"}, world: "package5", want: "1.5.0"},
+		{name: "bare name not installed", holds: []string{"package6"}, world: "package6", want: "2.0.0"},
+		{name: "world within hold", holds: []string{"package5<2.0.0"}, world: "package5>1.0.0", want: "1.5.1"},
+		{name: "world outside hold", holds: []string{"package5<2.0.0"}, world: "package5=2.0.0", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _, err := testGetTestAPK()
+			require.NoError(t, err)
+			a.holds = tt.holds
+			require.NoError(t, a.addInstalledPackage(&repository.Package{Name: "package5", Version: "1.5.0"}, nil))
+
+			held, err := a.applyHolds(indexes)
+			require.NoError(t, err)
+			pkgs, err := NewPkgResolver(context.Background(), held).ResolvePackage(tt.world)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, pkgs[0].Version)
+		})
+	}
+
+	t.Run("invalid version", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		a.holds = []string{"package5<not.a.version!"}
+		_, err = a.applyHolds(indexes)
+		require.Error(t, err)
+	})
+}
@@ -16,10 +16,15 @@ package apk
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
@@ -47,15 +52,59 @@ import (
 )
 
 type APK struct {
-	arch              string
-	version           string
-	logger            logger.Logger
-	fs                apkfs.FullFS
-	executor          Executor
-	ignoreMknodErrors bool
-	client            *http.Client
-	cache             *cache
-	ignoreSignatures  bool
+	arch                  string
+	version               string
+	logger                logger.Logger
+	fs                    apkfs.FullFS
+	executor              Executor
+	ignoreMknodErrors     bool
+	client                *http.Client
+	transport             *http.Transport
+	cache                 *cache
+	ignoreSignatures      bool
+	releasesCacheTTL      time.Duration
+	ociPuller             OCIPuller
+	deltaUpgrades         bool
+	deltaFetcher          DeltaFetcher
+	requestTimeout        time.Duration
+	maxDecompressedSize   int64
+	allowedPaths          []string
+	mirrors               map[string][]Mirror
+	holds                 []string
+	licenseAllowlist      []string
+	excludeSuffixes       []string
+	repositoryPrefs       []string
+	alternativeDeps       bool
+	resolveTracer         func(ResolveStep)
+	compressedInstalledDB bool
+	flatRepositories      []string
+	staleIndexOK          bool
+	verificationCallback  func(PackageVerification)
+	allowUnsignedIndexes  bool
+	strictArchFile        bool
+	manifestWriter        io.Writer
+	skipScripts           bool
+	skipTriggers          bool
+	resolveValidator      func([]*repository.RepositoryPackage) error
+	uidGIDMapper          func(uid, gid int) (int, int)
+	continueOnError       bool
+	blockedChecksums      map[string]bool
+	reposFile             string
+	archFile              string
+	worldFile             string
+	keysDir               string
+	cacheHash             crypto.Hash
+	baseLayout            bool
+	keysTime              time.Time
+	breaker               *circuitBreaker
+	deviceOwners          map[string]DeviceOwner
+	compatibleArchs       []string
+	allowDowngrade        bool
+	bundles               []string
+	remoteCache           RemoteCache
+	remoteCachePush       bool
+	bundleCache           *bundleCache
+	validateScriptsTar    bool
 }
 
 func New(options ...Option) (*APK, error) {
@@ -65,14 +114,69 @@ func New(options ...Option) (*APK, error) {
 			return nil, err
 		}
 	}
+	compatibleArchs := append([]string(nil), opt.compatibleArchs...)
+	if opt.normalizeArch {
+		opt.arch = normalizeArch(opt.arch)
+		for i, arch := range compatibleArchs {
+			compatibleArchs[i] = normalizeArch(arch)
+		}
+	}
+	var breaker *circuitBreaker
+	if opt.breakerFailures > 0 {
+		breaker = newCircuitBreaker(opt.breakerFailures, opt.breakerWindow, opt.logger)
+	}
 	return &APK{
-		fs:                opt.fs,
-		logger:            opt.logger,
-		arch:              opt.arch,
-		executor:          opt.executor,
-		ignoreMknodErrors: opt.ignoreMknodErrors,
-		version:           opt.version,
-		cache:             opt.cache,
+		fs:                    opt.fs,
+		logger:                opt.logger,
+		arch:                  opt.arch,
+		executor:              opt.executor,
+		ignoreMknodErrors:     opt.ignoreMknodErrors,
+		version:               opt.version,
+		cache:                 opt.cache,
+		releasesCacheTTL:      opt.releasesCacheTTL,
+		ociPuller:             opt.ociPuller,
+		deltaUpgrades:         opt.deltaUpgrades,
+		deltaFetcher:          opt.deltaFetcher,
+		requestTimeout:        opt.requestTimeout,
+		maxDecompressedSize:   opt.maxDecompressedSize,
+		allowedPaths:          opt.allowedPaths,
+		mirrors:               opt.mirrors,
+		holds:                 opt.holds,
+		licenseAllowlist:      opt.licenseAllowlist,
+		excludeSuffixes:       opt.excludeSuffixes,
+		repositoryPrefs:       opt.repositoryPrefs,
+		alternativeDeps:       opt.alternativeDeps,
+		resolveTracer:         opt.resolveTracer,
+		compressedInstalledDB: opt.compressedInstalledDB,
+		flatRepositories:      opt.flatRepositories,
+		staleIndexOK:          opt.staleIndexOK,
+		verificationCallback:  opt.verificationCallback,
+		allowUnsignedIndexes:  opt.allowUnsignedIndexes,
+		strictArchFile:        opt.strictArchFile,
+		manifestWriter:        opt.manifestWriter,
+		skipScripts:           opt.skipScripts,
+		skipTriggers:          opt.skipTriggers,
+		resolveValidator:      opt.resolveValidator,
+		uidGIDMapper:          opt.uidGIDMapper,
+		continueOnError:       opt.continueOnError,
+		blockedChecksums:      opt.blockedChecksums,
+		reposFile:             opt.reposFile,
+		archFile:              opt.archFile,
+		worldFile:             opt.worldFile,
+		keysDir:               opt.keysDir,
+		cacheHash:             opt.cacheHash,
+		baseLayout:            opt.baseLayout,
+		keysTime:              opt.keysTime,
+		breaker:               breaker,
+		deviceOwners:          opt.deviceOwners,
+		compatibleArchs:       compatibleArchs,
+		allowDowngrade:        opt.allowDowngrade,
+		bundles:               opt.bundles,
+		remoteCache:           opt.remoteCache,
+		remoteCachePush:       opt.remoteCachePush,
+		bundleCache:           &bundleCache{},
+		validateScriptsTar:    opt.validateScriptsTar,
+		transport:             newHTTPTransport(opt),
 	}, nil
 }
 
@@ -122,6 +226,38 @@ var initDirectories = []directory{
 	{"/var/cache/misc", 0o755},
 }
 
+// baseLayoutDirectories is the standard directory skeleton created by InitDB with WithBaseLayout,
+// like the one alpine-baselayout installs. /bin, /sbin and /var/lock are left out, as they are symlinks
+// in merged /usr layouts, which a package could not install over a directory. As with initDirectories,
+// parents come before children.
+var baseLayoutDirectories = []directory{
+	{"/home", 0o755},
+	{"/media", 0o755},
+	{"/mnt", 0o755},
+	{"/opt", 0o755},
+	{"/root", 0o700},
+	{"/run", 0o755},
+	{"/srv", 0o755},
+	{"/sys", 0o555},
+	{"/usr", 0o755},
+	{"/usr/bin", 0o755},
+	{"/usr/lib", 0o755},
+	{"/usr/local", 0o755},
+	{"/usr/local/bin", 0o755},
+	{"/usr/local/lib", 0o755},
+	{"/usr/local/share", 0o755},
+	{"/usr/sbin", 0o755},
+	{"/usr/share", 0o755},
+	{"/var/empty", 0o555},
+	{"/var/lib", 0o755},
+	{"/var/local", 0o755},
+	{"/var/log", 0o755},
+	{"/var/mail", 0o755},
+	{"/var/opt", 0o755},
+	{"/var/spool", 0o755},
+	{"/var/tmp", 0o777 | fs.ModeSticky},
+}
+
 // files is a list of files to create relative to the root, as well as optional content.
 // We will not do MkdirAll for the parent dir it is in, so it must exist.
 var initFiles = []file{
@@ -149,6 +285,39 @@ func (a *APK) SetClient(client *http.Client) {
 	a.client = client
 }
 
+// httpClient returns the client to use for fetching keys, indexes and packages: the one set with
+// SetClient, or a retrying default client sharing the transport of a. If a request timeout is set,
+// it is applied per request.
+func (a *APK) httpClient() *http.Client {
+	if a.client == nil {
+		rc := retryablehttp.NewClient()
+		if a.transport != nil {
+			rc.HTTPClient.Transport = a.transport
+		}
+		if a.requestTimeout > 0 {
+			// apply the timeout below the retries, so that a stuck attempt is retried
+			rc.HTTPClient.Transport = newTimeoutTransport(rc.HTTPClient.Transport, a.requestTimeout)
+		}
+		if a.breaker != nil {
+			// below the retries as well, so that every attempt counts against the budget
+			rc.HTTPClient.Transport = newCircuitBreakerTransport(rc.HTTPClient.Transport, a.breaker)
+			rc.CheckRetry = circuitBreakerRetryPolicy
+		}
+		return rc.StandardClient()
+	}
+	if a.requestTimeout <= 0 && a.breaker == nil {
+		return a.client
+	}
+	c := *a.client
+	if a.requestTimeout > 0 {
+		c.Transport = newTimeoutTransport(c.Transport, a.requestTimeout)
+	}
+	if a.breaker != nil {
+		c.Transport = newCircuitBreakerTransport(c.Transport, a.breaker)
+	}
+	return &c
+}
+
 // ListInitFiles list the files that are installed during the InitDB phase.
 func (a *APK) ListInitFiles() []tar.Header {
 	headers := make([]tar.Header, 0, 20)
@@ -156,10 +325,14 @@ func (a *APK) ListInitFiles() []tar.Header {
 	// additionalFiles are files we need but can only be resolved in the context of
 	// this func, e.g. we need the architecture
 	additionalFiles := []file{
-		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
+		{"/" + a.archFile, 0o644, []byte(a.arch + "\n")},
 	}
 
-	for _, e := range initDirectories {
+	dirs := initDirectories
+	if a.baseLayout {
+		dirs = append(dirs[:len(dirs):len(dirs)], baseLayoutDirectories...)
+	}
+	for _, e := range dirs {
 		headers = append(headers, tar.Header{
 			Name:     e.path,
 			Mode:     int64(e.perms),
@@ -178,12 +351,13 @@ func (a *APK) ListInitFiles() []tar.Header {
 		})
 	}
 	for _, e := range initDeviceFiles {
+		owner := a.deviceOwners[e.path]
 		headers = append(headers, tar.Header{
 			Name:     e.path,
 			Typeflag: tar.TypeChar,
 			Mode:     int64(e.perms),
-			Uid:      0,
-			Gid:      0,
+			Uid:      owner.UID,
+			Gid:      owner.GID,
 		})
 	}
 
@@ -200,10 +374,18 @@ func (a *APK) ListInitFiles() []tar.Header {
 
 // Initialize the APK database for a given build context.
 // Assumes base directories are in place and checks them.
-// Returns the list of files and directories and files installed and permissions,
-// unless those files will be included in the installed database, in which case they can
-// be retrieved via GetInstalled().
+// Use InitDBManifest to get the list of files and directories it creates.
 func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
+	_, err := a.InitDBManifest(ctx, alpineVersions...)
+	return err
+}
+
+// InitDBManifest initializes the APK database like InitDB does, and returns the list of files and
+// directories installed and permissions, unless those files will be included in the installed
+// database, in which case they can be retrieved via GetInstalled(). Directories that already
+// existed are listed with their actual permissions. Device nodes are listed even if creating them
+// failed and the error was ignored with WithIgnoreMknodErrors, so a tar built from the list has them.
+func (a *APK) InitDBManifest(ctx context.Context, alpineVersions ...string) ([]tar.Header, error) {
 	/*
 		equivalent of: "apk add --initdb --arch arch --root root"
 	*/
@@ -212,78 +394,129 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 	// additionalFiles are files we need but can only be resolved in the context of
 	// this func, e.g. we need the architecture
 	additionalFiles := []file{
-		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
+		{"/" + a.archFile, 0o644, []byte(a.arch + "\n")},
 	}
 
+	var headers []tar.Header
 	for _, e := range baseDirectories {
 		stat, err := a.fs.Stat(e.path)
 		switch {
 		case err != nil && errors.Is(err, fs.ErrNotExist):
 			err := a.fs.Mkdir(e.path, e.perms)
 			if err != nil {
-				return fmt.Errorf("failed to create base directory %s: %w", e.path, err)
+				return nil, fmt.Errorf("failed to create base directory %s: %w", e.path, err)
 			}
 		case err != nil:
-			return fmt.Errorf("error opening base directory %s: %w", e.path, err)
+			return nil, fmt.Errorf("error opening base directory %s: %w", e.path, err)
 		case !stat.IsDir():
-			return fmt.Errorf("base directory %s is not a directory", e.path)
+			return nil, fmt.Errorf("base directory %s is not a directory", e.path)
 		case stat.Mode().Perm() != e.perms:
-			return fmt.Errorf("base directory %s has incorrect permissions: %o", e.path, stat.Mode().Perm())
+			return nil, fmt.Errorf("base directory %s has incorrect permissions: %o", e.path, stat.Mode().Perm())
+		default:
+			headers = append(headers, initHeader(e.path, tar.TypeDir, stat.Mode()))
+			continue
 		}
+		headers = append(headers, initHeader(e.path, tar.TypeDir, e.perms))
+	}
+	dirs := initDirectories
+	if a.baseLayout {
+		dirs = append(dirs[:len(dirs):len(dirs)], baseLayoutDirectories...)
 	}
-	for _, e := range initDirectories {
+	for _, e := range dirs {
+		perms := e.perms
 		err := a.fs.Mkdir(e.path, e.perms)
 		switch {
 		case err != nil && !errors.Is(err, fs.ErrExist):
-			return fmt.Errorf("failed to create directory %s: %w", e.path, err)
+			return nil, fmt.Errorf("failed to create directory %s: %w", e.path, err)
 		case err != nil && errors.Is(err, fs.ErrExist):
 			stat, err := a.fs.Stat(e.path)
 			if err != nil {
-				return fmt.Errorf("failed to stat directory %s: %w", e.path, err)
+				return nil, fmt.Errorf("failed to stat directory %s: %w", e.path, err)
 			}
 			if !stat.IsDir() {
-				return fmt.Errorf("failed to create directory %s: already exists as file", e.path)
+				return nil, fmt.Errorf("failed to create directory %s: already exists as file", e.path)
 			}
+			// it was left as it was, so list it that way
+			perms = stat.Mode()
 		}
+		headers = append(headers, initHeader(e.path, tar.TypeDir, perms))
 	}
 	for _, e := range append(initFiles, additionalFiles...) {
 		if err := a.fs.WriteFile(e.path, e.contents, e.perms); err != nil {
-			return fmt.Errorf("failed to create file %s: %w", e.path, err)
+			return nil, fmt.Errorf("failed to create file %s: %w", e.path, err)
 		}
+		header := initHeader(e.path, tar.TypeReg, e.perms)
+		header.Size = int64(len(e.contents))
+		headers = append(headers, header)
 	}
 	for _, e := range initDeviceFiles {
 		perms := uint32(e.perms.Perm())
 		err := a.fs.Mknod(e.path, unix.S_IFCHR|perms, int(unix.Mkdev(e.major, e.minor)))
 		if !a.ignoreMknodErrors && err != nil {
-			return fmt.Errorf("failed to create char device %s: %w", e.path, err)
+			return nil, fmt.Errorf("failed to create char device %s: %w", e.path, err)
 		}
+		owner, ok := a.deviceOwners[e.path]
+		if ok && err == nil {
+			if err := a.fs.Chown(e.path, owner.UID, owner.GID); err != nil {
+				return nil, fmt.Errorf("failed to change owner of char device %s: %w", e.path, err)
+			}
+		}
+		header := initHeader(e.path, tar.TypeChar, e.perms)
+		header.Devmajor = int64(e.major)
+		header.Devminor = int64(e.minor)
+		header.Uid = owner.UID
+		header.Gid = owner.GID
+		headers = append(headers, header)
 	}
 
 	// add scripts.tar with nothing in it
-	scriptsTarPerms := 0o644
-	tarfile, err := a.fs.OpenFile(scriptsFilePath, os.O_CREATE|os.O_WRONLY, fs.FileMode(scriptsTarPerms))
-	if err != nil {
-		return fmt.Errorf("could not create tarball file '%s', got error '%w'", scriptsFilePath, err)
+	var scripts bytes.Buffer
+	if err := tar.NewWriter(&scripts).Close(); err != nil {
+		return nil, fmt.Errorf("could not create tarball file '%s', got error '%w'", scriptsFilePath, err)
 	}
-	defer tarfile.Close()
-	tarWriter := tar.NewWriter(tarfile)
-	defer tarWriter.Close()
-
-	// nothing to add to it; scripts.tar should be empty
+	if err := a.fs.WriteFile(scriptsFilePath, scripts.Bytes(), scriptsTarPerms); err != nil {
+		return nil, fmt.Errorf("could not create tarball file '%s', got error '%w'", scriptsFilePath, err)
+	}
+	header := initHeader(scriptsFilePath, tar.TypeReg, scriptsTarPerms)
+	header.Size = int64(scripts.Len())
+	headers = append(headers, header)
 
 	// get the alpine-keys base keys for our usage
 	if len(alpineVersions) > 0 {
-		if err := a.fetchAlpineKeys(ctx, alpineVersions); err != nil {
+		keys, err := a.fetchAlpineKeys(ctx, alpineVersions)
+		if err != nil {
 			var nokeysErr *NoKeysFoundError
 			if !errors.As(err, &nokeysErr) {
-				return fmt.Errorf("failed to fetch alpine-keys: %w", err)
+				return nil, fmt.Errorf("failed to fetch alpine-keys: %w", err)
 			}
 			a.logger.Infof("ignoring missing keys: %s", err.Error())
 		}
+		headers = append(headers, keys...)
 	}
 
 	a.logger.Infof("finished initializing apk database")
-	return nil
+	return headers, nil
+}
+
+// initHeader returns the header of a file created by InitDB, owned by root.
+func initHeader(path string, typeflag byte, perms fs.FileMode) tar.Header {
+	mode := int64(perms.Perm())
+	if perms&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if perms&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if perms&fs.ModeSticky != 0 {
+		mode |= 0o1000 // the tar sticky bit
+	}
+	return tar.Header{
+		Name:     path,
+		Mode:     mode,
+		Typeflag: typeflag,
+		Uid:      0,
+		Gid:      0,
+	}
 }
 
 // loadSystemKeyring returns the keys found in the system keyring
@@ -351,7 +584,9 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 
 			var asURL *url.URL
 			var err error
-			if strings.HasPrefix(element, "https://") {
+			if strings.HasPrefix(element, "data:") {
+				asURL = &url.URL{Scheme: "data", Opaque: strings.TrimPrefix(element, "data:")}
+			} else if strings.HasPrefix(element, "https://") {
 				asURL, err = url.Parse(element)
 			} else {
 				// Attempt to parse non-https elements into URI's so they are translated into
@@ -363,16 +598,25 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 			}
 
 			var data []byte
+			keyName := filepath.Base(element)
 			switch asURL.Scheme {
+			case "data":
+				keyName, data, err = parseKeyDataURL(asURL.Opaque)
+				if err != nil {
+					return fmt.Errorf("failed to parse inline apk key: %w", err)
+				}
 			case "file": //nolint:goconst
 				data, err = os.ReadFile(element)
 				if err != nil {
 					return fmt.Errorf("failed to read apk key: %w", err)
 				}
 			case "https": //nolint:goconst
-				client := a.client
-				if client == nil {
-					client = retryablehttp.NewClient().StandardClient()
+				client := a.httpClient()
+				if a.requestTimeout <= 0 {
+					// never let a key download block init indefinitely
+					c := *client
+					c.Transport = newTimeoutTransport(c.Transport, defaultKeyRequestTimeout)
+					client = &c
 				}
 				if a.cache != nil {
 					client = a.cache.client(client, true)
@@ -398,16 +642,23 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 					return fmt.Errorf("failed to fetch apk key: http response indicated error code: %d", resp.StatusCode)
 				}
 
-				data, err = io.ReadAll(resp.Body)
+				data, err = io.ReadAll(io.LimitReader(resp.Body, maxKeySize+1))
 				if err != nil {
-					return fmt.Errorf("failed to read apk key response: %w", err)
+					return fmt.Errorf("failed to read apk key response from %s: %w", asURL.Redacted(), err)
 				}
 			default:
 				return fmt.Errorf("scheme %s not supported", asURL.Scheme)
 			}
 
+			if len(data) > maxKeySize {
+				return fmt.Errorf("invalid apk key %s: larger than the maximum key size of %d bytes", keyName, maxKeySize)
+			}
+			if err := validateKey(data); err != nil {
+				return fmt.Errorf("invalid apk key %s: %w", keyName, err)
+			}
+
 			// #nosec G306 -- apk keyring must be publicly readable
-			if err := a.fs.WriteFile(filepath.Join("etc", "apk", "keys", filepath.Base(element)), data,
+			if err := a.fs.WriteFile(filepath.Join(a.keysDir, keyName), data,
 				0o644); err != nil {
 				return fmt.Errorf("failed to write apk key: %w", err)
 			}
@@ -419,38 +670,232 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 	return eg.Wait()
 }
 
-// ResolveWorld determine the target state for the requested dependencies in /etc/apk/world. Do not install anything.
-func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
-	a.logger.Infof("determining desired apk world")
+// parseKeyDataURL parses the part of a data: URL after the scheme, e.g.
+// "application/x-pem-file;name=foo.rsa.pub;base64,LS0tLS1CRUdJTi...".
+// Only base64 encoded content is supported. The optional name parameter sets the file name
+// of the key in the keyring; if not provided, a name is derived from the key content.
+func parseKeyDataURL(opaque string) (name string, data []byte, err error) {
+	meta, content, ok := strings.Cut(opaque, ",")
+	if !ok {
+		return "", nil, errors.New("missing ',' separator in data URL")
+	}
+	var isBase64 bool
+	for _, param := range strings.Split(meta, ";") {
+		switch {
+		case param == "base64":
+			isBase64 = true
+		case strings.HasPrefix(param, "name="):
+			name = filepath.Base(strings.TrimPrefix(param, "name="))
+		}
+	}
+	if !isBase64 {
+		return "", nil, errors.New("data URL must be base64 encoded")
+	}
+	// allow for URL escaping of the base64 alphabet, e.g. when passed in a config file
+	if unescaped, err := url.PathUnescape(content); err == nil {
+		content = unescaped
+	}
+	data, err = base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decode base64 data: %w", err)
+	}
+	// the name is of a file in the keyring directory, so it may not lead anywhere else
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		sum := sha256.Sum256(data)
+		name = fmt.Sprintf("inline-%s.rsa.pub", hex.EncodeToString(sum[:])[:16])
+	}
+	return name, data, nil
+}
 
-	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveWorld")
+// validateKey checks that the key is a PEM encoded public key, as expected by apk.
+func validateKey(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("no PEM block found")
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return nil
+}
+
+// LoadIndexes fetches and parses the indexes for the repositories in /etc/apk/repositories.
+// The result can be passed to ResolveWorldWithIndexes and FixateWorldWithIndexes, so that a
+// sequence of operations fetches the indexes only once. The indexes are a snapshot: packages
+// published to the repositories afterwards are not seen until LoadIndexes is called again.
+func (a *APK) LoadIndexes(ctx context.Context) ([]NamedIndex, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "LoadIndexes")
 	defer span.End()
 
-	// to fix the world, we need to:
-	// 1. Get the apkIndexes for each repository for the target arch
 	indexes, err := a.getRepositoryIndexes(ctx, a.ignoreSignatures)
 	if err != nil {
-		return toInstall, conflicts, fmt.Errorf("error getting repository indexes: %w", err)
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
 	}
 	// debugging info, if requested
 	a.logger.Debugf("got %d indexes:\n%s", len(indexes), strings.Join(indexNames(indexes), "\n"))
+	return indexes, nil
+}
+
+// RefreshIndexes fetches the indexes again, like LoadIndexes, and reports whether they changed
+// compared to prev, e.g. from an earlier call to LoadIndexes or RefreshIndexes. Indexes are compared
+// by the repositories they come from and the name, version and checksum of each of their packages,
+// so changed is false when nothing moved, even if an index was re-signed or re-compressed.
+// When the cache is set, unchanged indexes are not downloaded again.
+func (a *APK) RefreshIndexes(ctx context.Context, prev []NamedIndex) (indexes []NamedIndex, changed bool, err error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "RefreshIndexes")
+	defer span.End()
 
+	indexes, err = a.LoadIndexes(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return indexes, !equalIndexDigests(prev, indexes), nil
+}
+
+// equalIndexDigests reports whether both sets of indexes have the same sources and contents,
+// irrespective of their order.
+func equalIndexDigests(a, b []NamedIndex) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	digests := make(map[string]int, len(a))
+	for _, idx := range a {
+		digests[indexDigest(idx)]++
+	}
+	for _, idx := range b {
+		d := indexDigest(idx)
+		if digests[d] == 0 {
+			return false
+		}
+		digests[d]--
+	}
+	return true
+}
+
+// indexDigest returns a digest of the source and packages of the index.
+func indexDigest(idx NamedIndex) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", idx.Name(), idx.Source())
+	for _, pkg := range idx.Packages() {
+		fmt.Fprintf(h, "%s %s %s\n", pkg.Name, pkg.Version, pkg.ChecksumString())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ResolveWorld determine the target state for the requested dependencies in /etc/apk/world. Do not install anything.
+func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
+	// to fix the world, we need to:
+	// 1. Get the apkIndexes for each repository for the target arch
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return toInstall, conflicts, err
+	}
+	return a.ResolveWorldWithIndexes(ctx, indexes)
+}
+
+// ResolveWorldFrom is like ResolveWorld, but fetches indexes only from the given repositories,
+// ignoring /etc/apk/repositories, e.g. to resolve against a trusted subset of repositories.
+func (a *APK) ResolveWorldFrom(ctx context.Context, repos []string) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
+	indexes, err := a.getRepositoryIndexesFrom(ctx, repos, a.ignoreSignatures)
+	if err != nil {
+		return toInstall, conflicts, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	return a.ResolveWorldWithIndexes(ctx, indexes)
+}
+
+// ResolveWorldFromList is like ResolveWorld, but resolves world as given, instead of reading it from
+// /etc/apk/world, e.g. for tooling that computes worlds without writing them to the root.
+func (a *APK) ResolveWorldFromList(ctx context.Context, world []string) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return toInstall, conflicts, err
+	}
+	return a.resolveWorldList(ctx, indexes, world)
+}
+
+// ResolveWorldWithIndexes is like ResolveWorld, but uses the given indexes, e.g. from LoadIndexes,
+// instead of fetching them. See LoadIndexes for the staleness trade-off.
+func (a *APK) ResolveWorldWithIndexes(ctx context.Context, indexes []NamedIndex) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
 	// 2. Get the dependency tree for each package from the world file
 	directPkgs, err := a.GetWorld()
 	if err != nil {
 		return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
 	}
-	resolver := NewPkgResolver(ctx, indexes)
+	return a.resolveWorldList(ctx, indexes, directPkgs)
+}
+
+// resolveWorldList determines the target state for the packages in world from indexes.
+func (a *APK) resolveWorldList(ctx context.Context, indexes []NamedIndex, directPkgs []string) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
+	a.logger.Infof("determining desired apk world")
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveWorld")
+	defer span.End()
+
+	// virtual packages only exist in the installed db, make them resolvable like any other
+	virtual, err := a.virtualIndex()
+	if err != nil {
+		return toInstall, conflicts, err
+	}
+	if virtual.Count() > 0 {
+		indexes = append(indexes[:len(indexes):len(indexes)], virtual)
+	}
+	indexes, err = a.applyHolds(indexes)
+	if err != nil {
+		return toInstall, conflicts, err
+	}
+	resolver := NewPkgResolver(ctx, indexes, a.resolverOptions()...)
 	toInstall, conflicts, err = resolver.GetPackagesWithDependencies(ctx, directPkgs)
+	for _, invalid := range resolver.InvalidVersions() {
+		a.logger.Warnf("%v, ranking it lowest", invalid)
+	}
 	if err != nil {
 		return
 	}
+	if err = a.checkBlocked(toInstall); err != nil {
+		return nil, nil, err
+	}
+	for _, pkg := range toInstall {
+		if a.isFallbackArch(pkg) {
+			a.logger.Warnf("no %s for the arch of the root, using %s (%s) for compatible arch %s", pkg.Name, pkg.Name, pkg.Version, pkg.Arch)
+		}
+	}
 	a.logger.Debugf("got %d packages to install:\n%s", len(toInstall), strings.Join(packageRefs(toInstall), "\n"))
 	return
 }
 
+// resolverOptions returns the options of a for the resolvers that choose packages to install.
+func (a *APK) resolverOptions() []ResolverOption {
+	opts := []ResolverOption{WithResolverLogger(a.logger)}
+	if a.licenseAllowlist != nil {
+		opts = append(opts, WithLicenseAllowlist(a.licenseAllowlist))
+	}
+	if len(a.excludeSuffixes) > 0 {
+		opts = append(opts, WithExcludeSubpackageSuffixes(a.excludeSuffixes))
+	}
+	if len(a.repositoryPrefs) > 0 {
+		opts = append(opts, WithRepositoryPreference(a.repositoryPrefs))
+	}
+	if a.alternativeDeps {
+		opts = append(opts, WithAlternativeDependencies(true))
+	}
+	if a.resolveTracer != nil {
+		opts = append(opts, WithResolveTracer(a.resolveTracer))
+	}
+	return opts
+}
+
 // FixateWorld force apk's resolver to re-resolve the requested dependencies in /etc/apk/world.
 func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error {
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting package dependencies: %w", err)
+	}
+	return a.FixateWorldWithIndexes(ctx, indexes, sourceDateEpoch)
+}
+
+// FixateWorldWithIndexes is like FixateWorld, but uses the given indexes, e.g. from LoadIndexes,
+// instead of fetching them. See LoadIndexes for the staleness trade-off.
+func (a *APK) FixateWorldWithIndexes(ctx context.Context, indexes []NamedIndex, sourceDateEpoch *time.Time) error {
 	/*
 		equivalent of: "apk fix --arch arch --root root"
 		with possible options for --no-scripts, --no-cache, --update-cache
@@ -462,29 +907,306 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "FixateWorld")
 	defer span.End()
 
+	if a.breaker != nil {
+		a.breaker.reset()
+	}
+
 	// to fix the world, we need to:
 	// 1. Get the apkIndexes for each repository for the target arch
-	allpkgs, conflicts, err := a.ResolveWorld(ctx)
+	// 2. Let the caller veto the resolved set before anything is fetched
+	allpkgs, err := a.resolveWorldToInstall(ctx, indexes)
 	if err != nil {
-		return fmt.Errorf("error getting package dependencies: %w", err)
+		return err
 	}
 
 	// 3. For each name on the list:
 	//     a. Check if it is installed, if so, skip
 	//     b. Get the .apk file
-	//     c. Install the .apk file
-	//     d. Update /lib/apk/db/scripts.tar
-	//     d. Update /lib/apk/db/triggers
-	//     e. Update the installed file
+	//     c. Install the files of the .apk file
+	//     d. Update the installed file
+	// 4. Once the files of all packages are in place:
+	//     a. Update /lib/apk/db/scripts.tar
+	//     b. Update /lib/apk/db/triggers
+
+	// the packages installed before any failure keep their scripts and triggers
+	hooks, err := a.installPackages(ctx, allpkgs, signedRepositories(indexes), sourceDateEpoch)
+	if recordErr := a.recordHooks(hooks); recordErr != nil {
+		return errors.Join(err, recordErr)
+	}
+	return err
+}
+
+// resolveWorldToInstall resolves world with indexes, and checks the result before anything is
+// fetched: with the resolve validator, for downgrades, and for installed packages it conflicts with.
+func (a *APK) resolveWorldToInstall(ctx context.Context, indexes []NamedIndex) ([]*repository.RepositoryPackage, error) {
+	allpkgs, conflicts, err := a.ResolveWorldWithIndexes(ctx, indexes)
+	if err != nil {
+		return nil, fmt.Errorf("error getting package dependencies: %w", err)
+	}
+	if a.resolveValidator != nil {
+		if err := a.resolveValidator(allpkgs); err != nil {
+			return nil, fmt.Errorf("resolved packages rejected: %w", err)
+		}
+	}
+	if err := a.checkDowngrades(allpkgs); err != nil {
+		return nil, err
+	}
 	for _, pkg := range conflicts {
 		isInstalled, err := a.isInstalledPackage(pkg)
 		if err != nil {
-			return fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
+			return nil, fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
 		}
 		if isInstalled {
-			return fmt.Errorf("cannot install due to conflict with %s", pkg)
+			return nil, fmt.Errorf("cannot install due to conflict with %s", pkg)
+		}
+	}
+	return allpkgs, nil
+}
+
+type installFileOpts struct {
+	metadataOnly bool
+}
+
+type InstallFileOption func(*installFileOpts)
+
+// WithInstallMetadataOnly records the package as installed, with its scripts and triggers, without
+// extracting any of its files, e.g. for a package whose contents were put in place by other means.
+// The installed database lists no files for it, so they are not checked or removed as its files.
+// Its dependencies still are installed as usual.
+func WithInstallMetadataOnly(metadataOnly bool) InstallFileOption {
+	return func(o *installFileOpts) {
+		o.metadataOnly = metadataOnly
+	}
+}
+
+// InstallFile installs a single .apk that is not part of any index, given as a local file path or
+// an https URL. The package's declared dependencies are resolved from the configured repositories
+// and installed first. The world file is not modified. As there is no index to verify it with, the
+// package has to be signed by a trusted key, unless signatures are ignored. It fails if a package
+// of the same name is installed already.
+func (a *APK) InstallFile(ctx context.Context, path string, sourceDateEpoch *time.Time, options ...InstallFileOption) error {
+	var opts installFileOpts
+	for _, opt := range options {
+		opt(&opts)
+	}
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallFile", trace.WithAttributes(attribute.String("path", path)))
+	defer span.End()
+
+	var (
+		rc  io.ReadCloser
+		err error
+	)
+	switch {
+	case strings.HasPrefix(path, "https://"):
+		rc, err = fetchPackageURL(ctx, a.httpClient(), path)
+	case strings.HasPrefix(path, "http://"):
+		return fmt.Errorf("refusing to fetch package %s over plain http", path)
+	default:
+		rc, err = os.Open(path)
+	}
+	if err != nil {
+		return fmt.Errorf("opening package %s: %w", path, err)
+	}
+	defer rc.Close()
+
+	exp, err := ExpandApk(ctx, rc, "", WithExpandMaxDecompressedSize(a.maxDecompressedSize))
+	if err != nil {
+		return fmt.Errorf("expanding %s: %w", path, err)
+	}
+	// installPackage closes exp when it is done, until then we are responsible for it
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			exp.Close()
+		}
+	}()
+
+	controlData, err := os.Open(exp.ControlFile)
+	if err != nil {
+		return fmt.Errorf("opening control file %q: %w", exp.ControlFile, err)
+	}
+	pkg, err := parsePkgInfo(controlData)
+	controlData.Close()
+	if err != nil {
+		return fmt.Errorf("reading package info from %s: %w", path, err)
+	}
+	pkg.Checksum = exp.ControlHash
+	pkg.Size = uint64(exp.Size)
+	a.logger.Infof("installing %s (%s) from %s", pkg.Name, pkg.Version, path)
+
+	rpkg := repository.NewRepositoryPackage(pkg, nil)
+	if err := a.checkBlocked([]*repository.RepositoryPackage{rpkg}); err != nil {
+		return err
+	}
+	isInstalled, err := a.isInstalledPackage(pkg.Name)
+	if err != nil {
+		return fmt.Errorf("error checking if package %s is installed: %w", pkg.Name, err)
+	}
+	if isInstalled {
+		return fmt.Errorf("package %s is already installed", pkg.Name)
+	}
+
+	// the package is not from any index, so only its own signature can verify it
+	var verification PackageVerification
+	if a.verificationCallback != nil || !a.ignoreSignatures {
+		keys, err := a.readKeys()
+		if err != nil {
+			return err
+		}
+		if verification, err = a.packageVerification(rpkg, exp, nil, keys); err != nil {
+			return err
+		}
+	}
+	if !a.ignoreSignatures && !verification.PackageSigned {
+		return fmt.Errorf("package %s is not signed by a trusted key", path)
+	}
+
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return err
+	}
+	toInstall, err := a.missingDependencies(ctx, indexes, rpkg)
+	if err != nil {
+		return err
+	}
+
+	hooks, err := a.installPackages(ctx, toInstall, signedRepositories(indexes), sourceDateEpoch)
+	if err != nil {
+		return errors.Join(err, a.recordHooks(hooks))
+	}
+
+	handedOff = true
+	pkgHooks, err := a.installPackage(ctx, rpkg, exp, sourceDateEpoch, opts.metadataOnly)
+	if err != nil {
+		return fmt.Errorf("installing %s: %w", pkg.Name, err)
+	}
+	hooks = append(hooks, pkgHooks)
+	if a.verificationCallback != nil {
+		a.verificationCallback(verification)
+	}
+
+	return a.recordHooks(hooks)
+}
+
+// missingDependencies resolves the dependencies of a package that is not part of any index, such as
+// a local file or a virtual package, from indexes and returns the ones not yet installed in install order.
+func (a *APK) missingDependencies(ctx context.Context, indexes []NamedIndex, pkg *repository.RepositoryPackage) ([]*repository.RepositoryPackage, error) {
+	indexes, err := a.applyHolds(indexes)
+	if err != nil {
+		return nil, err
+	}
+	deps, conflicts, err := NewPkgResolver(ctx, indexes, a.resolverOptions()...).getPackageDependencies(pkg, "", true, map[string]bool{}, map[string]*repository.RepositoryPackage{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting dependencies of %s: %w", pkg.Name, err)
+	}
+	for _, conflict := range uniqify(conflicts) {
+		isInstalled, err := a.isInstalledPackage(conflict)
+		if err != nil {
+			return nil, fmt.Errorf("error checking if package %s is installed: %w", conflict, err)
+		}
+		if isInstalled {
+			return nil, fmt.Errorf("cannot install %s due to conflict with %s", pkg.Name, conflict)
+		}
+	}
+
+	// deps lists shared dependencies once per dependent, keep only the first occurrence
+	// and skip the ones already installed so they are not fetched at all
+	seen := map[string]bool{}
+	toInstall := make([]*repository.RepositoryPackage, 0, len(deps))
+	for _, dep := range deps {
+		if seen[dep.Name] {
+			continue
+		}
+		seen[dep.Name] = true
+		isInstalled, err := a.isInstalledPackage(dep.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error checking if package %s is installed: %w", dep.Name, err)
+		}
+		if !isInstalled {
+			toInstall = append(toInstall, dep)
+		}
+	}
+	return toInstall, nil
+}
+
+// checkBlocked returns a BlockedPackageError for the first of pkgs whose checksum is blocked.
+func (a *APK) checkBlocked(pkgs []*repository.RepositoryPackage) error {
+	if len(a.blockedChecksums) == 0 {
+		return nil
+	}
+	for _, pkg := range pkgs {
+		if checksum := pkg.ChecksumString(); a.blockedChecksums[checksum] {
+			return BlockedPackageError{Package: pkg.Name, Version: pkg.Version, Checksum: checksum}
+		}
+	}
+	return nil
+}
+
+// checkDowngrades returns a DowngradeError for the first of pkgs that is older than the installed
+// package of the same name, unless downgrades are allowed with WithAllowDowngrade.
+func (a *APK) checkDowngrades(pkgs []*repository.RepositoryPackage) error {
+	if a.allowDowngrade {
+		return nil
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("error getting installed packages: %w", err)
+	}
+	versions := make(map[string]string, len(installed))
+	for _, pkg := range installed {
+		versions[pkg.Name] = pkg.Version
+	}
+	for _, pkg := range pkgs {
+		if version, ok := versions[pkg.Name]; ok {
+			if err := a.checkDowngrade(pkg, version); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
+
+// checkDowngrade returns a DowngradeError if pkg is older than installedVersion, unless downgrades
+// are allowed with WithAllowDowngrade. Versions that cannot be parsed are not compared.
+func (a *APK) checkDowngrade(pkg *repository.RepositoryPackage, installedVersion string) error {
+	if a.allowDowngrade || pkg.Version == installedVersion {
+		return nil
+	}
+	resolved, err := parseVersion(pkg.Version)
+	if err != nil {
+		return nil
+	}
+	current, err := parseVersion(installedVersion)
+	if err != nil {
+		return nil
+	}
+	if compareVersions(resolved, current) == less {
+		return DowngradeError{Package: pkg.Name, Installed: installedVersion, Resolved: pkg.Version}
+	}
+	return nil
+}
+
+// installPackages fetches and expands allpkgs concurrently, then installs them sequentially in the
+// given order, skipping any that are already installed. It returns the scripts and triggers of every
+// installed package, for the caller to record with recordHooks. signed holds the repositories whose
+// index signature was verified, to report how each package was verified.
+// With continueOnError, packages that fail to fetch or install, and the ones depending on
+// them, are skipped; the hooks of the others are returned along with the joined errors. On any
+// other error, the hooks of the packages installed until then are returned along with it.
+func (a *APK) installPackages(ctx context.Context, allpkgs []*repository.RepositoryPackage, signed map[*repository.RepositoryWithIndex]bool, sourceDateEpoch *time.Time) ([]packageHooks, error) {
+	return a.installExpandedPackages(ctx, allpkgs, signed, sourceDateEpoch, nil)
+}
+
+// installExpandedPackages is like installPackages, but takes the packages in prefetched, by name,
+// as they are instead of fetching them. It removes those it takes from prefetched; the caller
+// closes the rest.
+func (a *APK) installExpandedPackages(ctx context.Context, allpkgs []*repository.RepositoryPackage, signed map[*repository.RepositoryWithIndex]bool, sourceDateEpoch *time.Time, prefetched map[string]*APKExpanded) ([]packageHooks, error) {
+	if err := a.checkBlocked(allpkgs); err != nil {
+		return nil, err
+	}
 
 	// TODO: Consider making this configurable option.
 	jobs := runtime.GOMAXPROCS(0)
@@ -493,6 +1215,33 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	g.SetLimit(jobs + 1)
 
 	expanded := make([]*APKExpanded, len(allpkgs))
+	// the scripts and triggers of all installed packages, to record once all files are in place
+	var hooks []packageHooks
+
+	// with continueOnError, the packages that failed to fetch or install, and the names
+	// they provide, so that packages depending on them are skipped as well
+	var (
+		expandErrs = make([]error, len(allpkgs))
+		failures   []error
+		failed     = map[string]bool{}
+	)
+	fail := func(pkg *repository.RepositoryPackage, err error) {
+		a.logger.Warnf("skipping %s: %v", pkg.Name, err)
+		failures = append(failures, err)
+		failed[pkg.Name] = true
+		for _, provide := range pkg.Provides {
+			failed[resolvePackageNameVersionPin(provide).name] = true
+		}
+	}
+
+	// the keys to verify package signatures with, only needed to report verification
+	var keys map[string][]byte
+	if a.verificationCallback != nil {
+		var err error
+		if keys, err = a.readKeys(); err != nil {
+			return nil, err
+		}
+	}
 
 	// A slice of pseudo-promises that get closed when expanded[i] is ready.
 	done := make([]chan struct{}, len(allpkgs))
@@ -520,12 +1269,55 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 				}
 
 				if isInstalled {
+					if exp != nil {
+						exp.Close()
+					}
+					continue
+				}
+
+				if dep := failedDependency(pkg, failed); dep != "" {
+					if exp != nil {
+						exp.Close()
+					}
+					fail(pkg, fmt.Errorf("installing %s: dependency %s failed", pkg.Name, dep))
+					continue
+				}
+				if err := expandErrs[i]; err != nil {
+					fail(pkg, err)
 					continue
 				}
 
-				if err := a.installPackage(gctx, pkg, exp, sourceDateEpoch); err != nil {
+				if isVirtual(pkg.Package) {
+					if err := a.addInstalledPackage(pkg.Package, nil); err != nil {
+						return fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
+					}
+					continue
+				}
+
+				// installing cleans up the expanded package, so check it first
+				var verification PackageVerification
+				if a.verificationCallback != nil {
+					if verification, err = a.packageVerification(pkg, exp, signed, keys); err != nil {
+						exp.Close()
+						if a.continueOnError {
+							fail(pkg, err)
+							continue
+						}
+						return err
+					}
+				}
+				pkgHooks, err := a.installPackage(gctx, pkg, exp, sourceDateEpoch, false)
+				if err != nil {
+					if a.continueOnError {
+						fail(pkg, fmt.Errorf("installing %s: %w", pkg.Name, err))
+						continue
+					}
 					return fmt.Errorf("installing %s: %w", pkg.Name, err)
 				}
+				hooks = append(hooks, pkgHooks)
+				if a.verificationCallback != nil {
+					a.verificationCallback(verification)
+				}
 			}
 		}
 
@@ -537,9 +1329,27 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	for i, pkg := range allpkgs {
 		i, pkg := i, pkg
 
+		if exp, ok := prefetched[pkg.Name]; ok {
+			delete(prefetched, pkg.Name)
+			expanded[i] = exp
+			close(done[i])
+			continue
+		}
+
 		g.Go(func() error {
+			// virtual packages have no apk to fetch
+			if isVirtual(pkg.Package) {
+				close(done[i])
+				return nil
+			}
+
 			exp, err := a.expandPackage(gctx, pkg)
 			if err != nil {
+				if a.continueOnError {
+					expandErrs[i] = fmt.Errorf("expanding %s: %w", pkg.Name, err)
+					close(done[i])
+					return nil
+				}
 				return fmt.Errorf("expanding %s: %w", pkg.Name, err)
 			}
 
@@ -551,9 +1361,49 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	}
 
 	if err := g.Wait(); err != nil {
-		return fmt.Errorf("installing packages: %w", err)
+		// the packages installed so far stay installed, so their hooks still need recording
+		return hooks, fmt.Errorf("installing packages: %w", err)
 	}
 
+	return hooks, errors.Join(failures...)
+}
+
+// failedDependency returns the dependency of pkg that is one of the failed names, if any.
+func failedDependency(pkg *repository.RepositoryPackage, failed map[string]bool) string {
+	if len(failed) == 0 {
+		return ""
+	}
+	for _, dep := range pkg.Dependencies {
+		if strings.HasPrefix(dep, "!") {
+			continue
+		}
+		if name := resolvePackageNameVersionPin(dep).name; failed[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// recordHooks is the second phase of installing packages, after the files of all of them are in
+// place: it writes the scripts of the installed packages to scripts.tar, once for all of them, and
+// adds their triggers, in install order. Keeping it separate means that running the scripts and
+// triggers recorded here sees the complete filesystem, as with apk.
+func (a *APK) recordHooks(hooks []packageHooks) error {
+	var scripts []scriptsTarEntry
+	for _, h := range hooks {
+		scripts = append(scripts, h.scripts...)
+		if err := a.addTriggers(h.pkg, h.triggers); err != nil {
+			return fmt.Errorf("unable to update triggers for pkg %s: %w", h.pkg.Name, err)
+		}
+	}
+	if err := a.appendScriptsTar(scripts); err != nil {
+		return fmt.Errorf("unable to update scripts.tar: %w", err)
+	}
+	if a.validateScriptsTar {
+		if err := a.ValidateScriptsTar(); err != nil {
+			return fmt.Errorf("invalid scripts.tar after install: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -567,34 +1417,19 @@ func (e *NoKeysFoundError) Error() string {
 }
 
 // fetchAlpineKeys fetches the public keys for the repositories in the APK database.
-func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) error {
+// It returns the headers of the key files it wrote.
+func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) ([]tar.Header, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "fetchAlpineKeys")
 	defer span.End()
 
-	u := alpineReleasesURL
-	client := a.client
-	if client == nil {
-		client = retryablehttp.NewClient().StandardClient()
-	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	client := a.httpClient()
+	releases, err := a.fetchReleases(ctx, client, alpineReleasesURL)
 	if err != nil {
-		return err
-	}
-	res, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to fetch alpine releases: %w", err)
-	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("unable to get alpine releases at %s: %v", u, res.Status)
-	}
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read alpine releases: %w", err)
+		return nil, err
 	}
-	var releases Releases
-	if err := json.Unmarshal(b, &releases); err != nil {
-		return fmt.Errorf("failed to unmarshal alpine releases: %w", err)
+	keysTime := a.keysTime
+	if keysTime.IsZero() {
+		keysTime = time.Now()
 	}
 	var urls []string
 	// now just need to get the keys for the desired architecture and releases
@@ -603,79 +1438,141 @@ func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) erro
 		if branch == nil {
 			continue
 		}
-		urls = append(urls, branch.KeysFor(a.arch, time.Now())...)
+		urls = append(urls, branch.KeysFor(a.arch, keysTime)...)
 	}
 	if len(urls) == 0 {
-		return &NoKeysFoundError{arch: a.arch, releases: alpineVersions}
+		return nil, &NoKeysFoundError{arch: a.arch, releases: alpineVersions}
 	}
 	// get the keys for each URL and save them to a file with that name
+	var headers []tar.Header
 	for _, u := range urls {
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		res, err := client.Do(req)
 		if err != nil {
-			return fmt.Errorf("failed to fetch alpine key %s: %w", u, err)
+			return nil, fmt.Errorf("failed to fetch alpine key %s: %w", u, err)
 		}
 		defer res.Body.Close()
 		basefilenameEscape := filepath.Base(u)
 		basefilename, err := url.PathUnescape(basefilenameEscape)
 		if err != nil {
-			return fmt.Errorf("failed to unescape key filename %s: %w", basefilenameEscape, err)
+			return nil, fmt.Errorf("failed to unescape key filename %s: %w", basefilenameEscape, err)
 		}
-		filename := filepath.Join(keysDirPath, basefilename)
+		filename := filepath.Join(a.keysDir, basefilename)
 		f, err := a.fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0o644)
 		if err != nil {
-			return fmt.Errorf("failed to open key file %s: %w", filename, err)
+			return nil, fmt.Errorf("failed to open key file %s: %w", filename, err)
 		}
 		defer f.Close()
-		if _, err := io.Copy(f, res.Body); err != nil {
-			return fmt.Errorf("failed to write key file %s: %w", filename, err)
+		n, err := io.Copy(f, res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write key file %s: %w", filename, err)
 		}
+		header := initHeader("/"+filename, tar.TypeReg, 0o644)
+		header.Size = n
+		headers = append(headers, header)
 	}
-	return nil
+	return headers, nil
+}
+
+// fetchReleases gets the parsed releases document at the given URL. If a releases cache TTL
+// is configured, a previously parsed document for the same URL is reused until it expires.
+func (a *APK) fetchReleases(ctx context.Context, client *http.Client, u string) (*Releases, error) {
+	if a.releasesCacheTTL > 0 {
+		if releases, ok := globalReleasesCache.get(u, a.releasesCacheTTL); ok {
+			a.logger.Debugf("using cached alpine releases from %s", u)
+			return releases, nil
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch alpine releases: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get alpine releases at %s: %v", u, res.Status)
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alpine releases: %w", err)
+	}
+	var releases Releases
+	if err := json.Unmarshal(b, &releases); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alpine releases: %w", err)
+	}
+	if a.releasesCacheTTL > 0 {
+		globalReleasesCache.put(u, &releases)
+	}
+	return &releases, nil
 }
 
 func (a *APK) cachePackage(ctx context.Context, pkg *repository.RepositoryPackage, exp *APKExpanded, cacheDir string) (*APKExpanded, error) {
 	_, span := otel.Tracer("go-apk").Start(ctx, "cachePackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
 
-	// Rename exp's temp files to content-addressable identifiers in the cache.
+	// Only what is verified here goes into the cache, and it is marked as verified, so that hits
+	// are not hashed again: the control section is what the index says, and the data section is
+	// what the control section says.
+	checksum, err := packageChecksum(pkg)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkExpanded(exp, checksum); err != nil {
+		a.logger.Warnf("not caching %s: %v", pkg.Name, err)
+		return exp, nil
+	}
 
-	ctlHex := hex.EncodeToString(exp.ControlHash)
-	ctlDst := filepath.Join(cacheDir, ctlHex+".ctl.tar.gz")
+	// Rename exp's temp files to content-addressable identifiers in the cache,
+	// copying them if the temp dir is on a different filesystem. Either way, each
+	// file appears whole or not at all, and the control section goes last, so
+	// that an entry is complete once it has one.
 
-	if err := os.Rename(exp.ControlFile, ctlDst); err != nil {
+	datHex := hex.EncodeToString(exp.PackageHash)
+	datDst := filepath.Join(cacheDir, datHex+".dat.tar.gz")
+
+	if err := renameOrCopy(exp.PackageFile, datDst); err != nil {
 		return nil, fmt.Errorf("renaming control file: %w", err)
 	}
 
-	exp.ControlFile = ctlDst
+	exp.PackageFile = datDst
+
+	tarDst := strings.TrimSuffix(exp.PackageFile, ".gz")
+	if err := renameOrCopy(exp.tarFile, tarDst); err != nil {
+		return nil, fmt.Errorf("renaming control file: %w", err)
+	}
+	exp.tarFile = tarDst
+
+	ctlHex := hex.EncodeToString(exp.ControlHash)
+	if exp.ControlCacheHash != nil {
+		ctlHex = hex.EncodeToString(exp.ControlCacheHash)
+	}
+	ctlDst := filepath.Join(cacheDir, ctlHex+".ctl.tar.gz")
 
 	if exp.SignatureFile != "" {
 		sigDst := filepath.Join(cacheDir, ctlHex+".sig.tar.gz")
 
-		if err := os.Rename(exp.SignatureFile, sigDst); err != nil {
+		if err := renameOrCopy(exp.SignatureFile, sigDst); err != nil {
 			return nil, fmt.Errorf("renaming control file: %w", err)
 		}
 
 		exp.SignatureFile = sigDst
 	}
 
-	datHex := hex.EncodeToString(exp.PackageHash)
-	datDst := filepath.Join(cacheDir, datHex+".dat.tar.gz")
-
-	if err := os.Rename(exp.PackageFile, datDst); err != nil {
+	if err := renameOrCopy(exp.ControlFile, ctlDst); err != nil {
 		return nil, fmt.Errorf("renaming control file: %w", err)
 	}
 
-	exp.PackageFile = datDst
+	exp.ControlFile = ctlDst
 
-	tarDst := strings.TrimSuffix(exp.PackageFile, ".gz")
-	if err := os.Rename(exp.tarFile, tarDst); err != nil {
-		return nil, fmt.Errorf("renaming control file: %w", err)
+	if err := markCacheVerified(checksum, ctlDst, datDst); err != nil {
+		a.logger.Debugf("unable to mark %s as verified in cache: %v", pkg.Name, err)
 	}
-	exp.tarFile = tarDst
 
 	return exp, nil
 }
@@ -684,21 +1581,17 @@ func (a *APK) cachedPackage(ctx context.Context, pkg *repository.RepositoryPacka
 	_, span := otel.Tracer("go-apk").Start(ctx, "cachedPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
 
-	chk := pkg.ChecksumString()
-	if !strings.HasPrefix(chk, "Q1") {
-		return nil, fmt.Errorf("unexpected checksum: %q", chk)
-	}
-
-	checksum, err := base64.StdEncoding.DecodeString(chk[2:])
+	checksum, err := packageChecksum(pkg)
 	if err != nil {
 		return nil, err
 	}
 
-	pkgHexSum := hex.EncodeToString(checksum)
-
 	exp := APKExpanded{}
 
-	ctl := filepath.Join(cacheDir, pkgHexSum+".ctl.tar.gz")
+	ctl, err := a.cachedControlFile(cacheDir, checksum)
+	if err != nil {
+		return nil, err
+	}
 	cf, err := os.Stat(ctl)
 	if err != nil {
 		return nil, err
@@ -707,7 +1600,7 @@ func (a *APK) cachedPackage(ctx context.Context, pkg *repository.RepositoryPacka
 	exp.ControlHash = checksum
 	exp.Size += cf.Size()
 
-	sig := filepath.Join(cacheDir, pkgHexSum+".sig.tar.gz")
+	sig := cachedSignatureFile(ctl)
 	sf, err := os.Stat(sig)
 	if err == nil {
 		exp.SignatureFile = sig
@@ -731,6 +1624,26 @@ func (a *APK) cachedPackage(ctx context.Context, pkg *repository.RepositoryPacka
 	if err != nil {
 		return nil, err
 	}
+	// entries filled by cachePackage are verified already; anything else, e.g. from an older version,
+	// another tool, or an entry that changed since, is checked once, and is a miss if it does not match
+	if !cacheVerified(checksum, cf.Size(), dat, df.Size()) {
+		sums, err := hashFile(ctl, crypto.SHA1)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(sums[0], checksum) {
+			return nil, fmt.Errorf("cached control section of %s does not match the checksum in the index", pkg.Name)
+		}
+		if sums, err = hashFile(dat, crypto.SHA256); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(sums[0]) != datahash {
+			return nil, fmt.Errorf("cached data section of %s does not match the datahash of the control section", pkg.Name)
+		}
+		if err := markCacheVerified(checksum, ctl, dat); err != nil {
+			a.logger.Debugf("unable to mark %s as verified in cache: %v", pkg.Name, err)
+		}
+	}
 	exp.PackageFile = dat
 	exp.Size += df.Size()
 
@@ -748,6 +1661,16 @@ func (a *APK) cachedPackage(ctx context.Context, pkg *repository.RepositoryPacka
 	return &exp, nil
 }
 
+// packageChecksum returns the decoded SHA1 control checksum of the package.
+func packageChecksum(pkg *repository.RepositoryPackage) ([]byte, error) {
+	chk := pkg.ChecksumString()
+	if !strings.HasPrefix(chk, "Q1") {
+		return nil, fmt.Errorf("unexpected checksum: %q", chk)
+	}
+
+	return base64.StdEncoding.DecodeString(chk[2:])
+}
+
 func (a *APK) expandPackage(ctx context.Context, pkg *repository.RepositoryPackage) (*APKExpanded, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "expandPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
@@ -773,17 +1696,37 @@ func (a *APK) expandPackage(ctx context.Context, pkg *repository.RepositoryPacka
 		}
 	}
 
+	expandOpts := a.expandOptions()
+
+	if a.remoteCache != nil {
+		exp, err := a.remoteCachedPackage(ctx, pkg, cacheDir, expandOpts)
+		if err == nil {
+			a.logger.Debugf("remote cache hit (%s)", pkg.Name)
+			if a.cache == nil {
+				return exp, nil
+			}
+			return a.cachePackage(ctx, pkg, exp, cacheDir)
+		}
+		a.logger.Debugf("remote cache miss (%s): %v", pkg.Name, err)
+	}
+
 	rc, err := a.fetchPackage(ctx, pkg)
 	if err != nil {
 		return nil, fmt.Errorf("fetching package %q: %w", pkg.Name, err)
 	}
 	defer rc.Close()
 
-	exp, err := ExpandApk(ctx, rc, cacheDir)
+	exp, err := ExpandApk(ctx, rc, cacheDir, expandOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("expanding %s: %w", pkg.Name, err)
 	}
 
+	if a.remoteCache != nil && a.remoteCachePush {
+		if err := a.pushRemoteCache(ctx, pkg, exp); err != nil {
+			a.logger.Warnf("unable to store %s in remote cache: %v", pkg.Name, err)
+		}
+	}
+
 	// If we don't have a cache, we're done.
 	if a.cache == nil {
 		return exp, nil
@@ -792,6 +1735,15 @@ func (a *APK) expandPackage(ctx context.Context, pkg *repository.RepositoryPacka
 	return a.cachePackage(ctx, pkg, exp, cacheDir)
 }
 
+// expandOptions returns the options to expand fetched packages with.
+func (a *APK) expandOptions() []ExpandApkOption {
+	expandOpts := []ExpandApkOption{WithExpandMaxDecompressedSize(a.maxDecompressedSize)}
+	if a.cache != nil && a.cacheHash != crypto.SHA1 {
+		expandOpts = append(expandOpts, WithExpandControlHash(a.cacheHash))
+	}
+	return expandOpts
+}
+
 func packageAsURI(pkg *repository.RepositoryPackage) (uri.URI, error) {
 	u := pkg.Url()
 
@@ -803,6 +1755,10 @@ func packageAsURI(pkg *repository.RepositoryPackage) (uri.URI, error) {
 }
 
 func packageAsURL(pkg *repository.RepositoryPackage) (*url.URL, error) {
+	if u := pkg.Url(); strings.HasPrefix(u, ociScheme+"://") || strings.HasPrefix(u, bundleScheme+"://") {
+		return url.Parse(u)
+	}
+
 	asURI, err := packageAsURI(pkg)
 	if err != nil {
 		return nil, err
@@ -835,40 +1791,73 @@ func (a *APK) fetchPackage(ctx context.Context, pkg *repository.RepositoryPackag
 		}
 		return f, nil
 	case "https":
-		client := a.client
-		if client == nil {
-			client = retryablehttp.NewClient().StandardClient()
-		}
+		client := a.httpClient()
+		client = withAuthStrippingRedirects(client)
 		if a.cache != nil {
 			client = a.cache.client(client, false)
 		}
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-		if err != nil {
-			return nil, err
-		}
 
-		// This will return a body that retries requests using Range requests if Read() hits an error.
-		rrt := newRangeRetryTransport(ctx, client)
-		res, err := rrt.RoundTrip(req)
-		if err != nil {
-			return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
+		var errs []error
+		for _, candidate := range mirrorCandidates(u, a.mirrors, nil) {
+			rc, err := fetchPackageURL(ctx, client, candidate)
+			if err == nil {
+				return rc, nil
+			}
+			errs = append(errs, err)
 		}
-		if res.StatusCode != http.StatusOK {
-			res.Body.Close()
-			return nil, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
+		return nil, errors.Join(errs...)
+	case ociScheme:
+		if a.ociPuller == nil {
+			return nil, fmt.Errorf("no OCI puller configured to fetch %s", u)
 		}
-		return res.Body, nil
+		rc, err := a.ociPuller.Pull(ctx, strings.TrimPrefix(u, ociScheme+"://"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to pull package apk at %s: %w", u, err)
+		}
+		return rc, nil
+	case bundleScheme:
+		return a.fetchBundlePackage(u, pkg.Checksum)
 	default:
 		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 	}
 }
 
+// fetchPackageURL fetches the package at u using client.
+func fetchPackageURL(ctx context.Context, client *http.Client, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// This will return a body that retries requests using Range requests if Read() hits an error.
+	rrt := newRangeRetryTransport(ctx, client)
+	res, err := rrt.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
+	}
+	return res.Body, nil
+}
+
 type writeHeaderer interface {
 	WriteHeader(hdr tar.Header, tfs fs.FS, pkg *repository.Package) error
 }
 
-// installPackage installs a single package and updates installed db.
-func (a *APK) installPackage(ctx context.Context, pkg *repository.RepositoryPackage, expanded *APKExpanded, sourceDateEpoch *time.Time) error {
+// packageHooks are the scripts and triggers of an installed package. They are recorded by
+// recordHooks only once the files of all packages being installed are in place, as apk does.
+type packageHooks struct {
+	pkg      *repository.Package
+	scripts  []scriptsTarEntry
+	triggers []string
+}
+
+// installPackage installs the files of a single package and updates installed db.
+// With metadataOnly, no files are installed, and the installed db lists none for it.
+// The scripts and triggers of the package are returned rather than written, see recordHooks.
+func (a *APK) installPackage(ctx context.Context, pkg *repository.RepositoryPackage, expanded *APKExpanded, sourceDateEpoch *time.Time, metadataOnly bool) (packageHooks, error) {
 	a.logger.Debugf("installing %s (%s)", pkg.Name, pkg.Version)
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "installPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
@@ -881,47 +1870,60 @@ func (a *APK) installPackage(ctx context.Context, pkg *repository.RepositoryPack
 		err            error
 	)
 
-	if wh, ok := a.fs.(writeHeaderer); ok {
+	if metadataOnly {
+		a.logger.Debugf("installing only the metadata of %s (%s)", pkg.Name, pkg.Version)
+	} else if wh, ok := a.fs.(writeHeaderer); ok {
 		installedFiles, err = a.lazilyInstallAPKFiles(ctx, wh, expanded.tarfs, pkg.Package)
 		if err != nil {
-			return fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
+			return packageHooks{}, fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
 		}
 	} else {
 		packageData, err := expanded.PackageData()
 		if err != nil {
-			return fmt.Errorf("opening package file %q: %w", expanded.PackageFile, err)
+			return packageHooks{}, fmt.Errorf("opening package file %q: %w", expanded.PackageFile, err)
 		}
 		defer packageData.Close()
 
 		installedFiles, err = a.installAPKFiles(ctx, packageData, pkg.Origin, pkg.Replaces)
 		if err != nil {
-			return fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
+			return packageHooks{}, fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
 		}
 	}
 
-	// update the scripts.tar
+	// collect the scripts for scripts.tar
 	controlData, err := os.Open(expanded.ControlFile)
 	if err != nil {
-		return fmt.Errorf("opening control file %q: %w", expanded.ControlFile, err)
+		return packageHooks{}, fmt.Errorf("opening control file %q: %w", expanded.ControlFile, err)
 	}
+	defer controlData.Close()
 
-	if err := a.updateScriptsTar(pkg.Package, controlData, sourceDateEpoch); err != nil {
-		return fmt.Errorf("unable to update scripts.tar for pkg %s: %w", pkg.Name, err)
+	hooks := packageHooks{pkg: pkg.Package}
+	if !a.skipScripts {
+		hooks.scripts, err = packageScripts(pkg.Package, controlData, sourceDateEpoch)
+		if err != nil {
+			return packageHooks{}, fmt.Errorf("unable to read scripts for pkg %s: %w", pkg.Name, err)
+		}
 	}
 
-	// update the triggers
-	if _, err := controlData.Seek(0, 0); err != nil {
-		return fmt.Errorf("unable to seek to start of control data for pkg %s: %w", pkg.Name, err)
-	}
-	if err := a.updateTriggers(pkg.Package, controlData); err != nil {
-		return fmt.Errorf("unable to update triggers for pkg %s: %w", pkg.Name, err)
+	// collect the triggers
+	if !a.skipTriggers {
+		if _, err := controlData.Seek(0, 0); err != nil {
+			return packageHooks{}, fmt.Errorf("unable to seek to start of control data for pkg %s: %w", pkg.Name, err)
+		}
+		hooks.triggers, err = a.packageTriggers(controlData)
+		if err != nil {
+			return packageHooks{}, fmt.Errorf("unable to read triggers for pkg %s: %w", pkg.Name, err)
+		}
 	}
 
 	// update the installed file
 	if err := a.addInstalledPackage(pkg.Package, installedFiles); err != nil {
-		return fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
+		return packageHooks{}, fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
 	}
-	return nil
+	if err := a.writeManifest(pkg.Package, installedFiles); err != nil {
+		return packageHooks{}, err
+	}
+	return hooks, nil
 }
 
 func (a *APK) datahash(controlTarGz io.Reader) (string, error) {
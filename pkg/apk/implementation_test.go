@@ -15,11 +15,24 @@
 package apk
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -27,9 +40,11 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"gitlab.alpinelinux.org/alpine/go/repository"
+	"golang.org/x/sys/unix"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
@@ -65,7 +80,7 @@ func TestInitDB(t *testing.T) {
 	src := apkfs.NewMemFS()
 	apk, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
 	require.NoError(t, err)
-	err = apk.InitDB(context.Background())
+	headers, err := apk.InitDBManifest(context.Background())
 	require.NoError(t, err)
 	// check all of the contents
 	for _, d := range initDirectories {
@@ -91,6 +106,143 @@ func TestInitDB(t *testing.T) {
 			require.Equal(t, targetPerms, actualPerms, "expected %s to have permissions %v, got %v", f.path, targetPerms, actualPerms)
 		}
 	}
+	// check the returned manifest
+	byName := map[string]tar.Header{}
+	for _, h := range headers {
+		byName[h.Name] = h
+	}
+	for _, d := range append(baseDirectories, initDirectories...) {
+		require.Equal(t, byte(tar.TypeDir), byName[d.path].Typeflag, "expected %s in the manifest as a directory", d.path)
+	}
+	require.Equal(t, int64(0o1777), byName["/tmp"].Mode)
+	for _, f := range initFiles {
+		require.Equal(t, byte(tar.TypeReg), byName[f.path].Typeflag, "expected %s in the manifest as a file", f.path)
+		require.Equal(t, int64(len(f.contents)), byName[f.path].Size)
+	}
+	require.Equal(t, byte(tar.TypeReg), byName["/etc/apk/arch"].Typeflag)
+	require.Equal(t, int64(len(apk.arch)+1), byName["/etc/apk/arch"].Size)
+	for _, f := range initDeviceFiles {
+		h := byName[f.path]
+		require.Equal(t, byte(tar.TypeChar), h.Typeflag, "expected %s in the manifest as a char device", f.path)
+		require.Equal(t, int64(f.major), h.Devmajor)
+		require.Equal(t, int64(f.minor), h.Devminor)
+		require.Equal(t, int64(f.perms), h.Mode)
+	}
+	scripts, err := src.ReadFile(scriptsFilePath)
+	require.NoError(t, err)
+	require.Equal(t, byte(tar.TypeReg), byName[scriptsFilePath].Typeflag)
+	require.Equal(t, int64(len(scripts)), byName[scriptsFilePath].Size)
+	_, err = tar.NewReader(bytes.NewReader(scripts)).Next()
+	require.ErrorIs(t, err, io.EOF, "scripts.tar should be empty")
+}
+
+func TestInitDBBaseLayout(t *testing.T) {
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(context.Background()))
+	_, err = fs.Stat(src, "usr/bin")
+	require.ErrorIs(t, err, fs.ErrNotExist, "no base layout by default")
+
+	src = apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("home", 0o750))
+	a, err = New(WithFS(src), WithIgnoreMknodErrors(true), WithBaseLayout(true))
+	require.NoError(t, err)
+	headers, err := a.InitDBManifest(context.Background())
+	require.NoError(t, err)
+	for _, d := range baseLayoutDirectories {
+		fi, err := fs.Stat(src, strings.TrimPrefix(d.path, "/"))
+		require.NoError(t, err, "error statting %s", d.path)
+		require.True(t, fi.IsDir(), "expected %s to be a directory, got %v", d.path, fi.Mode())
+		if d.path != "/home" {
+			require.Equal(t, d.perms.Perm(), fi.Mode().Perm(), "expected %s to have permissions %v, got %v", d.path, d.perms, fi.Mode().Perm())
+		}
+	}
+	fi, err := fs.Stat(src, "home")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o750), fi.Mode().Perm(), "existing directories are left alone")
+	for _, h := range headers {
+		if h.Name == "/home" {
+			require.Equal(t, int64(0o750), h.Mode, "existing directories are listed as they are")
+		}
+	}
+
+	var names []string
+	for _, h := range a.ListInitFiles() {
+		names = append(names, h.Name)
+	}
+	require.Contains(t, names, "/usr/bin")
+}
+
+func TestInitDBDeviceOwner(t *testing.T) {
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithDeviceOwner("/dev/console", 0, 5))
+	require.NoError(t, err)
+	headers, err := a.InitDBManifest(context.Background())
+	require.NoError(t, err)
+
+	fi, err := fs.Stat(src, "dev/console")
+	require.NoError(t, err)
+	require.Equal(t, 5, fi.Sys().(*tar.Header).Gid)
+	fi, err = fs.Stat(src, "dev/null")
+	require.NoError(t, err)
+	require.Equal(t, 0, fi.Sys().(*tar.Header).Gid, "other device nodes are owned by root")
+
+	for _, list := range [][]tar.Header{headers, a.ListInitFiles()} {
+		owners := map[string]int{}
+		for _, h := range list {
+			owners[h.Name] = h.Gid
+		}
+		require.Equal(t, 5, owners["/dev/console"])
+		require.Equal(t, 0, owners["/dev/null"])
+	}
+
+	_, err = New(WithDeviceOwner("/dev/tty0", 0, 5))
+	require.ErrorContains(t, err, "not a device node")
+}
+
+func TestInitDBArchFile(t *testing.T) {
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(true), WithArch("x86_64"), WithArchFile("/etc/apk/arch.custom"))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(context.Background()))
+	b, err := src.ReadFile("etc/apk/arch.custom")
+	require.NoError(t, err)
+	require.Equal(t, "x86_64\n", string(b))
+	_, err = src.Stat("etc/apk/arch")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	var names []string
+	for _, h := range a.ListInitFiles() {
+		names = append(names, h.Name)
+	}
+	require.Contains(t, names, "/etc/apk/arch.custom")
+	require.NotContains(t, names, "/etc/apk/arch")
+}
+
+func TestInitDBArchNormalization(t *testing.T) {
+	tests := []struct {
+		arch      string
+		normalize bool
+		expected  string
+	}{
+		{"amd64", true, "x86_64"},
+		{"arm64", true, "aarch64"},
+		{"linux/ARM64", true, "aarch64"},
+		{"x86_64", true, "x86_64"},
+		{"amd64", false, "amd64"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%v", tt.arch, tt.normalize), func(t *testing.T) {
+			src := apkfs.NewMemFS()
+			a, err := New(WithFS(src), WithIgnoreMknodErrors(true), WithArch(tt.arch), WithArchNormalization(tt.normalize))
+			require.NoError(t, err)
+			require.NoError(t, a.InitDB(context.Background()))
+			b, err := src.ReadFile("etc/apk/arch")
+			require.NoError(t, err)
+			require.Equal(t, tt.expected+"\n", string(b))
+		})
+	}
 }
 
 func TestSetWorld(t *testing.T) {
@@ -199,6 +351,77 @@ func TestInitKeyring(t *testing.T) {
 		Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true, requireBasicAuth: true},
 	})
 	require.NoError(t, a.InitKeyring(context.Background(), keyfiles, nil))
+
+	// add inline keys as data URLs, with and without a name
+	encoded := base64.StdEncoding.EncodeToString([]byte(testDemoKey))
+	keyfiles = []string{
+		"data:application/x-pem-file;name=inline-demo.rsa.pub;base64," + encoded,
+		"data:;base64," + encoded,
+	}
+	require.NoError(t, a.InitKeyring(context.Background(), keyfiles, nil))
+	data, err := src.ReadFile(filepath.Join(DefaultKeyRingPath, "inline-demo.rsa.pub"))
+	require.NoError(t, err)
+	require.Equal(t, testDemoKey, string(data))
+	fi, err = src.ReadDir(DefaultKeyRingPath)
+	require.NoError(t, err)
+	require.Len(t, fi, 4)
+
+	// inline data that is not a key, or not base64, is rejected
+	keyfiles = []string{"data:;base64," + base64.StdEncoding.EncodeToString([]byte("not a key"))}
+	require.Error(t, a.InitKeyring(context.Background(), keyfiles, nil))
+	keyfiles = []string{"data:," + testDemoKey}
+	require.Error(t, a.InitKeyring(context.Background(), keyfiles, nil))
+}
+
+func TestParseKeyDataURL(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(testDemoKey))
+	sum := sha256.Sum256([]byte(testDemoKey))
+	generated := "inline-" + hex.EncodeToString(sum[:])[:16] + ".rsa.pub"
+	for _, tt := range []struct {
+		name     string
+		expected string
+	}{
+		{"demo.rsa.pub", "demo.rsa.pub"},
+		{"keys/demo.rsa.pub", "demo.rsa.pub"},
+		{"", generated},
+		{".", generated},
+		{"/", generated},
+		{"..", generated},
+		{"keys/..", generated},
+		{`..\demo.rsa.pub`, generated},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			name, data, err := parseKeyDataURL("application/x-pem-file;name=" + tt.name + ";base64," + encoded)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, name)
+			require.Equal(t, testDemoKey, string(data))
+		})
+	}
+}
+
+func TestInitKeyringLimits(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/huge.rsa.pub", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testDemoKey))
+		_, _ = w.Write(bytes.Repeat([]byte("A"), 2*maxKeySize))
+	})
+	mux.HandleFunc("/hang.rsa.pub", func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	a, err := New(WithFS(apkfs.NewMemFS()), WithRequestTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	a.SetClient(server.Client())
+
+	err = a.InitKeyring(context.Background(), []string{server.URL + "/huge.rsa.pub"}, nil)
+	require.ErrorContains(t, err, "larger than the maximum key size")
+
+	start := time.Now()
+	err = a.InitKeyring(context.Background(), []string{server.URL + "/hang.rsa.pub"}, nil)
+	require.ErrorContains(t, err, "timed out")
+	require.Less(t, time.Since(start), 10*time.Second)
 }
 
 func TestLoadSystemKeyring(t *testing.T) {
@@ -288,7 +511,7 @@ func TestFetchPackage(t *testing.T) {
 		pkg      = repository.NewRepositoryPackage(&testPkg, repoWithIndex)
 		ctx      = context.Background()
 	)
-	prepLayout := func(t *testing.T, cache string) *APK {
+	prepLayout := func(t *testing.T, cache string, extra ...Option) *APK {
 		src := apkfs.NewMemFS()
 		err := src.MkdirAll("lib/apk/db", 0o755)
 		require.NoError(t, err, "unable to mkdir /lib/apk/db")
@@ -297,6 +520,7 @@ func TestFetchPackage(t *testing.T) {
 		if cache != "" {
 			opts = append(opts, WithCache(cache, false))
 		}
+		opts = append(opts, extra...)
 		a, err := New(opts...)
 		require.NoError(t, err, "unable to create APK")
 		err = a.InitDB(ctx)
@@ -366,6 +590,226 @@ func TestFetchPackage(t *testing.T) {
 		require.NoError(t, err, "unable to read previous apk file")
 		require.Equal(t, apk1, apk2, "apk files do not match")
 	})
+	t.Run("cache across filesystems", func(t *testing.T) {
+		// simulate the temp files being on another filesystem than the cache
+		renames := 0
+		rename = func(string, string) error {
+			renames++
+			return &os.LinkError{Op: "rename", Err: unix.EXDEV}
+		}
+		defer func() { rename = os.Rename }()
+
+		tmpDir := t.TempDir()
+		a := prepLayout(t, tmpDir)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		cacheApkDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch, strings.TrimSuffix(testPkgFilename, ".apk"))
+
+		_, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err, "unable to expand package")
+		require.Greater(t, renames, 0, "expected rename to be attempted")
+		exp, err := a.cachedPackage(ctx, pkg, cacheApkDir)
+		require.NoError(t, err, "package should be cached")
+		f, err := exp.APK()
+		require.NoError(t, err)
+		defer f.Close()
+		apk1, err := io.ReadAll(f)
+		require.NoError(t, err)
+		apk2, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+		require.NoError(t, err)
+		require.Equal(t, apk1, apk2, "apk files do not match")
+	})
+	t.Run("purge cache", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		a := prepLayout(t, tmpDir)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		cacheApkDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch, strings.TrimSuffix(testPkgFilename, ".apk"))
+
+		// purging something never cached is fine
+		require.NoError(t, a.PurgeCache(pkg))
+
+		_, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err, "unable to expand package")
+		_, err = a.cachedPackage(ctx, pkg, cacheApkDir)
+		require.NoError(t, err, "package should be cached")
+
+		require.NoError(t, a.PurgeCache(pkg))
+		_, err = a.cachedPackage(ctx, pkg, cacheApkDir)
+		require.Error(t, err, "package should no longer be cached")
+		files, err := os.ReadDir(cacheApkDir)
+		require.NoError(t, err)
+		for _, f := range files {
+			require.True(t, f.IsDir(), "unexpected file %s left in cache", f.Name())
+		}
+
+		// and again, now that it is gone
+		require.NoError(t, a.PurgeCache(pkg))
+	})
+	t.Run("stale cache", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		a := prepLayout(t, tmpDir)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		cacheApkDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch, strings.TrimSuffix(testPkgFilename, ".apk"))
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err, "unable to expand package")
+		sig, ctl, dat := exp.SignatureFile, exp.ControlFile, exp.PackageFile
+		want, err := os.ReadFile(dat)
+		require.NoError(t, err)
+
+		// a control section without the data section it refers to, e.g. after the data section was
+		// removed, is a miss, so the package is fetched again, which fixes the cache
+		require.NoError(t, os.Remove(dat))
+		_, err = a.cachedPackage(ctx, pkg, cacheApkDir)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = a.expandPackage(ctx, pkg)
+		require.NoError(t, err, "unable to expand package")
+		got, err := os.ReadFile(dat)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+
+		// an entry that was not filled by cachePackage, e.g. by an older version, is checked once
+		require.NoError(t, os.Remove(cachedVerifiedFile(dat)))
+		_, err = a.cachedPackage(ctx, pkg, cacheApkDir)
+		require.NoError(t, err)
+		_, err = os.Stat(cachedVerifiedFile(dat))
+		require.NoError(t, err, "checked entries are marked as verified")
+
+		// a data section that changed since it was verified, e.g. a truncated copy, is a miss
+		require.NoError(t, os.WriteFile(dat, want[:len(want)/2], 0o644))
+		_, err = a.cachedPackage(ctx, pkg, cacheApkDir)
+		require.ErrorContains(t, err, "does not match")
+		_, err = a.expandPackage(ctx, pkg)
+		require.NoError(t, err, "unable to expand package")
+		got, err = os.ReadFile(dat)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+
+		// the data section of some other build, after the signature and control section of the
+		// package, is not what the control section says, so it is not cached at all
+		var mismatched bytes.Buffer
+		for _, name := range []string{sig, ctl} {
+			b, err := os.ReadFile(name)
+			require.NoError(t, err)
+			mismatched.Write(b)
+		}
+		other := testCreateAPK(t, "pkgname = other\npkgver = 1.0-r0\n", []testDirEntry{{path: "etc/other", perms: 0o644, content: []byte("other")}})
+		otherExp, err := ExpandApk(ctx, bytes.NewReader(other), "")
+		require.NoError(t, err)
+		defer otherExp.Close()
+		otherDat, err := os.ReadFile(otherExp.PackageFile)
+		require.NoError(t, err)
+		mismatched.Write(otherDat)
+
+		emptyCache := filepath.Join(t.TempDir(), "pkg")
+		require.NoError(t, os.MkdirAll(emptyCache, 0o755))
+		exp, err = ExpandApk(ctx, &mismatched, emptyCache)
+		require.NoError(t, err)
+		defer exp.Close()
+		_, err = a.cachePackage(ctx, pkg, exp, emptyCache)
+		require.NoError(t, err)
+		_, err = a.cachedPackage(ctx, pkg, emptyCache)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+	t.Run("cache hash", func(t *testing.T) {
+		_, err := New(WithCacheHash(crypto.Hash(0)))
+		require.Error(t, err)
+
+		checksum, err := packageChecksum(pkg)
+		require.NoError(t, err)
+		cacheNames := func(t *testing.T, dir string) (names []string) {
+			files, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			for _, f := range files {
+				if strings.HasSuffix(f.Name(), ".ctl.tar.gz") || strings.HasSuffix(f.Name(), ".sig.tar.gz") {
+					names = append(names, f.Name())
+				}
+			}
+			return names
+		}
+		sha256Names := func(t *testing.T, ctl string) []string {
+			b, err := os.ReadFile(ctl)
+			require.NoError(t, err)
+			sum := sha256.Sum256(b)
+			return []string{hex.EncodeToString(sum[:]) + ".ctl.tar.gz", hex.EncodeToString(sum[:]) + ".sig.tar.gz"}
+		}
+
+		t.Run("new entries", func(t *testing.T) {
+			tmpDir := t.TempDir()
+			a := prepLayout(t, tmpDir, WithCacheHash(crypto.SHA256))
+			a.SetClient(&http.Client{
+				Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+			})
+			cacheApkDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch, strings.TrimSuffix(testPkgFilename, ".apk"))
+
+			_, err := a.expandPackage(ctx, pkg)
+			require.NoError(t, err, "unable to expand package")
+			exp, err := a.cachedPackage(ctx, pkg, cacheApkDir)
+			require.NoError(t, err, "package should be cached")
+			require.Equal(t, checksum, exp.ControlHash)
+			require.ElementsMatch(t, sha256Names(t, exp.ControlFile), cacheNames(t, cacheApkDir))
+		})
+		t.Run("migrates entries", func(t *testing.T) {
+			tmpDir := t.TempDir()
+			a := prepLayout(t, tmpDir)
+			a.SetClient(&http.Client{
+				Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+			})
+			cacheApkDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch, strings.TrimSuffix(testPkgFilename, ".apk"))
+			_, err := a.expandPackage(ctx, pkg)
+			require.NoError(t, err, "unable to expand package")
+			require.ElementsMatch(t, []string{hex.EncodeToString(checksum) + ".ctl.tar.gz", hex.EncodeToString(checksum) + ".sig.tar.gz"}, cacheNames(t, cacheApkDir))
+
+			// found without the network, under the new names
+			a = prepLayout(t, tmpDir, WithCacheHash(crypto.SHA256))
+			a.SetClient(&http.Client{
+				Transport: &testLocalTransport{fail: true},
+			})
+			exp, err := a.expandPackage(ctx, pkg)
+			require.NoError(t, err, "package should be cached")
+			require.True(t, exp.Signed)
+			require.ElementsMatch(t, sha256Names(t, exp.ControlFile), cacheNames(t, cacheApkDir))
+
+			require.NoError(t, a.PurgeCache(pkg))
+			require.Empty(t, cacheNames(t, cacheApkDir))
+		})
+	})
+	t.Run("cache stats and clear", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		a := prepLayout(t, tmpDir)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		stats, err := a.CacheStats()
+		require.NoError(t, err)
+		require.Equal(t, 0, stats.Entries)
+
+		_, err = a.expandPackage(ctx, pkg)
+		require.NoError(t, err, "unable to expand package")
+		stats, err = a.CacheStats()
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.ControlFiles)
+		require.Equal(t, 1, stats.SignatureFiles)
+		require.Equal(t, 1, stats.DataFiles)
+		require.Greater(t, stats.Bytes, int64(0))
+
+		require.NoError(t, a.ClearCache())
+		stats, err = a.CacheStats()
+		require.NoError(t, err)
+		require.Equal(t, CacheStats{}, stats)
+		_, err = os.Stat(tmpDir)
+		require.NoError(t, err, "cache directory itself should remain")
+
+		// no cache configured
+		a = prepLayout(t, "")
+		_, err = a.CacheStats()
+		require.Error(t, err)
+		require.Error(t, a.ClearCache())
+	})
 	t.Run("cache hit no etag", func(t *testing.T) {
 		tmpDir := t.TempDir()
 		a := prepLayout(t, tmpDir)
@@ -457,3 +901,769 @@ func TestFetchPackage(t *testing.T) {
 		require.Equal(t, apk1, apk2, "apk files do not match")
 	})
 }
+
+type testOCIPuller struct {
+	root string
+	refs []string
+}
+
+func (p *testOCIPuller) Pull(_ context.Context, ref string) (io.ReadCloser, error) {
+	p.refs = append(p.refs, ref)
+	return os.Open(filepath.Join(p.root, filepath.Base(ref)))
+}
+
+func TestFetchPackageOCI(t *testing.T) {
+	var (
+		repo          = repository.Repository{Uri: "oci://registry.example.com/packages/" + testArch}
+		repoWithIndex = repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{&testPkg}})
+		pkg           = repository.NewRepositoryPackage(&testPkg, repoWithIndex)
+		ctx           = context.Background()
+	)
+	t.Run("no puller", func(t *testing.T) {
+		a, err := New(WithFS(apkfs.NewMemFS()))
+		require.NoError(t, err)
+		_, err = a.fetchPackage(ctx, pkg)
+		require.Error(t, err)
+	})
+	t.Run("with puller", func(t *testing.T) {
+		puller := &testOCIPuller{root: testPrimaryPkgDir}
+		a, err := New(WithFS(apkfs.NewMemFS()), WithOCIPuller(puller))
+		require.NoError(t, err)
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		defer exp.Close()
+		require.True(t, exp.Signed)
+		require.Equal(t, []string{"registry.example.com/packages/" + testArch + "/" + testPkgFilename}, puller.refs)
+	})
+}
+
+func TestExpandApkMaxDecompressedSize(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name    string
+		max     int64
+		wantErr bool
+	}{
+		{name: "no limit"},
+		{name: "within limit", max: 100 << 20},
+		{name: "exceeds limit", max: 1024, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+			require.NoError(t, err)
+			defer f.Close()
+
+			exp, err := ExpandApk(ctx, f, t.TempDir(), WithExpandMaxDecompressedSize(tc.max))
+			if tc.wantErr {
+				require.ErrorIs(t, err, MaxDecompressedSizeError{})
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, exp.Close())
+		})
+	}
+}
+
+// testGetTestAPKWithRepos returns the apk from testGetTestAPK, set up to load its indexes from local testdata.
+func testGetTestAPKWithRepos(t *testing.T) *APK {
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+	for k, v := range testKeys {
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, k), []byte(v), 0o644))
+	}
+	require.NoError(t, src.WriteFile(archFilePath, []byte(testArch+"\n"), 0o644))
+	require.NoError(t, src.WriteFile(reposFilePath, []byte(testAlpineRepos), 0o644))
+	a.SetClient(&http.Client{
+		Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+	})
+	return a
+}
+
+// testCreateAPK builds an unsigned .apk with the given .PKGINFO contents and data entries.
+func testCreateAPK(t *testing.T, pkginfo string, entries []testDirEntry) []byte {
+	var control bytes.Buffer
+	tw := tar.NewWriter(&control)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(pkginfo))}))
+	_, err := tw.Write([]byte(pkginfo))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	var out bytes.Buffer
+	for _, r := range []io.Reader{&control, testCreateTarForPackage(entries)} {
+		gw := gzip.NewWriter(&out)
+		_, err := io.Copy(gw, r)
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+	}
+	return out.Bytes()
+}
+
+// testSignAPK signs apk with a new key, which it adds to the trusted keys of a.
+func testSignAPK(t *testing.T, a *APK, apk []byte) []byte {
+	exp, err := ExpandApk(context.Background(), bytes.NewReader(apk), "")
+	require.NoError(t, err)
+	exp.Close()
+
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	require.NoError(t, err)
+	signature, err := rsa.SignPKCS1v15(crand.Reader, key, crypto.SHA1, exp.ControlHash)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, a.fs.WriteFile(filepath.Join(keysDirPath, "local.rsa.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0o644))
+
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: ".SIGN.RSA.local.rsa.pub", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(signature))}))
+	_, err = tw.Write(signature)
+	require.NoError(t, err)
+	// signature sections have no end of archive marker
+	require.NoError(t, tw.Flush())
+	require.NoError(t, gw.Close())
+	return append(out.Bytes(), apk...)
+}
+
+func TestInstallFile(t *testing.T) {
+	writeAPK := func(t *testing.T, a *APK, depend string) string {
+		pkginfo := "pkgname = localpkg\npkgver = 1.0.0-r0\narch = aarch64\nbuilddate = 1700000000\n"
+		if depend != "" {
+			pkginfo += "depend = " + depend + "\n"
+		}
+		apk := testCreateAPK(t, pkginfo, []testDirEntry{
+			{path: "usr", perms: 0o755, dir: true},
+			{path: "usr/share", perms: 0o755, dir: true},
+			{path: "usr/share/localpkg", perms: 0o755, dir: true},
+			{path: "usr/share/localpkg/hello", perms: 0o644, content: []byte("hello")},
+		})
+		if a != nil {
+			apk = testSignAPK(t, a, apk)
+		}
+		p := filepath.Join(t.TempDir(), "dev-build.apk")
+		require.NoError(t, os.WriteFile(p, apk, 0o644))
+		return p
+	}
+
+	t.Run("installed dependency", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		p := writeAPK(t, a, "musl")
+		require.NoError(t, a.InstallFile(context.Background(), p, nil))
+
+		b, err := a.fs.ReadFile("usr/share/localpkg/hello")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(b))
+
+		pkgs, err := a.GetInstalled()
+		require.NoError(t, err)
+		last := pkgs[len(pkgs)-1]
+		require.Equal(t, "localpkg", last.Name)
+		require.Equal(t, "1.0.0-r0", last.Version)
+		require.Equal(t, []string{"musl"}, last.Dependencies)
+		require.NotEmpty(t, last.Checksum)
+
+		require.ErrorContains(t, a.InstallFile(context.Background(), p, nil), "already installed")
+		pkgs, err = a.GetInstalled()
+		require.NoError(t, err)
+		require.Equal(t, "localpkg", pkgs[len(pkgs)-1].Name)
+		require.NotEqual(t, "localpkg", pkgs[len(pkgs)-2].Name, "installed once")
+	})
+	t.Run("unsigned", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		p := writeAPK(t, nil, "musl")
+		require.ErrorContains(t, a.InstallFile(context.Background(), p, nil), "not signed by a trusted key")
+		installed, err := a.isInstalledPackage("localpkg")
+		require.NoError(t, err)
+		require.False(t, installed)
+
+		a.ignoreSignatures = true
+		require.NoError(t, a.InstallFile(context.Background(), p, nil))
+	})
+	t.Run("plain http", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.ErrorContains(t, a.InstallFile(context.Background(), "http://example.com/localpkg.apk", nil), "plain http")
+	})
+	t.Run("unresolvable dependency", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		err := a.InstallFile(context.Background(), writeAPK(t, a, "does-not-exist"), nil)
+		require.ErrorContains(t, err, "does-not-exist")
+
+		installed, err := a.isInstalledPackage("localpkg")
+		require.NoError(t, err)
+		require.False(t, installed)
+	})
+	t.Run("blocked", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		p := writeAPK(t, a, "musl")
+		f, err := os.Open(p)
+		require.NoError(t, err)
+		defer f.Close()
+		exp, err := ExpandApk(context.Background(), f, "")
+		require.NoError(t, err)
+		exp.Close()
+		a.blockedChecksums = map[string]bool{(&repository.Package{Checksum: exp.ControlHash}).ChecksumString(): true}
+
+		require.ErrorIs(t, a.InstallFile(context.Background(), p, nil), BlockedPackageError{})
+		installed, err := a.isInstalledPackage("localpkg")
+		require.NoError(t, err)
+		require.False(t, installed)
+	})
+	t.Run("metadata only", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.InstallFile(context.Background(), writeAPK(t, a, "musl"), nil, WithInstallMetadataOnly(true)))
+
+		_, err := a.fs.Stat("usr/share/localpkg/hello")
+		require.ErrorIs(t, err, fs.ErrNotExist, "files should not be extracted")
+
+		pkgs, err := a.GetInstalled()
+		require.NoError(t, err)
+		last := pkgs[len(pkgs)-1]
+		require.Equal(t, "localpkg", last.Name)
+		require.Equal(t, "1.0.0-r0", last.Version)
+		require.Empty(t, last.Files)
+	})
+}
+
+func TestInstallFileWithoutData(t *testing.T) {
+	pkginfo := "pkgname = metapkg\npkgver = 1.0.0-r0\narch = aarch64\ntriggers = /usr/share/metapkg\n"
+	controlOnly := func(t *testing.T) []byte {
+		var control bytes.Buffer
+		tw := tar.NewWriter(&control)
+		for name, content := range map[string]string{".PKGINFO": pkginfo, ".post-install": "#!/bin/sh\n", ".trigger": "#!/bin/sh\n"} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o755, Size: int64(len(content))}))
+			_, err := tw.Write([]byte(content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		var out bytes.Buffer
+		gw := gzip.NewWriter(&out)
+		_, err := io.Copy(gw, &control)
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+		return out.Bytes()
+	}
+
+	for _, tt := range []struct {
+		name string
+		apk  func(t *testing.T) []byte
+	}{{
+		name: "empty data tar",
+		apk: func(t *testing.T) []byte {
+			control := controlOnly(t)
+			var data bytes.Buffer
+			gw := gzip.NewWriter(&data)
+			_, err := io.Copy(gw, testCreateTarForPackage(nil))
+			require.NoError(t, err)
+			require.NoError(t, gw.Close())
+			return append(control, data.Bytes()...)
+		},
+	}, {
+		name: "no data section",
+		apk:  controlOnly,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testGetTestAPKWithRepos(t)
+			p := filepath.Join(t.TempDir(), "metapkg.apk")
+			require.NoError(t, os.WriteFile(p, tt.apk(t), 0o644))
+			// an unsigned local build
+			a.ignoreSignatures = true
+			require.NoError(t, a.InstallFile(context.Background(), p, nil))
+
+			pkgs, err := a.GetInstalled()
+			require.NoError(t, err)
+			last := pkgs[len(pkgs)-1]
+			require.Equal(t, "metapkg", last.Name)
+			require.Empty(t, last.Files)
+
+			entries, err := a.readScriptsTarEntries()
+			require.NoError(t, err)
+			var found int
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.header.Name, scriptsTarPrefix(&last.Package)+".") {
+					found++
+				}
+			}
+			require.Equal(t, 2, found, "expected the post-install and trigger scripts")
+
+			matched, err := a.MatchTriggers([]string{"/usr/share/metapkg/file"})
+			require.NoError(t, err)
+			require.Contains(t, matched, "metapkg")
+		})
+	}
+}
+
+// testCreateScriptAPK builds an unsigned scriptpkg .apk with a post-install script and a trigger on
+// /usr/share/scriptpkg, and a file in that directory.
+func testCreateScriptAPK(t *testing.T) []byte {
+	pkginfo := "pkgname = scriptpkg\npkgver = 1.0.0-r0\narch = aarch64\ntriggers = /usr/share/scriptpkg\n"
+	var control bytes.Buffer
+	tw := tar.NewWriter(&control)
+	for name, content := range map[string]string{".PKGINFO": pkginfo, ".post-install": "#!/bin/sh\n", ".trigger": "#!/bin/sh\n"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o755, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	var apk bytes.Buffer
+	for _, r := range []io.Reader{&control, testCreateTarForPackage([]testDirEntry{
+		{path: "usr", perms: 0o755, dir: true},
+		{path: "usr/share", perms: 0o755, dir: true},
+		{path: "usr/share/scriptpkg", perms: 0o755, dir: true},
+		{path: "usr/share/scriptpkg/file", perms: 0o644, content: []byte("file")},
+	})} {
+		gw := gzip.NewWriter(&apk)
+		_, err := io.Copy(gw, r)
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+	}
+	return apk.Bytes()
+}
+
+func TestInstallFileSkipScriptsAndTriggers(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "scriptpkg.apk")
+	require.NoError(t, os.WriteFile(p, testCreateScriptAPK(t), 0o644))
+
+	for _, tt := range []struct {
+		name                      string
+		skipScripts, skipTriggers bool
+	}{
+		{name: "neither"},
+		{name: "scripts", skipScripts: true},
+		{name: "triggers", skipTriggers: true},
+		{name: "both", skipScripts: true, skipTriggers: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testGetTestAPKWithRepos(t)
+			a.skipScripts = tt.skipScripts
+			a.skipTriggers = tt.skipTriggers
+			// an unsigned local build
+			a.ignoreSignatures = true
+			require.NoError(t, a.InstallFile(context.Background(), p, nil))
+
+			// the installed db is always written
+			pkgs, err := a.GetInstalled()
+			require.NoError(t, err)
+			last := pkgs[len(pkgs)-1]
+			require.Equal(t, "scriptpkg", last.Name)
+			require.NotEmpty(t, last.Files)
+
+			entries, err := a.readScriptsTarEntries()
+			require.NoError(t, err)
+			var found int
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.header.Name, scriptsTarPrefix(&last.Package)+".") {
+					found++
+				}
+			}
+			if tt.skipScripts {
+				require.Zero(t, found)
+			} else {
+				require.Equal(t, 2, found)
+			}
+
+			matched, err := a.MatchTriggers([]string{"/usr/share/scriptpkg/file"})
+			require.NoError(t, err)
+			if tt.skipTriggers {
+				require.NotContains(t, matched, "scriptpkg")
+			} else {
+				require.Contains(t, matched, "scriptpkg")
+			}
+		})
+	}
+}
+
+func TestResolveValidator(t *testing.T) {
+	ctx := context.Background()
+	a := testGetTestAPKWithRepos(t)
+	require.NoError(t, a.SetWorld([]string{"alpine-baselayout"}))
+	expected, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+
+	before, err := a.GetInstalled()
+	require.NoError(t, err)
+
+	errBlocked := errors.New("blocked")
+	var validated []*repository.RepositoryPackage
+	a.resolveValidator = func(pkgs []*repository.RepositoryPackage) error {
+		validated = pkgs
+		return errBlocked
+	}
+	err = a.FixateWorld(ctx, nil)
+	require.ErrorIs(t, err, errBlocked)
+	require.Len(t, validated, len(expected))
+	for i, pkg := range expected {
+		require.Equal(t, pkg.Name, validated[i].Name)
+		require.Equal(t, pkg.Version, validated[i].Version)
+	}
+
+	// nothing was installed
+	after, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestInstallPackageRecordsHooksLater(t *testing.T) {
+	ctx := context.Background()
+	a := testGetTestAPKWithRepos(t)
+	exp, err := ExpandApk(ctx, bytes.NewReader(testCreateScriptAPK(t)), "")
+	require.NoError(t, err)
+	controlData, err := os.Open(exp.ControlFile)
+	require.NoError(t, err)
+	pkg, err := parsePkgInfo(controlData)
+	require.NoError(t, err)
+	require.NoError(t, controlData.Close())
+	pkg.Checksum = exp.ControlHash
+	scriptsPrefix := scriptsTarPrefix(pkg) + "."
+	recorded := func() (scripts int, triggered bool) {
+		entries, err := a.readScriptsTarEntries()
+		require.NoError(t, err)
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.header.Name, scriptsPrefix) {
+				scripts++
+			}
+		}
+		matched, err := a.MatchTriggers([]string{"/usr/share/scriptpkg/file"})
+		require.NoError(t, err)
+		_, triggered = matched["scriptpkg"]
+		return scripts, triggered
+	}
+
+	// the first phase places the files and records the package as installed, but nothing else
+	hooks, err := a.installPackage(ctx, repository.NewRepositoryPackage(pkg, nil), exp, nil, false)
+	require.NoError(t, err)
+	_, err = a.fs.Stat("usr/share/scriptpkg/file")
+	require.NoError(t, err)
+	installed, err := a.isInstalledPackage("scriptpkg")
+	require.NoError(t, err)
+	require.True(t, installed)
+	scripts, triggered := recorded()
+	require.Zero(t, scripts)
+	require.False(t, triggered)
+
+	// the second phase records the scripts and triggers
+	require.NoError(t, a.recordHooks([]packageHooks{hooks}))
+	scripts, triggered = recorded()
+	require.Equal(t, 2, scripts)
+	require.True(t, triggered)
+}
+
+func TestContinueOnInstallError(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// good and other can be fetched, bad cannot, and dependent depends on bad
+	writeAPK := func(name string) []byte {
+		b := testCreateAPK(t, "pkgname = "+name+"\npkgver = 1.0.0-r0\narch = aarch64\n", []testDirEntry{
+			{path: "usr", perms: 0o755, dir: true},
+			{path: "usr/share", perms: 0o755, dir: true},
+			{path: "usr/share/" + name, perms: 0o755, dir: true},
+			{path: "usr/share/" + name + "/file", perms: 0o644, content: []byte(name)},
+		})
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-1.0.0-r0.apk"), b, 0o644))
+		exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+		require.NoError(t, err)
+		defer exp.Close()
+		return exp.ControlHash
+	}
+	repo := repository.Repository{Uri: dir}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "good", Version: "1.0.0-r0", Arch: testArch, Checksum: writeAPK("good")},
+		{Name: "other", Version: "1.0.0-r0", Arch: testArch, Checksum: writeAPK("other"), Dependencies: []string{"good"}},
+		{Name: "bad", Version: "1.0.0-r0", Arch: testArch, Checksum: []byte("bad-checksum-bad-checksum")},
+		{Name: "dependent", Version: "1.0.0-r0", Arch: testArch, Checksum: []byte("dependent-checksum-dep"), Dependencies: []string{"bad"}},
+	}})})
+	installed := func(a *APK) (names []string) {
+		pkgs, err := a.GetInstalled()
+		require.NoError(t, err)
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+
+	t.Run("stop", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.SetWorld([]string{"other", "dependent"}))
+		err := a.FixateWorldWithIndexes(ctx, indexes, nil)
+		require.ErrorContains(t, err, "bad")
+		require.NotContains(t, installed(a), "dependent")
+	})
+	t.Run("continue", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		a.continueOnError = true
+		require.NoError(t, a.SetWorld([]string{"other", "dependent"}))
+		err := a.FixateWorldWithIndexes(ctx, indexes, nil)
+		require.ErrorContains(t, err, "expanding bad")
+		require.ErrorContains(t, err, "installing dependent: dependency bad failed")
+
+		names := installed(a)
+		require.Contains(t, names, "good")
+		require.Contains(t, names, "other")
+		require.NotContains(t, names, "bad")
+		require.NotContains(t, names, "dependent")
+		_, err = a.fs.Stat("usr/share/other/file")
+		require.NoError(t, err)
+	})
+}
+
+func TestInstallErrorRecordsHooks(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// clash is installed after scriptpkg, and fails as it has the same file with other contents
+	script := testCreateScriptAPK(t)
+	clash := testCreateAPK(t, "pkgname = clash\npkgver = 1.0.0-r0\narch = aarch64\n", []testDirEntry{
+		{path: "usr", perms: 0o755, dir: true},
+		{path: "usr/share", perms: 0o755, dir: true},
+		{path: "usr/share/scriptpkg", perms: 0o755, dir: true},
+		{path: "usr/share/scriptpkg/file", perms: 0o644, content: []byte("clash")},
+	})
+	var pkgs []*repository.Package
+	for _, p := range []struct {
+		name string
+		apk  []byte
+		deps []string
+	}{{"scriptpkg", script, nil}, {"clash", clash, []string{"scriptpkg"}}} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, p.name+"-1.0.0-r0.apk"), p.apk, 0o644))
+		exp, err := ExpandApk(ctx, bytes.NewReader(p.apk), "")
+		require.NoError(t, err)
+		exp.Close()
+		pkgs = append(pkgs, &repository.Package{Name: p.name, Version: "1.0.0-r0", Arch: testArch, Checksum: exp.ControlHash, Dependencies: p.deps})
+	}
+	repo := repository.Repository{Uri: dir}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: pkgs})})
+
+	a := testGetTestAPKWithRepos(t)
+	require.NoError(t, a.SetWorld([]string{"clash"}))
+	require.ErrorContains(t, a.FixateWorldWithIndexes(ctx, indexes, nil), "installing clash")
+
+	installed, err := a.isInstalledPackage("scriptpkg")
+	require.NoError(t, err)
+	require.True(t, installed)
+	entries, err := a.readScriptsTarEntries()
+	require.NoError(t, err)
+	var scripts int
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.header.Name, scriptsTarPrefix(pkgs[0])+".") {
+			scripts++
+		}
+	}
+	require.Equal(t, 2, scripts, "the scripts of the package installed before the failure are recorded")
+	matched, err := a.MatchTriggers([]string{"/usr/share/scriptpkg/file"})
+	require.NoError(t, err)
+	require.Contains(t, matched, "scriptpkg")
+}
+
+// testIndexWithAPKs writes an .apk for each of pkgs to a new directory and returns an index of
+// them, with their arch and checksums set, to install them from.
+func testIndexWithAPKs(t *testing.T, pkgs ...*repository.Package) []NamedIndex {
+	dir := t.TempDir()
+	for _, pkg := range pkgs {
+		b := testCreateAPK(t, "pkgname = "+pkg.Name+"\npkgver = "+pkg.Version+"\narch = aarch64\n", []testDirEntry{
+			{path: "usr", perms: 0o755, dir: true},
+			{path: "usr/share", perms: 0o755, dir: true},
+			{path: "usr/share/" + pkg.Name, perms: 0o755, dir: true},
+			{path: "usr/share/" + pkg.Name + "/file", perms: 0o644, content: []byte(pkg.Name + "-" + pkg.Version)},
+		})
+		require.NoError(t, os.WriteFile(filepath.Join(dir, pkg.Name+"-"+pkg.Version+".apk"), b, 0o644))
+		exp, err := ExpandApk(context.Background(), bytes.NewReader(b), "")
+		require.NoError(t, err)
+		exp.Close()
+		pkg.Arch = testArch
+		pkg.Checksum = exp.ControlHash
+	}
+	repo := repository.Repository{Uri: dir}
+	return testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: pkgs})})
+}
+
+// testInstalledVersions returns the versions of the packages installed by a, by name.
+func testInstalledVersions(t *testing.T, a *APK) map[string]string {
+	pkgs, err := a.GetInstalled()
+	require.NoError(t, err)
+	versions := map[string]string{}
+	for _, pkg := range pkgs {
+		versions[pkg.Name] = pkg.Version
+	}
+	return versions
+}
+
+func TestFixateWorldLicenseAllowlist(t *testing.T) {
+	ctx := context.Background()
+	indexes := testIndexWithAPKs(t,
+		&repository.Package{Name: "app", Version: "1.0.0-r0", License: "Apache-2.0", Dependencies: []string{"lib"}},
+		&repository.Package{Name: "lib", Version: "1.0.0-r0", License: "MIT"},
+		&repository.Package{Name: "lib", Version: "2.0.0-r0", License: "GPL-3.0-only"},
+		&repository.Package{Name: "gpl-app", Version: "1.0.0-r0", License: "GPL-2.0-only"},
+	)
+	a := testGetTestAPKWithRepos(t)
+	a.licenseAllowlist = []string{"Apache-2.0", "MIT"}
+
+	require.NoError(t, a.SetWorld([]string{"app"}))
+	require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+	versions := testInstalledVersions(t, a)
+	require.Equal(t, "1.0.0-r0", versions["app"])
+	require.Equal(t, "1.0.0-r0", versions["lib"], "the newer lib has a license that is not allowed")
+
+	require.NoError(t, a.SetWorld([]string{"app", "gpl-app"}))
+	require.ErrorContains(t, a.FixateWorldWithIndexes(ctx, indexes, nil), `gpl-app-1.0.0-r0 ("GPL-2.0-only")`)
+	require.NotContains(t, testInstalledVersions(t, a), "gpl-app")
+}
+
+func TestFixateWorldExcludedSubpackages(t *testing.T) {
+	ctx := context.Background()
+	indexes := testIndexWithAPKs(t,
+		&repository.Package{Name: "app", Version: "1.0.0-r0", Dependencies: []string{"lib"}},
+		&repository.Package{Name: "app-dev", Version: "1.0.0-r0", Dependencies: []string{"app", "lib-dev"}},
+		&repository.Package{Name: "lib", Version: "1.0.0-r0"},
+		&repository.Package{Name: "lib-dev", Version: "1.0.0-r0", Dependencies: []string{"lib"}},
+		&repository.Package{Name: "lib-doc", Version: "1.0.0-r0", InstallIf: []string{"lib"}},
+	)
+	a := testGetTestAPKWithRepos(t)
+	a.excludeSuffixes = []string{"-dev", "-doc"}
+
+	require.NoError(t, a.SetWorld([]string{"app-dev"}))
+	pkgs, _, err := a.ResolveWorldWithIndexes(ctx, indexes)
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range pkgs {
+		names = append(names, pkg.Name)
+	}
+	require.ElementsMatch(t, []string{"lib", "app", "app-dev"}, names)
+
+	require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+	versions := testInstalledVersions(t, a)
+	require.Contains(t, versions, "app-dev", "requested explicitly")
+	require.NotContains(t, versions, "lib-dev")
+	require.NotContains(t, versions, "lib-doc")
+}
+
+func TestResolveWorldPreferredRepositories(t *testing.T) {
+	ctx := context.Background()
+	upstream := testIndexWithAPKs(t, &repository.Package{Name: "app", Version: "1.0.0-r0"})
+	mirror := testIndexWithAPKs(t, &repository.Package{Name: "app", Version: "1.0.0-r0"})
+	indexes := []NamedIndex{upstream[0], mirror[0]}
+	a := testGetTestAPKWithRepos(t)
+	require.NoError(t, a.SetWorld([]string{"app"}))
+
+	for _, preferred := range indexes {
+		uri := preferred.Packages()[0].Repository().Uri
+		a.repositoryPrefs = []string{uri}
+		pkgs, _, err := a.ResolveWorldWithIndexes(ctx, indexes)
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+		require.Equal(t, uri, pkgs[0].Repository().Uri)
+	}
+}
+
+func TestFixateWorldDependencyAlternatives(t *testing.T) {
+	ctx := context.Background()
+	indexes := testIndexWithAPKs(t,
+		&repository.Package{Name: "app", Version: "1.0.0-r0", Dependencies: []string{"foo", "|", "bar>=2.0"}},
+		&repository.Package{Name: "bar", Version: "2.0.0-r0"},
+	)
+	a := testGetTestAPKWithRepos(t)
+	require.NoError(t, a.SetWorld([]string{"app"}))
+	require.Error(t, a.FixateWorldWithIndexes(ctx, indexes, nil), "alternatives are not enabled")
+
+	a.alternativeDeps = true
+	require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+	versions := testInstalledVersions(t, a)
+	require.Equal(t, "2.0.0-r0", versions["bar"])
+	require.NotContains(t, versions, "foo")
+}
+
+func TestResolveWorldResolutionTracer(t *testing.T) {
+	ctx := context.Background()
+	indexes := testIndexWithAPKs(t,
+		&repository.Package{Name: "app", Version: "1.0.0-r0", Dependencies: []string{"lib"}},
+		&repository.Package{Name: "lib", Version: "1.0.0-r0"},
+		&repository.Package{Name: "lib", Version: "2.0.0-r0"},
+	)
+	a := testGetTestAPKWithRepos(t)
+	chosen := map[string]string{}
+	a.resolveTracer = func(step ResolveStep) {
+		chosen[step.Name] = step.Chosen.Version
+	}
+	require.NoError(t, a.SetWorld([]string{"app"}))
+	_, _, err := a.ResolveWorldWithIndexes(ctx, indexes)
+	require.NoError(t, err)
+	require.Equal(t, "1.0.0-r0", chosen["app"])
+	require.Equal(t, "2.0.0-r0", chosen["lib"])
+}
+
+func TestResolveWorldFromList(t *testing.T) {
+	ctx := context.Background()
+	a := testGetTestAPKWithRepos(t)
+	require.NoError(t, a.SetWorld([]string{"alpine-baselayout"}))
+	expected, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, a.SetWorld([]string{"busybox"}))
+	pkgs, _, err := a.ResolveWorldFromList(ctx, []string{"alpine-baselayout"})
+	require.NoError(t, err)
+	require.Equal(t, expected, pkgs)
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox"}, world, "world is not changed")
+
+	_, _, err = a.ResolveWorldFromList(ctx, []string{"nonexistent-package"})
+	require.Error(t, err)
+}
+
+func TestBlockedChecksums(t *testing.T) {
+	ctx := context.Background()
+	a := testGetTestAPKWithRepos(t)
+	require.NoError(t, a.SetWorld([]string{"alpine-baselayout"}))
+	pkgs, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, pkgs)
+	blocked := pkgs[0]
+
+	a.blockedChecksums = map[string]bool{blocked.ChecksumString(): true}
+	_, _, err = a.ResolveWorld(ctx)
+	require.ErrorIs(t, err, BlockedPackageError{})
+	var blockedErr BlockedPackageError
+	require.ErrorAs(t, err, &blockedErr)
+	require.Equal(t, blocked.Name, blockedErr.Package)
+	require.ErrorContains(t, a.FixateWorld(ctx, nil), blocked.Name)
+
+	// packages that did not come from resolving world are checked before installing
+	_, err = a.installPackages(ctx, pkgs, nil, nil)
+	require.ErrorIs(t, err, BlockedPackageError{})
+}
+
+func TestAlternateConfigPaths(t *testing.T) {
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithWorldFile("/conf/world"), WithRepositoriesFile("conf/repositories"),
+		WithArchFile("conf/arch"), WithKeysDir("/conf/keys/"))
+	require.NoError(t, err)
+	a.SetClient(&http.Client{
+		Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+	})
+	require.NoError(t, src.MkdirAll("conf/keys", 0o755))
+	for k, v := range testKeys {
+		require.NoError(t, src.WriteFile(filepath.Join("conf/keys", k), []byte(v), 0o644))
+	}
+	require.NoError(t, src.WriteFile("conf/arch", []byte(testArch+"\n"), 0o644))
+
+	require.NoError(t, a.SetWorld([]string{"alpine-baselayout"}))
+	require.NoError(t, a.SetRepositories([]string{testAlpineRepos}))
+	world, err := src.ReadFile("conf/world")
+	require.NoError(t, err)
+	require.Equal(t, "alpine-baselayout\n", string(world))
+	_, err = src.Stat(worldFilePath)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	repos, err := a.GetRepositories()
+	require.NoError(t, err)
+	require.Equal(t, []string{testAlpineRepos}, repos)
+	keys, err := a.readKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, len(testKeys))
+
+	// the indexes are found for the arch in conf/arch, and verified with the keys in conf/keys
+	indexes, err := a.LoadIndexes(context.Background())
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	pkgs, _, err := a.ResolveWorldWithIndexes(context.Background(), indexes)
+	require.NoError(t, err)
+	require.NotEmpty(t, pkgs)
+}
@@ -16,6 +16,7 @@ package apk
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -25,7 +26,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/klauspost/compress/gzip"
@@ -35,13 +38,33 @@ import (
 	"gitlab.alpinelinux.org/alpine/go/repository"
 	"go.lsp.dev/uri"
 	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
 )
 
-var signatureFileRegex = regexp.MustCompile(`^\.SIGN\.RSA\.(.*\.rsa\.pub)$`)
+// signatureFileRegex matches the name of a signature file, .SIGN.<algorithm>.<key name>.
+var signatureFileRegex = regexp.MustCompile(`^\.SIGN\.([A-Za-z0-9]+)\.(.+)$`)
 
-// IndexURL full URL to the index file for the given repo and arch
+// indexSignatureVerifiers verify the signature of the signed part of a repository index, by the
+// algorithm in the name of its signature file. Verifying a new algorithm only needs an entry here.
+var indexSignatureVerifiers = map[string]func(keyName string, data, signature []byte, keys map[string][]byte) error{
+	"RSA": verifyRSAIndexSignature,
+}
+
+// IndexURL full URL to the index file for the given repo and arch.
+// If the repo URL already ends in the arch, it is not added again.
 func IndexURL(repo, arch string) string {
-	return fmt.Sprintf("%s/%s/%s", repo, arch, indexFilename)
+	return fmt.Sprintf("%s/%s", repositoryArchURL(repo, arch, false), indexFilename)
+}
+
+// repositoryArchURL returns the URL of the directory holding the index and packages for the given
+// repo and arch. Normally that is <repo>/<arch>, but if the repo URL already ends in the arch, or the
+// repository is flat, i.e. does not have a directory per arch, it is the repo URL itself.
+func repositoryArchURL(repo, arch string, flat bool) string {
+	repo = strings.TrimRight(repo, "/")
+	if flat || path.Base(repo) == arch {
+		return repo
+	}
+	return fmt.Sprintf("%s/%s", repo, arch)
 }
 
 // GetRepositoryIndexes returns the indexes for the named repositories, keys and archs.
@@ -57,41 +80,34 @@ func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][
 		opt(opts)
 	}
 
-	for _, repo := range repos {
-		// does it start with a pin?
-		var (
-			repoName string
-			repoURL  = repo
-		)
-		if strings.HasPrefix(repo, "@") {
-			// it's a pinned repository, get the name
-			parts := strings.Fields(repo)
-			if len(parts) < 2 {
-				return nil, errors.New("invalid repository line")
-			}
-			repoName = parts[0][1:]
-			repoURL = parts[1]
-		}
-
-		repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
-		u := IndexURL(repoURL, arch)
-
-		// Normalize the repo as a URI, so that local paths
-		// are translated into file:// URLs, allowing them to be parsed
-		// into a url.URL{}.
-		var (
-			b     []byte
-			asURL *url.URL
-		)
-		if strings.HasPrefix(u, "https://") {
-			asURL, err = url.Parse(u)
-		} else {
-			// Attempt to parse non-https elements into URI's so they are translated into
-			// file:// URLs allowing them to parse into a url.URL{}
-			asURL, err = url.Parse(string(uri.New(u)))
+	// fetching is sequential, but verifying the signatures and parsing the indexes is CPU bound and
+	// independent per index, so it is done in parallel with fetching the next ones; as soon as one
+	// fails, the rest are canceled
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	// by position in repos, so the order does not depend on which finishes first
+	results := make([]NamedIndex, len(repos))
+	fail := func(err error) ([]NamedIndex, error) {
+		// a failure in a worker is what canceled the fetch, if any, so it is the one to report
+		if werr := g.Wait(); werr != nil {
+			return nil, werr
 		}
+		return nil, err
+	}
+
+	for i, repo := range repos {
+		repoName, repoURL, err := parseRepositoryLine(repo)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
+			return fail(err)
+		}
+
+		repoBase := repositoryArchURL(repoURL, arch, opts.flatRepositories[repoURL])
+		u := fmt.Sprintf("%s/%s", repoBase, indexFilename)
+
+		var b []byte
+		asURL, err := parseIndexURL(u)
+		if err != nil {
+			return fail(fmt.Errorf("failed to parse repo as URI: %w", err))
 		}
 
 		switch asURL.Scheme {
@@ -99,7 +115,7 @@ func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][
 			b, err = os.ReadFile(u)
 			if err != nil {
 				if !errors.Is(err, fs.ErrNotExist) {
-					return nil, fmt.Errorf("failed to read repository %s: %w", u, err)
+					return fail(fmt.Errorf("failed to read repository %s: %w", u, err))
 				}
 				continue
 			}
@@ -108,133 +124,494 @@ func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][
 			if client == nil {
 				client = retryablehttp.NewClient().StandardClient()
 			}
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
-			if err != nil {
-				return nil, err
-			}
-			// if the repo URL contains HTTP Basic Auth credentials, add them to the request
-			if asURL.User != nil {
-				user := asURL.User.Username()
-				pass, _ := asURL.User.Password()
-				req.SetBasicAuth(user, pass)
+			var errs []error
+			for _, candidate := range mirrorCandidates(u, opts.mirrors, nil) {
+				b, err = fetchIndexURL(gctx, client, candidate, arch)
+				if err == nil {
+					break
+				}
+				errs = append(errs, err)
 			}
-
-			// This will return a body that retries requests using Range requests if Read() hits an error.
-			rrt := newRangeRetryTransport(ctx, client)
-			res, err := rrt.RoundTrip(req)
 			if err != nil {
-				return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
-			}
-			switch res.StatusCode {
-			case http.StatusOK:
-				// this is fine
-			case http.StatusNotFound:
-				return nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, u)
-			default:
-				return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, u)
+				return fail(errors.Join(errs...))
 			}
-			defer res.Body.Close()
-			buf := bytes.NewBuffer(nil)
-			if _, err := io.Copy(buf, res.Body); err != nil {
-				return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
-			}
-			b = buf.Bytes()
 		default:
-			return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+			return fail(fmt.Errorf("repository scheme %s not supported", asURL.Scheme))
 		}
 
-		// validate the signature
-		if !opts.ignoreSignatures {
-			buf := bytes.NewReader(b)
-			gzipReader, err := gzip.NewReader(buf)
+		if gctx.Err() != nil {
+			// another index failed, or the caller canceled
+			break
+		}
+		i := i
+		g.Go(func() error {
+			if gctx.Err() != nil {
+				return nil
+			}
+			idx, err := repositoryIndex(b, u, repoName, repoBase, keys, opts)
 			if err != nil {
-				return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+				return err
 			}
-			// set multistream to false, so we can read each part separately;
-			// the first part is the signature, the second is the index, which should be
-			// verified.
-			gzipReader.Multistream(false)
-			defer gzipReader.Close()
+			results[i] = idx
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	// no worker failed, but the caller canceled, so some indexes may not have been fetched or parsed
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-			tarReader := tar.NewReader(gzipReader)
+	for _, idx := range results {
+		if idx != nil {
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes, nil
+}
 
-			// read the signature
-			signatureFile, err := tarReader.Next()
-			if err != nil {
-				return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-			}
-			matches := signatureFileRegex.FindStringSubmatch(signatureFile.Name)
-			if len(matches) != 2 {
-				return nil, fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
-			}
-			signature, err := io.ReadAll(tarReader)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-			}
-			// with multistream false, we should read the next one
-			if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
-				return nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
+// repositoryIndex checks and parses b, the index fetched from u, into the index of the repository
+// at repoBase, verifying its signature with keys as opts say.
+func repositoryIndex(b []byte, u, repoName, repoBase string, keys map[string][]byte, opts *indexOpts) (NamedIndex, error) {
+	// validate the signature
+	var signed bool
+	if !opts.ignoreSignatures {
+		err := verifyIndexSignature(b, keys, opts.allSignatures)
+		switch {
+		case err == nil:
+			signed = true
+		case opts.allowUnsigned:
+			// keep it, marked as unsigned
+		default:
+			return nil, fmt.Errorf("repository index at %s: %w", u, err)
+		}
+	}
+
+	// convert it to an ApkIndex
+	index, err := indexFromArchive(b, opts.packageFilter, opts.maxDecompressedSize)
+	if errors.Is(err, MaxDecompressedSizeError{}) {
+		return nil, fmt.Errorf("unable to decompress repository index at %s: %w", u, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
+	}
+	var raw map[rawEntryKey]map[string]string
+	if opts.rawEntries {
+		if raw, err = rawIndexEntries(b, index, opts.maxDecompressedSize); err != nil {
+			return nil, fmt.Errorf("unable to read raw entries of repository index at %s: %w", u, err)
+		}
+	}
+	repoRef := repository.Repository{Uri: repoBase}
+	return &namedRepositoryWithIndex{name: repoName, repo: repoRef.WithIndex(index), signed: signed, raw: raw}, nil
+}
+
+// indexFromArchive converts b, an APKINDEX.tar.gz, to an index. With a filter, the packages are
+// passed to it one at a time as they are parsed, and only the ones it keeps are in the index. With a
+// maxSize, it fails with a MaxDecompressedSizeError as soon as b decompresses to more than that.
+func indexFromArchive(b []byte, filter func(*repository.Package) bool, maxSize int64) (*repository.ApkIndex, error) {
+	if filter == nil && maxSize <= 0 {
+		return repository.IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(newMaxSizeReader(gz, maxSize))
+
+	index := &repository.ApkIndex{}
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch header.Name {
+		case "APKINDEX":
+			if err := streamPackageIndex(tr, func(pkg *repository.Package) {
+				if filter == nil || filter(pkg) {
+					index.Packages = append(index.Packages, pkg)
+				}
+			}); err != nil {
+				return nil, err
 			}
-			// we now have the signature bytes and name, get the contents of the rest;
-			// this should be everything else in the raw gzip file as is.
-			allBytes := len(b)
-			unreadBytes := buf.Len()
-			readBytes := allBytes - unreadBytes
-			indexData := b[readBytes:]
-
-			indexDigest, err := sign.HashData(indexData)
+		case "DESCRIPTION":
+			description, err := io.ReadAll(tr)
 			if err != nil {
 				return nil, err
 			}
-			// now we can check the signature
-			if keys == nil {
-				return nil, fmt.Errorf("no keys provided to verify signature")
-			}
-			var verified bool
-			keyData, ok := keys[matches[1]]
-			if ok {
-				if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err != nil {
-					verified = false
-				}
-			}
-			if !verified {
-				for _, keyData := range keys {
-					if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err == nil {
-						verified = true
-						break
-					}
-				}
-			}
-			if !verified {
-				return nil, fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", matches[1])
+			index.Description = string(description)
+		}
+	}
+	return index, nil
+}
+
+// streamPackageIndex parses the package records of r, an uncompressed APKINDEX, and calls fn with
+// each one as soon as it is complete, without keeping any of them.
+func streamPackageIndex(r io.Reader, fn func(*repository.Package)) error {
+	scanner := bufio.NewScanner(r)
+	pkg := &repository.Package{}
+	for linenr := 1; scanner.Scan(); linenr++ {
+		line := scanner.Text()
+		if line == "" {
+			if pkg.Name != "" {
+				fn(pkg)
 			}
+			pkg = &repository.Package{}
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			return fmt.Errorf("cannot parse line %d of APKINDEX: expected \":\" not found", linenr)
+		}
+		if err := parsePackageField(pkg, line[:1], line[2:]); err != nil {
+			return fmt.Errorf("cannot parse line %d of APKINDEX: %w", linenr, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if pkg.Name != "" {
+		fn(pkg)
+	}
+	return nil
+}
 
-			// with a valid signature, convert it to an ApkIndex
-			index, err := repository.IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
-			if err != nil {
-				return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
+// parseRepositoryLine splits a line of /etc/apk/repositories into the name of the pin, if it starts
+// with one, e.g. "@testing https://...", and the repository URL.
+func parseRepositoryLine(repo string) (name, repoURL string, err error) {
+	if !strings.HasPrefix(repo, "@") {
+		return "", repo, nil
+	}
+	// it's a pinned repository, get the name
+	parts := strings.Fields(repo)
+	if len(parts) < 2 {
+		return "", "", errors.New("invalid repository line")
+	}
+	return parts[0][1:], parts[1], nil
+}
+
+// parseIndexURL parses u, the location of an index, as a URL. Anything but https is normalized
+// as a URI, so that local paths are translated into file:// URLs.
+func parseIndexURL(u string) (*url.URL, error) {
+	if strings.HasPrefix(u, "https://") {
+		return url.Parse(u)
+	}
+	return url.Parse(string(uri.New(u)))
+}
+
+// Resolve fetches the indexes for repos, as GetRepositoryIndexes does, and resolves the packages
+// in world against them, returning the packages to install, in install order, and the conflicts.
+// It needs no root filesystem, so it suits resolving without installing.
+func Resolve(ctx context.Context, repos []string, keys map[string][]byte, arch string, world []string, options ...IndexOption) ([]*repository.RepositoryPackage, []string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Resolve")
+	defer span.End()
+
+	indexes, err := GetRepositoryIndexes(ctx, repos, keys, arch, options...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	return NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, world)
+}
+
+// rawEntryKey identifies an entry of an APKINDEX by the package name and version.
+type rawEntryKey struct {
+	name, version string
+}
+
+// rawIndexEntries returns the fields of the entries in the APKINDEX of the raw repository index
+// archive for the packages of index, keyed by their single letter field names, e.g. "P" and "V".
+// With a maxSize, it fails with a MaxDecompressedSizeError once archive decompresses to more than that.
+func rawIndexEntries(archive []byte, index *repository.ApkIndex, maxSize int64) (map[rawEntryKey]map[string]string, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(newMaxSizeReader(gzipReader, maxSize))
+	for {
+		hdr, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("no APKINDEX in repository index")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read repository index: %w", err)
+		}
+		if hdr.Name == "APKINDEX" {
+			break
+		}
+	}
+
+	// only keep the entries of the packages in the index, which may have been filtered
+	wanted := make(map[rawEntryKey]bool, len(index.Packages))
+	for _, pkg := range index.Packages {
+		wanted[rawEntryKey{pkg.Name, pkg.Version}] = true
+	}
+	entries := make(map[rawEntryKey]map[string]string, len(wanted))
+	keep := func(entry map[string]string) {
+		if key := (rawEntryKey{entry["P"], entry["V"]}); wanted[key] {
+			entries[key] = entry
+		}
+	}
+
+	scanner := bufio.NewScanner(tarReader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	entry := map[string]string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			keep(entry)
+			entry = map[string]string{}
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		entry[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read repository index: %w", err)
+	}
+	// the last entry need not be followed by an empty line
+	keep(entry)
+	return entries, nil
+}
+
+// verifyIndexSignature verifies the signatures of the raw repository index b with keys. The index is
+// valid if any of its signatures verifies, or with requireAll, if all of them do, each by the
+// distinct key it names.
+func verifyIndexSignature(b []byte, keys map[string][]byte, requireAll bool) error {
+	buf := bytes.NewReader(b)
+	gzipReader, err := gzip.NewReader(buf)
+	if err != nil {
+		return fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	// set multistream to false, so we can read each part separately;
+	// the first part is the signatures, the second is the index, which should be
+	// verified.
+	gzipReader.Multistream(false)
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+
+	// read the signatures; there may be several, by different keys
+	type indexSignature struct {
+		name, algorithm, keyName string
+		signature                []byte
+	}
+	var signatures []indexSignature
+	for {
+		signatureFile, err := tarReader.Next()
+		if errors.Is(err, io.EOF) && len(signatures) > 0 {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read signature from repository index: %w", err)
+		}
+		matches := signatureFileRegex.FindStringSubmatch(signatureFile.Name)
+		if len(matches) != 3 {
+			return fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
+		}
+		signature, err := io.ReadAll(tarReader)
+		if err != nil {
+			return fmt.Errorf("failed to read signature from repository index: %w", err)
+		}
+		signatures = append(signatures, indexSignature{name: signatureFile.Name, algorithm: matches[1], keyName: matches[2], signature: signature})
+	}
+	// we now have the signature bytes and names, get the contents of the rest;
+	// this should be everything else in the raw gzip file as is.
+	allBytes := len(b)
+	unreadBytes := buf.Len()
+	readBytes := allBytes - unreadBytes
+	indexData := b[readBytes:]
+
+	// now we can check the signatures: any one verifying is enough, unless all are required, in
+	// which case each has to verify with the key it names, and the keys have to be distinct, so
+	// that one signature repeated under other names does not count more than once
+	var (
+		errs []error
+		seen = map[string]string{}
+	)
+	for _, sig := range signatures {
+		sigKeys := keys
+		if requireAll {
+			keyData, ok := keys[sig.keyName]
+			if !ok {
+				return fmt.Errorf("repository index signature %s is by %s, which is not a trusted key", sig.name, sig.keyName)
 			}
-			repoRef := repository.Repository{Uri: repoBase}
-			indexes = append(indexes, NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)))
+			if other, ok := seen[string(keyData)]; ok {
+				return fmt.Errorf("repository index signatures %s and %s are by the same key", other, sig.name)
+			}
+			seen[string(keyData)] = sig.name
+			sigKeys = map[string][]byte{sig.keyName: keyData}
+		}
+		verify, ok := indexSignatureVerifiers[sig.algorithm]
+		if !ok {
+			err = fmt.Errorf("unable to verify repository index signature %s: %w", sig.name, UnsupportedSignatureAlgorithmError{Algorithm: sig.algorithm})
+		} else {
+			err = verify(sig.keyName, indexData, sig.signature, sigKeys)
+		}
+		switch {
+		case err == nil && !requireAll:
+			return nil
+		case err != nil && requireAll:
+			return err
+		case err != nil:
+			errs = append(errs, err)
 		}
 	}
-	return indexes, nil
+	return errors.Join(errs...)
+}
+
+// verifyRSAIndexSignature verifies the RSA signature of the SHA1 digest of data with keys, trying
+// the key named keyName first.
+func verifyRSAIndexSignature(keyName string, data, signature []byte, keys map[string][]byte) error {
+	digest, err := sign.HashData(data)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return fmt.Errorf("no keys provided to verify signature")
+	}
+	if !verifySignature(keyName, digest, signature, keys) {
+		return fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", keyName)
+	}
+	return nil
+}
+
+// fetchIndexURL fetches the index at u using client.
+func fetchIndexURL(ctx context.Context, client *http.Client, u, arch string) ([]byte, error) {
+	asURL, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// if the repo URL contains HTTP Basic Auth credentials, add them to the request
+	if asURL.User != nil {
+		user := asURL.User.Username()
+		pass, _ := asURL.User.Password()
+		req.SetBasicAuth(user, pass)
+	}
+
+	// This will return a body that retries requests using Range requests if Read() hits an error.
+	rrt := newRangeRetryTransport(ctx, client)
+	res, err := rrt.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		// this is fine
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, u)
+	default:
+		return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, u)
+	}
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buf, res.Body); err != nil {
+		return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
+	}
+	return buf.Bytes(), nil
 }
 
 type indexOpts struct {
-	ignoreSignatures bool
-	httpClient       *http.Client
+	ignoreSignatures    bool
+	allowUnsigned       bool
+	httpClient          *http.Client
+	maxDecompressedSize int64
+	mirrors             map[string][]Mirror
+	flatRepositories    map[string]bool
+	packageFilter       func(*repository.Package) bool
+	allSignatures       bool
+	rawEntries          bool
 }
 type IndexOption func(*indexOpts)
 
+// WithIndexRequireAllSignatures requires every signature of an index that is signed by several keys
+// to verify, each against the trusted key that its file names, with no key used twice. By default,
+// an index is valid if any of its signatures verifies against a trusted key.
+func WithIndexRequireAllSignatures(requireAll bool) IndexOption {
+	return func(o *indexOpts) {
+		o.allSignatures = requireAll
+	}
+}
+
+// WithIndexRawEntries keeps every field of the entries of each index, including those that are not
+// part of repository.Package, for PkgResolver.RawIndexEntry. They are parsed once when the index is
+// fetched, and are not kept by default, as they take about as much memory as the index itself.
+func WithIndexRawEntries(keep bool) IndexOption {
+	return func(o *indexOpts) {
+		o.rawEntries = keep
+	}
+}
+
+// WithIndexPackageFilter streams the packages of each index through filter as they are parsed, after
+// the index is fetched and verified, and keeps only the ones it returns true for. For very large
+// indexes of which only a few packages are of interest, this avoids holding all of them in memory.
+func WithIndexPackageFilter(filter func(*repository.Package) bool) IndexOption {
+	return func(o *indexOpts) {
+		o.packageFilter = filter
+	}
+}
+
 func WithIgnoreSignatures(ignoreSignatures bool) IndexOption {
 	return func(o *indexOpts) {
 		o.ignoreSignatures = ignoreSignatures
 	}
 }
 
+// WithIndexAllowUnsigned keeps indexes that are not signed, or whose signature cannot be verified
+// with the keys, rather than failing. Signatures still are verified where possible; use IndexSigned
+// to tell which indexes were verified.
+func WithIndexAllowUnsigned(allow bool) IndexOption {
+	return func(o *indexOpts) {
+		o.allowUnsigned = allow
+	}
+}
+
 func WithHTTPClient(c *http.Client) IndexOption {
 	return func(o *indexOpts) {
 		o.httpClient = c
 	}
 }
+
+// WithIndexMaxDecompressedSize sets the maximum number of bytes an index may decompress to.
+// If exceeded, fetching the indexes fails with a MaxDecompressedSizeError.
+// If not provided, or zero, there is no limit.
+func WithIndexMaxDecompressedSize(size int64) IndexOption {
+	return func(o *indexOpts) {
+		o.maxDecompressedSize = size
+	}
+}
+
+// WithIndexFlatRepositories marks the repositories with the given URLs as flat, i.e. with
+// APKINDEX.tar.gz and the packages directly at the repository URL, rather than under a
+// directory for the arch. See WithFlatRepositories.
+func WithIndexFlatRepositories(repositories ...string) IndexOption {
+	return func(o *indexOpts) {
+		if o.flatRepositories == nil {
+			o.flatRepositories = map[string]bool{}
+		}
+		for _, repo := range repositories {
+			o.flatRepositories[repo] = true
+		}
+	}
+}
+
+// WithIndexMirrors sets mirrors for the repository with the given URL. See WithMirrors.
+func WithIndexMirrors(repository string, mirrors ...Mirror) IndexOption {
+	return func(o *indexOpts) {
+		if o.mirrors == nil {
+			o.mirrors = map[string][]Mirror{}
+		}
+		o.mirrors[repository] = append(o.mirrors[repository], mirrors...)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PackageInfo is the metadata a package declares about itself in its .PKGINFO, as returned by
+// APK.PackageInfo.
+type PackageInfo struct {
+	Name          string
+	Version       string
+	Arch          string
+	Description   string
+	URL           string
+	License       string
+	Maintainer    string
+	Origin        string
+	Dependencies  []string
+	Provides      []string
+	InstalledSize uint64
+	// Size is the size of the .apk file, as recorded in the repository index.
+	Size uint64
+	// Repository is the URI of the repository the package was resolved from.
+	Repository string
+}
+
+// PackageInfo resolves name against the configured repositories, like it would be for an install,
+// and returns the metadata of the best match. Only the control section of the package is read:
+// it comes from the cache if the package was cached before, and otherwise the download stops once
+// the control section is read, without fetching the package data.
+func (a *APK) PackageInfo(ctx context.Context, name string) (*PackageInfo, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "PackageInfo", trace.WithAttributes(attribute.String("package", name)))
+	defer span.End()
+
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading indexes: %w", err)
+	}
+	pkgs, err := NewPkgResolver(ctx, indexes).ResolvePackage(name)
+	if err != nil {
+		return nil, err
+	}
+	pkg := pkgs[0]
+
+	pkgInfo, err := a.packageControlInfo(ctx, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("reading control section of %s: %w", pkg.Filename(), err)
+	}
+
+	return &PackageInfo{
+		Name:          pkgInfo.Name,
+		Version:       pkgInfo.Version,
+		Arch:          pkgInfo.Arch,
+		Description:   pkgInfo.Description,
+		URL:           pkgInfo.URL,
+		License:       pkgInfo.License,
+		Maintainer:    pkgInfo.Maintainer,
+		Origin:        pkgInfo.Origin,
+		Dependencies:  pkgInfo.Dependencies,
+		Provides:      pkgInfo.Provides,
+		InstalledSize: pkgInfo.InstalledSize,
+		Size:          pkg.Size,
+		Repository:    pkg.Repository().Uri,
+	}, nil
+}
+
+// packageControlInfo returns the .PKGINFO of pkg, from the control section in the cache if there
+// is one, or else from the start of the package download. Either way, the control section is only
+// parsed if it matches the checksum of pkg in the index.
+func (a *APK) packageControlInfo(ctx context.Context, pkg *repository.RepositoryPackage) (*repository.Package, error) {
+	checksum, err := packageChecksum(pkg)
+	if err != nil {
+		return nil, err
+	}
+	if a.cache != nil {
+		cacheDir, err := cacheDirForPackage(a.cache.dir, pkg)
+		if err != nil {
+			return nil, err
+		}
+		ctl, err := a.cachedControlFile(cacheDir, checksum)
+		var control []byte
+		if err == nil {
+			control, err = os.ReadFile(ctl)
+		}
+		if err == nil {
+			err = checkControlChecksum(control, checksum)
+		}
+		if err == nil {
+			a.logger.Debugf("cache hit (%s)", pkg.Name)
+			return parsePkgInfo(bytes.NewReader(control))
+		}
+		a.logger.Debugf("cache miss (%s): %v", pkg.Name, err)
+	}
+
+	rc, err := a.fetchPackage(ctx, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("fetching package %q: %w", pkg.Name, err)
+	}
+	// closing the body before it is read to the end is what keeps the data section from being fetched
+	defer rc.Close()
+
+	control, err := readControlSection(rc)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkControlChecksum(control, checksum); err != nil {
+		return nil, err
+	}
+	return parsePkgInfo(bytes.NewReader(control))
+}
+
+// checkControlChecksum returns an error if control, a control section as it is in a package, does
+// not have the SHA1 checksum from the index.
+func checkControlChecksum(control, checksum []byte) error {
+	sum := sha1.Sum(control) //nolint:gosec // this is what apk tools is using
+	if !bytes.Equal(sum[:], checksum) {
+		return errors.New("control section does not match the checksum in the index")
+	}
+	return nil
+}
+
+// readControlSection reads an .apk package from r up to the end of its control section, and returns
+// the control section as it is in the package, i.e. as a tar.gz. Nothing after it is read.
+func readControlSection(r io.Reader) ([]byte, error) {
+	// a package is a series of gzip streams: the optional signature, the control section and the
+	// data; read them one at a time from a byte reader, so the gzip reader does not read ahead
+	br := bufio.NewReader(r)
+	var section bytes.Buffer
+	gzipReader, err := gzip.NewReader(&teeByteReader{r: br, w: &section})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gzip reader for package: %w", err)
+	}
+	defer gzipReader.Close()
+	gzipReader.Multistream(false)
+
+	first, err := tar.NewReader(gzipReader).Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read first section of package: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, gzipReader); err != nil {
+		return nil, fmt.Errorf("failed to read first section of package: %w", err)
+	}
+	if !strings.HasPrefix(first.Name, ".SIGN.") {
+		// not signed, so the first section is the control section
+		return section.Bytes(), nil
+	}
+
+	section.Reset()
+	if err := gzipReader.Reset(&teeByteReader{r: br, w: &section}); err != nil {
+		return nil, fmt.Errorf("failed to read control section of package: %w", err)
+	}
+	gzipReader.Multistream(false)
+	if _, err := io.Copy(io.Discard, gzipReader); err != nil {
+		return nil, fmt.Errorf("failed to read control section of package: %w", err)
+	}
+	return section.Bytes(), nil
+}
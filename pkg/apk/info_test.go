@@ -0,0 +1,193 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// testByteCountingTransport counts the bytes read from the bodies of the responses of transport
+// to requests for packages.
+type testByteCountingTransport struct {
+	transport http.RoundTripper
+	read      int64
+}
+
+func (t *testByteCountingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	res, err := t.transport.RoundTrip(request)
+	if err != nil || !strings.HasSuffix(request.URL.Path, ".apk") {
+		return res, err
+	}
+	res.Body = &testByteCountingBody{ReadCloser: res.Body, read: &t.read}
+	return res, nil
+}
+
+type testByteCountingBody struct {
+	io.ReadCloser
+	read *int64
+}
+
+func (b *testByteCountingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	*b.read += int64(n)
+	return n, err
+}
+
+func TestPackageInfo(t *testing.T) {
+	ctx := context.Background()
+	apkFile := filepath.Join(testPrimaryPkgDir, "alpine-baselayout-3.2.0-r23.apk")
+	b, err := os.ReadFile(apkFile)
+	require.NoError(t, err)
+	exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+	require.NoError(t, err)
+	defer exp.Close()
+
+	// the package in testdata is not the one the testdata index has the checksum of, so serve an
+	// unsigned copy of the index with the checksum of the package
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, filepath.Base(apkFile)), b, 0o644))
+	index, err := os.Open(filepath.Join(testPrimaryPkgDir, indexFilename))
+	require.NoError(t, err)
+	defer index.Close()
+	gz, err := gzip.NewReader(index)
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if strings.HasPrefix(hdr.Name, ".SIGN.") {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		if hdr.Name == "APKINDEX" {
+			content = []byte(strings.Replace(string(content), "C:Q19UI7UxyiUywG6aew9c3lCBPshsE=\nP:alpine-baselayout\n",
+				"C:Q1"+base64.StdEncoding.EncodeToString(exp.ControlHash)+"\nP:alpine-baselayout\n", 1))
+		}
+		hdr.Size = int64(len(content))
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(root, indexFilename), out.Bytes(), 0o644))
+
+	a := testGetTestAPKWithRepos(t)
+	a.ignoreSignatures = true
+	counter := &testByteCountingTransport{transport: &testLocalTransport{root: root, basenameOnly: true}}
+	a.SetClient(&http.Client{Transport: counter})
+	indexes, err := a.LoadIndexes(ctx)
+	require.NoError(t, err)
+	pkgs, err := NewPkgResolver(ctx, indexes).ResolvePackage("alpine-baselayout")
+	require.NoError(t, err)
+	require.Equal(t, exp.ControlHash, pkgs[0].Checksum)
+
+	info, err := a.PackageInfo(ctx, "alpine-baselayout")
+	require.NoError(t, err)
+	require.Equal(t, "alpine-baselayout", info.Name)
+	require.Equal(t, "3.2.0-r23", info.Version)
+	require.NotEmpty(t, info.Description)
+	require.NotEmpty(t, info.License)
+	require.NotEmpty(t, info.Dependencies)
+	require.NotZero(t, info.InstalledSize)
+	require.Equal(t, pkgs[0].Size, info.Size)
+
+	require.NotZero(t, counter.read)
+	require.Less(t, counter.read, int64(len(b)), "package data should not be read")
+}
+
+func TestReadControlSection(t *testing.T) {
+	pkginfo := "pkgname = unsigned\npkgver = 1.0-r0\npkgdesc = not signed\n"
+	apk := testCreateAPK(t, pkginfo, []testDirEntry{{path: "etc/file", perms: 0o644, content: []byte("data")}})
+
+	control, err := readControlSection(bytes.NewReader(apk))
+	require.NoError(t, err)
+	pkg, err := parsePkgInfo(bytes.NewReader(control))
+	require.NoError(t, err)
+	require.Equal(t, "unsigned", pkg.Name)
+	require.Equal(t, "not signed", pkg.Description)
+}
+
+func TestParsePkgInfoLongLine(t *testing.T) {
+	// longer than the 64 KiB a bufio.Scanner allows by default
+	desc := strings.Repeat("x", 256<<10)
+	pkginfo := "# generated\npkgname = long\npkgver = 1.0-r0\npkgdesc = " + desc + "\nprovides = cmd:long=1.0-r0\nsize = 1024"
+	apk := testCreateAPK(t, pkginfo, []testDirEntry{{path: "etc/file", perms: 0o644, content: []byte("data")}})
+
+	control, err := readControlSection(bytes.NewReader(apk))
+	require.NoError(t, err)
+	pkg, err := parsePkgInfo(bytes.NewReader(control))
+	require.NoError(t, err)
+	require.Equal(t, "long", pkg.Name)
+	require.Equal(t, desc, pkg.Description)
+	require.Equal(t, []string{"cmd:long=1.0-r0"}, pkg.Provides)
+	// the last line has no newline
+	require.Equal(t, uint64(1024), pkg.InstalledSize)
+}
+
+func TestPackageControlInfoChecksum(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	b := testCreateAPK(t, "pkgname = app\npkgver = 1.0.0-r0\n", []testDirEntry{{path: "etc/file", perms: 0o644, content: []byte("data")}})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app-1.0.0-r0.apk"), b, 0o644))
+	exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+	require.NoError(t, err)
+	defer exp.Close()
+
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	repo := repository.Repository{Uri: dir}
+	for _, tt := range []struct {
+		name     string
+		checksum []byte
+		err      string
+	}{
+		{name: "matching", checksum: exp.ControlHash},
+		{name: "other", checksum: make([]byte, len(exp.ControlHash)), err: "does not match the checksum in the index"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg := repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{
+				{Name: "app", Version: "1.0.0-r0", Arch: testArch, Checksum: tt.checksum},
+			}}).Packages()[0]
+			info, err := a.packageControlInfo(ctx, pkg)
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "app", info.Name)
+		})
+	}
+}
@@ -24,7 +24,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"strings"
 
 	"gitlab.alpinelinux.org/alpine/go/repository"
@@ -67,6 +69,218 @@ func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool)
 	return nil
 }
 
+// escapesRoot reports whether the slash-separated path p, relative to the root, refers to
+// something outside of the root once cleaned.
+func escapesRoot(p string) bool {
+	cleaned := path.Clean(p)
+	return cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
+
+// validateHeader checks that the tar entry itself cannot refer to anything outside of the root
+// filesystem. Absolute names and absolute symlink targets are interpreted relative to the root, as
+// they would be inside the installed image, so only ".." components can escape it. Symlinks in the
+// parent directories of the entry are handled by resolveInRoot.
+func validateHeader(header *tar.Header) error {
+	if escapesRoot(header.Name) {
+		return UnsafePathError{Path: header.Name, Reason: "path escapes the root"}
+	}
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		target := header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(header.Name), target)
+		}
+		if escapesRoot(target) {
+			return UnsafePathError{Path: header.Name, Reason: fmt.Sprintf("symlink target %s escapes the root", header.Linkname)}
+		}
+	case tar.TypeLink:
+		if escapesRoot(header.Linkname) {
+			return UnsafePathError{Path: header.Name, Reason: fmt.Sprintf("hardlink target %s escapes the root", header.Linkname)}
+		}
+	}
+	return nil
+}
+
+// resolveInRoot returns the path that name refers to once the symlinks among its parent directories
+// are followed inside the root, rather than by the underlying filesystem, which would resolve absolute
+// targets against the root of the host. The last component of name is not followed. It returns an
+// UnsafePathError if a symlink leads outside of the root. If parents is not nil, the resolved parent
+// directories are remembered in it, by their names, so that the entries of a package that share a
+// parent do not read its links again; it has to be emptied when a symlink is created.
+func (a *APK) resolveInRoot(name string, parents map[string]string) (string, error) {
+	dir, base := path.Split(strings.TrimPrefix(path.Clean("/"+name), "/"))
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		return base, nil
+	}
+	if resolved, ok := parents[dir]; ok {
+		return path.Join(resolved, base), nil
+	}
+	resolved, err := a.resolveParents(name)
+	if err != nil {
+		return "", err
+	}
+	if parents != nil {
+		parents[dir] = path.Dir(resolved)
+	}
+	return resolved, nil
+}
+
+// resolveParents does the work of resolveInRoot, reading every link along the way.
+func (a *APK) resolveParents(name string) (string, error) {
+	var (
+		resolved string
+		links    int
+	)
+	parts := strings.Split(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+	for len(parts) > 1 {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		next := path.Join(resolved, part)
+		// anything that cannot be read as a link, including what does not exist yet, is not one
+		target, err := a.fs.Readlink(next)
+		if err != nil {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", UnsafePathError{Path: name, Reason: "too many levels of symbolic links"}
+		}
+		if path.IsAbs(target) {
+			target = strings.TrimPrefix(path.Clean(target), "/")
+		} else {
+			target = path.Join(resolved, target)
+		}
+		if escapesRoot(target) {
+			return "", UnsafePathError{Path: name, Reason: fmt.Sprintf("parent %s is a symlink to %s, which escapes the root", next, target)}
+		}
+		// start over from the root with the target, followed by whatever was left of name
+		resolved = ""
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return path.Join(resolved, parts[0]), nil
+}
+
+// checkAllowedPath checks that a non-directory tar entry, written to resolved, the path its name
+// resolves to with resolveInRoot, is under one of the allowed paths, if any are set, and so are the
+// targets of links, resolved with parents as for resolveInRoot. Directories are not checked, as the
+// parents of allowed paths have to be created as well.
+func (a *APK) checkAllowedPath(header *tar.Header, resolved string, parents map[string]string) error {
+	if len(a.allowedPaths) == 0 || header.Typeflag == tar.TypeDir {
+		return nil
+	}
+	if !a.isAllowedPath(resolved) {
+		return DisallowedPathError{Path: header.Name}
+	}
+	var target string
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		target = header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(resolved), target)
+		}
+	case tar.TypeLink:
+		target = header.Linkname
+	default:
+		return nil
+	}
+	target, err := a.resolveInRoot(target, parents)
+	if err != nil {
+		return err
+	}
+	if !a.isAllowedPath(target) {
+		return DisallowedPathError{Path: header.Name}
+	}
+	return nil
+}
+
+// isAllowedPath returns whether name is under one of the allowed paths.
+func (a *APK) isAllowedPath(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, allowed := range a.allowedPaths {
+		prefix := strings.TrimPrefix(path.Clean("/"+allowed), "/")
+		if prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mapOwnership applies the uid and gid mapper, if one is set, to the ownership of header.
+func (a *APK) mapOwnership(header *tar.Header) {
+	if a.uidGIDMapper != nil {
+		header.Uid, header.Gid = a.uidGIDMapper(header.Uid, header.Gid)
+	}
+}
+
+// createParentDirs creates the missing parent directories of the tar entry name with mode 0755, and
+// returns the ones it created, parents first.
+func (a *APK) createParentDirs(name string) ([]string, error) {
+	var missing []string
+	for dir := path.Dir(path.Clean(name)); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		_, err := a.fs.Stat(dir)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("error checking parent directory %s of %s: %w", dir, name, err)
+		}
+		missing = append(missing, dir)
+	}
+	created := make([]string, 0, len(missing))
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := a.fs.Mkdir(missing[i], 0o755); err != nil {
+			return nil, fmt.Errorf("error creating parent directory %s of %s: %w", missing[i], name, err)
+		}
+		created = append(created, missing[i])
+	}
+	return created, nil
+}
+
+// entryResolver resolves the entries of a package, in order, to where they are written in the root,
+// for both installAPKFiles and lazilyInstallAPKFiles.
+type entryResolver struct {
+	a *APK
+	// the parent directories of entries resolved so far, see resolveInRoot
+	parents map[string]string
+}
+
+func (a *APK) newEntryResolver() *entryResolver {
+	return &entryResolver{a: a, parents: map[string]string{}}
+}
+
+// resolve validates header, maps its ownership and returns the path that it resolves to in the
+// root, once it is checked to be allowed there.
+func (r *entryResolver) resolve(header *tar.Header) (string, error) {
+	if err := validateHeader(header); err != nil {
+		return "", err
+	}
+	r.a.mapOwnership(header)
+
+	resolved, err := r.a.resolveInRoot(header.Name, r.parents)
+	if err != nil {
+		return "", err
+	}
+	if err := r.a.checkAllowedPath(header, resolved, r.parents); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// resolveLink returns the path that the target of a hardlink resolves to in the root.
+func (r *entryResolver) resolveLink(linkname string) (string, error) {
+	return r.a.resolveInRoot(linkname, r.parents)
+}
+
+// symlinked forgets the resolved parents once a symlink is created, as the new link may be the
+// parent of entries still to come.
+func (r *entryResolver) symlinked() {
+	r.parents = map[string]string{}
+}
+
 // installAPKFiles install the files from the APK and return the list of installed files
 // and their permissions. Returns a tar.Header because it is a convenient existing
 // struct that has all of the fields we need.
@@ -74,7 +288,12 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 	_, span := otel.Tracer("go-apk").Start(ctx, "installAPKFiles")
 	defer span.End()
 
-	var files []tar.Header
+	var (
+		files []tar.Header
+		// directories created because an entry came before them, by resolved name, to their index in files
+		implicitDirs = map[string]int{}
+		entries      = a.newEntryResolver()
+	)
 	tmpDir, err := os.MkdirTemp("", "apk-install")
 	if err != nil {
 		return nil, fmt.Errorf("unable to create temporary directory for unpacking an apk: %w", err)
@@ -104,8 +323,40 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
+		// the entry is recorded under its own name, but written wherever that resolves to in the root
+		name := header.Name
+		resolved, err := entries.resolve(header)
+		if err != nil {
+			return nil, err
+		}
+		if resolved != strings.TrimPrefix(path.Clean("/"+name), "/") {
+			header.Name = resolved
+		}
+
+		// like apk, tolerate entries that come before their parent directory, or whose parent
+		// directory is not in the package at all, by creating the missing parents
+		created, err := a.createParentDirs(resolved)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range created {
+			parent := tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0o755}
+			a.mapOwnership(&parent)
+			implicitDirs[dir] = len(files)
+			files = append(files, parent)
+		}
+
+		implicit, isImplicit := implicitDirs[resolved]
+		isImplicit = isImplicit && header.Typeflag == tar.TypeDir
+
 		switch header.Typeflag {
 		case tar.TypeDir:
+			// a directory that was created as a parent earlier gets its own mode now
+			if isImplicit {
+				if err := a.fs.Chmod(header.Name, header.FileInfo().Mode().Perm()); err != nil {
+					return nil, fmt.Errorf("error setting mode of directory %s: %w", header.Name, err)
+				}
+			}
 			// special case, if the target already exists, and it is a symlink to a directory, we can accept it as is
 			// otherwise, we need to create the directory.
 			if fi, err := a.fs.Stat(header.Name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
@@ -170,47 +421,16 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 			if err := a.writeOneFile(header, r, false); err != nil {
 				// if the error is something other than the file exists, return the error
 				var fileExistsError FileExistsError
-				if !errors.As(err, &fileExistsError) || origin == "" {
+				if !errors.As(err, &fileExistsError) {
 					return nil, err
 				}
-				// if the two files are identical, no need to overwrite, but we will keep the first one
-				// that wrote it, which might be the base system or an earlier package
-				if bytes.Equal(checksum, fileExistsError.Sha1) {
-					continue
-				}
-
-				// they are not identical,
-				// compare the origin of the package that we are installing now, to the origin of the package
-				// that provided the file. If the origins are the same, then we can allow the
-				// overwrite. Otherwise, we need to return an error.
-				installed, err := a.GetInstalled()
+				overwrite, err := checkOverwrite(a.GetInstalled, header.Name, name, origin, replaces, checksum, fileExistsError.Sha1)
 				if err != nil {
-					return nil, fmt.Errorf("unable to get list of installed packages and files: %w", err)
-				}
-				// go through each installed, looking for those that match our origin
-				var found bool
-				for _, pkg := range installed {
-					// if it is not the same origin or isn't a replacement, we are not interested
-					if pkg.Origin != origin && pkg.Name != replaces {
-						continue
-					}
-					// matched the origin (or is a replacement), so look for the file we are installing
-					for _, file := range pkg.Files {
-						if file.Name == header.Name {
-							found = true
-							break
-						}
-					}
-					if found {
-						break
-					}
+					return nil, err
 				}
-				if !found {
-					return nil, fmt.Errorf("unable to install file over existing one, different contents: %s", header.Name)
+				if !overwrite {
+					continue
 				}
-				// it was found in a package with the same origin, so just overwrite
-
-				// if we get here, it had the same origin so even if different, we are allowed to overwrite the file
 				if err := a.writeOneFile(header, r, true); err != nil {
 					return nil, err
 				}
@@ -246,20 +466,64 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, origin, replace
 			if err := a.fs.Symlink(header.Linkname, header.Name); err != nil {
 				return nil, fmt.Errorf("unable to install symlink from %s -> %s: %w", header.Name, header.Linkname, err)
 			}
+			entries.symlinked()
 		case tar.TypeLink:
-			if err := a.fs.Link(header.Linkname, header.Name); err != nil {
+			target, err := entries.resolveLink(header.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			if err := a.fs.Link(target, header.Name); err != nil {
 				return nil, err
 			}
 		default:
 			return nil, fmt.Errorf("unsupported file type %s %v", header.Name, header.Typeflag)
 		}
 
+		header.Name = name
+		if isImplicit {
+			// replace the parent we made up with the entry from the package
+			files[implicit] = *header
+			delete(implicitDirs, resolved)
+			continue
+		}
 		files = append(files, *header)
 	}
 
 	return files, nil
 }
 
+// checkOverwrite decides whether a package with origin, that replaces the package replaces, may
+// install its file name, with checksum, to path, where a file with the checksum existing already is.
+// It returns false if the existing file is identical, so that it is kept, along with its owner, which
+// might be the base system or an earlier package, and true if it belongs to an installed package with
+// the same origin, or to the replaced package, so that it is overwritten. Otherwise, or if the package
+// has no origin at all, it returns an error. installed is only called when the files differ.
+func checkOverwrite(installed func() ([]*InstalledPackage, error), path, name, origin, replaces string, checksum, existing []byte) (bool, error) {
+	if origin == "" {
+		return false, FileExistsError{Path: path, Sha1: existing}
+	}
+	if bytes.Equal(checksum, existing) {
+		return false, nil
+	}
+
+	pkgs, err := installed()
+	if err != nil {
+		return false, fmt.Errorf("unable to get list of installed packages and files: %w", err)
+	}
+	for _, pkg := range pkgs {
+		// if it is not the same origin or isn't a replacement, we are not interested
+		if pkg.Origin != origin && pkg.Name != replaces {
+			continue
+		}
+		for _, file := range pkg.Files {
+			if file.Name == name {
+				return true, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("unable to install file over existing one, different contents: %s", path)
+}
+
 func checksumFromHeader(header *tar.Header) ([]byte, error) {
 	pax := header.PAXRecords
 	if pax == nil {
@@ -300,7 +564,10 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh writeHeaderer, tf *t
 	_, span := otel.Tracer("go-apk").Start(ctx, "lazilyInstallAPKFiles")
 	defer span.End()
 
-	var files []tar.Header
+	var (
+		files   []tar.Header
+		entries = a.newEntryResolver()
+	)
 
 	var startedDataSection bool
 	for _, header := range tf.Entries() {
@@ -315,9 +582,15 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh writeHeaderer, tf *t
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
+		if _, err := entries.resolve(&header.Header); err != nil {
+			return nil, err
+		}
 		if err := wh.WriteHeader(header.Header, tf, pkg); err != nil {
 			return nil, err
 		}
+		if header.Typeflag == tar.TypeSymlink {
+			entries.symlinked()
+		}
 
 		files = append(files, header.Header)
 	}
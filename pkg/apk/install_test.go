@@ -22,10 +22,14 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/internal/tarfs"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
 
 type testDirEntry struct {
@@ -296,6 +300,367 @@ func TestInstallAPKFiles(t *testing.T) {
 	})
 }
 
+func TestInstallAPKFilesUnsafePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  tar.Header
+		wantErr bool
+	}{
+		{"relative file", tar.Header{Name: "etc/foo", Typeflag: tar.TypeReg, Mode: 0o644}, false},
+		{"file with dot-dot inside root", tar.Header{Name: "etc/../etc/foo", Typeflag: tar.TypeReg, Mode: 0o644}, false},
+		{"file escaping root", tar.Header{Name: "etc/../../foo", Typeflag: tar.TypeReg, Mode: 0o644}, true},
+		{"dir escaping root", tar.Header{Name: "../foo", Typeflag: tar.TypeDir, Mode: 0o755}, true},
+		{"relative symlink", tar.Header{Name: "etc/foo", Typeflag: tar.TypeSymlink, Linkname: "../usr/foo"}, false},
+		{"absolute symlink inside root", tar.Header{Name: "etc/foo", Typeflag: tar.TypeSymlink, Linkname: "/usr/foo"}, false},
+		{"absolute symlink to root", tar.Header{Name: "etc/foo", Typeflag: tar.TypeSymlink, Linkname: "/"}, false},
+		{"file through symlink escaping root", tar.Header{Name: "escape/foo", Typeflag: tar.TypeReg, Mode: 0o644}, true},
+		{"symlink escaping root", tar.Header{Name: "etc/foo", Typeflag: tar.TypeSymlink, Linkname: "../../foo"}, true},
+		{"hardlink escaping root", tar.Header{Name: "etc/foo", Typeflag: tar.TypeLink, Linkname: "../foo"}, true},
+	}
+	for _, tt := range tests {
+		// write the crafted entry to a tar, after a directory so the data section has started
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0o755}))
+		header := tt.header
+		require.NoError(t, tw.WriteHeader(&header))
+		require.NoError(t, tw.Close())
+		data := buf.Bytes()
+
+		t.Run(tt.name, func(t *testing.T) {
+			apk, src, err := testGetTestAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			require.NoError(t, src.Symlink("../..", "escape"))
+			_, err = apk.installAPKFiles(context.Background(), bytes.NewReader(data), "", "")
+			if tt.wantErr {
+				require.ErrorIs(t, err, UnsafePathError{})
+				require.ErrorContains(t, err, tt.header.Name)
+			} else if err != nil {
+				require.NotErrorIs(t, err, UnsafePathError{})
+			}
+		})
+		t.Run(tt.name+" lazily", func(t *testing.T) {
+			apk, src, err := testGetTestAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			require.NoError(t, src.Symlink("../..", "escape"))
+			tf, err := tarfs.New(func() (io.ReadSeekCloser, error) {
+				return testReadSeekNopCloser{bytes.NewReader(data)}, nil
+			})
+			require.NoError(t, err)
+			wh := &testWriteHeaderer{}
+			_, err = apk.lazilyInstallAPKFiles(context.Background(), wh, tf, &repository.Package{Name: "test"})
+			if tt.wantErr {
+				require.ErrorIs(t, err, UnsafePathError{})
+				require.NotContains(t, wh.names, tt.header.Name)
+			} else {
+				require.NoError(t, err)
+				require.Contains(t, wh.names, tt.header.Name)
+			}
+		})
+	}
+}
+
+func TestInstallAPKFilesThroughSymlink(t *testing.T) {
+	// a symlink to an absolute path, followed by a file under it, must end up inside the root,
+	// even though the host would resolve the symlink against its own root
+	outside := t.TempDir()
+	root := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside}))
+	content := []byte("root:x:0:0:root:/root:/bin/sh\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "a/passwd", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	apk, err := New(WithFS(apkfs.DirFS(root)), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	headers, err := apk.installAPKFiles(context.Background(), &buf, "", "")
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(outside, "passwd"))
+	require.ErrorIs(t, err, fs.ErrNotExist, "file was written outside of the root")
+	actual, err := os.ReadFile(filepath.Join(root, outside, "passwd"))
+	require.NoError(t, err)
+	require.Equal(t, content, actual)
+
+	// the file is still recorded under the name it has in the package
+	var names []string
+	for _, h := range headers {
+		names = append(names, h.Name)
+	}
+	require.Contains(t, names, "a/passwd")
+}
+
+func TestInstallAPKFilesUnderSymlinkedParent(t *testing.T) {
+	root := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"}))
+	content := []byte("hello")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "lib/foo/file", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "lib/foo", Typeflag: tar.TypeDir, Mode: 0o700}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "lib/hard", Typeflag: tar.TypeLink, Linkname: "lib/foo/file"}))
+	require.NoError(t, tw.Close())
+
+	apk, err := New(WithFS(apkfs.DirFS(root)), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	headers, err := apk.installAPKFiles(context.Background(), &buf, "", "")
+	require.NoError(t, err)
+
+	// the directory created for the file is replaced by the entry of the package
+	modes := map[string]int64{}
+	for _, header := range headers {
+		_, dup := modes[header.Name]
+		require.False(t, dup, "duplicate header for %s", header.Name)
+		modes[header.Name] = header.Mode
+	}
+	require.Equal(t, map[string]int64{
+		"usr":          0o755,
+		"lib":          0,
+		"usr/lib":      0o755,
+		"lib/foo":      0o700,
+		"lib/foo/file": 0o644,
+		"lib/hard":     0,
+	}, modes)
+	fi, err := os.Stat(filepath.Join(root, "usr/lib/foo"))
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+
+	// the hardlink target is resolved through the symlink as well
+	file, err := os.Stat(filepath.Join(root, "usr/lib/foo/file"))
+	require.NoError(t, err)
+	hard, err := os.Stat(filepath.Join(root, "usr/lib/hard"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(file, hard))
+}
+
+func TestInstallAPKFilesAllowedPaths(t *testing.T) {
+	entries := []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"etc/foo", 0o644, false, []byte("hello world"), nil},
+		{"usr/bin/foo", 0o755, false, []byte("hello usr"), nil},
+	}
+	tests := []struct {
+		name    string
+		allowed []string
+		wantErr string
+	}{
+		{"no restriction", nil, ""},
+		{"all allowed", []string{"/usr", "/etc"}, ""},
+		{"root allowed", []string{"/"}, ""},
+		{"nested prefix", []string{"/usr/bin", "etc/"}, ""},
+		{"file outside", []string{"/usr"}, "etc/foo"},
+		{"prefix is not a path component", []string{"/usr/bi", "/etc"}, "usr/bin/foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apk, _, err := testGetTestAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			apk.allowedPaths = tt.allowed
+			_, err = apk.installAPKFiles(context.Background(), testCreateTarForPackage(entries), "", "")
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, DisallowedPathError{})
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestCheckAllowedPathLinks(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, src.MkdirAll("usr", 0o755))
+	require.NoError(t, src.MkdirAll("etc", 0o755))
+	require.NoError(t, src.Symlink("/etc", "usr/etc"))
+	apk.allowedPaths = []string{"/usr"}
+
+	tests := []struct {
+		name    string
+		header  tar.Header
+		wantErr bool
+	}{
+		{"file", tar.Header{Name: "usr/foo", Typeflag: tar.TypeReg}, false},
+		{"file through symlinked parent", tar.Header{Name: "usr/etc/foo", Typeflag: tar.TypeReg}, true},
+		{"symlink inside", tar.Header{Name: "usr/foo", Typeflag: tar.TypeSymlink, Linkname: "bar"}, false},
+		{"relative symlink outside", tar.Header{Name: "usr/foo", Typeflag: tar.TypeSymlink, Linkname: "../etc/passwd"}, true},
+		{"absolute symlink outside", tar.Header{Name: "usr/foo", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, true},
+		{"symlink through symlinked parent", tar.Header{Name: "usr/foo", Typeflag: tar.TypeSymlink, Linkname: "etc/passwd"}, true},
+		{"hardlink inside", tar.Header{Name: "usr/foo", Typeflag: tar.TypeLink, Linkname: "usr/bar"}, false},
+		{"hardlink outside", tar.Header{Name: "usr/foo", Typeflag: tar.TypeLink, Linkname: "etc/passwd"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := apk.resolveInRoot(tt.header.Name, nil)
+			require.NoError(t, err)
+			err = apk.checkAllowedPath(&tt.header, resolved, nil)
+			if tt.wantErr {
+				require.ErrorIs(t, err, DisallowedPathError{})
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestInstallAPKFilesSymlinkedAfterResolving(t *testing.T) {
+	// usr/lib is resolved while checking the target of usr/s, and only then made a link to usr/etc,
+	// which leads out of the allowed paths, so the file under it must be rejected by both paths
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr/s", Typeflag: tar.TypeSymlink, Linkname: "lib/passwd"}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr/lib", Typeflag: tar.TypeSymlink, Linkname: "etc"}))
+	content := []byte("root:x:0:0:root:/root:/bin/sh\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr/lib/passwd", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	data := buf.Bytes()
+
+	setup := func(t *testing.T) (*APK, apkfs.FullFS) {
+		apk, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, src.MkdirAll("usr", 0o755))
+		require.NoError(t, src.Symlink("/etc", "usr/etc"))
+		apk.allowedPaths = []string{"/usr"}
+		return apk, src
+	}
+
+	t.Run("eagerly", func(t *testing.T) {
+		apk, _ := setup(t)
+		_, err := apk.installAPKFiles(context.Background(), bytes.NewReader(data), "", "")
+		require.ErrorIs(t, err, DisallowedPathError{})
+		require.ErrorContains(t, err, "usr/lib/passwd")
+	})
+	t.Run("lazily", func(t *testing.T) {
+		apk, src := setup(t)
+		tf, err := tarfs.New(func() (io.ReadSeekCloser, error) {
+			return testReadSeekNopCloser{bytes.NewReader(data)}, nil
+		})
+		require.NoError(t, err)
+		wh := &testLinkingWriteHeaderer{fs: src}
+		_, err = apk.lazilyInstallAPKFiles(context.Background(), wh, tf, &repository.Package{Name: "test"})
+		require.ErrorIs(t, err, DisallowedPathError{})
+		require.ErrorContains(t, err, "usr/lib/passwd")
+		require.Equal(t, []string{"usr/s", "usr/lib"}, wh.names)
+	})
+}
+
+func TestInstallAPKFilesMissingParents(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	// usr/lib is not in the package at all, usr/lib/foo only comes after its contents
+	entries := []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/lib/foo/file", 0o644, false, []byte("hello"), nil},
+		{"usr/lib/foo", 0o700, true, nil, nil},
+	}
+	headers, err := apk.installAPKFiles(context.Background(), testCreateTarForPackage(entries), "", "")
+	require.NoError(t, err)
+
+	modes := map[string]int64{}
+	for _, header := range headers {
+		_, dup := modes[header.Name]
+		require.False(t, dup, "duplicate header for %s", header.Name)
+		modes[header.Name] = header.Mode
+	}
+	require.Equal(t, map[string]int64{
+		"usr":              0o755,
+		"usr/lib":          0o755,
+		"usr/lib/foo":      0o700,
+		"usr/lib/foo/file": 0o644,
+	}, modes)
+
+	fi, err := src.Stat("usr/lib")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.Equal(t, fs.FileMode(0o755), fi.Mode().Perm())
+	fi, err = src.Stat("usr/lib/foo")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+	content, err := src.ReadFile("usr/lib/foo/file")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+
+	// the directories are recorded, so the file is listed in the installed db
+	var names []string
+	for _, header := range sortTarHeaders(headers) {
+		names = append(names, header.Name)
+	}
+	require.Equal(t, []string{"usr", "usr/lib", "usr/lib/foo", "usr/lib/foo/file"}, names)
+}
+
+func TestInstallAPKFilesUIDGIDMapper(t *testing.T) {
+	a := testGetTestAPKWithRepos(t)
+	a.uidGIDMapper = func(uid, gid int) (int, int) {
+		return uid + 1000, gid + 2000
+	}
+	apk := testCreateAPK(t, "pkgname = localpkg\npkgver = 1.0.0-r0\narch = aarch64\n", []testDirEntry{
+		{path: "usr", perms: 0o755, dir: true},
+		{path: "usr/bin", perms: 0o755, dir: true},
+		{path: "usr/bin/foo", perms: 0o644, content: []byte("hello")},
+	})
+	p := filepath.Join(t.TempDir(), "localpkg.apk")
+	require.NoError(t, os.WriteFile(p, apk, 0o644))
+	// an unsigned local build
+	a.ignoreSignatures = true
+	require.NoError(t, a.InstallFile(context.Background(), p, nil))
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	pkg := installed[len(installed)-1]
+	require.Equal(t, "localpkg", pkg.Name)
+	require.Len(t, pkg.Files, 3)
+	for _, f := range pkg.Files {
+		require.Equal(t, 1000, f.Uid, f.Name)
+		require.Equal(t, 2000, f.Gid, f.Name)
+	}
+
+	b, err := a.readInstalledDB()
+	require.NoError(t, err)
+	require.Contains(t, string(b), "F:usr/bin\nM:1000:2000:0755\nR:foo\na:1000:2000:0644\n")
+}
+
+type testReadSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (testReadSeekNopCloser) Close() error { return nil }
+
+type testWriteHeaderer struct {
+	names []string
+}
+
+func (w *testWriteHeaderer) WriteHeader(hdr tar.Header, _ fs.FS, _ *repository.Package) error {
+	w.names = append(w.names, hdr.Name)
+	return nil
+}
+
+// testLinkingWriteHeaderer creates the symlinks it is given in fs, as the filesystems that install
+// packages lazily do, so that they are followed by the entries after them.
+type testLinkingWriteHeaderer struct {
+	fs    apkfs.FullFS
+	names []string
+}
+
+func (w *testLinkingWriteHeaderer) WriteHeader(hdr tar.Header, _ fs.FS, _ *repository.Package) error {
+	if hdr.Typeflag == tar.TypeSymlink {
+		if err := w.fs.Symlink(hdr.Linkname, hdr.Name); err != nil {
+			return err
+		}
+	}
+	w.names = append(w.names, hdr.Name)
+	return nil
+}
+
 func testCreateTarForPackage(entries []testDirEntry) io.Reader {
 	var buf bytes.Buffer
 	tw := tar.NewWriter(&buf)
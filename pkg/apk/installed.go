@@ -17,12 +17,16 @@ package apk
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
 	"encoding/base64"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -30,6 +34,7 @@ import (
 	"time"
 
 	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
 
 	"gitlab.alpinelinux.org/alpine/go/repository"
 )
@@ -41,27 +46,171 @@ type InstalledPackage struct {
 
 // getInstalledPackages get list of installed packages
 func (a *APK) GetInstalled() ([]*InstalledPackage, error) {
-	installedFile, err := a.fs.Open(installedFilePath)
+	b, err := a.readInstalledDB()
+	if err != nil {
+		return nil, err
+	}
+	return parseInstalled(bytes.NewReader(b))
+}
+
+// gzipMagic is the header every gzip stream starts with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readInstalledDB returns the contents of the installed db, decompressing it if it is gzipped.
+func (a *APK) readInstalledDB() ([]byte, error) {
+	b, err := a.fs.ReadFile(installedFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("could not open installed file in %s at %s: %w", a.fs, installedFilePath, err)
 	}
-	defer installedFile.Close()
-	return parseInstalled(installedFile)
+	if !bytes.HasPrefix(b, gzipMagic) {
+		return b, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("unable to gunzip installed file at %s: %w", installedFilePath, err)
+	}
+	defer gz.Close()
+	b, err = io.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("unable to gunzip installed file at %s: %w", installedFilePath, err)
+	}
+	return b, nil
 }
 
-// addInstalledPackage add a package to the list of installed packages
-func (a *APK) addInstalledPackage(pkg *repository.Package, files []tar.Header) error {
-	// be sure to open the file in append mode so we add to the end
-	installedFile, err := a.fs.OpenFile(installedFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+// writeInstalledDB replaces the contents of the installed db, compressing them if configured to.
+func (a *APK) writeInstalledDB(b []byte) error {
+	if a.compressedInstalledDB {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(b); err != nil {
+			return fmt.Errorf("unable to compress installed file: %w", err)
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("unable to compress installed file: %w", err)
+		}
+		b = buf.Bytes()
+	}
+	// #nosec G306 -- apk db must be publicly readable
+	if err := a.fs.WriteFile(installedFilePath, b, 0o644); err != nil {
+		return fmt.Errorf("could not write installed file at %s: %w", installedFilePath, err)
+	}
+	return nil
+}
+
+// installedDBCompressed reports whether the installed db on disk is gzipped. A missing or empty
+// db is in whatever format we are configured to write.
+func (a *APK) installedDBCompressed() (bool, error) {
+	f, err := a.fs.Open(installedFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return a.compressedInstalledDB, nil
+	}
 	if err != nil {
-		return fmt.Errorf("could not open installed file at %s: %w", installedFilePath, err)
+		return false, fmt.Errorf("could not open installed file at %s: %w", installedFilePath, err)
 	}
-	defer installedFile.Close()
+	defer f.Close()
+	magic := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(f, magic)
+	if n == 0 {
+		return a.compressedInstalledDB, nil
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, fmt.Errorf("could not read installed file at %s: %w", installedFilePath, err)
+	}
+	return bytes.Equal(magic[:n], gzipMagic), nil
+}
+
+// installedIndex returns an index of the given installed packages, so that the resolver can work
+// against what is installed rather than against what is available.
+func installedIndex(installed []*InstalledPackage) NamedIndex {
+	pkgs := make([]*repository.Package, 0, len(installed))
+	for _, pkg := range installed {
+		pkg := pkg.Package
+		pkgs = append(pkgs, &pkg)
+	}
+	// leave the index unnamed, packages from named indexes are only used for pinned world entries
+	repo := repository.Repository{}
+	return NewNamedRepositoryWithIndex("", repo.WithIndex(&repository.ApkIndex{Packages: pkgs}))
+}
 
+// ListOrphans returns the installed packages that are not reachable from world, directly or
+// through dependencies, and so are safe to remove.
+func (a *APK) ListOrphans(ctx context.Context) ([]*InstalledPackage, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ListOrphans")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	return orphans(ctx, installed, world)
+}
+
+// orphans returns the packages in installed that are not reachable from world.
+func orphans(ctx context.Context, installed []*InstalledPackage, world []string) ([]*InstalledPackage, error) {
+	resolver := NewPkgResolver(ctx, []NamedIndex{installedIndex(installed)})
+	reachable, _, err := resolver.GetPackagesWithDependencies(ctx, world)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving world against installed packages: %w", err)
+	}
+
+	keep := make(map[string]*repository.Package, len(reachable))
+	for _, pkg := range reachable {
+		keep[pkg.Name] = pkg.Package
+	}
+	// the resolver only applies install_if within the dependencies of each world entry, but the
+	// conditions can be met by packages coming from different entries, so apply them to the whole set
+	for changed := true; changed; {
+		changed = false
+		for _, pkg := range installed {
+			if _, ok := keep[pkg.Name]; ok || len(pkg.InstallIf) == 0 || !installIfSatisfied(pkg.InstallIf, keep) {
+				continue
+			}
+			deps, _, err := resolver.GetPackagesWithDependencies(ctx, []string{pkg.Name})
+			if err != nil {
+				return nil, fmt.Errorf("error resolving %s against installed packages: %w", pkg.Name, err)
+			}
+			for _, dep := range deps {
+				keep[dep.Name] = dep.Package
+			}
+			changed = true
+		}
+	}
+	var orphans []*InstalledPackage
+	for _, pkg := range installed {
+		if _, ok := keep[pkg.Name]; !ok {
+			orphans = append(orphans, pkg)
+		}
+	}
+	return orphans, nil
+}
+
+// installIfSatisfied reports whether every install_if condition, a package name or name=version,
+// is met by the given packages.
+func installIfSatisfied(installIf []string, pkgs map[string]*repository.Package) bool {
+	for _, cond := range installIf {
+		name, version, pinned := strings.Cut(cond, "=")
+		pkg, ok := pkgs[name]
+		if !ok || (pinned && pkg.Version != version) {
+			return false
+		}
+	}
+	return true
+}
+
+// addInstalledPackage add a package to the list of installed packages
+func (a *APK) addInstalledPackage(pkg *repository.Package, files []tar.Header) error {
 	// sort the files by directory
 	sortedFiles := sortTarHeaders(files)
 	// package lines
 	pkgLines := PackageToIndex(pkg)
+	// apk writes replaces after the index fields and before the file lines
+	if pkg.Replaces != "" {
+		pkgLines = append(pkgLines, fmt.Sprintf("r:%s", pkg.Replaces))
+	}
 	// file lines
 	for _, f := range sortedFiles {
 		perm := f.Mode & 0777
@@ -78,26 +227,90 @@ func (a *APK) addInstalledPackage(pkg *repository.Package, files []tar.Header) e
 			if perm != 0o644 || user != 0 || group != 0 {
 				pkgLines = append(pkgLines, fmt.Sprintf("a:%d:%d:%04o", user, group, perm))
 			}
-			if f.PAXRecords != nil {
-				if checksum := f.PAXRecords[paxRecordsChecksumKey]; checksum != "" {
-					if !strings.HasPrefix(checksum, "Q1") {
-						hexsum, err := hex.DecodeString(checksum)
-						if err != nil {
-							return err
-						}
-						checksum = "Q1" + base64.StdEncoding.EncodeToString(hexsum)
-					}
-					pkgLines = append(pkgLines, fmt.Sprintf("Z:%s", checksum))
-				}
+			checksum, err := headerChecksum(f.PAXRecords)
+			if err != nil {
+				return err
+			}
+			if checksum != "" {
+				pkgLines = append(pkgLines, fmt.Sprintf("Z:%s", checksum))
 			}
 		}
 	}
-	// write to installed file
 	b := []byte(strings.Join(pkgLines, "\n") + "\n\n")
-	if _, err := installedFile.Write(b); err != nil {
+
+	// when the db is not in the format we write, rewrite it whole rather than mixing formats
+	compressed, err := a.installedDBCompressed()
+	if err != nil {
 		return err
 	}
-	return nil
+	if compressed != a.compressedInstalledDB {
+		existing, err := a.readInstalledDB()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return a.writeInstalledDB(append(existing, b...))
+	}
+
+	// be sure to open the file in append mode so we add to the end
+	installedFile, err := a.fs.OpenFile(installedFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open installed file at %s: %w", installedFilePath, err)
+	}
+	defer installedFile.Close()
+
+	// write to installed file; concatenated gzip streams are a valid gzip stream, so a compressed
+	// db can be appended to as well
+	if !a.compressedInstalledDB {
+		if _, err := installedFile.Write(b); err != nil {
+			return err
+		}
+		return installedFile.Close()
+	}
+	gz := gzip.NewWriter(installedFile)
+	if _, err := gz.Write(b); err != nil {
+		return err
+	}
+	// the gzip trailer is only written on close, so a failure here leaves a truncated stream
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("could not finish compressed installed file at %s: %w", installedFilePath, err)
+	}
+	return installedFile.Close()
+}
+
+// InstalledChecksum returns the Q1-prefixed SHA1 checksum of the installed database, in the same
+// encoding apk uses for package and file checksums. Entries are hashed in package name order, so two
+// roots with the same installed packages produce the same checksum regardless of install order.
+func (a *APK) InstalledChecksum() (string, error) {
+	b, err := a.readInstalledDB()
+	if err != nil {
+		return "", err
+	}
+
+	entries := []string{}
+	for _, entry := range strings.Split(string(b), "\n\n") {
+		if entry = strings.Trim(entry, "\n"); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	entryName := func(entry string) string {
+		for _, line := range strings.Split(entry, "\n") {
+			if strings.HasPrefix(line, "P:") {
+				return line[2:]
+			}
+		}
+		return ""
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entryName(entries[i]) < entryName(entries[j])
+	})
+
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	for _, entry := range entries {
+		if _, err := io.WriteString(h, entry+"\n\n"); err != nil {
+			return "", err
+		}
+	}
+	return "Q1" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
 }
 
 // isInstalledPackage check if a specific package is installed
@@ -114,39 +327,30 @@ func (a *APK) isInstalledPackage(pkg string) (bool, error) {
 	return false, nil
 }
 
-// updateScriptsTar insert the scripts into the tarball
-func (a *APK) updateScriptsTar(pkg *repository.Package, controlTarGz io.Reader, sourceDateEpoch *time.Time) error {
+// scriptsTarEntry is a script to be written to scripts.tar.
+type scriptsTarEntry struct {
+	header  *tar.Header
+	content []byte
+}
+
+// packageScripts returns the scripts from the control section of the package,
+// named the way they are stored in scripts.tar.
+func packageScripts(pkg *repository.Package, controlTarGz io.Reader, sourceDateEpoch *time.Time) ([]scriptsTarEntry, error) {
 	gz, err := gzip.NewReader(controlTarGz)
 	if err != nil {
-		return fmt.Errorf("unable to gunzip control tar.gz file: %w", err)
+		return nil, fmt.Errorf("unable to gunzip control tar.gz file: %w", err)
 	}
 	defer gz.Close()
 	tr := tar.NewReader(gz)
-	fi, err := a.fs.Stat(scriptsFilePath)
-	if err != nil {
-		return fmt.Errorf("unable to stat scripts file: %w", err)
-	}
-	scripts, err := a.fs.OpenFile(scriptsFilePath, os.O_RDWR, 0)
-	if err != nil {
-		return fmt.Errorf("unable to open scripts file %s: %w", scriptsFilePath, err)
-	}
-	// only need to rewind if the file has tar in it
-	if fi.Size() >= 1024 {
-		if _, err = scripts.Seek(-1024, io.SeekEnd); err != nil {
-			return fmt.Errorf("could not seek to end of tar file: %w", err)
-		}
-	}
 
-	defer scripts.Close()
-	tw := tar.NewWriter(scripts)
-	defer tw.Close()
+	var entries []scriptsTarEntry
 	for {
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// ignore .PKGINFO as it is not a script
@@ -155,7 +359,7 @@ func (a *APK) updateScriptsTar(pkg *repository.Package, controlTarGz io.Reader,
 		}
 
 		origName := header.Name
-		header.Name = fmt.Sprintf("%s-%s.Q1%s%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum), origName)
+		header.Name = scriptsTarPrefix(pkg) + origName
 
 		// zero out timestamps for reproducibility
 		if sourceDateEpoch != nil {
@@ -167,21 +371,127 @@ func (a *APK) updateScriptsTar(pkg *repository.Package, controlTarGz io.Reader,
 			header.ChangeTime = time.Time{}
 		}
 
-		if err := tw.WriteHeader(header); err != nil {
-			return fmt.Errorf("unable to write scripts header for %s: %w", header.Name, err)
+		content := make([]byte, header.Size)
+		if _, err := io.ReadFull(tr, content); err != nil {
+			return nil, fmt.Errorf("unable to read content for %s: %w", header.Name, err)
+		}
+		entries = append(entries, scriptsTarEntry{header: header, content: content})
+	}
+	return entries, nil
+}
+
+// appendScriptsTar adds the entries to scripts.tar. Rather than appending in place, which
+// depends on correctly finding and overwriting the tar trailer, it reads the existing entries
+// and writes the whole archive again, so the result is always a single valid tar.
+func (a *APK) appendScriptsTar(entries []scriptsTarEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	existing, err := a.readScriptsTarEntries()
+	if err != nil {
+		return err
+	}
+
+	return a.writeScriptsTar(append(existing, entries...))
+}
+
+// writeScriptsTar replaces the contents of scripts.tar with the given entries.
+func (a *APK) writeScriptsTar(entries []scriptsTarEntry) error {
+	scripts, err := a.fs.OpenFile(scriptsFilePath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open scripts file %s: %w", scriptsFilePath, err)
+	}
+	defer scripts.Close()
+
+	tw := tar.NewWriter(scripts)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(entry.header); err != nil {
+			return fmt.Errorf("unable to write scripts header for %s: %w", entry.header.Name, err)
+		}
+		if _, err := tw.Write(entry.content); err != nil {
+			return fmt.Errorf("unable to write content for %s: %w", entry.header.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("unable to close scripts file %s: %w", scriptsFilePath, err)
+	}
+	return nil
+}
+
+// ValidateScriptsTar checks that scripts.tar is a well-formed tar archive, whose entries are
+// all regular files named for an installed package, as apk expects, and that no entry is duplicated.
+func (a *APK) ValidateScriptsTar() error {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	prefixes := make(map[string]bool, len(installed))
+	for _, pkg := range installed {
+		prefixes[scriptsTarPrefix(&pkg.Package)] = true
+	}
+
+	entries, err := a.readScriptsTarEntries()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		name := entry.header.Name
+		if entry.header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("invalid entry %s in %s: not a regular file", name, scriptsFilePath)
 		}
-		if _, err := io.CopyN(tw, tr, header.Size); err != nil {
-			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		if seen[name] {
+			return fmt.Errorf("invalid entry %s in %s: duplicate entry", name, scriptsFilePath)
+		}
+		seen[name] = true
+		i := strings.LastIndex(name, ".")
+		if i <= 0 || !prefixes[name[:i]] {
+			return fmt.Errorf("invalid entry %s in %s: does not belong to an installed package", name, scriptsFilePath)
 		}
 	}
 	return nil
 }
 
+// scriptsTarPrefix returns the prefix of the names of the scripts of pkg in scripts.tar.
+func scriptsTarPrefix(pkg *repository.Package) string {
+	return fmt.Sprintf("%s-%s.Q1%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum))
+}
+
+// readScriptsTarEntries returns the entries currently in scripts.tar.
+func (a *APK) readScriptsTarEntries() ([]scriptsTarEntry, error) {
+	scripts, err := a.readScriptsTar()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open scripts file %s: %w", scriptsFilePath, err)
+	}
+	defer scripts.Close()
+
+	var entries []scriptsTarEntry
+	tr := tar.NewReader(scripts)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read scripts file %s: %w", scriptsFilePath, err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read content for %s: %w", header.Name, err)
+		}
+		entries = append(entries, scriptsTarEntry{header: header, content: content})
+	}
+	return entries, nil
+}
+
 // readScriptsTar returns a reader for the current scripts.tar. It is up to the caller to close it.
 func (a *APK) readScriptsTar() (io.ReadCloser, error) {
 	return a.fs.Open(scriptsFilePath)
 }
 
+// controlValue returns every value of the key want in the .PKGINFO of controlTarGz. The control
+// section is streamed, and nothing after .PKGINFO is read.
 // TODO: We should probably parse control section on the first pass and reuse it.
 func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error) {
 	gz, err := gzip.NewReader(controlTarGz)
@@ -206,23 +516,16 @@ func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error
 			continue
 		}
 
-		b, err := io.ReadAll(tr)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read .PKGINFO from control tar.gz file: %w", err)
-		}
-		lines := strings.Split(string(b), "\n")
-		for _, line := range lines {
-			parts := strings.Split(line, "=")
-			if len(parts) != 2 {
-				continue
-			}
-			key := strings.TrimSpace(parts[0])
-			if key != want {
-				continue
+		if err := readPkgInfoLines(tr, func(line []byte) error {
+			if bytes.Count(line, []byte("=")) == 1 {
+				key, value, _ := bytes.Cut(line, []byte("="))
+				if string(bytes.TrimSpace(key)) == want {
+					values = append(values, string(bytes.TrimSpace(value)))
+				}
 			}
-
-			value := strings.TrimSpace(parts[1])
-			values = append(values, value)
+			return nil
+		}); err != nil {
+			return nil, err
 		}
 
 		break
@@ -231,28 +534,167 @@ func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error
 	return values, nil
 }
 
-// updateTriggers insert the triggers into the triggers file
-func (a *APK) updateTriggers(pkg *repository.Package, controlTarGz io.Reader) error {
-	triggers, err := a.fs.OpenFile(triggersFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0)
-	if err != nil {
-		return fmt.Errorf("unable to open triggers file %s: %w", triggersFilePath, err)
+// readPkgInfoLines calls fn with each line of the .PKGINFO read from r, without its line ending,
+// and returns the first error fn returns. It reads a line at a time, so a large control section is
+// not held in memory; unlike a bufio.Scanner, there is no limit on the length of a line, those longer
+// than the buffer are put together. line is only valid until fn returns.
+func readPkgInfoLines(r io.Reader, fn func(line []byte) error) error {
+	var (
+		br   = bufio.NewReader(r)
+		long []byte
+	)
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			long = append(long, line...)
+			continue
+		}
+		if len(long) > 0 {
+			long = append(long, line...)
+			line, long = long, long[:0]
+		}
+		if len(line) > 0 {
+			if err := fn(bytes.TrimRight(line, "\r\n")); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read .PKGINFO from control tar.gz file: %w", err)
+		}
 	}
-	defer triggers.Close()
+}
 
+// packageTriggers returns the trigger paths from the control section of the package.
+func (a *APK) packageTriggers(controlTarGz io.Reader) ([]string, error) {
 	values, err := a.controlValue(controlTarGz, "triggers")
 	if err != nil {
-		return fmt.Errorf("updating triggers for %s: %w", pkg.Name, err)
+		return nil, err
 	}
-
+	var paths []string
 	for _, value := range values {
-		if _, err := triggers.Write([]byte(fmt.Sprintf("%s %s\n", base64.StdEncoding.EncodeToString(pkg.Checksum), value))); err != nil {
-			return fmt.Errorf("unable to write triggers file %s: %w", triggersFilePath, err)
-		}
+		paths = append(paths, strings.Fields(value)...)
+	}
+	return paths, nil
+}
+
+// addTriggers adds the trigger paths of pkg to the triggers file.
+// The file has one line per package, with the checksum of the package in the same Q1 format as
+// the installed db, followed by the trigger paths. The file is rewritten as a whole, so that
+// triggers of a package that is added again are merged into its existing line, without duplicates.
+func (a *APK) addTriggers(pkg *repository.Package, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	keys, triggers, err := a.readTriggersEntries()
+	if err != nil {
+		return err
 	}
+	key := "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)
+	if _, ok := triggers[key]; !ok {
+		keys = append(keys, key)
+	}
+	triggers[key] = uniqify(append(triggers[key], paths...))
+	return a.writeTriggers(keys, triggers)
+}
 
+// writeTriggers replaces the contents of the triggers file, with one line per key in the given order.
+func (a *APK) writeTriggers(keys []string, triggers map[string][]string) error {
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s %s\n", k, strings.Join(triggers[k], " "))
+	}
+	// #nosec G306 -- apk db must be publicly readable
+	if err := a.fs.WriteFile(triggersFilePath, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("unable to write triggers file %s: %w", triggersFilePath, err)
+	}
 	return nil
 }
 
+// readTriggersEntries returns the package checksums in the triggers file, in order, and their
+// trigger paths. Checksums written without the Q1 prefix by earlier versions are normalized.
+func (a *APK) readTriggersEntries() ([]string, map[string][]string, error) {
+	triggers := map[string][]string{}
+	f, err := a.readTriggers()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, triggers, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open triggers file %s: %w", triggersFilePath, err)
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		key := fields[0]
+		if !strings.HasPrefix(key, "Q1") {
+			key = "Q1" + key
+		}
+		if _, ok := triggers[key]; !ok {
+			keys = append(keys, key)
+		}
+		triggers[key] = uniqify(append(triggers[key], fields[1:]...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("unable to read triggers file %s: %w", triggersFilePath, err)
+	}
+	return keys, triggers, nil
+}
+
+// MatchTriggers returns the triggers of installed packages that fire for the given changed paths,
+// so that callers can run them in their own way. A trigger fires when the directory containing a
+// changed path, or the path itself, matches one of the globs of the package. The result is keyed by
+// package name; the value is the command to run: the name of the package's trigger script in
+// scripts.tar, followed by the matched directories as arguments, as apk passes them.
+func (a *APK) MatchTriggers(paths []string) (map[string][]string, error) {
+	keys, triggers, err := a.readTriggersEntries()
+	if err != nil {
+		return nil, err
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get installed packages: %w", err)
+	}
+	byChecksum := make(map[string]*repository.Package, len(installed))
+	for _, pkg := range installed {
+		byChecksum["Q1"+base64.StdEncoding.EncodeToString(pkg.Checksum)] = &pkg.Package
+	}
+
+	matches := map[string][]string{}
+	for _, key := range keys {
+		pkg, ok := byChecksum[key]
+		if !ok {
+			continue
+		}
+		var dirs []string
+		for _, p := range paths {
+			p = path.Clean("/" + p)
+			for _, candidate := range []string{path.Dir(p), p} {
+				for _, glob := range triggers[key] {
+					if ok, err := path.Match(glob, candidate); err == nil && ok {
+						dirs = append(dirs, candidate)
+					}
+				}
+			}
+		}
+		if len(dirs) == 0 {
+			continue
+		}
+		dirs = uniqify(dirs)
+		sort.Strings(dirs)
+		matches[pkg.Name] = append([]string{scriptsTarPrefix(pkg) + ".trigger"}, dirs...)
+	}
+	return matches, nil
+}
+
 // readTriggers returns a reader for the current triggers. It is up to the caller to close it.
 func (a *APK) readTriggers() (io.ReadCloser, error) {
 	return a.fs.Open(triggersFilePath)
@@ -292,69 +734,13 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 		val := line[2:]
 
 		switch token {
-		case "P":
-			pkg.Name = val
-		case "V":
-			pkg.Version = val
-		case "A":
-			pkg.Arch = val
-		case "L":
-			pkg.License = val
-		case "T":
-			pkg.Description = val
-		case "o":
-			pkg.Origin = val
-		case "m":
-			pkg.Maintainer = val
-		case "U":
-			pkg.URL = val
-		case "D":
-			pkg.Dependencies = strings.Split(val, " ")
-		case "p":
-			pkg.Provides = strings.Split(val, " ")
-		case "c":
-			pkg.RepoCommit = val
-		case "t":
-			i, err := strconv.ParseInt(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse build time %s: %w", val, err)
-			}
-			pkg.BuildTime = time.Unix(i, 0).UTC()
-		case "i":
-			pkg.InstallIf = strings.Split(val, " ")
-		case "S":
-			size, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse size field %s: %w", val, err)
-			}
-			pkg.Size = size
-		case "I":
-			installedSize, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse installed size field %s: %w", val, err)
-			}
-			pkg.InstalledSize = installedSize
-		case "k":
-			priority, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
-			}
-			pkg.ProviderPriority = priority
-		case "C":
-			// Handle SHA1 checksums:
-			if strings.HasPrefix(val, "Q1") {
-				checksum, err := base64.StdEncoding.DecodeString(val[2:])
-				if err != nil {
-					return nil, err
-				}
-				pkg.Checksum = checksum
-			}
 		case "F":
 			lastDir = &tar.Header{
-				Name: val,
-				Mode: 0o755,
-				Uid:  0,
-				Gid:  0,
+				Name:     val,
+				Typeflag: tar.TypeDir,
+				Mode:     0o755,
+				Uid:      0,
+				Gid:      0,
 			}
 			pkg.Files = append(pkg.Files, lastDir)
 			lastFile = nil
@@ -376,12 +762,19 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 				fullpath, _ = sanitizeArchivePath(lastDir.Name, val)
 			}
 			lastFile = &tar.Header{
-				Name: fullpath,
-				Mode: 0o644,
-				Uid:  0,
-				Gid:  0,
+				Name:     fullpath,
+				Typeflag: tar.TypeReg,
+				Mode:     0o644,
+				Uid:      0,
+				Gid:      0,
 			}
 			pkg.Files = append(pkg.Files, lastFile)
+		case "Z":
+			// checksum of the last file
+			if lastFile == nil {
+				return nil, fmt.Errorf("cannot parse line %d: no file specified when setting checksum", linenr)
+			}
+			lastFile.PAXRecords = map[string]string{paxRecordsChecksumKey: val}
 		case "a":
 			// file perms if not 0o644
 			if lastFile == nil {
@@ -394,6 +787,10 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			lastFile.Uid = uid
 			lastFile.Gid = gid
 			lastFile.Mode = perms
+		default:
+			if err := parsePackageField(&pkg.Package, token, val); err != nil {
+				return nil, err
+			}
 		}
 
 		linenr++
@@ -402,6 +799,73 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 	return packages, nil
 }
 
+// parsePackageField sets the field of pkg for token, one of the single letter keys of a package
+// record in an index or in the installed db, to val. Unknown tokens are ignored.
+func parsePackageField(pkg *repository.Package, token, val string) error {
+	switch token {
+	case "P":
+		pkg.Name = val
+	case "V":
+		pkg.Version = val
+	case "A":
+		pkg.Arch = val
+	case "L":
+		pkg.License = val
+	case "T":
+		pkg.Description = val
+	case "o":
+		pkg.Origin = val
+	case "m":
+		pkg.Maintainer = val
+	case "U":
+		pkg.URL = val
+	case "D":
+		pkg.Dependencies = strings.Split(val, " ")
+	case "p":
+		pkg.Provides = strings.Split(val, " ")
+	case "c":
+		pkg.RepoCommit = val
+	case "r":
+		pkg.Replaces = val
+	case "t":
+		i, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse build time %s: %w", val, err)
+		}
+		pkg.BuildTime = time.Unix(i, 0).UTC()
+	case "i":
+		pkg.InstallIf = strings.Split(val, " ")
+	case "S":
+		size, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse size field %s: %w", val, err)
+		}
+		pkg.Size = size
+	case "I":
+		installedSize, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse installed size field %s: %w", val, err)
+		}
+		pkg.InstalledSize = installedSize
+	case "k":
+		priority, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
+		}
+		pkg.ProviderPriority = priority
+	case "C":
+		// Handle SHA1 checksums:
+		if strings.HasPrefix(val, "Q1") {
+			checksum, err := base64.StdEncoding.DecodeString(val[2:])
+			if err != nil {
+				return err
+			}
+			pkg.Checksum = checksum
+		}
+	}
+	return nil
+}
+
 func parseInstalledPerms(permString string) (uid, gid int, perms int64, err error) {
 	permParts := strings.Split(permString, ":")
 	if len(permParts) != 3 {
@@ -19,11 +19,14 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -105,6 +108,110 @@ func TestAddInstalledPackage(t *testing.T) {
 	require.Contains(t, str, want)
 }
 
+// TestPackageToIndexGolden checks that the metadata lines we emit for each package match, byte for byte,
+// the entries apk-tools itself wrote to testdata/root/lib/apk/db/installed.
+func TestPackageToIndexGolden(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	golden, err := a.fs.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	pkgs, err := a.GetInstalled()
+	require.NoError(t, err)
+
+	entries := strings.Split(strings.TrimSpace(string(golden)), "\n\n")
+	require.Len(t, entries, len(pkgs))
+	for i, entry := range entries {
+		var want []string
+		for _, line := range strings.Split(entry, "\n") {
+			if strings.HasPrefix(line, "F:") || strings.HasPrefix(line, "R:") {
+				break
+			}
+			want = append(want, line)
+		}
+		got := PackageToIndex(&pkgs[i].Package)
+		if pkgs[i].Replaces != "" {
+			got = append(got, fmt.Sprintf("r:%s", pkgs[i].Replaces))
+		}
+		require.Equal(t, want, got, "package %s", pkgs[i].Name)
+	}
+}
+
+func TestAddInstalledPackageCommitAndBuildTime(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		pkg  *repository.Package
+		want []string
+		skip []string
+	}{{
+		name: "present",
+		pkg: &repository.Package{
+			Name:       "withmeta",
+			Version:    "1.0.0",
+			BuildTime:  time.Unix(1655134784, 0),
+			RepoCommit: "cb70ca5c6d6db0399d2dd09189c5d57827bce5cd",
+		},
+		want: []string{"t:1655134784", "c:cb70ca5c6d6db0399d2dd09189c5d57827bce5cd"},
+	}, {
+		name: "absent",
+		pkg:  &repository.Package{Name: "withoutmeta", Version: "1.0.0"},
+		skip: []string{"t:", "c:"},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _, err := testGetTestAPK()
+			require.NoError(t, err)
+			require.NoError(t, a.fs.WriteFile(installedFilePath, nil, 0o644))
+			require.NoError(t, a.addInstalledPackage(tt.pkg, nil))
+
+			b, err := a.fs.ReadFile(installedFilePath)
+			require.NoError(t, err)
+			lines := strings.Split(string(b), "\n")
+			for _, w := range tt.want {
+				require.Contains(t, lines, w)
+			}
+			for _, line := range lines {
+				for _, prefix := range tt.skip {
+					require.False(t, strings.HasPrefix(line, prefix), "unexpected line %q", line)
+				}
+			}
+
+			pkgs, err := a.GetInstalled()
+			require.NoError(t, err)
+			require.Len(t, pkgs, 1)
+			require.Equal(t, tt.pkg.RepoCommit, pkgs[0].RepoCommit)
+			require.Equal(t, tt.pkg.BuildTime.IsZero(), pkgs[0].BuildTime.IsZero())
+		})
+	}
+}
+
+func TestInstalledChecksum(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	orig, err := a.fs.ReadFile(installedFilePath)
+	require.NoError(t, err)
+
+	sum, err := a.InstalledChecksum()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(sum, "Q1"), "checksum %s should be Q1-prefixed", sum)
+
+	again, err := a.InstalledChecksum()
+	require.NoError(t, err)
+	require.Equal(t, sum, again)
+
+	// reordering entries does not change the checksum
+	entries := strings.Split(strings.TrimSpace(string(orig)), "\n\n")
+	entries[0], entries[len(entries)-1] = entries[len(entries)-1], entries[0]
+	require.NoError(t, a.fs.WriteFile(installedFilePath, []byte(strings.Join(entries, "\n\n")+"\n\n"), 0o644))
+	reordered, err := a.InstalledChecksum()
+	require.NoError(t, err)
+	require.Equal(t, sum, reordered)
+
+	// adding a package does
+	require.NoError(t, a.addInstalledPackage(&repository.Package{Name: "newpkg", Version: "1.0.0"}, nil))
+	changed, err := a.InstalledChecksum()
+	require.NoError(t, err)
+	require.NotEqual(t, sum, changed)
+}
+
 func TestIsInstalledPackage(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
@@ -125,7 +232,7 @@ func TestIsInstalledPackage(t *testing.T) {
 	}
 }
 
-func TestUpdateScriptsTar(t *testing.T) {
+func TestRecordScripts(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoError(t, err, "unable to initialize APK implementation")
 	// create the pkg
@@ -166,9 +273,10 @@ func TestUpdateScriptsTar(t *testing.T) {
 	tw.Close()
 	gw.Close()
 
-	// pass the controltargz to updateScriptsTar
-	r := bytes.NewReader(buf.Bytes())
-	err = a.updateScriptsTar(pkg, r, nil)
+	// read the scripts from the controltargz and record them, as installing does
+	entries, err := packageScripts(pkg, bytes.NewReader(buf.Bytes()), nil)
+	require.NoError(t, err, "unable to read scripts")
+	err = a.recordHooks([]packageHooks{{pkg: pkg, scripts: entries}})
 	require.NoErrorf(t, err, "unable to update scripts tar: %v", err)
 	expected := map[string][]byte{}
 	for k, v := range scripts {
@@ -207,7 +315,88 @@ func TestUpdateScriptsTar(t *testing.T) {
 	}
 }
 
-func TestUpdateTriggers(t *testing.T) {
+func TestAppendScriptsTar(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+
+	controlTarGz := func(scripts map[string]string) io.Reader {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for name, content := range scripts {
+			_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))})
+			_, _ = tw.Write([]byte(content))
+		}
+		tw.Close()
+		gw.Close()
+		return &buf
+	}
+
+	initial, err := a.readScriptsTarEntries()
+	require.NoError(t, err)
+
+	// scripts of several packages, written in separate calls and in a single one
+	var want []string
+	var batch []scriptsTarEntry
+	for i := 0; i < 4; i++ {
+		pkg := &repository.Package{Name: fmt.Sprintf("pkg%d", i), Version: "1.0.0", Checksum: []byte{byte(i)}}
+		entries, err := packageScripts(pkg, controlTarGz(map[string]string{
+			".PKGINFO":      "pkgname = " + pkg.Name,
+			".post-install": "echo " + pkg.Name,
+		}), nil)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		want = append(want, entries[0].header.Name)
+		if i < 2 {
+			require.NoError(t, a.appendScriptsTar(entries))
+		} else {
+			batch = append(batch, entries...)
+		}
+	}
+	require.NoError(t, a.appendScriptsTar(batch))
+
+	// the result is a single valid archive with the initial entries, followed by the new ones in order
+	entries, err := a.readScriptsTarEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, len(initial)+len(want))
+	var got []string
+	for _, entry := range entries[len(initial):] {
+		got = append(got, entry.header.Name)
+	}
+	require.Equal(t, want, got)
+}
+
+func TestValidateScriptsTar(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	require.NoError(t, a.ValidateScriptsTar(), "test root should be valid")
+
+	pkg := &repository.Package{Name: "testpkg", Version: "1.0.0", Checksum: []byte("checksum")}
+	script := scriptsTarEntry{
+		header:  &tar.Header{Name: scriptsTarPrefix(pkg) + ".post-install", Typeflag: tar.TypeReg, Mode: 0o755, Size: 4},
+		content: []byte("true"),
+	}
+	require.NoError(t, a.appendScriptsTar([]scriptsTarEntry{script}))
+	require.ErrorContains(t, a.ValidateScriptsTar(), "does not belong to an installed package")
+
+	// installing only validates with WithValidateScriptsTar
+	require.NoError(t, a.recordHooks(nil))
+	a.validateScriptsTar = true
+	require.ErrorContains(t, a.recordHooks(nil), "does not belong to an installed package")
+	a.validateScriptsTar = false
+
+	require.NoError(t, a.addInstalledPackage(pkg, nil))
+	require.NoError(t, a.ValidateScriptsTar())
+
+	require.NoError(t, a.appendScriptsTar([]scriptsTarEntry{script}))
+	require.ErrorContains(t, a.ValidateScriptsTar(), "duplicate entry")
+
+	// not a tar at all
+	require.NoError(t, a.fs.WriteFile(scriptsFilePath, bytes.Repeat([]byte("garbage"), 200), 0o644))
+	require.Error(t, a.ValidateScriptsTar())
+}
+
+func TestRecordTriggers(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoError(t, err, "unable to initialize APK implementation")
 	// create the pkg
@@ -248,16 +437,17 @@ func TestUpdateTriggers(t *testing.T) {
 	tw.Close()
 	gw.Close()
 
-	// pass the controltargz to updateScriptsTar
-	r := bytes.NewReader(buf.Bytes())
-	err = a.updateTriggers(pkg, r)
+	// read the triggers from the controltargz and record them, as installing does
+	paths, err := a.packageTriggers(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err, "unable to read triggers")
+	err = a.recordHooks([]packageHooks{{pkg: pkg, triggers: paths}})
 	require.NoError(t, err, "unable to update triggers: %v", err)
 
 	// successfully wrote it; not check that it was written correctly
 	readTriggers, err := a.readTriggers()
 	require.NoError(t, err, "unable to read triggers: %v", err)
 	defer readTriggers.Close()
-	cksum := base64.StdEncoding.EncodeToString(pkg.Checksum)
+	cksum := "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)
 	// read every line in triggers, looking for one with our comment
 	scanner := bufio.NewScanner(readTriggers)
 	for scanner.Scan() {
@@ -309,3 +499,305 @@ func TestSortTarHeaders(t *testing.T) {
 		assert.Equal(t, expected[i], header.Name, "position %d: expected %s, got %s", i, expected[i], header.Name)
 	}
 }
+
+func TestInstalledEntryReproducible(t *testing.T) {
+	entries := []testDirEntry{
+		{path: "usr", perms: 0o755, dir: true},
+		{path: "usr/bin", perms: 0o755, dir: true},
+		{path: "usr/share", perms: 0o755, dir: true},
+		{path: "usr/share/localpkg", perms: 0o700, dir: true},
+		{path: "usr/bin/b", perms: 0o755, content: []byte("b")},
+		{path: "usr/bin/a", perms: 0o755, content: []byte("a")},
+		{path: "usr/share/localpkg/hello", perms: 0o600, content: []byte("hello")},
+	}
+	// same package, with the tarball listing its contents in a different order
+	shuffled := []testDirEntry{entries[0], entries[2], entries[3], entries[6], entries[1], entries[4], entries[5]}
+
+	install := func(entries []testDirEntry) string {
+		a := testGetTestAPKWithRepos(t)
+		apk := testCreateAPK(t, "pkgname = localpkg\npkgver = 1.0.0-r0\narch = aarch64\n", entries)
+		p := filepath.Join(t.TempDir(), "localpkg.apk")
+		require.NoError(t, os.WriteFile(p, apk, 0o644))
+		// an unsigned local build
+		a.ignoreSignatures = true
+		require.NoError(t, a.InstallFile(context.Background(), p, nil))
+
+		b, err := a.readInstalledDB()
+		require.NoError(t, err)
+		for _, entry := range strings.Split(string(b), "\n\n") {
+			if strings.Contains(entry, "\nP:localpkg\n") || strings.HasPrefix(entry, "P:localpkg\n") {
+				return entry
+			}
+		}
+		t.Fatalf("no installed db entry for localpkg")
+		return ""
+	}
+
+	first := install(entries)
+	require.Equal(t, first, install(entries))
+	// the archive differs, and so does its size, but the file lines must not
+	fileLines := func(entry string) string {
+		return entry[strings.Index(entry, "\nF:"):]
+	}
+	require.Equal(t, fileLines(first), fileLines(install(shuffled)))
+	require.Contains(t, first, "F:usr\nF:usr/bin\nR:a\n")
+	require.Contains(t, first, "F:usr/share/localpkg\nM:0:0:0700\nR:hello\na:0:0:0600\n")
+}
+
+func TestRecordTriggersMultiplePackages(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+
+	controlTarGz := func(triggers ...string) io.Reader {
+		lines := []string{"pkgname = test"}
+		for _, trigger := range triggers {
+			lines = append(lines, "triggers = "+trigger)
+		}
+		pkginfo := strings.Join(lines, "\n")
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		_ = tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Mode: 0o644, Size: int64(len(pkginfo))})
+		_, _ = tw.Write([]byte(pkginfo))
+		tw.Close()
+		gw.Close()
+		return &buf
+	}
+
+	hooks := func(pkg *repository.Package, triggers ...string) packageHooks {
+		paths, err := a.packageTriggers(controlTarGz(triggers...))
+		require.NoError(t, err)
+		return packageHooks{pkg: pkg, triggers: paths}
+	}
+
+	first := &repository.Package{Name: "first", Checksum: []byte("first-checksum")}
+	second := &repository.Package{Name: "second", Checksum: []byte("second-checksum")}
+	none := &repository.Package{Name: "none", Checksum: []byte("none-checksum")}
+	require.NoError(t, a.recordHooks([]packageHooks{
+		hooks(first, "/usr/bin /usr/lib/*"),
+		hooks(second, "/usr/lib/* /usr/share/*", "/usr/share/* /etc"),
+		hooks(none),
+	}))
+	// adding triggers for a package again merges them
+	require.NoError(t, a.recordHooks([]packageHooks{hooks(first, "/usr/bin /usr/sbin")}))
+
+	readTriggers := func() string {
+		f, err := a.readTriggers()
+		require.NoError(t, err)
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		require.NoError(t, err)
+		return string(b)
+	}
+	require.Equal(t, strings.Join([]string{
+		"Q1Meo+LHGPSi3uY9gIouEVb9z8Fbo= /bin /usr/bin /sbin /usr/sbin /lib/modules/*",
+		"Q1" + base64.StdEncoding.EncodeToString(first.Checksum) + " /usr/bin /usr/lib/* /usr/sbin",
+		"Q1" + base64.StdEncoding.EncodeToString(second.Checksum) + " /usr/lib/* /usr/share/* /etc",
+	}, "\n")+"\n", readTriggers())
+
+	// removing a package finds its triggers by the same Q1 key
+	require.NoError(t, a.removePackages([]*InstalledPackage{{Package: *first}}, nil))
+	require.Equal(t, strings.Join([]string{
+		"Q1Meo+LHGPSi3uY9gIouEVb9z8Fbo= /bin /usr/bin /sbin /usr/sbin /lib/modules/*",
+		"Q1" + base64.StdEncoding.EncodeToString(second.Checksum) + " /usr/lib/* /usr/share/* /etc",
+	}, "\n")+"\n", readTriggers())
+}
+
+func TestMatchTriggers(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+
+	// the test root has busybox installed, with triggers on /bin /usr/bin /sbin /usr/sbin /lib/modules/*
+	const busyboxTrigger = "busybox-1.35.0-r17.Q1Meo+LHGPSi3uY9gIouEVb9z8Fbo=.trigger"
+	tests := []struct {
+		name  string
+		paths []string
+		want  map[string][]string
+	}{
+		{"no paths", nil, map[string][]string{}},
+		{"no match", []string{"/etc/foo", "/usr/share/bin/foo"}, map[string][]string{}},
+		{"matches", []string{"/usr/bin/foo", "usr/bin/bar", "/lib/modules/6.1/foo.ko", "/lib/modules/6.1/kernel/foo.ko", "/lib/modules/6.2", "/etc/foo"}, map[string][]string{
+			"busybox": {busyboxTrigger, "/lib/modules/6.1", "/lib/modules/6.2", "/usr/bin"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.MatchTriggers(tt.paths)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestListOrphans(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		world []string
+		want  []string
+	}{{
+		name:  "base layout only",
+		world: []string{"alpine-baselayout"},
+		want: []string{
+			"alpine-keys", "ca-certificates-bundle", "libcrypto1.1", "libssl1.1", "ssl_client",
+			"zlib", "apk-tools", "scanelf", "musl-utils", "libc-utils",
+		},
+	}, {
+		// ssl_client is kept through its install_if on busybox and libssl1.1
+		name:  "with apk-tools",
+		world: []string{"alpine-baselayout", "apk-tools"},
+		want:  []string{"alpine-keys", "scanelf", "musl-utils", "libc-utils"},
+	}, {
+		name:  "everything",
+		world: []string{"alpine-baselayout", "alpine-keys", "apk-tools", "libc-utils"},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, src, err := testGetTestAPK()
+			require.NoError(t, err)
+			require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+			require.NoError(t, a.SetWorld(tt.world))
+
+			orphans, err := a.ListOrphans(context.Background())
+			require.NoError(t, err)
+			var got []string
+			for _, pkg := range orphans {
+				got = append(got, pkg.Name)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+	t.Run("world not installed", func(t *testing.T) {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+		require.NoError(t, a.SetWorld([]string{"not-installed"}))
+		_, err = a.ListOrphans(context.Background())
+		require.Error(t, err)
+	})
+}
+
+func TestCompressedInstalledDB(t *testing.T) {
+	names := func(t *testing.T, a *APK) []string {
+		pkgs, err := a.GetInstalled()
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+	compress := func(t *testing.T, a *APK) {
+		b, err := a.fs.ReadFile(installedFilePath)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err = gz.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		require.NoError(t, a.fs.WriteFile(installedFilePath, buf.Bytes(), 0o644))
+	}
+	isCompressed := func(t *testing.T, a *APK) bool {
+		b, err := a.fs.ReadFile(installedFilePath)
+		require.NoError(t, err)
+		return bytes.HasPrefix(b, gzipMagic)
+	}
+
+	t.Run("read compressed", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		want := names(t, a)
+		sum, err := a.InstalledChecksum()
+		require.NoError(t, err)
+
+		compress(t, a)
+		require.Equal(t, want, names(t, a))
+		installed, err := a.isInstalledPackage("busybox")
+		require.NoError(t, err)
+		require.True(t, installed)
+		compressedSum, err := a.InstalledChecksum()
+		require.NoError(t, err)
+		require.Equal(t, sum, compressedSum)
+	})
+	t.Run("write compressed", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		a.compressedInstalledDB = true
+		want := names(t, a)
+
+		// the first write converts the uncompressed db, the second appends to it
+		for _, name := range []string{"first", "second"} {
+			require.NoError(t, a.addInstalledPackage(&repository.Package{Name: name, Version: "1.0.0"}, nil))
+			require.True(t, isCompressed(t, a))
+			want = append(want, name)
+			require.Equal(t, want, names(t, a))
+		}
+	})
+	t.Run("write uncompressed to compressed db", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		want := names(t, a)
+		compress(t, a)
+
+		require.NoError(t, a.addInstalledPackage(&repository.Package{Name: "new", Version: "1.0.0"}, nil))
+		require.False(t, isCompressed(t, a))
+		require.Equal(t, append(want, "new"), names(t, a))
+	})
+}
+
+func TestControlValueLongLine(t *testing.T) {
+	// longer than the 64 KiB a bufio.Scanner allows by default
+	pkginfo := "pkgname = long\npkgver = 1.0-r0\npkgdesc = " + strings.Repeat("x", 256<<10) + "\ndatahash = 0123456789abcdef"
+
+	var control bytes.Buffer
+	gw := gzip.NewWriter(&control)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(pkginfo))}))
+	_, err := tw.Write([]byte(pkginfo))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	desc, err := a.controlValue(bytes.NewReader(control.Bytes()), "pkgdesc")
+	require.NoError(t, err)
+	require.Equal(t, []string{strings.Repeat("x", 256<<10)}, desc)
+	// the last line has no newline
+	datahash, err := a.datahash(bytes.NewReader(control.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, "0123456789abcdef", datahash)
+}
+
+// BenchmarkControlValueLargeControl reads the datahash from a control section with a large
+// .PKGINFO; B/op stays in the tens of KB, far below the size of the .PKGINFO, as it is streamed.
+func BenchmarkControlValueLargeControl(b *testing.B) {
+	var pkginfo bytes.Buffer
+	pkginfo.WriteString("pkgname = large\npkgver = 1.0-r0\n")
+	for i := 0; pkginfo.Len() < 4<<20; i++ {
+		fmt.Fprintf(&pkginfo, "depend = so:libdep%d.so.1\n", i)
+	}
+	pkginfo.WriteString("datahash = 0123456789abcdef\n")
+
+	var control bytes.Buffer
+	gw := gzip.NewWriter(&control)
+	tw := tar.NewWriter(gw)
+	require.NoError(b, tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(pkginfo.Len())}))
+	_, err := tw.Write(pkginfo.Bytes())
+	require.NoError(b, err)
+	require.NoError(b, tw.Close())
+	require.NoError(b, gw.Close())
+
+	a, _, err := testGetTestAPK()
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		datahash, err := a.datahash(bytes.NewReader(control.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if datahash != "0123456789abcdef" {
+			b.Fatalf("unexpected datahash %q", datahash)
+		}
+	}
+}
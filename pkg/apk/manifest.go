@@ -0,0 +1,103 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// ManifestEntry is a single installed file, directory or link, as written by WithManifestWriter.
+type ManifestEntry struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	// Path is relative to the root, without a leading slash.
+	Path string `json:"path"`
+	// Type is one of "file", "dir", "symlink", "hardlink" or "other".
+	Type string `json:"type"`
+	// Mode is the octal permission bits, e.g. "0644".
+	Mode string `json:"mode"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+	// Checksum is the Q1-prefixed SHA1 checksum apk records for files and links, if any.
+	Checksum string `json:"checksum,omitempty"`
+	// Link is the target of a link.
+	Link string `json:"link,omitempty"`
+}
+
+// writeManifest writes a ManifestEntry for each of the files installed for pkg, as one JSON object
+// per line, to the manifest writer, if set.
+func (a *APK) writeManifest(pkg *repository.Package, files []tar.Header) error {
+	if a.manifestWriter == nil {
+		return nil
+	}
+	enc := json.NewEncoder(a.manifestWriter)
+	for _, f := range files {
+		checksum, err := headerChecksum(f.PAXRecords)
+		if err != nil {
+			return fmt.Errorf("checksum of %s in %s: %w", f.Name, pkg.Name, err)
+		}
+		entry := ManifestEntry{
+			Package:  pkg.Name,
+			Version:  pkg.Version,
+			Path:     strings.TrimSuffix(strings.TrimPrefix(f.Name, "/"), "/"),
+			Type:     manifestType(f.Typeflag),
+			Mode:     fmt.Sprintf("%04o", f.Mode&0o7777),
+			UID:      f.Uid,
+			GID:      f.Gid,
+			Checksum: checksum,
+			Link:     f.Linkname,
+		}
+		if err := enc.Encode(entry); err != nil {
+			return fmt.Errorf("writing manifest for %s: %w", pkg.Name, err)
+		}
+	}
+	return nil
+}
+
+func manifestType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return "other"
+	}
+}
+
+// headerChecksum returns the checksum in the PAX records of an installed file, in the Q1-prefixed
+// encoding of the installed db, or an empty string if there is none.
+func headerChecksum(pax map[string]string) (string, error) {
+	checksum := pax[paxRecordsChecksumKey]
+	if checksum == "" || strings.HasPrefix(checksum, "Q1") {
+		return checksum, nil
+	}
+	hexsum, err := hex.DecodeString(checksum)
+	if err != nil {
+		return "", err
+	}
+	return "Q1" + base64.StdEncoding.EncodeToString(hexsum), nil
+}
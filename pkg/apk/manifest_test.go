@@ -0,0 +1,70 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestWriter(t *testing.T) {
+	a := testGetTestAPKWithRepos(t)
+	var manifest bytes.Buffer
+	a.manifestWriter = &manifest
+
+	apk := testCreateAPK(t, "pkgname = localpkg\npkgver = 1.0.0-r0\narch = aarch64\n", []testDirEntry{
+		{path: "usr", perms: 0o755, dir: true},
+		{path: "usr/share", perms: 0o755, dir: true},
+		{path: "usr/share/localpkg", perms: 0o700, dir: true},
+		{path: "usr/share/localpkg/hello", perms: 0o600, content: []byte("hello")},
+	})
+	p := filepath.Join(t.TempDir(), "localpkg.apk")
+	require.NoError(t, os.WriteFile(p, apk, 0o644))
+	// an unsigned local build
+	a.ignoreSignatures = true
+	require.NoError(t, a.InstallFile(context.Background(), p, nil))
+
+	var entries []ManifestEntry
+	dec := json.NewDecoder(&manifest)
+	for dec.More() {
+		var entry ManifestEntry
+		require.NoError(t, dec.Decode(&entry))
+		entries = append(entries, entry)
+	}
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	pkg := installed[len(installed)-1]
+	require.Equal(t, "localpkg", pkg.Name)
+	var checksum string
+	for _, f := range pkg.Files {
+		if f.Name == "usr/share/localpkg/hello" {
+			checksum = f.PAXRecords[paxRecordsChecksumKey]
+		}
+	}
+	require.NotEmpty(t, checksum)
+
+	require.Equal(t, []ManifestEntry{
+		{Package: "localpkg", Version: "1.0.0-r0", Path: "usr", Type: "dir", Mode: "0755"},
+		{Package: "localpkg", Version: "1.0.0-r0", Path: "usr/share", Type: "dir", Mode: "0755"},
+		{Package: "localpkg", Version: "1.0.0-r0", Path: "usr/share/localpkg", Type: "dir", Mode: "0700"},
+		{Package: "localpkg", Version: "1.0.0-r0", Path: "usr/share/localpkg/hello", Type: "file", Mode: "0600", Checksum: checksum},
+	}, entries)
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Mirror is an alternate location for the contents of a repository.
+type Mirror struct {
+	// URL of the mirror, replacing the repository URL as prefix of index and package URLs.
+	URL string
+	// Weight is the relative likelihood of the mirror being tried first.
+	// Mirrors with a weight of 0 or less are only used as fallbacks.
+	Weight int
+}
+
+// mirrorCandidates returns the URLs to try, in order, to fetch u. If u is in a repository with mirrors,
+// the first one is picked according to the weights, using intn to draw a random number; the other
+// mirrors follow in order of descending weight, and u itself is always tried last.
+func mirrorCandidates(u string, mirrors map[string][]Mirror, intn func(int) int) []string {
+	// pick the longest matching repository, in case repositories are nested
+	var repo string
+	for r := range mirrors {
+		prefix := strings.TrimSuffix(r, "/") + "/"
+		if strings.HasPrefix(u, prefix) && len(r) > len(repo) {
+			repo = r
+		}
+	}
+	if repo == "" {
+		return []string{u}
+	}
+	rest := strings.TrimPrefix(u, strings.TrimSuffix(repo, "/"))
+
+	ordered := make([]Mirror, len(mirrors[repo]))
+	copy(ordered, mirrors[repo])
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Weight > ordered[j].Weight
+	})
+
+	var total int
+	for _, m := range ordered {
+		if m.Weight > 0 {
+			total += m.Weight
+		}
+	}
+	if total > 0 {
+		if intn == nil {
+			intn = rand.Intn //nolint:gosec // not used for anything security related
+		}
+		n := intn(total)
+		for i, m := range ordered {
+			if m.Weight <= 0 {
+				break
+			}
+			if n < m.Weight {
+				// move the picked mirror to the front, keeping the order of the others
+				ordered = append([]Mirror{m}, append(ordered[:i:i], ordered[i+1:]...)...)
+				break
+			}
+			n -= m.Weight
+		}
+	}
+
+	candidates := make([]string, 0, len(ordered)+1)
+	for _, m := range ordered {
+		candidates = append(candidates, strings.TrimSuffix(m.URL, "/")+rest)
+	}
+	return append(candidates, u)
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestMirrorCandidates(t *testing.T) {
+	const (
+		repo = "https://repo.example.com/alpine/main"
+		u    = repo + "/x86_64/foo-1.0.0-r0.apk"
+	)
+	mirrors := map[string][]Mirror{
+		repo: {
+			{URL: "https://fallback.example.com/main", Weight: 0},
+			{URL: "https://far.example.com/main/", Weight: 1},
+			{URL: "https://near.example.com/main", Weight: 9},
+		},
+	}
+	tests := []struct {
+		name string
+		u    string
+		draw int
+		want []string
+	}{
+		{"no mirrors for repository", "https://other.example.com/alpine/main/x86_64/foo-1.0.0-r0.apk", 0, []string{
+			"https://other.example.com/alpine/main/x86_64/foo-1.0.0-r0.apk",
+		}},
+		{"preferred mirror drawn", u, 0, []string{
+			"https://near.example.com/main/x86_64/foo-1.0.0-r0.apk",
+			"https://far.example.com/main/x86_64/foo-1.0.0-r0.apk",
+			"https://fallback.example.com/main/x86_64/foo-1.0.0-r0.apk",
+			u,
+		}},
+		{"other mirror drawn", u, 9, []string{
+			"https://far.example.com/main/x86_64/foo-1.0.0-r0.apk",
+			"https://near.example.com/main/x86_64/foo-1.0.0-r0.apk",
+			"https://fallback.example.com/main/x86_64/foo-1.0.0-r0.apk",
+			u,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mirrorCandidates(tt.u, mirrors, func(n int) int {
+				require.Equal(t, 10, n, "total of the weights")
+				return tt.draw
+			})
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// testHostTransport fails requests to the given hosts, and records the hosts requested.
+type testHostTransport struct {
+	wrapped   http.RoundTripper
+	failHosts map[string]bool
+	hosts     []string
+}
+
+func (t *testHostTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.hosts = append(t.hosts, request.URL.Host)
+	if t.failHosts[request.URL.Host] {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+	}
+	return t.wrapped.RoundTrip(request)
+}
+
+func TestFetchPackageMirrors(t *testing.T) {
+	const repoURL = "https://repo.example.com/alpine/main"
+	var (
+		repo          = repository.Repository{Uri: repoURL + "/" + testArch}
+		repoWithIndex = repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{&testPkg}})
+		pkg           = repository.NewRepositoryPackage(&testPkg, repoWithIndex)
+	)
+	a, err := New(WithFS(apkfs.NewMemFS()),
+		WithMirrors(repoURL, Mirror{URL: "https://mirror1.example.com/main", Weight: 1}),
+		WithMirrors(repoURL, Mirror{URL: "https://mirror2.example.com/main"}),
+	)
+	require.NoError(t, err)
+	transport := &testHostTransport{
+		wrapped:   &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		failHosts: map[string]bool{"mirror1.example.com": true},
+	}
+	a.SetClient(&http.Client{Transport: transport})
+
+	rc, err := a.fetchPackage(context.Background(), pkg)
+	require.NoError(t, err)
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	require.NoError(t, err)
+	require.Equal(t, []string{"mirror1.example.com", "mirror2.example.com"}, transport.hosts)
+
+	// when all mirrors fail, the repository itself is used
+	transport.hosts = nil
+	transport.failHosts["mirror2.example.com"] = true
+	rc, err = a.fetchPackage(context.Background(), pkg)
+	require.NoError(t, err)
+	rc.Close()
+	require.Equal(t, []string{"mirror1.example.com", "mirror2.example.com", "repo.example.com"}, transport.hosts)
+}
@@ -0,0 +1,32 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+)
+
+const ociScheme = "oci"
+
+// OCIPuller provider of package blobs stored as OCI artifacts.
+// Used to fetch packages whose repository URL has the oci:// scheme.
+type OCIPuller interface {
+	// Pull returns the package blob for the given reference, which is the package URL
+	// with the oci:// prefix removed, e.g. registry.example.com/repo@sha256:abc... or
+	// registry.example.com/repo/foo-1.0.0-r0.apk. It is up to the implementation how
+	// to map the reference to a blob. The caller closes the returned reader.
+	Pull(ctx context.Context, ref string) (io.ReadCloser, error)
+}
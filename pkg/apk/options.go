@@ -15,24 +15,76 @@
 package apk
 
 import (
+	"crypto"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 	logger "github.com/chainguard-dev/go-apk/pkg/logger"
 	"github.com/sirupsen/logrus"
+	"gitlab.alpinelinux.org/alpine/go/repository"
 )
 
 type opts struct {
-	logger            logger.Logger
-	executor          Executor
-	arch              string
-	ignoreMknodErrors bool
-	fs                apkfs.FullFS
-	version           string
-	cache             *cache
+	logger                logger.Logger
+	executor              Executor
+	arch                  string
+	ignoreMknodErrors     bool
+	fs                    apkfs.FullFS
+	version               string
+	cache                 *cache
+	releasesCacheTTL      time.Duration
+	ociPuller             OCIPuller
+	deltaUpgrades         bool
+	deltaFetcher          DeltaFetcher
+	requestTimeout        time.Duration
+	maxDecompressedSize   int64
+	allowedPaths          []string
+	mirrors               map[string][]Mirror
+	holds                 []string
+	licenseAllowlist      []string
+	excludeSuffixes       []string
+	repositoryPrefs       []string
+	alternativeDeps       bool
+	resolveTracer         func(ResolveStep)
+	compressedInstalledDB bool
+	normalizeArch         bool
+	flatRepositories      []string
+	staleIndexOK          bool
+	http2                 bool
+	maxConnsPerHost       int
+	idleConnTimeout       time.Duration
+	verificationCallback  func(PackageVerification)
+	allowUnsignedIndexes  bool
+	strictArchFile        bool
+	manifestWriter        io.Writer
+	skipScripts           bool
+	skipTriggers          bool
+	resolveValidator      func([]*repository.RepositoryPackage) error
+	uidGIDMapper          func(uid, gid int) (int, int)
+	continueOnError       bool
+	blockedChecksums      map[string]bool
+	reposFile             string
+	archFile              string
+	worldFile             string
+	keysDir               string
+	cacheHash             crypto.Hash
+	baseLayout            bool
+	keysTime              time.Time
+	breakerFailures       int
+	breakerWindow         time.Duration
+	deviceOwners          map[string]DeviceOwner
+	compatibleArchs       []string
+	allowDowngrade        bool
+	bundles               []string
+	remoteCache           RemoteCache
+	remoteCachePush       bool
+	validateScriptsTar    bool
 }
 
 type Option func(*opts) error
@@ -54,6 +106,8 @@ func WithExecutor(executor Executor) Option {
 }
 
 // WithArch sets the architecture to use. If not provided, will use the default runtime.GOARCH.
+// Unless disabled with WithArchNormalization, aliases such as "amd64" or "arm64" are converted
+// to the names apk uses, "x86_64" or "aarch64".
 func WithArch(arch string) Option {
 	return func(o *opts) error {
 		o.arch = arch
@@ -109,6 +163,526 @@ func WithCache(cacheDir string, offline bool) Option {
 	}
 }
 
+// WithCacheHash sets the hash used to name the control section and signature of packages in the
+// cache, e.g. crypto.SHA256 where SHA1 is not acceptable. The default is crypto.SHA1, which is the
+// checksum in the index, so cached packages are found by name. With any other hash, the control
+// section is hashed with it as well when the package is expanded, and a cached package is found by
+// hashing the control sections cached for it; either way, it is only used if its SHA1 checksum
+// matches the one in the index. The data section always is named by its SHA256, as in the package.
+//
+// Packages already cached with SHA1 names are renamed to the new names the first time they are
+// used, so changing to another hash keeps the cache. Changing back to SHA1 does not rename them
+// back: they are not found, and are fetched again; ClearCache removes the ones left behind.
+func WithCacheHash(h crypto.Hash) Option {
+	return func(o *opts) error {
+		if !h.Available() {
+			return fmt.Errorf("cache hash %v is not available", h)
+		}
+		o.cacheHash = h
+		return nil
+	}
+}
+
+// WithHTTP2 sets whether the internally created HTTP client uses HTTP/2 with servers that support it,
+// multiplexing concurrent requests over a single connection. Some mirrors misbehave with HTTP/2,
+// so it can be disabled. It has no effect on a client set with SetClient. Default is true.
+func WithHTTP2(enabled bool) Option {
+	return func(o *opts) error {
+		o.http2 = enabled
+		return nil
+	}
+}
+
+// WithMaxConnsPerHost limits the number of connections the internally created HTTP client opens
+// to any single host, including connections that are dialing or in use; further requests wait
+// for one to become available. It has no effect on a client set with SetClient.
+// If not provided, or not positive, there is no limit.
+func WithMaxConnsPerHost(n int) Option {
+	return func(o *opts) error {
+		o.maxConnsPerHost = n
+		return nil
+	}
+}
+
+// WithIdleConnTimeout sets how long the internally created HTTP client keeps an idle connection
+// open for reuse before closing it. It has no effect on a client set with SetClient.
+// If not provided, or zero, the net/http default of 90 seconds is used.
+func WithIdleConnTimeout(timeout time.Duration) Option {
+	return func(o *opts) error {
+		o.idleConnTimeout = timeout
+		return nil
+	}
+}
+
+// WithFetchCircuitBreaker limits how often requests to a host, e.g. a repository or mirror, can fail
+// before it is considered down: once maxFailures requests to it failed within window, including
+// retries, requests to it fail fast with a CircuitOpenError for the length of window, rather than
+// every package spending its own retries against it. Fetching a package then falls back to the next
+// mirror, if any, and otherwise the operation fails. A request fails if there is no response, or a
+// 5xx or 429 one. The budget is shared by all requests of the APK, and starts afresh with every
+// FixateWorld. Without it, or with maxFailures of 0, requests are never failed fast.
+func WithFetchCircuitBreaker(maxFailures int, window time.Duration) Option {
+	return func(o *opts) error {
+		if maxFailures < 0 || (maxFailures > 0 && window <= 0) {
+			return fmt.Errorf("invalid circuit breaker of %d failures within %s", maxFailures, window)
+		}
+		o.breakerFailures = maxFailures
+		o.breakerWindow = window
+		return nil
+	}
+}
+
+// WithStaleIndexOK sets whether, when a repository cannot be reached, a previously fetched index
+// in the cache is used instead, with a warning that includes how old it is. It has no effect
+// without WithCache. Default is false, failing when a repository cannot be reached.
+func WithStaleIndexOK(ok bool) Option {
+	return func(o *opts) error {
+		o.staleIndexOK = ok
+		return nil
+	}
+}
+
+// WithReleasesCacheTTL sets how long the parsed Alpine releases document is reused
+// when fetching keys during InitDB. The releases document changes rarely, so repeated
+// InitDB calls within a process can share a single fetch. The cache is keyed by URL and
+// is independent of the package cache set with WithCache.
+// If not provided, or zero, the releases document is fetched every time.
+func WithReleasesCacheTTL(ttl time.Duration) Option {
+	return func(o *opts) error {
+		o.releasesCacheTTL = ttl
+		return nil
+	}
+}
+
+// WithOCIPuller sets the puller used to fetch packages from repositories with the oci:// scheme,
+// so packages stored as OCI artifacts can be installed. If not provided, such packages cannot be fetched.
+func WithOCIPuller(puller OCIPuller) Option {
+	return func(o *opts) error {
+		o.ociPuller = puller
+		return nil
+	}
+}
+
+// WithRemoteCache sets a cache shared between machines, e.g. by a team, to read packages through:
+// a package that is not in the local cache, if any, is taken from remote before it is fetched from
+// its repository. With push, packages that are fetched from their repository are stored in remote
+// too; failing to store one is logged, but does not fail the installation.
+func WithRemoteCache(remote RemoteCache, push bool) Option {
+	return func(o *opts) error {
+		o.remoteCache = remote
+		o.remoteCachePush = push
+		return nil
+	}
+}
+
+// WithDeltaUpgrades sets whether UpgradeWorld fetches the newer version of an installed package as a
+// delta against the installed version, with the DeltaFetcher from WithDeltaFetcher, to download less.
+// The installed version has to be in the cache. When there is no delta, or it cannot be applied, the
+// full package is fetched instead.
+func WithDeltaUpgrades(enabled bool) Option {
+	return func(o *opts) error {
+		o.deltaUpgrades = enabled
+		return nil
+	}
+}
+
+// WithDeltaFetcher sets how deltas are fetched with WithDeltaUpgrades.
+func WithDeltaFetcher(fetcher DeltaFetcher) Option {
+	return func(o *opts) error {
+		o.deltaFetcher = fetcher
+		return nil
+	}
+}
+
+// WithRequestTimeout sets a timeout for each individual HTTP request made when fetching keys,
+// indexes and packages. It covers connecting, receiving the response headers and the first
+// byte of the body, so that stalled connections fail fast and are retried, while long downloads
+// that are making progress are not interrupted. It is independent of any deadline on the context.
+// If not provided, or zero, requests have no timeout of their own, except for fetching keys,
+// which time out after 30 seconds.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(o *opts) error {
+		o.requestTimeout = timeout
+		return nil
+	}
+}
+
+// WithMaxDecompressedSize sets the maximum number of bytes a repository index or a package
+// may decompress to. Decompression is aborted with a MaxDecompressedSizeError as soon as the
+// limit is exceeded, protecting against decompression bombs served by untrusted repositories.
+// If not provided, or zero, there is no limit.
+func WithMaxDecompressedSize(size int64) Option {
+	return func(o *opts) error {
+		o.maxDecompressedSize = size
+		return nil
+	}
+}
+
+// WithAllowedPaths restricts where packages may install files, e.g. []string{"/usr", "/etc"}.
+// Installing a package with a file, symlink or hardlink outside of all of the given prefixes, once
+// symlinks among its parent directories are followed, or with a link to a target outside of them,
+// fails with a DisallowedPathError. Directories are not checked, so that parents of the prefixes can be created.
+// If not provided, or empty, packages may install files anywhere.
+func WithAllowedPaths(paths []string) Option {
+	return func(o *opts) error {
+		o.allowedPaths = paths
+		return nil
+	}
+}
+
+// WithMirrors sets mirrors for the repository with the given URL, as it appears in /etc/apk/repositories.
+// Index and package fetches from the repository first try a mirror picked at random according to the
+// weights, then the other mirrors in order of descending weight, and finally the repository itself.
+// Can be passed multiple times, for different repositories.
+func WithMirrors(repository string, mirrors ...Mirror) Option {
+	return func(o *opts) error {
+		if o.mirrors == nil {
+			o.mirrors = map[string][]Mirror{}
+		}
+		o.mirrors[repository] = append(o.mirrors[repository], mirrors...)
+		return nil
+	}
+}
+
+// WithFlatRepositories marks the repositories with the given URLs, as they appear in
+// /etc/apk/repositories without any pin, as flat: the APKINDEX.tar.gz and packages are directly
+// at the repository URL, rather than under a directory for the arch, <url>/<arch>/APKINDEX.tar.gz.
+// Repositories whose URL already ends in the arch are detected without this option.
+func WithFlatRepositories(repositories ...string) Option {
+	return func(o *opts) error {
+		o.flatRepositories = append(o.flatRepositories, repositories...)
+		return nil
+	}
+}
+
+// WithHolds holds packages back from being upgraded. Each hold is a package name with an optional
+// version constraint, in the same format as world, e.g. "busybox<1.36" or "busybox=1.35.0-r17".
+// A bare name holds the package at its installed version, and has no effect if it is not installed.
+// Holds are applied on top of world: versions outside a hold are never selected, even when world
+// asks for them, in which case resolution fails.
+func WithHolds(holds ...string) Option {
+	return func(o *opts) error {
+		o.holds = append(o.holds, holds...)
+		return nil
+	}
+}
+
+// WithAllowedLicenses restricts the packages chosen when resolving the world, or for Add, to those
+// whose license is allowed, as WithLicenseAllowlist does for a PkgResolver. If not provided, packages
+// with any license may be chosen.
+func WithAllowedLicenses(licenses []string) Option {
+	return func(o *opts) error {
+		o.licenseAllowlist = licenses
+		return nil
+	}
+}
+
+// WithExcludedSubpackages keeps packages whose name ends in one of suffixes, e.g. "-dev" or "-doc",
+// from being pulled in as dependencies when resolving the world, or for Add, as
+// WithExcludeSubpackageSuffixes does for a PkgResolver. The dependencies left out are warned about
+// on the logger.
+func WithExcludedSubpackages(suffixes []string) Option {
+	return func(o *opts) error {
+		o.excludeSuffixes = suffixes
+		return nil
+	}
+}
+
+// WithPreferredRepositories sets an ordered list of preferred repositories, to choose between packages
+// that are otherwise equal when resolving the world, or for Add, as WithRepositoryPreference does for
+// a PkgResolver.
+func WithPreferredRepositories(repositories []string) Option {
+	return func(o *opts) error {
+		o.repositoryPrefs = repositories
+		return nil
+	}
+}
+
+// WithDependencyAlternatives enables dependencies with alternatives separated by "|", e.g.
+// "foo | bar>=2.0", when resolving the world, or for Add, as WithAlternativeDependencies does for a
+// PkgResolver. Without it, such a dependency is treated as a single package name, as apk does.
+func WithDependencyAlternatives(enabled bool) Option {
+	return func(o *opts) error {
+		o.alternativeDeps = enabled
+		return nil
+	}
+}
+
+// WithResolutionTracer sets a function that is called with every package selection made when
+// resolving the world, or for Add, as WithResolveTracer does for a PkgResolver.
+func WithResolutionTracer(tracer func(ResolveStep)) Option {
+	return func(o *opts) error {
+		o.resolveTracer = tracer
+		return nil
+	}
+}
+
+// WithCompressedInstalledDB writes the installed db, /lib/apk/db/installed, gzip-compressed.
+// The installed db is read correctly whether it is compressed or not.
+func WithCompressedInstalledDB(compressed bool) Option {
+	return func(o *opts) error {
+		o.compressedInstalledDB = compressed
+		return nil
+	}
+}
+
+// WithArchNormalization sets whether the architecture is converted from common aliases, such as
+// "amd64" or "arm64", to the names apk uses, such as "x86_64" or "aarch64". Default is true.
+func WithArchNormalization(normalize bool) Option {
+	return func(o *opts) error {
+		o.normalizeArch = normalize
+		return nil
+	}
+}
+
+// WithVerificationCallback sets a function that is called with how each package was verified, after
+// it is installed, e.g. to audit that every installed package was verified. Packages that already
+// are installed, and virtual packages, which have no contents, are not reported.
+func WithVerificationCallback(callback func(PackageVerification)) Option {
+	return func(o *opts) error {
+		o.verificationCallback = callback
+		return nil
+	}
+}
+
+// WithAllowUnsignedIndexes uses repository indexes that are not signed, or whose signature cannot
+// be verified, rather than failing, while still verifying the signatures of all others. Whether a
+// resolved package comes from a verified index is reported in the Signed field of ResolveWorldPlan.
+func WithAllowUnsignedIndexes(allow bool) Option {
+	return func(o *opts) error {
+		o.allowUnsignedIndexes = allow
+		return nil
+	}
+}
+
+// WithStrictArchFile requires /etc/apk/arch to exist when fetching indexes. By default, if it does
+// not exist, the arch set with WithArch, or the default arch, is used instead, with a warning.
+func WithStrictArchFile(strict bool) Option {
+	return func(o *opts) error {
+		o.strictArchFile = strict
+		return nil
+	}
+}
+
+// WithManifestWriter writes a manifest of every file, directory and link installed, as packages are
+// installed, to w: one JSON object per line, a ManifestEntry with the owning package, mode and
+// checksum. It allows generating e.g. an SBOM without reading the installed db afterwards.
+func WithManifestWriter(w io.Writer) Option {
+	return func(o *opts) error {
+		o.manifestWriter = w
+		return nil
+	}
+}
+
+// WithSkipScripts does not write the scripts of installed packages to scripts.tar, e.g. for minimal
+// images that never run apk again. The installed db is still written. The scripts of the installed
+// packages cannot be run later on the resulting root.
+func WithSkipScripts(skip bool) Option {
+	return func(o *opts) error {
+		o.skipScripts = skip
+		return nil
+	}
+}
+
+// WithSkipTriggers does not write the triggers of installed packages to the triggers file, e.g. for
+// minimal images that never run apk again. The installed db is still written. Triggers cannot be run
+// later on the resulting root, as apk no longer knows which packages have them.
+func WithSkipTriggers(skip bool) Option {
+	return func(o *opts) error {
+		o.skipTriggers = skip
+		return nil
+	}
+}
+
+// WithValidateScriptsTar sets whether installing packages checks scripts.tar with ValidateScriptsTar
+// once their scripts are written, and fails if it is not valid. This reads back the installed db and
+// scripts.tar after every install, and fails on entries that other tools may have added, so it is
+// off by default.
+func WithValidateScriptsTar(validate bool) Option {
+	return func(o *opts) error {
+		o.validateScriptsTar = validate
+		return nil
+	}
+}
+
+// WithResolveValidator sets a function that FixateWorld calls with the resolved packages, before
+// any of them is fetched or installed, e.g. to block known-bad packages or enforce a size budget.
+// If it returns an error, nothing is installed and FixateWorld returns the error.
+func WithResolveValidator(validator func([]*repository.RepositoryPackage) error) Option {
+	return func(o *opts) error {
+		o.resolveValidator = validator
+		return nil
+	}
+}
+
+// WithUIDGIDMapper sets a function that maps the uid and gid of every file, directory and link in
+// installed packages, e.g. to force everything to one non-root uid for rootless or user namespaced
+// builds. The mapped ownership is what is recorded in the installed db.
+func WithUIDGIDMapper(mapper func(uid, gid int) (int, int)) Option {
+	return func(o *opts) error {
+		o.uidGIDMapper = mapper
+		return nil
+	}
+}
+
+// WithContinueOnInstallError keeps FixateWorld going when a package fails to fetch or install: the
+// package, and the packages depending on it, are skipped with a warning, the others are installed,
+// and FixateWorld returns an error listing all failures at the end. A package that failed while
+// installing might have left some of its files behind.
+func WithContinueOnInstallError(continueOnError bool) Option {
+	return func(o *opts) error {
+		o.continueOnError = continueOnError
+		return nil
+	}
+}
+
+// WithBlockedChecksums blocks the package builds with the given checksums, as returned by
+// ChecksumString, e.g. "Q1...", to quarantine known-bad builds whatever their name or version.
+// Resolving or installing a blocked package fails with a BlockedPackageError naming it.
+func WithBlockedChecksums(checksums []string) Option {
+	return func(o *opts) error {
+		o.blockedChecksums = make(map[string]bool, len(checksums))
+		for _, checksum := range checksums {
+			o.blockedChecksums[checksum] = true
+		}
+		return nil
+	}
+}
+
+// WithBaseLayout sets whether InitDB also creates a standard directory skeleton, e.g. /usr/bin,
+// /usr/lib, /home, /root, /run and /var/tmp, like alpine-baselayout does. Packages that assume these
+// exist, without including them in their data, then install into a root without alpine-baselayout.
+// Directories that already exist are left as they are. Default is false.
+func WithBaseLayout(enabled bool) Option {
+	return func(o *opts) error {
+		o.baseLayout = enabled
+		return nil
+	}
+}
+
+// DeviceOwner is the owner of a device node created by InitDB.
+type DeviceOwner struct {
+	UID int
+	GID int
+}
+
+// WithDeviceOwner sets the owner of the device node at path that InitDB creates, and ListInitFiles
+// lists, instead of root, e.g. to give /dev/console to the tty group for images that run getty.
+// path is one of the device nodes InitDB creates, e.g. /dev/console. Default is uid and gid 0 for
+// every device node.
+func WithDeviceOwner(path string, uid, gid int) Option {
+	return func(o *opts) error {
+		path = "/" + configPath(path)
+		known := false
+		for _, e := range initDeviceFiles {
+			known = known || e.path == path
+		}
+		if !known {
+			return fmt.Errorf("%s is not a device node created by InitDB", path)
+		}
+		if uid < 0 || gid < 0 {
+			return fmt.Errorf("invalid owner %d:%d for %s", uid, gid, path)
+		}
+		if o.deviceOwners == nil {
+			o.deviceOwners = map[string]DeviceOwner{}
+		}
+		o.deviceOwners[path] = DeviceOwner{UID: uid, GID: gid}
+		return nil
+	}
+}
+
+// WithCompatibleArchs sets archs whose packages can be installed on the arch of the root, in order of
+// preference, e.g. "x86" on x86_64. The indexes of the repositories are fetched for each of them too,
+// but their packages are only resolved if no package of the same name exists for the arch of the
+// root, or for an arch earlier in the list. ResolveWorldPlan marks the packages resolved this way,
+// and a warning is logged for each. Default is none.
+func WithCompatibleArchs(archs ...string) Option {
+	return func(o *opts) error {
+		for _, arch := range archs {
+			if arch == "" {
+				return fmt.Errorf("empty compatible arch in %q", archs)
+			}
+		}
+		o.compatibleArchs = archs
+		return nil
+	}
+}
+
+// WithAllowDowngrade sets whether a package may resolve to an older version than the one installed,
+// e.g. because of a pin or an index that was rolled back. By default, this is a DowngradeError from
+// FixateWorld, Add and UpgradeWorld, reporting both versions. Either way, installed packages are not
+// replaced: FixateWorld keeps them as they are, and Add fails as it does for any other version.
+func WithAllowDowngrade(allow bool) Option {
+	return func(o *opts) error {
+		o.allowDowngrade = allow
+		return nil
+	}
+}
+
+// WithBundle adds the tar or zip archive of .apk files at path, e.g. an offline package set, as a
+// repository, after the configured ones. The archive may also be a gzipped tar. Its packages for the
+// arch of the root, or noarch, are indexed when the indexes are loaded, and fetched from it when
+// installed. As a bundle has no signed index, every package in it must be signed by a trusted key,
+// unless signatures are ignored.
+func WithBundle(path string) Option {
+	return func(o *opts) error {
+		o.bundles = append(o.bundles, path)
+		return nil
+	}
+}
+
+// WithKeysTime sets the time at which the keys that InitDB fetches for Alpine releases are chosen,
+// instead of the current time, e.g. the source date epoch of the build. Keys deprecated as of t are
+// not fetched, and keys deprecated since are, so the same keys are fetched for the same t, however
+// close it is to a key rotation. An older t can fetch keys that no longer are used, and miss keys
+// that were added after t.
+func WithKeysTime(t time.Time) Option {
+	return func(o *opts) error {
+		o.keysTime = t
+		return nil
+	}
+}
+
+// WithRepositoriesFile reads and writes the list of repositories at path in the filesystem, instead
+// of /etc/apk/repositories, e.g. to keep several configurations side by side.
+func WithRepositoriesFile(path string) Option {
+	return func(o *opts) error {
+		o.reposFile = configPath(path)
+		return nil
+	}
+}
+
+// WithArchFile reads the arch of the root from path in the filesystem, instead of /etc/apk/arch.
+// InitDB writes the arch there too.
+func WithArchFile(path string) Option {
+	return func(o *opts) error {
+		o.archFile = configPath(path)
+		return nil
+	}
+}
+
+// WithWorldFile reads and writes world at path in the filesystem, instead of /etc/apk/world.
+func WithWorldFile(path string) Option {
+	return func(o *opts) error {
+		o.worldFile = configPath(path)
+		return nil
+	}
+}
+
+// WithKeysDir reads and writes the keys to verify indexes and packages with in the directory path in
+// the filesystem, instead of /etc/apk/keys.
+func WithKeysDir(path string) Option {
+	return func(o *opts) error {
+		o.keysDir = configPath(path)
+		return nil
+	}
+}
+
+// configPath returns path relative to the root of the filesystem, as all paths in it are.
+func configPath(path string) string {
+	return strings.TrimPrefix(filepath.Clean(path), "/")
+}
+
 func defaultOpts() *opts {
 	fs := apkfs.DirFS("/")
 	discardLogger := &logrus.Logger{Out: io.Discard}
@@ -119,5 +693,12 @@ func defaultOpts() *opts {
 		arch:              ArchToAPK(runtime.GOARCH),
 		ignoreMknodErrors: false,
 		fs:                fs,
+		normalizeArch:     true,
+		http2:             true,
+		reposFile:         reposFilePath,
+		archFile:          archFilePath,
+		worldFile:         worldFilePath,
+		keysDir:           keysDirPath,
+		cacheHash:         crypto.SHA1,
 	}
 }
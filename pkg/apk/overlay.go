@@ -0,0 +1,94 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// ResolveOverlay resolves world on top of lock, an install plan resolved before, e.g. by
+// ResolveWorldPlan for a base image, and returns only the packages to add to it, in install order,
+// along with the packages they conflict with. Packages in lock are kept at their locked versions, and
+// satisfy dependencies like installed packages do, but unlike Add, nothing has to be installed: the
+// lock is the baseline. Only what lock does not have yet is resolved, so the result is consistent
+// with the base. It fails if anything in world requires a different version of a locked package.
+func (a *APK) ResolveOverlay(ctx context.Context, lock []PlannedPackage, world []string) ([]*repository.RepositoryPackage, []string, error) {
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a.ResolveOverlayWithIndexes(ctx, indexes, lock, world)
+}
+
+// ResolveOverlayWithIndexes is like ResolveOverlay, but uses the given indexes instead of fetching
+// them. Every package in lock must be in indexes, and not be excluded by a hold, see WithHolds.
+func (a *APK) ResolveOverlayWithIndexes(ctx context.Context, indexes []NamedIndex, lock []PlannedPackage, world []string) ([]*repository.RepositoryPackage, []string, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveOverlay")
+	defer span.End()
+
+	held, err := a.applyHolds(indexes)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolver := NewPkgResolver(ctx, held, a.resolverOptions()...)
+	// a hold can leave out a locked version, which is a conflict rather than a stale lock, so tell
+	// them apart with the indexes as they are
+	all := resolver
+	if len(a.holds) > 0 {
+		all = NewPkgResolver(ctx, indexes, a.resolverOptions()...)
+	}
+	existing := make(map[string]*repository.RepositoryPackage, len(lock))
+	for _, locked := range lock {
+		pkg := resolver.lockedPackage(locked)
+		if pkg == nil {
+			if all.lockedPackage(locked) != nil {
+				return nil, nil, fmt.Errorf("locked package %s %s (%s) conflicts with the holds %v", locked.Name, locked.Version, locked.Checksum, a.holds)
+			}
+			return nil, nil, fmt.Errorf("locked package %s %s (%s) is not in the indexes", locked.Name, locked.Version, locked.Checksum)
+		}
+		existing[pkg.Name] = pkg
+	}
+
+	toInstall, conflicts, err := a.resolveOnBaseline(resolver, existing, world, "locked")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := a.checkBlocked(toInstall); err != nil {
+		return nil, nil, err
+	}
+	return toInstall, conflicts, nil
+}
+
+// lockedPackage returns the package in the indexes that locked refers to, by name and version, and
+// by checksum and repository where locked has them, or nil if there is none.
+func (p *PkgResolver) lockedPackage(locked PlannedPackage) *repository.RepositoryPackage {
+	for _, pkg := range p.nameMap[locked.Name] {
+		if pkg.Name != locked.Name || pkg.Version != locked.Version {
+			continue
+		}
+		if locked.Checksum != "" && pkg.ChecksumString() != locked.Checksum {
+			continue
+		}
+		if locked.Repo != "" && (pkg.Repository() == nil || pkg.Repository().Uri != locked.Repo) {
+			continue
+		}
+		return pkg.RepositoryPackage
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestResolveOverlay(t *testing.T) {
+	ctx := context.Background()
+	repo := repository.Repository{Uri: "https://example.com/main"}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "base", Version: "1.0.0-r0", Arch: testArch, Checksum: []byte("base-1.0.0")},
+		{Name: "base", Version: "1.1.0-r0", Arch: testArch, Checksum: []byte("base-1.1.0")},
+		{Name: "libfoo", Version: "2.0.0-r0", Arch: testArch, Checksum: []byte("libfoo-2.0.0"), Dependencies: []string{"base"}},
+		{Name: "app", Version: "1.0.0-r0", Arch: testArch, Checksum: []byte("app-1.0.0"), Dependencies: []string{"base", "libfoo"}},
+	}})})
+	lockedPackage := func(name, version string) PlannedPackage {
+		for _, pkg := range indexes[0].Packages() {
+			if pkg.Name == name && pkg.Version == version {
+				return PlannedPackage{Name: name, Version: version, Repo: repo.Uri, Checksum: pkg.ChecksumString()}
+			}
+		}
+		t.Fatalf("no package %s %s", name, version)
+		return PlannedPackage{}
+	}
+	lock := []PlannedPackage{lockedPackage("base", "1.0.0-r0")}
+	a := testGetTestAPKWithRepos(t)
+
+	t.Run("only deltas", func(t *testing.T) {
+		pkgs, conflicts, err := a.ResolveOverlayWithIndexes(ctx, indexes, lock, []string{"app"})
+		require.NoError(t, err)
+		require.Empty(t, conflicts)
+		var resolved []string
+		for _, pkg := range pkgs {
+			resolved = append(resolved, pkg.Name+"-"+pkg.Version)
+		}
+		require.Equal(t, []string{"libfoo-2.0.0-r0", "app-1.0.0-r0"}, resolved)
+	})
+	t.Run("locked version wins", func(t *testing.T) {
+		_, _, err := a.ResolveOverlayWithIndexes(ctx, indexes, lock, []string{"base>1.0.0-r0"})
+		require.ErrorContains(t, err, "1.0.0-r0 is locked")
+	})
+	t.Run("locked package not in indexes", func(t *testing.T) {
+		stale := lockedPackage("base", "1.0.0-r0")
+		stale.Checksum = "Q1bm90IGluIHRoZSBpbmRleA=="
+		_, _, err := a.ResolveOverlayWithIndexes(ctx, indexes, []PlannedPackage{stale}, []string{"app"})
+		require.ErrorContains(t, err, "is not in the indexes")
+	})
+	t.Run("locked package held back", func(t *testing.T) {
+		held := testGetTestAPKWithRepos(t)
+		held.holds = []string{"base>1.0.0-r0"}
+		_, _, err := held.ResolveOverlayWithIndexes(ctx, indexes, lock, []string{"app"})
+		require.ErrorContains(t, err, "conflicts with the holds")
+		require.NotContains(t, err.Error(), "is not in the indexes")
+	})
+}
@@ -15,34 +15,160 @@
 package apk
 
 import (
+	"archive/tar"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
 
 	"gitlab.alpinelinux.org/alpine/go/repository"
 )
 
+// PackageFilename returns the file name of pkg in a repository, <name>-<version>.apk, as apk uses it
+// to fetch the package, e.g. to lay out a mirror or a local repository that apk can use.
+func PackageFilename(pkg *repository.RepositoryPackage) string {
+	return fmt.Sprintf("%s-%s.apk", pkg.Name, pkg.Version)
+}
+
 // PackageToIndex takes a Package and returns it as the string representation of lines in an index file.
+// Fields are emitted in the same order as apk-tools, and optional fields are omitted when unset.
 func PackageToIndex(pkg *repository.Package) (out []string) {
+	if len(pkg.Checksum) > 0 {
+		out = append(out, fmt.Sprintf("C:Q1%s", base64.StdEncoding.EncodeToString(pkg.Checksum)))
+	}
 	out = append(out, fmt.Sprintf("P:%s", pkg.Name))
 	out = append(out, fmt.Sprintf("V:%s", pkg.Version))
-	out = append(out, fmt.Sprintf("A:%s", pkg.Arch))
-	out = append(out, fmt.Sprintf("L:%s", pkg.License))
-	out = append(out, fmt.Sprintf("T:%s", pkg.Description))
-	out = append(out, fmt.Sprintf("o:%s", pkg.Origin))
-	out = append(out, fmt.Sprintf("m:%s", pkg.Maintainer))
-	out = append(out, fmt.Sprintf("U:%s", pkg.URL))
-	out = append(out, fmt.Sprintf("D:%s", strings.Join(pkg.Dependencies, " ")))
-	out = append(out, fmt.Sprintf("p:%s", strings.Join(pkg.Provides, " ")))
-	out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
-	out = append(out, fmt.Sprintf("i:%s", pkg.InstallIf))
-	out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
+	if pkg.Arch != "" {
+		out = append(out, fmt.Sprintf("A:%s", pkg.Arch))
+	}
 	out = append(out, fmt.Sprintf("S:%d", pkg.Size))
 	out = append(out, fmt.Sprintf("I:%d", pkg.InstalledSize))
-	out = append(out, fmt.Sprintf("k:%d", pkg.ProviderPriority))
-	if len(pkg.Checksum) > 0 {
-		out = append(out, fmt.Sprintf("C:Q1%s", base64.StdEncoding.EncodeToString(pkg.Checksum)))
+	out = append(out, fmt.Sprintf("T:%s", pkg.Description))
+	out = append(out, fmt.Sprintf("U:%s", pkg.URL))
+	out = append(out, fmt.Sprintf("L:%s", pkg.License))
+	if pkg.Origin != "" {
+		out = append(out, fmt.Sprintf("o:%s", pkg.Origin))
+	}
+	if pkg.Maintainer != "" {
+		out = append(out, fmt.Sprintf("m:%s", pkg.Maintainer))
+	}
+	if !pkg.BuildTime.IsZero() && pkg.BuildTime.Unix() != 0 {
+		out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
+	}
+	if pkg.RepoCommit != "" {
+		out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
+	}
+	if pkg.ProviderPriority != 0 {
+		out = append(out, fmt.Sprintf("k:%d", pkg.ProviderPriority))
+	}
+	if len(pkg.Dependencies) > 0 {
+		out = append(out, fmt.Sprintf("D:%s", strings.Join(pkg.Dependencies, " ")))
+	}
+	if len(pkg.Provides) > 0 {
+		out = append(out, fmt.Sprintf("p:%s", strings.Join(pkg.Provides, " ")))
+	}
+	if len(pkg.InstallIf) > 0 {
+		out = append(out, fmt.Sprintf("i:%s", strings.Join(pkg.InstallIf, " ")))
 	}
 
 	return
 }
+
+// parsePkgInfo reads the .PKGINFO file from a package's control section in tar.gz format, and returns
+// the package metadata it declares. Fields that only exist in an index, such as the checksum and the
+// compressed size, are left for the caller to fill in.
+func parsePkgInfo(controlTarGz io.Reader) (*repository.Package, error) {
+	gz, err := gzip.NewReader(controlTarGz)
+	if err != nil {
+		return nil, fmt.Errorf("unable to gunzip control tar file: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("no .PKGINFO in control tar.gz file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == ".PKGINFO" {
+			break
+		}
+	}
+
+	pkg := &repository.Package{}
+	var replaces []string
+	if err := readPkgInfoLines(tr, func(b []byte) error {
+		line := string(b)
+		if strings.HasPrefix(line, "#") {
+			return nil
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil
+		}
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		switch key {
+		case "pkgname":
+			pkg.Name = val
+		case "pkgver":
+			pkg.Version = val
+		case "arch":
+			pkg.Arch = val
+		case "pkgdesc":
+			pkg.Description = val
+		case "license":
+			pkg.License = val
+		case "origin":
+			pkg.Origin = val
+		case "maintainer":
+			pkg.Maintainer = val
+		case "url":
+			pkg.URL = val
+		case "commit":
+			pkg.RepoCommit = val
+		case "depend":
+			pkg.Dependencies = append(pkg.Dependencies, val)
+		case "provides":
+			pkg.Provides = append(pkg.Provides, val)
+		case "replaces":
+			replaces = append(replaces, val)
+		case "install_if":
+			pkg.InstallIf = append(pkg.InstallIf, strings.Fields(val)...)
+		case "builddate":
+			i, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("cannot parse build date %s: %w", val, err)
+			}
+			pkg.BuildTime = time.Unix(i, 0).UTC()
+		case "size":
+			size, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("cannot parse size %s: %w", val, err)
+			}
+			pkg.InstalledSize = size
+		case "provider_priority":
+			priority, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("cannot parse provider priority %s: %w", val, err)
+			}
+			pkg.ProviderPriority = priority
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if pkg.Name == "" || pkg.Version == "" {
+		return nil, fmt.Errorf(".PKGINFO is missing pkgname or pkgver")
+	}
+	pkg.Replaces = strings.Join(replaces, " ")
+
+	return pkg, nil
+}
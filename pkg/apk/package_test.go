@@ -0,0 +1,30 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestPackageFilename(t *testing.T) {
+	repo := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "https://example.com/main/aarch64"}}
+	pkg := repository.NewRepositoryPackage(&repository.Package{Name: "py3-foo", Version: "1.2.3_rc1-r4"}, repo)
+	require.Equal(t, "py3-foo-1.2.3_rc1-r4.apk", PackageFilename(pkg))
+	require.Equal(t, path.Base(pkg.Url()), PackageFilename(pkg), "the file name is the one fetched")
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// PlannedPackage is a single package of the install plan for world, as returned by ResolveWorldPlan.
+type PlannedPackage struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Repo     string `json:"repo"`
+	URL      string `json:"url"`
+	Checksum string `json:"checksum"`
+	Size     uint64 `json:"size"`
+	// Direct is true for packages named in world, and false for the ones pulled in as dependencies.
+	Direct bool `json:"direct"`
+	// Signed is true for packages from a repository index whose signature was verified.
+	Signed bool `json:"signed"`
+	// FallbackArch is the arch of packages for a compatible arch, see WithCompatibleArchs, used
+	// because there is no package of the name for the arch of the root; it is empty otherwise.
+	FallbackArch string `json:"fallbackArch,omitempty"`
+}
+
+// ResolveWorldPlan resolves world like ResolveWorld, and returns the packages to install in install order.
+func (a *APK) ResolveWorldPlan(ctx context.Context) ([]PlannedPackage, error) {
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	toInstall, _, err := a.ResolveWorldWithIndexes(ctx, indexes)
+	if err != nil {
+		return nil, err
+	}
+	signed := signedRepositories(indexes)
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	direct := make(map[string]bool, len(world))
+	for _, entry := range world {
+		direct[resolvePackageNameVersionPin(entry).name] = true
+	}
+
+	plan := make([]PlannedPackage, 0, len(toInstall))
+	for _, pkg := range toInstall {
+		planned := PlannedPackage{
+			Name:     pkg.Name,
+			Version:  pkg.Version,
+			Checksum: pkg.ChecksumString(),
+			Size:     pkg.Size,
+			Direct:   isDirect(pkg, direct),
+			Signed:   pkg.Repository() != nil && signed[pkg.Repository()],
+		}
+		if a.isFallbackArch(pkg) {
+			planned.FallbackArch = pkg.Arch
+		}
+		// virtual packages do not come from a repository
+		if repo := pkg.Repository(); repo != nil && repo.Repository != nil && repo.Uri != "" {
+			planned.Repo = repo.Uri
+			planned.URL = pkg.Url()
+		}
+		plan = append(plan, planned)
+	}
+	return plan, nil
+}
+
+// FetchError is a resolved package that VerifyFetchable could not fetch.
+type FetchError struct {
+	Package *repository.RepositoryPackage
+	URL     string
+	Err     error
+}
+
+func (e FetchError) Error() string {
+	return fmt.Sprintf("unable to fetch %s-%s from %s: %v", e.Package.Name, e.Package.Version, e.URL, e.Err)
+}
+
+func (e FetchError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyFetchable resolves world like ResolveWorld, and checks that every resolved package can be
+// fetched, with a HEAD request, or a request for the first byte where HEAD is not allowed, through
+// the configured client and mirrors, without fetching or installing anything. It returns the
+// packages that cannot be fetched, in install order, e.g. because an index references a package
+// that a mirror no longer has. Packages in OCI repositories are not checked.
+func (a *APK) VerifyFetchable(ctx context.Context) ([]FetchError, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "VerifyFetchable")
+	defer span.End()
+
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	toInstall, _, err := a.ResolveWorldWithIndexes(ctx, indexes)
+	if err != nil {
+		return nil, err
+	}
+
+	client := withAuthStrippingRedirects(a.httpClient())
+	results := make([]error, len(toInstall))
+	var g errgroup.Group
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for i, pkg := range toInstall {
+		i, pkg := i, pkg
+		// virtual packages have nothing to fetch
+		if isVirtual(pkg.Package) {
+			continue
+		}
+		g.Go(func() error {
+			results[i] = a.checkFetchable(ctx, client, pkg)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	var fetchErrors []FetchError
+	for i, err := range results {
+		if err != nil {
+			fetchErrors = append(fetchErrors, FetchError{Package: toInstall[i], URL: toInstall[i].Url(), Err: err})
+		}
+	}
+	return fetchErrors, nil
+}
+
+// checkFetchable checks that pkg can be fetched, as fetchPackage would, without fetching it.
+func (a *APK) checkFetchable(ctx context.Context, client *http.Client, pkg *repository.RepositoryPackage) error {
+	u := pkg.Url()
+	asURL, err := packageAsURL(pkg)
+	if err != nil {
+		return fmt.Errorf("failed to parse package as URL: %w", err)
+	}
+	switch asURL.Scheme {
+	case "file":
+		_, err := os.Stat(u)
+		return err
+	case "https":
+		var errs []error
+		for _, candidate := range mirrorCandidates(u, a.mirrors, nil) {
+			err := checkPackageURL(ctx, client, candidate)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	case ociScheme:
+		return nil
+	case bundleScheme:
+		_, err := os.Stat(path.Dir(strings.TrimPrefix(u, bundleScheme+"://")))
+		return err
+	default:
+		return fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+	}
+}
+
+// checkPackageURL checks that the package at u can be fetched with client, with a HEAD request, or
+// a request for only its first byte if the server does not allow HEAD.
+func checkPackageURL(ctx context.Context, client *http.Client, u string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented {
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil); err != nil {
+			return err
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		if res, err = client.Do(req); err != nil {
+			return err
+		}
+		res.Body.Close()
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s: status %d", u, res.StatusCode)
+	}
+	return nil
+}
+
+// ResolveWorldJSON returns the install plan from ResolveWorldPlan as a JSON array.
+func (a *APK) ResolveWorldJSON(ctx context.Context) ([]byte, error) {
+	plan, err := a.ResolveWorldPlan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(plan)
+}
+
+// isDirect reports whether pkg satisfies one of the given world names, either by name or by
+// something it provides.
+func isDirect(pkg *repository.RepositoryPackage, world map[string]bool) bool {
+	if world[pkg.Name] {
+		return true
+	}
+	for _, provide := range pkg.Provides {
+		if world[resolvePackageNameVersionPin(provide).name] {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingChanges compares world, resolved against the configured repositories, with the installed
+// packages. It returns the packages that fixating world would install, in install order, and the
+// installed packages that would then no longer be reachable from world, and so be removed by GC. As
+// FixateWorld does not upgrade installed packages, ones that resolve to another version are neither
+// installed nor removed. It does not change anything.
+func (a *APK) PendingChanges(ctx context.Context) (toInstall, toRemove []*repository.RepositoryPackage, err error) {
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a.PendingChangesWithIndexes(ctx, indexes)
+}
+
+// PendingChangesWithIndexes is like PendingChanges, but uses the given indexes, e.g. from LoadIndexes,
+// instead of fetching them.
+func (a *APK) PendingChangesWithIndexes(ctx context.Context, indexes []NamedIndex) (toInstall, toRemove []*repository.RepositoryPackage, err error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "PendingChanges")
+	defer span.End()
+
+	resolved, _, err := a.ResolveWorldWithIndexes(ctx, indexes)
+	if err != nil {
+		return nil, nil, err
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+
+	// what will be installed after fixating: everything that already is installed, at the
+	// installed version, and the resolved packages that are not installed at any version
+	installedNames := make(map[string]bool, len(installed))
+	for _, pkg := range installed {
+		installedNames[pkg.Name] = true
+	}
+	after := make([]*InstalledPackage, 0, len(installed)+len(resolved))
+	after = append(after, installed...)
+	for _, pkg := range resolved {
+		if !installedNames[pkg.Name] {
+			after = append(after, &InstalledPackage{Package: *pkg.Package})
+			toInstall = append(toInstall, pkg)
+		}
+	}
+
+	removed, err := orphans(ctx, after, world)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, pkg := range removed {
+		pkg := pkg.Package
+		toRemove = append(toRemove, repository.NewRepositoryPackage(&pkg, nil))
+	}
+	return toInstall, toRemove, nil
+}
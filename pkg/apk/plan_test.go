@@ -0,0 +1,153 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestResolveWorldJSON(t *testing.T) {
+	ctx := context.Background()
+	a := testGetTestAPKWithRepos(t)
+	require.NoError(t, a.SetWorld([]string{"alpine-baselayout"}))
+
+	toInstall, _, err := a.ResolveWorld(ctx)
+	require.NoError(t, err)
+
+	b, err := a.ResolveWorldJSON(ctx)
+	require.NoError(t, err)
+	var plan []PlannedPackage
+	require.NoError(t, json.Unmarshal(b, &plan))
+	require.Len(t, plan, len(toInstall))
+
+	for i, planned := range plan {
+		pkg := toInstall[i]
+		require.Equal(t, pkg.Name, planned.Name, "plan must keep the install order")
+		require.Equal(t, pkg.Version, planned.Version)
+		require.Equal(t, pkg.ChecksumString(), planned.Checksum)
+		require.Equal(t, pkg.Size, planned.Size)
+		require.Equal(t, pkg.Url(), planned.URL)
+		require.True(t, strings.HasPrefix(planned.URL, planned.Repo+"/"), "url %s should be in repo %s", planned.URL, planned.Repo)
+		require.Equal(t, pkg.Name == "alpine-baselayout", planned.Direct, "package %s", pkg.Name)
+	}
+
+	// the raw JSON uses the documented field names
+	var raw []map[string]any
+	require.NoError(t, json.Unmarshal(b, &raw))
+	for _, key := range []string{"name", "version", "repo", "url", "checksum", "size", "direct"} {
+		require.Contains(t, raw[0], key)
+	}
+}
+
+// testNoHeadTransport rejects HEAD requests, like some servers do, and passes anything else on.
+type testNoHeadTransport struct {
+	http.RoundTripper
+}
+
+func (t testNoHeadTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Method == http.MethodHead {
+		return &http.Response{StatusCode: http.StatusMethodNotAllowed, Body: http.NoBody}, nil
+	}
+	return t.RoundTripper.RoundTrip(request)
+}
+
+func TestVerifyFetchable(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name      string
+		transport http.RoundTripper
+	}{
+		{name: "head", transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}},
+		{name: "head not allowed", transport: testNoHeadTransport{&testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testGetTestAPKWithRepos(t)
+			a.SetClient(&http.Client{Transport: tt.transport})
+			require.NoError(t, a.SetWorld([]string{"alpine-baselayout"}))
+			toInstall, _, err := a.ResolveWorld(ctx)
+			require.NoError(t, err)
+
+			// only alpine-baselayout itself is in the test repository
+			var expected []string
+			for _, pkg := range toInstall {
+				if pkg.Name != "alpine-baselayout" {
+					expected = append(expected, pkg.Name)
+				}
+			}
+			require.NotEmpty(t, expected)
+
+			fetchErrors, err := a.VerifyFetchable(ctx)
+			require.NoError(t, err)
+			var missing []string
+			for _, fetchErr := range fetchErrors {
+				missing = append(missing, fetchErr.Package.Name)
+				require.Equal(t, fetchErr.Package.Url(), fetchErr.URL)
+				require.ErrorContains(t, fetchErr, "status 404")
+			}
+			require.Equal(t, expected, missing)
+		})
+	}
+}
+
+func TestPendingChanges(t *testing.T) {
+	ctx := context.Background()
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld([]string{"alpine-baselayout", "newpkg"}))
+
+	// the repository has everything that is installed, with busybox upgraded, and a new package
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	var pkgs []*repository.Package
+	for _, pkg := range installed {
+		pkg := pkg.Package
+		if pkg.Name == "busybox" {
+			pkg.Version = "1.36.0-r0"
+		}
+		pkgs = append(pkgs, &pkg)
+	}
+	pkgs = append(pkgs, &repository.Package{Name: "newpkg", Version: "1.0.0-r0", Dependencies: []string{"/bin/sh"}})
+	repo := repository.Repository{Uri: "https://example.com/main/aarch64"}
+	indexes := []NamedIndex{NewNamedRepositoryWithIndex("", repo.WithIndex(&repository.ApkIndex{Packages: pkgs}))}
+
+	names := func(pkgs []*repository.RepositoryPackage) (out []string) {
+		for _, pkg := range pkgs {
+			out = append(out, pkg.Name+"-"+pkg.Version)
+		}
+		return out
+	}
+	toInstall, toRemove, err := a.PendingChangesWithIndexes(ctx, indexes)
+	require.NoError(t, err)
+	// fixating does not upgrade the installed busybox
+	require.Equal(t, []string{"newpkg-1.0.0-r0"}, names(toInstall))
+	require.Equal(t, []string{
+		"alpine-keys-2.4-r1", "ca-certificates-bundle-20220614-r0", "libcrypto1.1-1.1.1q-r0",
+		"libssl1.1-1.1.1q-r0", "ssl_client-1.35.0-r17", "zlib-1.2.12-r3", "apk-tools-2.12.9-r3",
+		"scanelf-1.3.4-r0", "musl-utils-1.2.3-r0", "libc-utils-0.7.2-r3",
+	}, names(toRemove))
+
+	// nothing changed on disk
+	after, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, after, len(installed))
+}
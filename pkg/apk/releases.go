@@ -16,6 +16,7 @@ package apk
 
 import (
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -95,3 +96,34 @@ func (r ReleaseBranch) KeysFor(arch string, date time.Time) []string {
 	}
 	return urls
 }
+
+// releasesCache holds parsed releases documents keyed by URL, so that they can be
+// shared across InitDB calls in the same process.
+type releasesCache struct {
+	mu      sync.Mutex
+	entries map[string]releasesCacheEntry
+}
+
+type releasesCacheEntry struct {
+	releases *Releases
+	fetched  time.Time
+}
+
+var globalReleasesCache = &releasesCache{entries: map[string]releasesCacheEntry{}}
+
+// get returns the cached releases for the URL, if present and not older than ttl.
+func (c *releasesCache) get(u string, ttl time.Duration) (*Releases, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[u]
+	if !ok || time.Since(entry.fetched) > ttl {
+		return nil, false
+	}
+	return entry.releases, true
+}
+
+func (c *releasesCache) put(u string, releases *Releases) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[u] = releasesCacheEntry{releases: releases, fetched: time.Now()}
+}
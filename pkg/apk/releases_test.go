@@ -0,0 +1,126 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+type testCountingTransport struct {
+	body  []byte
+	count int
+}
+
+func (t *testCountingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.count++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(t.body)),
+	}, nil
+}
+
+func TestFetchReleases(t *testing.T) {
+	body := []byte(`{"latest_stable":"v3.18","release_branches":[{"rel_branch":"v3.18"}]}`)
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		expected int
+	}{
+		{"no cache", 0, 3},
+		{"with cache", time.Hour, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := New(WithFS(apkfs.NewMemFS()), WithReleasesCacheTTL(tt.ttl))
+			require.NoError(t, err)
+			tr := &testCountingTransport{body: body}
+			client := &http.Client{Transport: tr}
+			// unique per subtest so that the process-wide cache does not leak between them
+			u := "https://example.com/" + t.Name() + "/releases.json"
+			for i := 0; i < 3; i++ {
+				releases, err := a.fetchReleases(context.Background(), client, u)
+				require.NoError(t, err)
+				require.Equal(t, "v3.18", releases.LatestStable)
+			}
+			require.Equal(t, tt.expected, tr.count)
+		})
+	}
+}
+
+// testURLTransport serves the bodies in responses by URL, and records the URLs requested.
+type testURLTransport struct {
+	responses map[string][]byte
+	requested []string
+}
+
+func (t *testURLTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	u := request.URL.String()
+	t.requested = append(t.requested, u)
+	body, ok := t.responses[u]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func TestFetchAlpineKeysTime(t *testing.T) {
+	const (
+		oldKey = "https://example.com/keys/old.rsa.pub"
+		newKey = "https://example.com/keys/new.rsa.pub"
+	)
+	releases := []byte(`{"release_branches":[{"rel_branch":"v3.18","keys":{"x86_64":[` +
+		`{"url":"` + oldKey + `","deprecated_since":"2023-01-01"},{"url":"` + newKey + `"}]}}]}`)
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected []string
+	}{
+		{"now", nil, []string{newKey}},
+		{"before deprecation", []Option{WithKeysTime(time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC))}, []string{oldKey, newKey}},
+		{"after deprecation", []Option{WithKeysTime(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC))}, []string{newKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := New(append([]Option{WithFS(apkfs.NewMemFS()), WithArch("x86_64")}, tt.opts...)...)
+			require.NoError(t, err)
+			require.NoError(t, a.fs.MkdirAll(a.keysDir, 0o755))
+			tr := &testURLTransport{responses: map[string][]byte{
+				alpineReleasesURL: releases,
+				oldKey:            []byte("old"),
+				newKey:            []byte("new"),
+			}}
+			a.SetClient(&http.Client{Transport: tr})
+			headers, err := a.fetchAlpineKeys(context.Background(), []string{"v3.18"})
+			require.NoError(t, err)
+			require.Equal(t, append([]string{alpineReleasesURL}, tt.expected...), tr.requested)
+			require.Len(t, headers, len(tt.expected))
+			for i, u := range tt.expected {
+				require.Equal(t, "/"+filepath.Join(a.keysDir, path.Base(u)), headers[i].Name)
+				require.Equal(t, int64(3), headers[i].Size)
+			}
+		})
+	}
+}
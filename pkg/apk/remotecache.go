@@ -0,0 +1,171 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// RemoteCache is a package cache shared between machines, e.g. by a team, that is tried before the
+// repository of a package when it is not in the local cache, see WithRemoteCache. Packages are the
+// .apk files as in the repository, keyed by the hex encoded SHA1 checksum of their control section,
+// as in the index.
+type RemoteCache interface {
+	// Get returns the package with checksum. If there is none, the error wraps fs.ErrNotExist.
+	// The caller closes the returned reader.
+	Get(ctx context.Context, checksum string) (io.ReadCloser, error)
+	// Put stores the package read from r under checksum.
+	Put(ctx context.Context, checksum string, r io.Reader) error
+}
+
+// HTTPRemoteCache is a RemoteCache in an HTTP object store, which has each package at the cache URL
+// followed by /<checksum>.apk. Packages are read with GET and stored with PUT.
+type HTTPRemoteCache struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPRemoteCache returns a RemoteCache at url, using client, or http.DefaultClient if nil.
+func NewHTTPRemoteCache(url string, client *http.Client) *HTTPRemoteCache {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPRemoteCache{url: strings.TrimSuffix(url, "/"), client: client}
+}
+
+func (h *HTTPRemoteCache) Get(ctx context.Context, checksum string) (io.ReadCloser, error) {
+	u := h.packageURL(checksum)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, fmt.Errorf("%s: %w", u, fs.ErrNotExist)
+	default:
+		res.Body.Close()
+		return nil, fmt.Errorf("unable to get %s: %v", u, res.Status)
+	}
+}
+
+func (h *HTTPRemoteCache) Put(ctx context.Context, checksum string, r io.Reader) error {
+	u := h.packageURL(checksum)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, r)
+	if err != nil {
+		return err
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unable to put %s: %v", u, res.Status)
+	}
+	return nil
+}
+
+func (h *HTTPRemoteCache) packageURL(checksum string) string {
+	return fmt.Sprintf("%s/%s.apk", h.url, checksum)
+}
+
+// remoteCachedPackage returns pkg expanded from the remote cache into cacheDir, or an error if it is
+// not there. A package whose control section does not match the checksum in the index, or whose data
+// section does not match the datahash of its control section, is a miss.
+func (a *APK) remoteCachedPackage(ctx context.Context, pkg *repository.RepositoryPackage, cacheDir string, expandOpts []ExpandApkOption) (*APKExpanded, error) {
+	checksum, err := packageChecksum(pkg)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := a.remoteCache.Get(ctx, hex.EncodeToString(checksum))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	exp, err := ExpandApk(ctx, rc, cacheDir, expandOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s from remote cache: %w", pkg.Name, err)
+	}
+	if err := a.checkExpanded(exp, checksum); err != nil {
+		exp.Close()
+		return nil, fmt.Errorf("package in remote cache: %w", err)
+	}
+	return exp, nil
+}
+
+// checkExpanded checks that exp is the package with the control checksum from the index, and that
+// its data section is the one that control section refers to.
+func (a *APK) checkExpanded(exp *APKExpanded, checksum []byte) error {
+	if !bytes.Equal(exp.ControlHash, checksum) {
+		return errors.New("control section does not match the checksum in the index")
+	}
+	f, err := os.Open(exp.ControlFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	datahash, err := a.datahash(f)
+	if err != nil {
+		return err
+	}
+	if datahash != hex.EncodeToString(exp.PackageHash) {
+		return errors.New("data section does not match the datahash of the control section")
+	}
+	return nil
+}
+
+// pushRemoteCache stores pkg, as expanded in exp, in the remote cache. The package is the signature,
+// control and data sections of exp, which are the gzip streams of the .apk file as they are.
+func (a *APK) pushRemoteCache(ctx context.Context, pkg *repository.RepositoryPackage, exp *APKExpanded) error {
+	checksum, err := packageChecksum(pkg)
+	if err != nil {
+		return err
+	}
+	// never share a package that is not what the index says it is
+	if err := a.checkExpanded(exp, checksum); err != nil {
+		return err
+	}
+	var readers []io.Reader
+	for _, name := range []string{exp.SignatureFile, exp.ControlFile, exp.PackageFile} {
+		if name == "" {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	return a.remoteCache.Put(ctx, hex.EncodeToString(checksum), io.MultiReader(readers...))
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// testObjectStore is an HTTP object store that keeps what is PUT in memory.
+type testObjectStore struct {
+	sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func (s *testObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		s.gets++
+		b, ok := s.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(b)
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.objects[r.URL.Path] = b
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	var (
+		repo          = repository.Repository{Uri: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+		repoWithIndex = repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{&testPkg}})
+		pkg           = repository.NewRepositoryPackage(&testPkg, repoWithIndex)
+		ctx           = context.Background()
+		key           = "/cache/" + hex.EncodeToString(testPkg.Checksum) + ".apk"
+	)
+	original, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+	require.NoError(t, err)
+	store := &testObjectStore{objects: map[string][]byte{}}
+	srv := httptest.NewServer(store)
+	defer srv.Close()
+	remote := NewHTTPRemoteCache(srv.URL+"/cache/", srv.Client())
+
+	prep := func(t *testing.T, transport http.RoundTripper, push bool) *APK {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithCache(t.TempDir(), false), WithRemoteCache(remote, push))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: transport})
+		return a
+	}
+
+	t.Run("push on fill", func(t *testing.T) {
+		a := prep(t, &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}, true)
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		exp.Close()
+		require.Equal(t, original, store.objects[key], "the package is stored as it is in the repository")
+	})
+	t.Run("read through", func(t *testing.T) {
+		// the repository is not reachable, so the package can only come from the remote cache
+		a := prep(t, &testLocalTransport{fail: true}, false)
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		require.Equal(t, testPkg.Checksum, exp.ControlHash)
+		require.True(t, strings.HasPrefix(exp.ControlFile, a.cache.dir), "filled into the local cache")
+		exp.Close()
+
+		gets := store.gets
+		exp, err = a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		exp.Close()
+		require.Equal(t, gets, store.gets, "local cache hits do not go to the remote cache")
+	})
+	t.Run("mismatch is a miss", func(t *testing.T) {
+		store.objects[key] = original[:len(original)/2]
+		a := prep(t, &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}, false)
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err, "falls back to the repository")
+		exp.Close()
+	})
+	t.Run("tampered data section", func(t *testing.T) {
+		// the signature and control section of the package, followed by some other data section
+		exp, err := ExpandApk(ctx, bytes.NewReader(original), t.TempDir())
+		require.NoError(t, err)
+		defer exp.Close()
+		var tampered bytes.Buffer
+		for _, name := range []string{exp.SignatureFile, exp.ControlFile} {
+			b, err := os.ReadFile(name)
+			require.NoError(t, err)
+			tampered.Write(b)
+		}
+		zw := gzip.NewWriter(&tampered)
+		tw := tar.NewWriter(zw)
+		content := []byte("not what the control section says")
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/tampered", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}))
+		_, err = tw.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		require.NoError(t, zw.Close())
+		store.objects[key] = tampered.Bytes()
+
+		// the repository is not reachable, so a miss fails
+		a := prep(t, &testLocalTransport{fail: true}, false)
+		_, err = a.expandPackage(ctx, pkg)
+		require.Error(t, err, "the tampered package is not used")
+	})
+}
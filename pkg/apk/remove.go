@@ -0,0 +1,230 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// GC removes every installed package that is not reachable from world, as reported by ListOrphans,
+// along with its files, scripts and triggers. Running it again without changing world is a no-op.
+// If sourceDateEpoch is set, it is used as the modification time of the rewritten scripts.tar entries.
+func (a *APK) GC(ctx context.Context, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GC")
+	defer span.End()
+
+	orphans, err := a.ListOrphans(ctx)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		a.logger.Debugf("no orphaned packages to remove")
+		return nil
+	}
+	for _, pkg := range orphans {
+		a.logger.Infof("removing orphaned package %s (%s)", pkg.Name, pkg.Version)
+	}
+	return a.removePackages(orphans, sourceDateEpoch)
+}
+
+// RemovePackage is the equivalent of `apk del name`: it removes name from world, and then, like GC,
+// every installed package that no longer is reachable from world. For a virtual package added with
+// AddVirtual, that removes the dependencies that nothing else needs along with it. A package that
+// still is required by something else in world stays installed.
+func (a *APK) RemovePackage(ctx context.Context, name string, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "RemovePackage", trace.WithAttributes(attribute.String("package", name)))
+	defer span.End()
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	kept := make([]string, 0, len(world))
+	for _, entry := range world {
+		if resolvePackageNameVersionPin(entry).name != name {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(world) {
+		return fmt.Errorf("package %s is not in world", name)
+	}
+	if err := a.SetWorld(kept); err != nil {
+		return err
+	}
+	if err := a.GC(ctx, sourceDateEpoch); err != nil {
+		return err
+	}
+	isInstalled, err := a.isInstalledPackage(name)
+	if err != nil {
+		return fmt.Errorf("error checking if package %s is installed: %w", name, err)
+	}
+	if isInstalled {
+		a.logger.Warnf("%s is still required by other packages in world, keeping it installed", name)
+	}
+	return nil
+}
+
+// removePackages removes the given installed packages: their files and any directories left
+// empty that no other package owns, their entries in the installed db, and their scripts and
+// triggers.
+func (a *APK) removePackages(pkgs []*InstalledPackage, sourceDateEpoch *time.Time) error {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("error getting installed packages: %w", err)
+	}
+	removed := make(map[string]bool, len(pkgs))
+	for _, pkg := range pkgs {
+		removed[pkg.Name] = true
+	}
+
+	// files and directories still owned by a remaining package must stay
+	owned := map[string]bool{}
+	for _, pkg := range installed {
+		if removed[pkg.Name] {
+			continue
+		}
+		for _, f := range pkg.Files {
+			owned[f.Name] = true
+		}
+	}
+
+	var dirs []string
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			if owned[f.Name] {
+				continue
+			}
+			if f.Typeflag == tar.TypeDir {
+				dirs = append(dirs, f.Name)
+				continue
+			}
+			if err := a.fs.Remove(f.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("unable to remove %s of %s: %w", f.Name, pkg.Name, err)
+			}
+		}
+	}
+	// deepest first, so parents are empty by the time we get to them
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		entries, err := a.fs.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read directory %s: %w", dir, err)
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if err := a.fs.Remove(dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to remove directory %s: %w", dir, err)
+		}
+	}
+
+	if err := a.removeInstalledEntries(removed); err != nil {
+		return err
+	}
+
+	// scripts and triggers are keyed by the package checksum
+	prefixes := make([]string, 0, len(pkgs))
+	triggerKeys := make(map[string]bool, len(pkgs))
+	for _, pkg := range pkgs {
+		prefixes = append(prefixes, scriptsTarPrefix(&pkg.Package)+".")
+		triggerKeys["Q1"+base64.StdEncoding.EncodeToString(pkg.Checksum)] = true
+	}
+
+	scripts, err := a.readScriptsTarEntries()
+	if err != nil {
+		return err
+	}
+	kept := make([]scriptsTarEntry, 0, len(scripts))
+	for _, entry := range scripts {
+		if hasAnyPrefix(entry.header.Name, prefixes) {
+			continue
+		}
+		if sourceDateEpoch != nil {
+			entry.header.ModTime = *sourceDateEpoch
+		}
+		kept = append(kept, entry)
+	}
+	if err := a.writeScriptsTar(kept); err != nil {
+		return fmt.Errorf("unable to update scripts.tar: %w", err)
+	}
+
+	keys, triggers, err := a.readTriggersEntries()
+	if err != nil {
+		return err
+	}
+	keptKeys := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if !triggerKeys[k] {
+			keptKeys = append(keptKeys, k)
+		}
+	}
+	if len(keptKeys) != len(keys) {
+		if err := a.writeTriggers(keptKeys, triggers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeInstalledEntries drops the entries of the named packages from the installed db, leaving
+// every other entry exactly as it was written.
+func (a *APK) removeInstalledEntries(names map[string]bool) error {
+	b, err := a.readInstalledDB()
+	if err != nil {
+		return err
+	}
+	var out strings.Builder
+	for _, entry := range strings.Split(string(b), "\n\n") {
+		if entry = strings.Trim(entry, "\n"); entry == "" {
+			continue
+		}
+		var name string
+		for _, line := range strings.Split(entry, "\n") {
+			if strings.HasPrefix(line, "P:") {
+				name = line[2:]
+				break
+			}
+		}
+		if names[name] {
+			continue
+		}
+		out.WriteString(entry + "\n\n")
+	}
+	return a.writeInstalledDB([]byte(out.String()))
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	prep := func(t *testing.T, world []string) *APK {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+		require.NoError(t, a.SetWorld(world))
+		require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+		require.NoError(t, src.WriteFile("usr/bin/scanelf", []byte("scanelf"), 0o755))
+		return a
+	}
+	installedNames := func(t *testing.T, a *APK) []string {
+		pkgs, err := a.GetInstalled()
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+
+	t.Run("remove everything but world", func(t *testing.T) {
+		a := prep(t, []string{"alpine-keys"})
+		// not owned by any package, so usr/bin must stay
+		require.NoError(t, a.fs.WriteFile("usr/bin/unowned", []byte("mine"), 0o644))
+
+		require.NoError(t, a.GC(ctx, nil))
+		require.Equal(t, []string{"alpine-keys"}, installedNames(t, a))
+
+		_, err := a.fs.Stat("usr/bin/scanelf")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = a.fs.Stat("usr/bin/unowned")
+		require.NoError(t, err)
+
+		entries, err := a.readScriptsTarEntries()
+		require.NoError(t, err)
+		require.Empty(t, entries)
+		triggers, err := a.fs.ReadFile(triggersFilePath)
+		require.NoError(t, err)
+		require.Empty(t, strings.TrimSpace(string(triggers)))
+
+		// nothing left to collect
+		before, err := a.InstalledChecksum()
+		require.NoError(t, err)
+		require.NoError(t, a.GC(ctx, nil))
+		after, err := a.InstalledChecksum()
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+	})
+	t.Run("keep reachable scripts and triggers", func(t *testing.T) {
+		a := prep(t, []string{"alpine-baselayout", "apk-tools"})
+		scriptsBefore, err := a.readScriptsTarEntries()
+		require.NoError(t, err)
+		triggersBefore, err := a.fs.ReadFile(triggersFilePath)
+		require.NoError(t, err)
+
+		require.NoError(t, a.GC(ctx, nil))
+		names := installedNames(t, a)
+		require.NotContains(t, names, "scanelf")
+		require.Contains(t, names, "busybox")
+		_, err = a.fs.Stat("usr/bin/scanelf")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		scriptsAfter, err := a.readScriptsTarEntries()
+		require.NoError(t, err)
+		require.Len(t, scriptsAfter, len(scriptsBefore))
+		require.NoError(t, a.ValidateScriptsTar())
+		triggersAfter, err := a.fs.ReadFile(triggersFilePath)
+		require.NoError(t, err)
+		require.Equal(t, string(triggersBefore), string(triggersAfter))
+	})
+	t.Run("remove package", func(t *testing.T) {
+		a := prep(t, []string{"alpine-keys", "scanelf"})
+		require.NoError(t, a.RemovePackage(ctx, "scanelf", nil))
+		require.Equal(t, []string{"alpine-keys"}, installedNames(t, a))
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"alpine-keys"}, world)
+		_, err = a.fs.Stat("usr/bin/scanelf")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		require.ErrorContains(t, a.RemovePackage(ctx, "scanelf", nil), "not in world")
+	})
+	t.Run("remove required package", func(t *testing.T) {
+		a := prep(t, []string{"apk-tools", "musl"})
+		require.NoError(t, a.RemovePackage(ctx, "musl", nil))
+		require.Contains(t, installedNames(t, a), "musl", "apk-tools depends on it")
+	})
+}
@@ -16,16 +16,21 @@ package apk
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"path/filepath"
 	"sort"
 	"strings"
 
-	"github.com/hashicorp/go-retryablehttp"
+	"github.com/sirupsen/logrus"
 	"gitlab.alpinelinux.org/alpine/go/repository"
 	"go.opentelemetry.io/otel"
+
+	logger "github.com/chainguard-dev/go-apk/pkg/logger"
 )
 
 // NamedIndex an index that contains all of its packages,
@@ -38,6 +43,46 @@ type NamedIndex interface {
 	Count() int
 }
 
+// IndexSigned reports whether idx is an index returned by GetRepositoryIndexes whose signature was
+// verified. It is false for indexes whose signatures were ignored or not verifiable, see
+// WithIndexAllowUnsigned, and for indexes created any other way.
+func IndexSigned(idx NamedIndex) bool {
+	n, ok := idx.(*namedRepositoryWithIndex)
+	return ok && n.signed
+}
+
+// IndexDiff compares the packages of two indexes by name and version, e.g. a mirror against its
+// upstream. It returns the packages only in a, the ones only in b, and the ones in both whose
+// checksums differ, as they are in a. Each is in the order of the packages in its index.
+func IndexDiff(a, b NamedIndex) (onlyA, onlyB, changed []*repository.RepositoryPackage) {
+	key := func(pkg *repository.RepositoryPackage) string {
+		return pkg.Name + "-" + pkg.Version
+	}
+	inA := make(map[string]*repository.RepositoryPackage, a.Count())
+	for _, pkg := range a.Packages() {
+		inA[key(pkg)] = pkg
+	}
+	inB := make(map[string]*repository.RepositoryPackage, b.Count())
+	for _, pkg := range b.Packages() {
+		inB[key(pkg)] = pkg
+	}
+	for _, pkg := range a.Packages() {
+		other, ok := inB[key(pkg)]
+		switch {
+		case !ok:
+			onlyA = append(onlyA, pkg)
+		case !bytes.Equal(pkg.Checksum, other.Checksum):
+			changed = append(changed, pkg)
+		}
+	}
+	for _, pkg := range b.Packages() {
+		if _, ok := inA[key(pkg)]; !ok {
+			onlyB = append(onlyB, pkg)
+		}
+	}
+	return onlyA, onlyB, changed
+}
+
 func indexNames(indexes []NamedIndex) []string {
 	names := make([]string, len(indexes))
 	for i, idx := range indexes {
@@ -49,6 +94,10 @@ func indexNames(indexes []NamedIndex) []string {
 type namedRepositoryWithIndex struct {
 	name string
 	repo *repository.RepositoryWithIndex
+	// signed is true if the signature of the index was verified when it was fetched
+	signed bool
+	// raw has the entries of the index as fetched, if it was with WithIndexRawEntries, for RawIndexEntry
+	raw map[rawEntryKey]map[string]string
 }
 
 func NewNamedRepositoryWithIndex(name string, repo *repository.RepositoryWithIndex) NamedIndex {
@@ -102,7 +151,7 @@ func (a *APK) SetRepositories(repos []string) error {
 	data := strings.Join(repos, "\n") + "\n"
 
 	// #nosec G306 -- apk repositories must be publicly readable
-	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "repositories"),
+	if err := a.fs.WriteFile(a.reposFile,
 		[]byte(data), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk repositories list: %w", err)
 	}
@@ -112,9 +161,9 @@ func (a *APK) SetRepositories(repos []string) error {
 
 func (a *APK) GetRepositories() (repos []string, err error) {
 	// get the repository URLs
-	reposFile, err := a.fs.Open(reposFilePath)
+	reposFile, err := a.fs.Open(a.reposFile)
 	if err != nil {
-		return nil, fmt.Errorf("could not open repositories file in %s at %s: %w", a.fs, reposFilePath, err)
+		return nil, fmt.Errorf("could not open repositories file in %s at %s: %w", a.fs, a.reposFile, err)
 	}
 	defer reposFile.Close()
 	scanner := bufio.NewScanner(reposFile)
@@ -127,51 +176,123 @@ func (a *APK) GetRepositories() (repos []string, err error) {
 // getRepositoryIndexes returns the indexes for the repositories in the specified root.
 // The signatures for each index are verified unless ignoreSignatures is set to true.
 func (a *APK) getRepositoryIndexes(ctx context.Context, ignoreSignatures bool) ([]NamedIndex, error) {
+	// get the repository URLs
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return nil, err
+	}
+	return a.getRepositoryIndexesFrom(ctx, repos, ignoreSignatures)
+}
+
+// getRepositoryIndexesFrom returns the indexes for the given repositories, using the arch and keys
+// in the specified root.
+func (a *APK) getRepositoryIndexesFrom(ctx context.Context, repos []string, ignoreSignatures bool) ([]NamedIndex, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "getRepositoryIndexes")
 	defer span.End()
 
-	// get the repository URLs
-	repos, err := a.GetRepositories()
+	arch, err := a.rootArch()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := a.readKeys()
+	if err != nil {
+		return nil, err
+	}
+	httpClient := a.httpClient()
+	if a.cache != nil {
+		if a.staleIndexOK {
+			httpClient = a.cache.staleClient(httpClient, a.logger)
+		} else {
+			httpClient = a.cache.client(httpClient, true)
+		}
+	}
+	opts := []IndexOption{WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(httpClient),
+		WithIndexMaxDecompressedSize(a.maxDecompressedSize), WithIndexAllowUnsigned(a.allowUnsignedIndexes)}
+	for repo, mirrors := range a.mirrors {
+		opts = append(opts, WithIndexMirrors(repo, mirrors...))
+	}
+	if len(a.flatRepositories) > 0 {
+		opts = append(opts, WithIndexFlatRepositories(a.flatRepositories...))
+	}
+	indexes, err := GetRepositoryIndexes(ctx, repos, keys, arch, opts...)
 	if err != nil {
 		return nil, err
 	}
+	for _, bundle := range a.bundles {
+		index, err := a.bundleIndex(ctx, bundle, arch, keys, ignoreSignatures)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	if len(a.compatibleArchs) == 0 {
+		return indexes, nil
+	}
+	var fallback [][]NamedIndex
+	for _, compatible := range a.compatibleArchs {
+		if compatible == arch {
+			continue
+		}
+		compatibleIndexes, err := GetRepositoryIndexes(ctx, repos, keys, compatible, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("getting indexes for compatible arch %s: %w", compatible, err)
+		}
+		fallback = append(fallback, compatibleIndexes)
+	}
+	return append(indexes, fallbackArchIndexes(indexes, fallback)...), nil
+}
 
-	archFile, err := a.fs.Open(archFilePath)
+// rootArch returns the arch in /etc/apk/arch. If the file does not exist, e.g. because the root was
+// created by other tooling, it falls back to the configured arch, unless the file is required.
+func (a *APK) rootArch() (string, error) {
+	archFile, err := a.fs.Open(a.archFile)
 	if err != nil {
-		return nil, fmt.Errorf("could not open arch file in %s at %s: %w", a.fs, archFile, err)
+		if errors.Is(err, fs.ErrNotExist) && !a.strictArchFile {
+			a.logger.Warnf("%s does not exist, using configured arch %s", a.archFile, a.arch)
+			return a.arch, nil
+		}
+		return "", fmt.Errorf("could not open arch file in %s at %s: %w", a.fs, a.archFile, err)
 	}
+	defer archFile.Close()
 	archB, err := io.ReadAll(archFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read arch file: %w", err)
+		return "", fmt.Errorf("failed to read arch file: %w", err)
 	}
 	// trim the newline
-	arch := strings.TrimSuffix(string(archB), "\n")
+	return strings.TrimSuffix(string(archB), "\n"), nil
+}
 
-	// create the list of keys
+// readKeys returns the keys in /etc/apk/keys, by file name.
+func (a *APK) readKeys() (map[string][]byte, error) {
 	keys := make(map[string][]byte)
-	dir, err := a.fs.ReadDir(keysDirPath)
+	dir, err := a.fs.ReadDir(a.keysDir)
 	if err != nil {
-		return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", a.fs, keysDirPath, err)
+		return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", a.fs, a.keysDir, err)
 	}
 	for _, d := range dir {
 		if d.IsDir() {
 			continue
 		}
-		fullPath := filepath.Join(keysDirPath, d.Name())
+		fullPath := filepath.Join(a.keysDir, d.Name())
 		b, err := a.fs.ReadFile(fullPath)
 		if err != nil {
 			return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
 		}
 		keys[d.Name()] = b
 	}
-	httpClient := a.client
-	if httpClient == nil {
-		httpClient = retryablehttp.NewClient().StandardClient()
-	}
-	if a.cache != nil {
-		httpClient = a.cache.client(httpClient, true)
+	return keys, nil
+}
+
+// signedRepositories returns the repositories of those indexes whose signature was verified.
+func signedRepositories(indexes []NamedIndex) map[*repository.RepositoryWithIndex]bool {
+	signed := map[*repository.RepositoryWithIndex]bool{}
+	for _, idx := range indexes {
+		if n, ok := idx.(*namedRepositoryWithIndex); ok && n.signed && n.repo != nil {
+			signed[n.repo] = true
+		}
 	}
-	return GetRepositoryIndexes(ctx, repos, keys, arch, WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(httpClient))
+	return signed
 }
 
 // PkgResolver resolves packages from a list of indexes.
@@ -191,11 +312,156 @@ type PkgResolver struct {
 
 	parsedVersions map[string]packageVersion
 	depForVersion  map[string]pinStuff
+
+	tracer          func(ResolveStep)
+	repositoryPrefs []string
+	alternativeDeps bool
+	licenses        map[string]bool
+	excludeSuffixes []string
+	signedRepos     map[*repository.RepositoryWithIndex]bool
+	strictVersions  bool
+	invalidVersions map[string]InvalidVersionError
+	maxDepth        int
+	ambiguities     map[string]Ambiguity
+	logger          logger.Logger
+}
+
+// ResolveReason is the factor that decided which of several candidate packages was chosen.
+type ResolveReason string
+
+const (
+	// ResolveReasonOnlyCandidate means there was only one candidate.
+	ResolveReasonOnlyCandidate ResolveReason = "only candidate"
+	// ResolveReasonRepository means the chosen package is from the same repository as the package that depends on it.
+	ResolveReasonRepository ResolveReason = "repository"
+	// ResolveReasonOrigin means the chosen package has the same origin as the package that depends on it.
+	ResolveReasonOrigin ResolveReason = "origin"
+	// ResolveReasonInstalled means the chosen package already is installed.
+	ResolveReasonInstalled ResolveReason = "installed"
+	// ResolveReasonInstalledOrigin means a package with the same origin as the chosen package already is installed.
+	ResolveReasonInstalledOrigin ResolveReason = "installed origin"
+	// ResolveReasonPin means the chosen package is from the requested pinned repository.
+	ResolveReasonPin ResolveReason = "pin"
+	// ResolveReasonProviderPriority means the chosen package has a higher provider priority.
+	ResolveReasonProviderPriority ResolveReason = "provider priority"
+	// ResolveReasonVersion means the chosen package has a higher version.
+	ResolveReasonVersion ResolveReason = "version"
+	// ResolveReasonRepositoryPreference means the chosen package is from a repository earlier in the list given to WithRepositoryPreference.
+	ResolveReasonRepositoryPreference ResolveReason = "repository preference"
+	// ResolveReasonName means all else was equal, and the chosen package sorts first by name.
+	ResolveReasonName ResolveReason = "name"
+)
+
+// ResolveStep describes a single selection among candidate packages made by the resolver.
+type ResolveStep struct {
+	// Name is the name, or provided name, being resolved. It may be empty.
+	Name string
+	// Candidates are all of the packages considered, in order of preference.
+	Candidates []*repository.RepositoryPackage
+	// Chosen is the selected package, the first of Candidates.
+	Chosen *repository.RepositoryPackage
+	// Reason is what decided between Chosen and the next best candidate.
+	Reason ResolveReason
+}
+
+// Ambiguity is a point in a resolution where several candidate packages are ranked equally, so that
+// the choice between them comes down to the name they sort by rather than anything in the indexes.
+type Ambiguity struct {
+	// Name is the name, or provided name, being resolved.
+	Name string
+	// Candidates are the equally ranked packages, in order of preference; the first is the one chosen.
+	Candidates []*repository.RepositoryPackage
+}
+
+// ResolverOption configures a PkgResolver.
+type ResolverOption func(*PkgResolver)
+
+// WithAlternativeDependencies enables dependencies with alternatives separated by "|", e.g.
+// "foo | bar>=2.0", as some tooling writes them; apk itself expresses alternatives using provides.
+// The D: line of an index is split on spaces, so the alternatives may be separate dependencies,
+// e.g. "foo", "|" and "bar>=2.0"; those are joined back into one.
+// The first alternative that already is installed or selected is used; otherwise, the first
+// alternative that can be resolved. Without this option, such a dependency is treated as a
+// single package name, as apk does.
+func WithAlternativeDependencies(enabled bool) ResolverOption {
+	return func(p *PkgResolver) {
+		p.alternativeDeps = enabled
+	}
+}
+
+// WithLicenseAllowlist restricts resolution to packages whose license is in licenses. A license
+// that is an expression, e.g. "MIT AND BSD-2-Clause", is allowed if it is listed as is, or if every
+// license in it is. Packages with other licenses are never chosen; if no candidate for a package or
+// dependency is allowed, resolution fails with an error naming the candidates and their licenses.
+func WithLicenseAllowlist(licenses []string) ResolverOption {
+	return func(p *PkgResolver) {
+		p.licenses = make(map[string]bool, len(licenses))
+		for _, license := range licenses {
+			p.licenses[license] = true
+		}
+	}
+}
+
+// WithExcludeSubpackageSuffixes keeps the resolver from pulling in packages whose name ends in one
+// of suffixes, e.g. "-dev", "-doc" or "-static", as dependencies or through install_if. They still
+// are installed when requested explicitly. A dependency that only excluded packages satisfy is left
+// out, rather than failing resolution, so the result might not be complete for build-time use; each
+// one left out is warned about on the logger set with WithResolverLogger.
+func WithExcludeSubpackageSuffixes(suffixes []string) ResolverOption {
+	return func(p *PkgResolver) {
+		p.excludeSuffixes = suffixes
+	}
+}
+
+// WithRepositoryPreference sets an ordered list of preferred repositories, used to choose between
+// packages that are otherwise equal, e.g. the same package and version in a mirror and upstream.
+// Each entry is either a repository URL, with or without the arch, or the name of a pinned index.
+// Packages from repositories earlier in the list are preferred over later ones, which are preferred
+// over repositories not in the list.
+func WithRepositoryPreference(repositories []string) ResolverOption {
+	return func(p *PkgResolver) {
+		p.repositoryPrefs = repositories
+	}
+}
+
+// WithStrictVersions sets how the resolver handles candidate packages whose version cannot be parsed.
+// By default, such packages are ranked below all others and reported by InvalidVersions; with strict
+// set, resolving any name that has such a candidate fails with an InvalidVersionError instead.
+func WithStrictVersions(strict bool) ResolverOption {
+	return func(p *PkgResolver) {
+		p.strictVersions = strict
+	}
+}
+
+// WithMaxDepth limits how deep the resolver follows dependencies, as a safeguard against pathological
+// dependency graphs, e.g. from untrusted indexes. The dependencies of a requested package are at depth 1,
+// their dependencies at depth 2, and so on; resolving a package with dependencies deeper than n fails
+// with a DependencyDepthError naming the chain of dependencies. A depth of 0, the default, is unlimited.
+func WithMaxDepth(n int) ResolverOption {
+	return func(p *PkgResolver) {
+		p.maxDepth = n
+	}
+}
+
+// WithResolveTracer sets a function that is called with every package selection the resolver makes,
+// for debugging why a particular package was chosen.
+func WithResolveTracer(tracer func(ResolveStep)) ResolverOption {
+	return func(p *PkgResolver) {
+		p.tracer = tracer
+	}
+}
+
+// WithResolverLogger sets the logger the resolver warns to, e.g. about dependencies it leaves out.
+// If not provided, warnings are discarded.
+func WithResolverLogger(logger logger.Logger) ResolverOption {
+	return func(p *PkgResolver) {
+		p.logger = logger
+	}
 }
 
 // NewPkgResolver creates a new pkgResolver from a list of indexes.
 // The indexes are anything that implements NamedIndex.
-func NewPkgResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
+func NewPkgResolver(ctx context.Context, indexes []NamedIndex, opts ...ResolverOption) *PkgResolver {
 	_, span := otel.Tracer("go-apk").Start(ctx, "NewPkgResolver")
 	defer span.End()
 
@@ -204,29 +470,53 @@ func NewPkgResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
 		numPackages += index.Count()
 	}
 
-	var (
-		pkgNameMap     = make(map[string][]*repositoryPackage, numPackages)
-		pkgProvidesMap = make(map[string][]*repositoryPackage, numPackages)
-		installIfMap   = map[string][]*repositoryPackage{}
-	)
 	p := &PkgResolver{
-		indexes:        indexes,
-		parsedVersions: map[string]packageVersion{},
-		depForVersion:  map[string]pinStuff{},
+		nameMap:         make(map[string][]*repositoryPackage, numPackages),
+		providesMap:     make(map[string][]*repositoryPackage, numPackages),
+		installIfMap:    map[string][]*repositoryPackage{},
+		signedRepos:     map[*repository.RepositoryWithIndex]bool{},
+		parsedVersions:  map[string]packageVersion{},
+		depForVersion:   map[string]pinStuff{},
+		invalidVersions: map[string]InvalidVersionError{},
+		logger:          &logrus.Logger{Out: io.Discard},
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.addIndexes(indexes)
+	return p
+}
 
+// AddIndex adds the packages in idx to those the resolver resolves from, as if idx had been passed
+// to NewPkgResolver after the existing indexes, without rebuilding the resolver from scratch.
+// It must be called before resolving packages that should see idx; the resolver does not keep
+// resolved results, so anything resolved afterwards takes idx into account. AddIndex is not safe for use
+// concurrently with itself or with resolving packages, unless guarded by the caller.
+func (p *PkgResolver) AddIndex(idx NamedIndex) {
+	p.addIndexes([]NamedIndex{idx})
+}
+
+// addIndexes adds the packages in indexes to the maps used for resolving.
+func (p *PkgResolver) addIndexes(indexes []NamedIndex) {
+	var added []*repositoryPackage
 	// create a map of every package by name and version to its RepositoryPackage
 	for _, index := range indexes {
+		// an index may list the same package more than once; only take it once
+		seen := make(map[string]bool, index.Count())
 		for _, pkg := range index.Packages() {
-			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], &repositoryPackage{
+			key := fmt.Sprintf("%s-%s-%x", pkg.Name, pkg.Version, pkg.Checksum)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			rp := &repositoryPackage{
 				RepositoryPackage: pkg,
 				pinnedName:        index.Name(),
-			})
+			}
+			p.nameMap[pkg.Name] = append(p.nameMap[pkg.Name], rp)
+			added = append(added, rp)
 			for _, dep := range pkg.InstallIf {
-				if _, ok := installIfMap[dep]; !ok {
-					installIfMap[dep] = []*repositoryPackage{}
-				}
-				installIfMap[dep] = append(installIfMap[dep], &repositoryPackage{
+				p.installIfMap[dep] = append(p.installIfMap[dep], &repositoryPackage{
 					RepositoryPackage: pkg,
 					pinnedName:        index.Name(),
 				})
@@ -234,26 +524,49 @@ func NewPkgResolver(ctx context.Context, indexes []NamedIndex) *PkgResolver {
 		}
 	}
 	// create a map of every provided file to its package
-	allPkgs := make([][]*repositoryPackage, 0, len(pkgNameMap))
-	for _, pkgVersions := range pkgNameMap {
-		allPkgs = append(allPkgs, pkgVersions)
-	}
-	for _, pkgVersions := range allPkgs {
-		for _, pkg := range pkgVersions {
-			for _, provide := range pkg.Provides {
-				name := p.resolvePackageNameVersionPin(provide).name
-				pkgNameMap[name] = append(pkgNameMap[name], pkg)
-				if _, ok := pkgProvidesMap[name]; !ok {
-					pkgProvidesMap[name] = []*repositoryPackage{}
-				}
-				pkgProvidesMap[name] = append(pkgProvidesMap[name], pkg)
-			}
+	for _, pkg := range added {
+		for _, provide := range pkg.Provides {
+			name := p.resolvePackageNameVersionPin(provide).name
+			p.nameMap[name] = append(p.nameMap[name], pkg)
+			p.providesMap[name] = append(p.providesMap[name], pkg)
 		}
 	}
-	p.nameMap = pkgNameMap
-	p.providesMap = pkgProvidesMap
-	p.installIfMap = installIfMap
-	return p
+	for repo := range signedRepositories(indexes) {
+		p.signedRepos[repo] = true
+	}
+	p.indexes = append(p.indexes, indexes...)
+}
+
+// FromSignedIndex reports whether pkg, e.g. as returned by GetPackagesWithDependencies, comes from
+// one of the resolver's indexes whose signature was verified; see IndexSigned. Callers resolving
+// against a mix of signed and unsigned indexes can use it to warn about or reject packages.
+func (p *PkgResolver) FromSignedIndex(pkg *repository.RepositoryPackage) bool {
+	repo := pkg.Repository()
+	return repo != nil && p.signedRepos[repo]
+}
+
+// RawIndexEntry returns every field of the index entry that pkg, e.g. as returned by
+// GetPackagesWithDependencies, was parsed from, keyed by the single letter field name, including
+// fields that are not part of repository.Package. It helps diagnose resolution surprises caused by
+// unusual index metadata. Only indexes fetched by GetRepositoryIndexes with WithIndexRawEntries keep
+// their raw entries.
+func (p *PkgResolver) RawIndexEntry(pkg *repository.RepositoryPackage) (map[string]string, error) {
+	repo := pkg.Repository()
+	for _, idx := range p.indexes {
+		n, ok := idx.(*namedRepositoryWithIndex)
+		if !ok || repo == nil || n.repo != repo {
+			continue
+		}
+		if n.raw == nil {
+			return nil, fmt.Errorf("raw index entries of %s are not available", idx.Name())
+		}
+		entry, ok := n.raw[rawEntryKey{pkg.Name, pkg.Version}]
+		if !ok {
+			return nil, fmt.Errorf("no entry for %s-%s in repository index", pkg.Name, pkg.Version)
+		}
+		return entry, nil
+	}
+	return nil, fmt.Errorf("package %s-%s is not from any of the resolver's indexes", pkg.Name, pkg.Version)
 }
 
 // GetPackagesWithDependencies get all of the dependencies for the given packages based on the
@@ -308,6 +621,30 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 	return toInstall, conflicts, nil
 }
 
+// ResolveAmbiguities resolves world like GetPackagesWithDependencies does, and reports every name
+// along the way that more than one package satisfies with nothing to choose between them, e.g. two
+// packages of the same version providing the same command without a provider_priority, where the
+// one that sorts first by name is chosen. The packages chosen are the same as without it; this only
+// makes the arbitrary choices visible, so that they can be pinned down in world. Builds of the same
+// package and version with the same checksum from different repositories are not considered
+// different. It is not safe for concurrent use.
+func (p *PkgResolver) ResolveAmbiguities(world []string) ([]Ambiguity, error) {
+	p.ambiguities = map[string]Ambiguity{}
+	defer func() { p.ambiguities = nil }()
+
+	if _, _, err := p.GetPackagesWithDependencies(context.Background(), world); err != nil {
+		return nil, err
+	}
+	ambiguities := make([]Ambiguity, 0, len(p.ambiguities))
+	for _, ambiguity := range p.ambiguities {
+		ambiguities = append(ambiguities, ambiguity)
+	}
+	sort.Slice(ambiguities, func(i, j int) bool {
+		return ambiguities[i].Name < ambiguities[j].Name
+	})
+	return ambiguities, nil
+}
+
 // GetPackageWithDependencies get all of the dependencies for a single package as well as looking
 // up the package itself and resolving its version, based on the indexes.
 // Requires the existing set because the logic for resolving dependencies between competing
@@ -354,6 +691,13 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 		}
 		// this package "dep" can trigger an installIf. It might not be enough, so check it
 		for _, installIfPkg := range depPkgList {
+			if p.excluded(installIfPkg.Name, existing) {
+				continue
+			}
+			// install_if packages are never required, so one with a disallowed license is just not installed
+			if p.licenses != nil && !p.licenseAllowed(installIfPkg.License) {
+				continue
+			}
 			var matchCount int
 			for _, subDep := range installIfPkg.InstallIf {
 				// two possibilities: package name, or name=version
@@ -398,14 +742,26 @@ func (p *PkgResolver) ResolvePackage(pkgName string) ([]*repository.RepositoryPa
 		if len(packages) == 0 {
 			return nil, fmt.Errorf("could not find package %s in indexes", pkgName)
 		}
-		p.sortPackages(packages, nil, name, nil, pin)
+		var err error
+		if packages, err = p.filterLicenses(pkgName, packages); err != nil {
+			return nil, err
+		}
+		if err := p.sortPackages(packages, nil, name, nil, pin); err != nil {
+			return nil, err
+		}
 	} else {
 		providers, ok := p.providesMap[name]
 		if !ok || len(providers) == 0 {
 			return nil, fmt.Errorf("could not find package, alias or a package that provides %s in indexes", pkgName)
 		}
+		var err error
+		if providers, err = p.filterLicenses(pkgName, providers); err != nil {
+			return nil, err
+		}
 		// we are going to do this in reverse order
-		p.sortPackages(providers, nil, name, nil, "")
+		if err := p.sortPackages(providers, nil, name, nil, ""); err != nil {
+			return nil, err
+		}
 		packages = providers
 	}
 	pkgs := make([]*repository.RepositoryPackage, 0, len(packages))
@@ -415,6 +771,125 @@ func (p *PkgResolver) ResolvePackage(pkgName string) ([]*repository.RepositoryPa
 	return pkgs, nil
 }
 
+// ResolvePackages resolves each of names, like ResolvePackage, and returns the matches by name.
+// It is meant for resolving many standalone names, e.g. for listing; it does not resolve
+// dependencies. Names that cannot be resolved are left out of the map, and reported together
+// in the returned error.
+func (p *PkgResolver) ResolvePackages(names []string) (map[string][]*repository.RepositoryPackage, error) {
+	resolved := make(map[string][]*repository.RepositoryPackage, len(names))
+	var errs []error
+	for _, name := range names {
+		if _, ok := resolved[name]; ok {
+			continue
+		}
+		pkgs, err := p.ResolvePackage(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resolved[name] = pkgs
+	}
+	return resolved, errors.Join(errs...)
+}
+
+// Exists reports whether name is the name of a package, or something provided by a package, in
+// the indexes. It does not consider versions or whether the package could be resolved.
+func (p *PkgResolver) Exists(name string) bool {
+	return len(p.nameMap[name]) > 0 || len(p.providesMap[name]) > 0
+}
+
+// AvailableVersions returns the distinct versions in the indexes of the package name, highest first.
+// If name is not a package but is provided by packages, it returns the versions at which it is
+// provided, which may be empty if it is provided without a version.
+func (p *PkgResolver) AvailableVersions(name string) ([]string, error) {
+	if !p.Exists(name) {
+		return nil, fmt.Errorf("could not find package, alias or a package that provides %s in indexes", name)
+	}
+	seen := map[string]bool{}
+	versions := []string{}
+	add := func(version string) {
+		if version != "" && !seen[version] {
+			seen[version] = true
+			versions = append(versions, version)
+		}
+	}
+	for _, pkg := range p.nameMap[name] {
+		if pkg.Name == name {
+			add(pkg.Version)
+			continue
+		}
+		for _, provide := range pkg.Provides {
+			if provided := p.resolvePackageNameVersionPin(provide); provided.name == name {
+				add(provided.version)
+			}
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, errA := p.parseVersion(versions[i])
+		b, errB := p.parseVersion(versions[j])
+		switch {
+		case errA != nil && errB != nil:
+			return versions[i] < versions[j]
+		case errA != nil || errB != nil:
+			// versions that cannot be parsed go last
+			return errB != nil
+		}
+		return compareVersions(a, b) == greater
+	})
+	return versions, nil
+}
+
+// DirectDependencies resolves the package pkgName and returns only its immediate dependencies and
+// conflicts, without recursing into the dependencies of those dependencies. It allows callers to
+// walk the dependency graph themselves, one level at a time.
+func (p *PkgResolver) DirectDependencies(pkgName string) ([]*repository.RepositoryPackage, []string, error) {
+	pkgs, err := p.ResolvePackage(pkgName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pkgs) == 0 {
+		return nil, nil, fmt.Errorf("could not find package %s", pkgName)
+	}
+	pkg := pkgs[0]
+
+	pin := p.resolvePackageNameVersionPin(pkgName).pin
+	myProvides := p.packageProvides(pkg)
+	existing := map[string]*repository.RepositoryPackage{}
+	var (
+		dependencies []*repository.RepositoryPackage
+		conflicts    []string
+	)
+	for _, dep := range p.dependencies(pkg) {
+		if strings.HasPrefix(dep, "!") {
+			conflicts = append(conflicts, dep[1:])
+			continue
+		}
+		depPkg, err := p.resolveDependencyAlternatives(pkg, dep, myProvides, pin, true, existing)
+		if err != nil {
+			return nil, nil, err
+		}
+		if depPkg == nil {
+			// already satisfied by the package itself
+			continue
+		}
+		dependencies = append(dependencies, depPkg)
+	}
+	return dependencies, conflicts, nil
+}
+
+// packageProvides returns the set of names, with and without versions, that pkg provides.
+func (p *PkgResolver) packageProvides(pkg *repository.RepositoryPackage) map[string]bool {
+	myProvides := make(map[string]bool, 3*len(pkg.Provides))
+	for _, provide := range pkg.Provides {
+		name := p.resolvePackageNameVersionPin(provide).name
+		myProvides[provide] = true
+		myProvides[name] = true
+		// a malformed version in what we provide should not keep us from satisfying ourselves
+		myProvides[providedName(provide)] = true
+	}
+	return myProvides
+}
+
 // getPackageDependencies get all of the dependencies for a single package based on the
 // indexes. Internal version includes passed arg for preventing infinite loops.
 // checked map is passed as an arg, rather than a member of the struct, because
@@ -448,100 +923,28 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 	if _, ok := parents[pkg.Name]; ok {
 		return nil, nil, nil
 	}
-	myProvides := make(map[string]bool, 2*len(pkg.Provides))
-	// see if we provide this
-	for _, provide := range pkg.Provides {
-		name := p.resolvePackageNameVersionPin(provide).name
-		myProvides[provide] = true
-		myProvides[name] = true
+	// parents holds every package above this one, so its size is the depth
+	if p.maxDepth > 0 && len(parents) > p.maxDepth {
+		return nil, nil, DependencyDepthError{MaxDepth: p.maxDepth, Chain: []string{pkg.Name}}
 	}
+	myProvides := p.packageProvides(pkg)
 
 	// each dependency has only one of two possibilities:
 	// - !name     - "I cannot be installed along with the package <name>"
 	// - name      - "I need package 'name'" -OR- "I need the package that provides <name>"
-	for _, dep := range pkg.Dependencies {
-		var (
-			depPkg *repository.RepositoryPackage
-			ok     bool
-		)
+	for _, dep := range p.dependencies(pkg) {
 		// if it was a conflict, just add it to the conflicts list and go to the next one
 		if strings.HasPrefix(dep, "!") {
 			conflicts = append(conflicts, dep[1:])
 			continue
 		}
-		// this package might be pinned to a version
-		stuff := p.resolvePackageNameVersionPin(dep)
-		name, version, compare := stuff.name, stuff.version, stuff.dep
-		// see if we provide this
-		if myProvides[name] || myProvides[dep] {
-			// we provide this, so skip it
-			continue
-		}
-
-		if allowSelfFulfill && pkg.Name == name {
-			var (
-				actualVersion, requiredVersion packageVersion
-				err1, err2                     error
-			)
-			actualVersion, err1 = p.parseVersion(pkg.Version)
-			if compare != versionNone {
-				requiredVersion, err2 = p.parseVersion(version)
-			}
-			// we accept invalid versions for ourself, but do not try to use it to fulfill
-			if err1 == nil && err2 == nil {
-				if compare.satisfies(actualVersion, requiredVersion) {
-					// we provide it, so skip looking elsewhere
-					continue
-				}
-			}
+		depPkg, err := p.resolveDependencyAlternatives(pkg, dep, myProvides, allowPin, allowSelfFulfill, existing)
+		if err != nil {
+			return nil, nil, err
 		}
-
-		// first see if it is a name of a package
-		depPkgWithVersions, ok := p.nameMap[name]
-		if ok {
-			// pkgsWithVersions contains a map of all versions of the package
-			// get the one that most matches what was requested
-			pkgs := p.filterPackages(depPkgWithVersions,
-				withVersion(version, compare),
-				withAllowPin(allowPin),
-				withInstalledPackage(existing[name]),
-			)
-			if len(pkgs) == 0 {
-				return nil, nil, fmt.Errorf("could not find package %s in indexes", dep)
-			}
-			p.sortPackages(pkgs, nil, name, existing, "")
-			depPkg = pkgs[0].RepositoryPackage
-		} else {
-			// it was not the name of a package, see if some package provides this
-			initialProviders, ok := p.providesMap[name]
-			if !ok || len(initialProviders) == 0 {
-				// no one provides it, return an error
-				return nil, nil, fmt.Errorf("could not find package either named %s or that provides %s for %s", dep, dep, pkg.Name)
-			}
-			// before we sort the packages, figure out if we satisfy the dependency
-			// also filter out invalid ones, i.e. ones that come from a pinned repository, but that pin is now allowed
-			var (
-				isSelf    bool
-				providers []*repositoryPackage
-			)
-			for _, provider := range initialProviders {
-				// if the provider package is pinned and does not match our allowed pin, skip it
-				if provider.pinnedName != "" && provider.pinnedName != allowPin {
-					continue
-				}
-				// if my package can provide this dependency, then already satisfied
-				if provider.Name == pkg.Name {
-					isSelf = true
-					break
-				}
-				providers = append(providers, provider)
-			}
-			if isSelf {
-				continue
-			}
-			// we are going to do this in reverse order
-			p.sortPackages(providers, pkg, name, existing, "")
-			depPkg = providers[0].RepositoryPackage
+		if depPkg == nil {
+			// already satisfied by the package itself
+			continue
 		}
 		// and then recurse to its children
 		// each child gets the parental chain, but should not affect any others,
@@ -552,6 +955,12 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 		}
 		childParents[pkg.Name] = true
 		subDeps, confs, err := p.getPackageDependencies(depPkg, allowPin, true, childParents, existing)
+		var depthErr DependencyDepthError
+		if errors.As(err, &depthErr) {
+			// extend the chain on the way back up, so it ends up starting at the requested package
+			depthErr.Chain = append([]string{pkg.Name}, depthErr.Chain...)
+			return nil, nil, depthErr
+		}
 		if err != nil {
 			return nil, nil, err
 		}
@@ -566,6 +975,275 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 	return dependencies, conflicts, nil
 }
 
+// resolveDependencyAlternatives resolves dependency dep of pkg, as resolveDependency does, but if
+// alternative dependencies are enabled and dep has alternatives, it resolves the first alternative
+// that is satisfied by an existing package, or failing that, the first one that can be resolved.
+func (p *PkgResolver) resolveDependencyAlternatives(pkg *repository.RepositoryPackage, dep string, myProvides map[string]bool, allowPin string, allowSelfFulfill bool, existing map[string]*repository.RepositoryPackage) (*repository.RepositoryPackage, error) {
+	if !p.alternativeDeps || !strings.Contains(dep, "|") {
+		return p.resolveDependency(pkg, dep, myProvides, allowPin, allowSelfFulfill, existing)
+	}
+	var alternatives []string
+	for _, alt := range strings.Split(dep, "|") {
+		if alt = strings.TrimSpace(alt); alt != "" {
+			alternatives = append(alternatives, alt)
+		}
+	}
+	for _, alt := range alternatives {
+		if p.satisfiedByExisting(alt, existing) {
+			return p.resolveDependency(pkg, alt, myProvides, allowPin, allowSelfFulfill, existing)
+		}
+	}
+	var errs []error
+	for _, alt := range alternatives {
+		depPkg, err := p.resolveDependency(pkg, alt, myProvides, allowPin, allowSelfFulfill, existing)
+		if err == nil {
+			return depPkg, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("could not resolve any alternative of %s for %s: %w", dep, pkg.Name, errors.Join(errs...))
+}
+
+// dependencies returns the dependencies of pkg. With alternative dependencies enabled, alternatives
+// that were split into separate dependencies, like "foo", "|", "bar" from "D:foo | bar", are joined
+// into one again.
+func (p *PkgResolver) dependencies(pkg *repository.RepositoryPackage) []string {
+	if !p.alternativeDeps {
+		return pkg.Dependencies
+	}
+	deps := make([]string, 0, len(pkg.Dependencies))
+	for _, dep := range pkg.Dependencies {
+		if last := len(deps) - 1; last >= 0 && (strings.HasPrefix(dep, "|") || strings.HasSuffix(deps[last], "|")) {
+			deps[last] += " " + dep
+			continue
+		}
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// satisfiedByExisting reports whether dep is satisfied by one of the existing packages, either by
+// name or by something it provides.
+func (p *PkgResolver) satisfiedByExisting(dep string, existing map[string]*repository.RepositoryPackage) bool {
+	want := p.resolvePackageNameVersionPin(dep)
+	var required packageVersion
+	if want.dep != versionNone {
+		var err error
+		if required, err = p.parseVersion(want.version); err != nil {
+			return false
+		}
+	}
+	satisfies := func(version string) bool {
+		if want.dep == versionNone {
+			return true
+		}
+		actual, err := p.parseVersion(version)
+		return err == nil && want.dep.satisfies(actual, required)
+	}
+	for _, pkg := range existing {
+		if pkg == nil {
+			continue
+		}
+		if pkg.Name == want.name && satisfies(pkg.Version) {
+			return true
+		}
+		for _, prov := range pkg.Provides {
+			provided := p.resolvePackageNameVersionPin(prov)
+			if provided.name == want.name && satisfies(provided.version) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// providedName returns the name part of a provides entry, everything before any version constraint
+// or pin, even if the rest of the entry is malformed.
+func providedName(provide string) string {
+	if i := strings.IndexAny(provide, "=<>~@"); i > 0 {
+		return provide[:i]
+	}
+	return provide
+}
+
+// resolveDependency resolves a single dependency dep of pkg to the package that should be installed
+// for it. If pkg already satisfies the dependency itself, it returns nil.
+func (p *PkgResolver) resolveDependency(pkg *repository.RepositoryPackage, dep string, myProvides map[string]bool, allowPin string, allowSelfFulfill bool, existing map[string]*repository.RepositoryPackage) (*repository.RepositoryPackage, error) {
+	// this package might be pinned to a version
+	stuff := p.resolvePackageNameVersionPin(dep)
+	name, version, compare := stuff.name, stuff.version, stuff.dep
+	// see if we provide this
+	if myProvides[name] || myProvides[dep] {
+		// we provide this, so skip it
+		return nil, nil
+	}
+
+	if allowSelfFulfill && pkg.Name == name {
+		var (
+			actualVersion, requiredVersion packageVersion
+			err1, err2                     error
+		)
+		actualVersion, err1 = p.parseVersion(pkg.Version)
+		if compare != versionNone {
+			requiredVersion, err2 = p.parseVersion(version)
+		}
+		// we accept invalid versions for ourself; there is no way to compare them, and looking
+		// elsewhere would fail to parse them as well, so consider the dependency satisfied
+		if err1 != nil || err2 != nil {
+			return nil, nil
+		}
+		if compare.satisfies(actualVersion, requiredVersion) {
+			// we provide it, so skip looking elsewhere
+			return nil, nil
+		}
+	}
+
+	// first see if it is a name of a package
+	depPkgWithVersions, ok := p.nameMap[name]
+	if ok {
+		// pkgsWithVersions contains a map of all versions of the package
+		// get the one that most matches what was requested
+		pkgs := p.filterPackages(depPkgWithVersions,
+			withVersion(version, compare),
+			withAllowPin(allowPin),
+			withInstalledPackage(existing[name]),
+		)
+		if len(pkgs) == 0 {
+			return nil, fmt.Errorf("could not find package %s in indexes", dep)
+		}
+		if pkgs = p.filterExcluded(pkgs, existing); len(pkgs) == 0 {
+			// only excluded subpackages satisfy it, so leave it out
+			p.logger.Warnf("leaving out dependency %s of %s, only excluded subpackages satisfy it", dep, pkg.Name)
+			return nil, nil
+		}
+		pkgs, err := p.filterLicenses(dep, pkgs)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.sortPackages(pkgs, nil, name, existing, ""); err != nil {
+			return nil, err
+		}
+		return pkgs[0].RepositoryPackage, nil
+	}
+
+	// it was not the name of a package, see if some package provides this
+	initialProviders, ok := p.providesMap[name]
+	if !ok || len(initialProviders) == 0 {
+		// no one provides it, return an error
+		return nil, fmt.Errorf("could not find package either named %s or that provides %s for %s", dep, dep, pkg.Name)
+	}
+	// before we sort the packages, figure out if we satisfy the dependency
+	// also filter out invalid ones, i.e. ones that come from a pinned repository, but that pin is now allowed
+	var (
+		isSelf    bool
+		providers []*repositoryPackage
+	)
+	for _, provider := range initialProviders {
+		// if the provider package is pinned and does not match our allowed pin, skip it
+		if provider.pinnedName != "" && provider.pinnedName != allowPin {
+			continue
+		}
+		// if my package can provide this dependency, then already satisfied
+		if provider.Name == pkg.Name {
+			isSelf = true
+			break
+		}
+		providers = append(providers, provider)
+	}
+	if isSelf {
+		return nil, nil
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("could not find package that provides %s for %s in allowed repositories", dep, pkg.Name)
+	}
+	if providers = p.filterExcluded(providers, existing); len(providers) == 0 {
+		p.logger.Warnf("leaving out dependency %s of %s, only excluded subpackages provide it", dep, pkg.Name)
+		return nil, nil
+	}
+	providers, err := p.filterLicenses(dep, providers)
+	if err != nil {
+		return nil, err
+	}
+	// we are going to do this in reverse order
+	if err := p.sortPackages(providers, pkg, name, existing, ""); err != nil {
+		return nil, err
+	}
+	return providers[0].RepositoryPackage, nil
+}
+
+// filterExcluded returns the packages that are not excluded subpackages; see excluded.
+func (p *PkgResolver) filterExcluded(pkgs []*repositoryPackage, existing map[string]*repository.RepositoryPackage) []*repositoryPackage {
+	if len(p.excludeSuffixes) == 0 {
+		return pkgs
+	}
+	var kept []*repositoryPackage
+	for _, pkg := range pkgs {
+		if !p.excluded(pkg.Name, existing) {
+			kept = append(kept, pkg)
+		}
+	}
+	return kept
+}
+
+// excluded reports whether name ends in one of the excluded subpackage suffixes, and is not already
+// in existing, e.g. because it was requested explicitly.
+func (p *PkgResolver) excluded(name string, existing map[string]*repository.RepositoryPackage) bool {
+	if _, ok := existing[name]; ok {
+		return false
+	}
+	for _, suffix := range p.excludeSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterLicenses returns the packages whose license is allowed, when a license allowlist is set.
+// It returns an error if none of the packages, all of them candidates for dep, is allowed.
+func (p *PkgResolver) filterLicenses(dep string, pkgs []*repositoryPackage) ([]*repositoryPackage, error) {
+	if p.licenses == nil {
+		return pkgs, nil
+	}
+	var (
+		allowed    []*repositoryPackage
+		disallowed []string
+	)
+	for _, pkg := range pkgs {
+		if p.licenseAllowed(pkg.License) {
+			allowed = append(allowed, pkg)
+			continue
+		}
+		disallowed = append(disallowed, fmt.Sprintf("%s-%s (%q)", pkg.Name, pkg.Version, pkg.License))
+	}
+	if len(allowed) == 0 && len(pkgs) > 0 {
+		sort.Strings(disallowed)
+		return nil, fmt.Errorf("no candidate for %s has an allowed license: %s", dep, strings.Join(uniqify(disallowed), ", "))
+	}
+	return allowed, nil
+}
+
+// licenseAllowed reports whether license, which may be an expression, is in the license allowlist.
+func (p *PkgResolver) licenseAllowed(license string) bool {
+	if p.licenses[license] {
+		return true
+	}
+	var found bool
+	for _, id := range strings.FieldsFunc(license, func(r rune) bool {
+		return r == ' ' || r == '(' || r == ')'
+	}) {
+		switch id {
+		case "AND", "OR", "WITH", "and", "or":
+			continue
+		}
+		if !p.licenses[id] {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
 func (p *PkgResolver) parseVersion(version string) (packageVersion, error) {
 	pkg, ok := p.parsedVersions[version]
 	if ok {
@@ -602,7 +1280,12 @@ func (p *PkgResolver) resolvePackageNameVersionPin(pkgName string) pinStuff {
 // For example, if the original search was for package "a", then pkgs may contain some that
 // are named "a", but others that provided "a". In that case, we should look not at the
 // version of the package, but the version of "a" that the package provides.
-func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *repository.RepositoryPackage, name string, existing map[string]*repository.RepositoryPackage, pin string) { //nolint:gocyclo
+// Packages whose version cannot be parsed are sorted after all others and recorded for InvalidVersions,
+// or, with WithStrictVersions, make it return an InvalidVersionError.
+func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *repository.RepositoryPackage, name string, existing map[string]*repository.RepositoryPackage, pin string) error {
+	if err := p.checkVersions(pkgs, name); err != nil {
+		return err
+	}
 	// get existing origins
 	existingOrigins := make(map[string]bool, len(existing))
 	for _, pkg := range existing {
@@ -611,97 +1294,218 @@ func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *repositor
 		}
 	}
 	sort.Slice(pkgs, func(i, j int) bool {
-		// determine versions
-		iVersionStr := p.getDepVersionForName(pkgs[i], name)
-		jVersionStr := p.getDepVersionForName(pkgs[j], name)
-		if compare != nil {
-			// matching repository
-			pkgRepo := compare.Repository().Uri
-			iRepo := pkgs[i].Repository().Uri
-			jRepo := pkgs[j].Repository().Uri
-			if iRepo == pkgRepo && jRepo != pkgRepo {
-				return true
-			}
-			if jRepo == pkgRepo && iRepo != pkgRepo {
-				return false
-			}
-			// matching origin with compare
-			pkgOrigin := compare.Origin
-			iOrigin := pkgs[i].Origin
-			jOrigin := pkgs[j].Origin
-			if iOrigin == pkgOrigin && jOrigin != pkgOrigin {
-				return true
-			}
-			if jOrigin == pkgOrigin && iOrigin != pkgOrigin {
-				return false
-			}
-		}
-		// see if one already is installed
-		iMatched, iOk := existing[pkgs[i].Name]
-		jMatched, jOk := existing[pkgs[j].Name]
+		less, _ := p.preferPackage(pkgs[i], pkgs[j], compare, name, existing, existingOrigins, pin)
+		return less
+	})
+	if p.ambiguities != nil && len(pkgs) > 1 {
+		p.recordAmbiguity(pkgs, compare, name, existing, existingOrigins, pin)
+	}
+	if p.tracer == nil || len(pkgs) == 0 {
+		return nil
+	}
+	step := ResolveStep{
+		Name:       name,
+		Candidates: make([]*repository.RepositoryPackage, 0, len(pkgs)),
+		Chosen:     pkgs[0].RepositoryPackage,
+		Reason:     ResolveReasonOnlyCandidate,
+	}
+	for _, pkg := range pkgs {
+		step.Candidates = append(step.Candidates, pkg.RepositoryPackage)
+	}
+	if len(pkgs) > 1 {
+		_, step.Reason = p.preferPackage(pkgs[0], pkgs[1], compare, name, existing, existingOrigins, pin)
+	}
+	p.tracer(step)
+	return nil
+}
 
-		// because existing takes priority, if either matches, we should take it
-		// check if the first matches
-		if iOk && iMatched.Version == pkgs[i].Version && (!jOk || jMatched.Version != pkgs[j].Version) {
-			return true
+// recordAmbiguity records the candidates in sorted pkgs that are ranked equally with the first one,
+// if there are any, the first time name is resolved.
+func (p *PkgResolver) recordAmbiguity(pkgs []*repositoryPackage, compare *repository.RepositoryPackage, name string, existing map[string]*repository.RepositoryPackage, existingOrigins map[string]bool, pin string) {
+	if name == "" {
+		name = pkgs[0].Name
+	}
+	if _, ok := p.ambiguities[name]; ok {
+		return
+	}
+	tied := []*repository.RepositoryPackage{pkgs[0].RepositoryPackage}
+	for _, pkg := range pkgs[1:] {
+		if _, reason := p.preferPackage(pkgs[0], pkg, compare, name, existing, existingOrigins, pin); reason != ResolveReasonName {
+			// sorted, so nothing after it is tied either
+			break
 		}
-		// the first did not match, check if the second matches
-		if jOk && jMatched.Version == pkgs[j].Version && (!iOk || iMatched.Version != pkgs[i].Version) {
-			return false
+		duplicate := false
+		for _, t := range tied {
+			duplicate = duplicate || (t.Name == pkg.Name && t.Version == pkg.Version && bytes.Equal(t.Checksum, pkg.Checksum))
 		}
-		// both matched, so keep looking
-
-		// see if an origin already is installed
-		iOriginMatched := existingOrigins[pkgs[i].Origin]
-		jOriginMatched := existingOrigins[pkgs[j].Origin]
-		if iOriginMatched && !jOriginMatched {
-			return true
+		if !duplicate {
+			tied = append(tied, pkg.RepositoryPackage)
 		}
-		if jOriginMatched && !iOriginMatched {
-			return false
+	}
+	if len(tied) > 1 {
+		p.ambiguities[name] = Ambiguity{Name: name, Candidates: tied}
+	}
+}
+
+// checkVersions records the packages in pkgs whose version, or the version they provide name at,
+// cannot be parsed. With strict versions, the first one is returned as an error instead.
+func (p *PkgResolver) checkVersions(pkgs []*repositoryPackage, name string) error {
+	for _, pkg := range pkgs {
+		for _, version := range []string{pkg.Version, p.getDepVersionForName(pkg, name)} {
+			if version == "" {
+				// name is not provided with a version, which is not an error
+				continue
+			}
+			if _, err := p.parseVersion(version); err != nil {
+				invalid := InvalidVersionError{Package: pkg.Name, Version: version, Err: err}
+				if p.strictVersions {
+					return invalid
+				}
+				p.invalidVersions[pkg.Name+"="+version] = invalid
+			}
 		}
-		if pkgs[i].pinnedName == pin && pkgs[j].pinnedName != pin {
-			return true
+	}
+	return nil
+}
+
+// InvalidVersions returns the candidate packages seen so far whose version could not be parsed,
+// and that therefore were ranked below all others, sorted by package and version.
+func (p *PkgResolver) InvalidVersions() []InvalidVersionError {
+	invalid := make([]InvalidVersionError, 0, len(p.invalidVersions))
+	for _, i := range p.invalidVersions {
+		invalid = append(invalid, i)
+	}
+	sort.Slice(invalid, func(i, j int) bool {
+		if invalid[i].Package != invalid[j].Package {
+			return invalid[i].Package < invalid[j].Package
 		}
-		if pkgs[i].pinnedName != pin && pkgs[j].pinnedName == pin {
-			return false
+		return invalid[i].Version < invalid[j].Version
+	})
+	return invalid
+}
+
+// preferPackage reports whether a should be preferred over b when sorting for sortPackages,
+// and which factor decided it.
+func (p *PkgResolver) preferPackage(a, b *repositoryPackage, compare *repository.RepositoryPackage, name string, existing map[string]*repository.RepositoryPackage, existingOrigins map[string]bool, pin string) (bool, ResolveReason) { //nolint:gocyclo
+	// determine versions
+	aVersionStr := p.getDepVersionForName(a, name)
+	bVersionStr := p.getDepVersionForName(b, name)
+	if compare != nil {
+		// matching repository
+		pkgRepo := compare.Repository().Uri
+		aRepo := a.Repository().Uri
+		bRepo := b.Repository().Uri
+		if aRepo == pkgRepo && bRepo != pkgRepo {
+			return true, ResolveReasonRepository
 		}
-		// check provider priority
-		if pkgs[i].ProviderPriority != pkgs[j].ProviderPriority {
-			return pkgs[i].ProviderPriority > pkgs[j].ProviderPriority
+		if bRepo == pkgRepo && aRepo != pkgRepo {
+			return false, ResolveReasonRepository
 		}
-		// both matched or both did not, so just compare versions
-		// version priority
-		iVersion, err := p.parseVersion(iVersionStr)
-		if err != nil {
-			return false
+		// matching origin with compare
+		pkgOrigin := compare.Origin
+		aOrigin := a.Origin
+		bOrigin := b.Origin
+		if aOrigin == pkgOrigin && bOrigin != pkgOrigin {
+			return true, ResolveReasonOrigin
 		}
-		jVersion, err := p.parseVersion(jVersionStr)
-		if err != nil {
-			return false
+		if bOrigin == pkgOrigin && aOrigin != pkgOrigin {
+			return false, ResolveReasonOrigin
 		}
-		versions := compareVersions(iVersion, jVersion)
+	}
+	// see if one already is installed
+	aMatched, aOk := existing[a.Name]
+	bMatched, bOk := existing[b.Name]
+
+	// because existing takes priority, if either matches, we should take it
+	// check if the first matches
+	if aOk && aMatched.Version == a.Version && (!bOk || bMatched.Version != b.Version) {
+		return true, ResolveReasonInstalled
+	}
+	// the first did not match, check if the second matches
+	if bOk && bMatched.Version == b.Version && (!aOk || aMatched.Version != a.Version) {
+		return false, ResolveReasonInstalled
+	}
+	// both matched, so keep looking
+
+	// see if an origin already is installed
+	aOriginMatched := existingOrigins[a.Origin]
+	bOriginMatched := existingOrigins[b.Origin]
+	if aOriginMatched && !bOriginMatched {
+		return true, ResolveReasonInstalledOrigin
+	}
+	if bOriginMatched && !aOriginMatched {
+		return false, ResolveReasonInstalledOrigin
+	}
+	if a.pinnedName == pin && b.pinnedName != pin {
+		return true, ResolveReasonPin
+	}
+	if a.pinnedName != pin && b.pinnedName == pin {
+		return false, ResolveReasonPin
+	}
+	// check provider priority
+	if a.ProviderPriority != b.ProviderPriority {
+		return a.ProviderPriority > b.ProviderPriority, ResolveReasonProviderPriority
+	}
+	// both matched or both did not, so just compare versions
+	// version priority
+	versions := p.compareVersionStrings(aVersionStr, bVersionStr)
+	if versions != equal {
+		return versions == greater, ResolveReasonVersion
+	}
+	// if versions are equal, they might not be the same as the package versions
+	if aVersionStr != a.Version || bVersionStr != b.Version {
+		versions := p.compareVersionStrings(a.Version, b.Version)
 		if versions != equal {
-			return versions == greater
+			return versions == greater, ResolveReasonVersion
 		}
-		// if versions are equal, they might not be the same as the package versions
-		if iVersionStr != pkgs[i].Version || jVersionStr != pkgs[j].Version {
-			iVersion, err := p.parseVersion(pkgs[i].Version)
-			if err != nil {
-				return false
-			}
-			jVersion, err := p.parseVersion(pkgs[j].Version)
-			if err != nil {
-				return false
-			}
-			versions := compareVersions(iVersion, jVersion)
-			if versions != equal {
-				return versions == greater
-			}
+	}
+	// if versions are equal, prefer the repository, if any preference was given
+	if aRank, bRank := p.repositoryRank(a), p.repositoryRank(b); aRank != bRank {
+		return aRank < bRank, ResolveReasonRepositoryPreference
+	}
+	// if all else is equal, compare names
+	return a.Name < b.Name, ResolveReasonName
+}
+
+// compareVersionStrings compares two versions like compareVersions. A version that cannot be parsed
+// is lower than any that can, and two that cannot are compared as strings, so that sorting by version
+// is consistent whatever the versions are.
+func (p *PkgResolver) compareVersionStrings(a, b string) versionCompare {
+	aVersion, aErr := p.parseVersion(a)
+	bVersion, bErr := p.parseVersion(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareVersions(aVersion, bVersion)
+	case aErr == nil:
+		return greater
+	case bErr == nil:
+		return less
+	case a > b:
+		return greater
+	case a < b:
+		return less
+	default:
+		return equal
+	}
+}
+
+// repositoryRank returns the position of the repository of pkg in the list of preferred repositories,
+// or the length of the list if it is not in it.
+func (p *PkgResolver) repositoryRank(pkg *repositoryPackage) int {
+	var uri string
+	if repo := pkg.Repository(); repo != nil && repo.Repository != nil {
+		uri = strings.TrimRight(repo.Uri, "/")
+	}
+	for i, pref := range p.repositoryPrefs {
+		if pkg.pinnedName != "" && pkg.pinnedName == pref {
+			return i
 		}
-		// if versions are equal, compare names
-		return pkgs[i].Name < pkgs[j].Name
-	})
+		pref = strings.TrimRight(pref, "/")
+		if uri != "" && (uri == pref || strings.HasPrefix(uri, pref+"/")) {
+			return i
+		}
+	}
+	return len(p.repositoryPrefs)
 }
 
 // getDepVersionForName get the version of the package that provides the given name.
@@ -0,0 +1,266 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"fmt"
+	"io"
+	"io/fs"
+	"runtime"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// FileConflict is a file that a package would install over a different existing file.
+type FileConflict struct {
+	// Path of the file, relative to the root.
+	Path string
+	// Package that would install the file.
+	Package string
+	// Owner is the package that already provides the file, either installed or earlier in
+	// the same simulation. It is empty if the file exists but does not belong to any package.
+	Owner string
+}
+
+// FixateSimulation is the result of SimulateFixateWorld.
+type FixateSimulation struct {
+	// Packages that would be installed, in order. Packages that are already installed are not included.
+	Packages []*repository.RepositoryPackage
+	// PackageConflicts are installed packages that conflict with the resolved world.
+	PackageConflicts []string
+	// Conflicts are files that would make FixateWorld fail, because the existing file has different
+	// contents and belongs to a package with a different origin, or the package has no origin at all.
+	Conflicts []FileConflict
+	// Overwrites are files with different contents that FixateWorld would overwrite, because the
+	// existing file belongs to a package with the same origin, or one that is replaced.
+	Overwrites []FileConflict
+}
+
+// SimulateFixateWorld resolves the world and plans the placement of every file of every package
+// that FixateWorld would install, without writing anything to the filesystem. Unlike ResolveWorld,
+// it fetches and expands each package to enumerate its files, so it can report cross-package file
+// conflicts and overwrites. Packages are fetched through the cache, if set, so it is cheap when the
+// cache is warm.
+func (a *APK) SimulateFixateWorld(ctx context.Context) (*FixateSimulation, error) {
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting package dependencies: %w", err)
+	}
+	return a.SimulateFixateWorldWithIndexes(ctx, indexes)
+}
+
+// SimulateFixateWorldWithIndexes is like SimulateFixateWorld, but uses the given indexes, e.g. from
+// LoadIndexes, instead of fetching them.
+func (a *APK) SimulateFixateWorldWithIndexes(ctx context.Context, indexes []NamedIndex) (*FixateSimulation, error) {
+	a.logger.Infof("simulating synchronization with desired apk world")
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "SimulateFixateWorld")
+	defer span.End()
+
+	allpkgs, conflicts, err := a.ResolveWorldWithIndexes(ctx, indexes)
+	if err != nil {
+		return nil, fmt.Errorf("error getting package dependencies: %w", err)
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get list of installed packages and files: %w", err)
+	}
+	installedNames := map[string]bool{}
+	for _, pkg := range installed {
+		installedNames[pkg.Name] = true
+	}
+
+	sim := &FixateSimulation{}
+	for _, pkg := range conflicts {
+		if installedNames[pkg] {
+			sim.PackageConflicts = append(sim.PackageConflicts, pkg)
+		}
+	}
+	for _, pkg := range allpkgs {
+		if !installedNames[pkg.Name] {
+			sim.Packages = append(sim.Packages, pkg)
+		}
+	}
+
+	expanded := make([]*APKExpanded, len(sim.Packages))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for i, pkg := range sim.Packages {
+		i, pkg := i, pkg
+		g.Go(func() error {
+			exp, err := a.expandPackage(gctx, pkg)
+			if err != nil {
+				return fmt.Errorf("expanding %s: %w", pkg.Name, err)
+			}
+			expanded[i] = exp
+			return nil
+		})
+	}
+	err = g.Wait()
+	defer func() {
+		for _, exp := range expanded {
+			if exp != nil {
+				exp.Close()
+			}
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	tracker := newFileTracker(a, installed)
+	for i, pkg := range sim.Packages {
+		var headers []tar.Header
+		for _, entry := range expanded[i].tarfs.Entries() {
+			headers = append(headers, entry.Header)
+		}
+		c, o, err := tracker.add(pkg.Package, expanded[i].tarfs, headers)
+		if err != nil {
+			return nil, fmt.Errorf("planning files for %s: %w", pkg.Name, err)
+		}
+		sim.Conflicts = append(sim.Conflicts, c...)
+		sim.Overwrites = append(sim.Overwrites, o...)
+	}
+
+	return sim, nil
+}
+
+// fileTracker keeps track of which package provides each file, to detect conflicts between
+// packages before anything is written, following the same rules as installAPKFiles.
+type fileTracker struct {
+	a *APK
+	// packages are the installed packages, followed by the ones planned so far, as if installed
+	packages  []*InstalledPackage
+	installed map[string]*repository.Package
+	planned   map[string]trackedFile
+}
+
+type trackedFile struct {
+	pkg      *repository.Package
+	checksum []byte
+}
+
+func newFileTracker(a *APK, installed []*InstalledPackage) *fileTracker {
+	t := &fileTracker{
+		a:         a,
+		packages:  append([]*InstalledPackage(nil), installed...),
+		installed: map[string]*repository.Package{},
+		planned:   map[string]trackedFile{},
+	}
+	for _, pkg := range installed {
+		pkg := pkg
+		for _, f := range pkg.Files {
+			t.installed[f.Name] = &pkg.Package
+		}
+	}
+	return t
+}
+
+// add plans the regular files of pkg given by headers, whose contents can be read from tfs, and
+// returns the files that would conflict with, or overwrite, files that are installed or planned.
+// Entries are resolved in the root and checked as installAPKFiles does, and so are the files.
+func (t *fileTracker) add(pkg *repository.Package, tfs fs.FS, headers []tar.Header) (conflicts, overwrites []FileConflict, err error) {
+	var (
+		startedDataSection bool
+		entries            = t.a.newEntryResolver()
+		files              []*tar.Header
+	)
+	// the files of pkg count as installed for the packages planned after it
+	defer func() {
+		t.packages = append(t.packages, &InstalledPackage{Package: *pkg, Files: files})
+	}()
+	for i := range headers {
+		header := &headers[i]
+		// skip the control files at the start, as installAPKFiles does
+		if !startedDataSection && header.Name[0] == '.' && !strings.Contains(header.Name, "/") {
+			continue
+		}
+		startedDataSection = true
+		resolved, err := entries.resolve(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		files = append(files, header)
+
+		checksum, err := checksumFromHeader(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if checksum == nil {
+			if checksum, err = sha1Sum(tfs, header.Name); err != nil {
+				return nil, nil, fmt.Errorf("unable to calculate sum of %s: %w", header.Name, err)
+			}
+		}
+
+		var (
+			owner    *repository.Package
+			existing []byte
+		)
+		if planned, ok := t.planned[resolved]; ok {
+			owner, existing = planned.pkg, planned.checksum
+		} else if _, err := t.a.fs.Stat(resolved); err == nil {
+			owner = t.installed[header.Name]
+			if existing, err = sha1Sum(t.a.fs, resolved); err != nil {
+				return nil, nil, fmt.Errorf("unable to calculate sum of existing file %s: %w", header.Name, err)
+			}
+		}
+		if existing == nil {
+			t.planned[resolved] = trackedFile{pkg: pkg, checksum: checksum}
+			continue
+		}
+
+		installed := func() ([]*InstalledPackage, error) { return t.packages, nil }
+		overwrite, err := checkOverwrite(installed, resolved, header.Name, pkg.Origin, pkg.Replaces, checksum, existing)
+		if err == nil && !overwrite {
+			// identical to the existing one, which is kept along with its owner
+			continue
+		}
+		t.planned[resolved] = trackedFile{pkg: pkg, checksum: checksum}
+
+		conflict := FileConflict{Path: header.Name, Package: pkg.Name}
+		if owner != nil {
+			conflict.Owner = owner.Name
+		}
+		if overwrite {
+			overwrites = append(overwrites, conflict)
+		} else {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts, overwrites, nil
+}
+
+func sha1Sum(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, err
+	}
+	return w.Sum(nil), nil
+}
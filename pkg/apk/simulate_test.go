@@ -0,0 +1,142 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	"github.com/chainguard-dev/go-apk/internal/tarfs"
+)
+
+func TestFileTracker(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, src.MkdirAll("etc", 0o755))
+	require.NoError(t, src.WriteFile("etc/existing", []byte("existing"), 0o644))
+
+	tracker := newFileTracker(apk, nil)
+	add := func(pkg *repository.Package, entries []testDirEntry) ([]FileConflict, []FileConflict) {
+		r := testCreateTarForPackage(entries).(io.ReadSeeker)
+		tf, err := tarfs.New(func() (io.ReadSeekCloser, error) {
+			_, err := r.Seek(0, io.SeekStart)
+			return testReadSeekNopCloser{r}, err
+		})
+		require.NoError(t, err)
+		var headers []tar.Header
+		for _, e := range tf.Entries() {
+			headers = append(headers, e.Header)
+		}
+		conflicts, overwrites, err := tracker.add(pkg, tf, headers)
+		require.NoError(t, err)
+		return conflicts, overwrites
+	}
+
+	first := &repository.Package{Name: "first", Origin: "first"}
+	conflicts, overwrites := add(first, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/foo", 0o644, false, []byte("first"), nil},
+		{"etc/same", 0o644, false, []byte("same"), nil},
+	})
+	require.Empty(t, conflicts)
+	require.Empty(t, overwrites)
+
+	// identical content is fine, different content from a different origin is a conflict,
+	// as is different content over a file that exists but is not owned by any package
+	second := &repository.Package{Name: "second", Origin: "second"}
+	conflicts, overwrites = add(second, []testDirEntry{
+		{"etc/foo", 0o644, false, []byte("second"), nil},
+		{"etc/same", 0o644, false, []byte("same"), nil},
+		{"etc/existing", 0o644, false, []byte("changed"), nil},
+	})
+	require.Equal(t, []FileConflict{
+		{Path: "etc/foo", Package: "second", Owner: "first"},
+		{Path: "etc/existing", Package: "second"},
+	}, conflicts)
+	require.Empty(t, overwrites)
+
+	// different content from the same origin, or from a package that replaces the owner, is an overwrite
+	subpkg := &repository.Package{Name: "first-sub", Origin: "first"}
+	conflicts, overwrites = add(subpkg, []testDirEntry{
+		{"etc/same", 0o644, false, []byte("same, but different"), nil},
+	})
+	require.Empty(t, conflicts)
+	require.Equal(t, []FileConflict{{Path: "etc/same", Package: "first-sub", Owner: "first"}}, overwrites)
+
+	replacer := &repository.Package{Name: "replacer", Origin: "replacer", Replaces: "first-sub"}
+	conflicts, overwrites = add(replacer, []testDirEntry{
+		{"etc/same", 0o644, false, []byte("replaced"), nil},
+	})
+	require.Empty(t, conflicts)
+	require.Equal(t, []FileConflict{{Path: "etc/same", Package: "replacer", Owner: "first-sub"}}, overwrites)
+}
+
+func TestSimulateFixateWorld(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// all of them install the same file, with their own contents, after first
+	var pkgs []*repository.Package
+	for _, p := range []struct {
+		name, origin string
+		deps         []string
+	}{{"first", "first", nil}, {"first-sub", "first", []string{"first"}}, {"second", "second", []string{"first"}}} {
+		b := testCreateAPK(t, "pkgname = "+p.name+"\npkgver = 1.0.0-r0\narch = aarch64\n", []testDirEntry{
+			{path: "usr", perms: 0o755, dir: true},
+			{path: "usr/share", perms: 0o755, dir: true},
+			{path: "usr/share/file", perms: 0o644, content: []byte(p.name)},
+		})
+		require.NoError(t, os.WriteFile(filepath.Join(dir, p.name+"-1.0.0-r0.apk"), b, 0o644))
+		exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+		require.NoError(t, err)
+		exp.Close()
+		pkgs = append(pkgs, &repository.Package{Name: p.name, Version: "1.0.0-r0", Arch: testArch, Origin: p.origin, Checksum: exp.ControlHash, Dependencies: p.deps})
+	}
+	repo := repository.Repository{Uri: dir}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: pkgs})})
+
+	// what is simulated is what happens when fixating the world for real
+	t.Run("overwrite", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.SetWorld([]string{"first-sub"}))
+		sim, err := a.SimulateFixateWorldWithIndexes(ctx, indexes)
+		require.NoError(t, err)
+		require.Empty(t, sim.Conflicts)
+		require.Equal(t, []FileConflict{{Path: "usr/share/file", Package: "first-sub", Owner: "first"}}, sim.Overwrites)
+
+		require.NoError(t, a.FixateWorldWithIndexes(ctx, indexes, nil))
+		content, err := a.fs.ReadFile("usr/share/file")
+		require.NoError(t, err)
+		require.Equal(t, "first-sub", string(content))
+	})
+	t.Run("conflict", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.SetWorld([]string{"second"}))
+		sim, err := a.SimulateFixateWorldWithIndexes(ctx, indexes)
+		require.NoError(t, err)
+		require.Equal(t, []FileConflict{{Path: "usr/share/file", Package: "second", Owner: "first"}}, sim.Conflicts)
+		require.Empty(t, sim.Overwrites)
+
+		err = a.FixateWorldWithIndexes(ctx, indexes, nil)
+		require.ErrorContains(t, err, "different contents: usr/share/file")
+	})
+}
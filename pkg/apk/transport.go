@@ -16,12 +16,127 @@ package apk
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/go-apk/pkg/logger"
+	"github.com/hashicorp/go-retryablehttp"
 )
 
+// maxRedirects matches the default limit of net/http.
+const maxRedirects = 10
+
+// newHTTPTransport returns the transport shared by all requests of the internally created client,
+// so that connections are reused across keys, indexes and packages. With http2, connections to
+// servers that support it are multiplexed; without it, only HTTP/1.1 is used. The connection
+// limits from o apply to every host.
+func newHTTPTransport(o *opts) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// packages are fetched concurrently, keep enough idle connections around to reuse them
+	t.MaxIdleConnsPerHost = runtime.GOMAXPROCS(0) + 1
+	t.ForceAttemptHTTP2 = o.http2
+	if !o.http2 {
+		// a non-nil, empty map disables HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if o.maxConnsPerHost > 0 {
+		t.MaxConnsPerHost = o.maxConnsPerHost
+		if t.MaxIdleConnsPerHost > o.maxConnsPerHost {
+			t.MaxIdleConnsPerHost = o.maxConnsPerHost
+		}
+	}
+	if o.idleConnTimeout > 0 {
+		t.IdleConnTimeout = o.idleConnTimeout
+	}
+	return t
+}
+
+// withAuthStrippingRedirects returns a copy of client that still follows redirects, but strips
+// credentials from the redirected request when the target host differs from the original one.
+// This keeps credentials for private repositories from leaking to e.g. a public CDN.
+// Any CheckRedirect policy already set on client is still applied afterwards.
+func withAuthStrippingRedirects(client *http.Client) *http.Client {
+	c := *client
+	next := client.CheckRedirect
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > 0 && req.URL.Host != via[0].URL.Host {
+			req.Header.Del("Authorization")
+			req.Header.Del("Cookie")
+			req.URL.User = nil
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+	return &c
+}
+
+// timeoutTransport fails a request if the response headers and the first byte of the body
+// do not arrive within timeout. Once the body starts flowing the timeout no longer applies.
+type timeoutTransport struct {
+	wrapped http.RoundTripper
+	timeout time.Duration
+}
+
+func newTimeoutTransport(wrapped http.RoundTripper, timeout time.Duration) *timeoutTransport {
+	if wrapped == nil {
+		wrapped = http.DefaultTransport
+	}
+	return &timeoutTransport{
+		wrapped: wrapped,
+		timeout: timeout,
+	}
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	resp, err := t.wrapped.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		fired := !timer.Stop()
+		cancel()
+		if fired {
+			return nil, fmt.Errorf("request to %s timed out after %s: %w", req.URL.Redacted(), t.timeout, err)
+		}
+		return nil, err
+	}
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, timer: timer, cancel: cancel}
+	return resp, nil
+}
+
+type timeoutBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Stop()
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 type rangeRetryTransport struct {
 	client *http.Client
 	ctx    context.Context
@@ -54,6 +169,24 @@ type rangeRetryReader struct {
 
 	progress int64
 	total    int64
+
+	// validator is the strong ETag, or else the Last-Modified date, of the first response.
+	// It is sent as If-Range when resuming, so that we never splice bytes of different content.
+	validator string
+}
+
+// errContentChanged is returned when resuming a download finds that the content changed
+// since the first response. The bytes already read cannot be taken back, so the download
+// has to be started again by the caller.
+var errContentChanged = errors.New("content changed while resuming download")
+
+// responseValidator returns the value to use in an If-Range header for resp, if any.
+// Weak ETags are not allowed in If-Range, so fall back to Last-Modified for those.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
 }
 
 func (r *rangeRetryReader) reset(oerr error) (*http.Response, error) {
@@ -67,6 +200,9 @@ func (r *rangeRetryReader) reset(oerr error) (*http.Response, error) {
 	rangeHeader := fmt.Sprintf("bytes=%d-", r.progress)
 	if r.progress != 0 {
 		req.Header.Set("Range", rangeHeader)
+		if r.validator != "" {
+			req.Header.Set("If-Range", r.validator)
+		}
 	}
 
 	resp, err := r.client.Do(req)
@@ -81,8 +217,16 @@ func (r *rangeRetryReader) reset(oerr error) (*http.Response, error) {
 	if r.total == 0 {
 		r.total = resp.ContentLength
 	}
+	if r.progress == 0 {
+		r.validator = responseValidator(resp)
+	}
 
 	if resp.StatusCode == http.StatusOK {
+		// A 200 to a request with If-Range means the content changed, unless the upstream
+		// just ignores Range, in which case the validator is unchanged.
+		if r.progress != 0 && r.validator != "" && responseValidator(resp) != r.validator {
+			return resp, fmt.Errorf("retrying %w: %s %s: %w", oerr, req.Method, req.URL.String(), errContentChanged)
+		}
 		// If the upstream doesn't support Range requests for some reason and only returns 200,
 		// we need to discard anything we've already Read().
 		if r.progress != 0 {
@@ -140,3 +284,117 @@ func (r *rangeRetryReader) Close() error {
 
 	return r.body.Close()
 }
+
+// circuitBreaker keeps track of failed requests by host, and once a host had too many of them
+// within a window, fails requests to it fast for the length of the window, rather than letting
+// every request spend its own retries on a host that is clearly down.
+type circuitBreaker struct {
+	maxFailures int
+	window      time.Duration
+	logger      logger.Logger
+	// now is time.Now, replaceable in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	// tripped is when requests to a host started failing fast.
+	tripped map[string]time.Time
+}
+
+func newCircuitBreaker(maxFailures int, window time.Duration, log logger.Logger) *circuitBreaker {
+	return &circuitBreaker{
+		maxFailures: maxFailures,
+		window:      window,
+		logger:      log,
+		now:         time.Now,
+		failures:    map[string][]time.Time{},
+		tripped:     map[string]time.Time{},
+	}
+}
+
+// allow returns a CircuitOpenError if requests to host fail fast.
+func (b *circuitBreaker) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tripped, ok := b.tripped[host]
+	if !ok {
+		return nil
+	}
+	if b.now().Sub(tripped) >= b.window {
+		// give it another chance
+		delete(b.tripped, host)
+		delete(b.failures, host)
+		return nil
+	}
+	return CircuitOpenError{Host: host, Failures: b.maxFailures, Window: b.window}
+}
+
+// fail records a failed request to host.
+func (b *circuitBreaker) fail(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	recent := b.failures[host][:0]
+	for _, t := range b.failures[host] {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	b.failures[host] = recent
+	if _, ok := b.tripped[host]; !ok && len(recent) >= b.maxFailures {
+		b.tripped[host] = now
+		b.logger.Warnf("%d requests to %s failed within %s, failing requests to it for %s", len(recent), host, b.window, b.window)
+	}
+}
+
+// reset forgets all failures, e.g. to give a new operation a new budget.
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = map[string][]time.Time{}
+	b.tripped = map[string]time.Time{}
+}
+
+// circuitBreakerTransport records the failures of requests made through it with breaker, and
+// fails requests to hosts that breaker says are down. A request fails if there is no response,
+// other than because its context was canceled, or if the server is unavailable, with a 5xx or
+// 429 status.
+type circuitBreakerTransport struct {
+	wrapped http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func newCircuitBreakerTransport(wrapped http.RoundTripper, breaker *circuitBreaker) *circuitBreakerTransport {
+	if wrapped == nil {
+		wrapped = http.DefaultTransport
+	}
+	return &circuitBreakerTransport{
+		wrapped: wrapped,
+		breaker: breaker,
+	}
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := t.breaker.allow(host); err != nil {
+		return nil, err
+	}
+	resp, err := t.wrapped.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() == nil:
+		t.breaker.fail(host)
+	case err == nil && (resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests):
+		t.breaker.fail(host)
+	}
+	return resp, err
+}
+
+// circuitBreakerRetryPolicy is the default retry policy, except that requests failed by a
+// circuitBreakerTransport are not retried.
+func circuitBreakerRetryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if errors.Is(err, CircuitOpenError{}) {
+		return false, err
+	}
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
@@ -17,12 +17,22 @@ package apk
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"testing/iotest"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"golang.org/x/sync/errgroup"
 )
 
 type testReader struct {
@@ -197,3 +207,498 @@ func TestTransport(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthStrippingRedirects(t *testing.T) {
+	var gotAuth []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+	}))
+	defer target.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		case "/other":
+			http.Redirect(w, r, target.URL+"/final", http.StatusFound)
+		default:
+			gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+		}
+	}))
+	defer origin.Close()
+
+	client := withAuthStrippingRedirects(origin.Client())
+	for _, tc := range []struct {
+		path     string
+		wantAuth bool
+	}{
+		{path: "/same", wantAuth: true},
+		{path: "/other", wantAuth: false},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			gotAuth = nil
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, origin.URL+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.SetBasicAuth("user", "pass")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if len(gotAuth) != 1 {
+				t.Fatalf("expected redirect to be followed once, got %d requests", len(gotAuth))
+			}
+			if hasAuth := gotAuth[0] != ""; hasAuth != tc.wantAuth {
+				t.Errorf("auth forwarded = %v, want %v", hasAuth, tc.wantAuth)
+			}
+		})
+	}
+}
+
+func TestTimeoutTransport(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stall":
+			// never send headers until the client gives up
+			<-r.Context().Done()
+		case "/slow-body":
+			// first byte arrives promptly, the rest takes longer than the timeout
+			_, _ = w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+			time.Sleep(3 * timeout)
+			_, _ = w.Write([]byte("b"))
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newTimeoutTransport(srv.Client().Transport, timeout)}
+
+	t.Run("stalled headers", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/stall", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatal("expected timeout error")
+		}
+		if elapsed := time.Since(start); elapsed > 10*timeout {
+			t.Errorf("request took %s, expected to fail after about %s", elapsed, timeout)
+		}
+	})
+	t.Run("slow body", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/slow-body", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		got, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "ab" {
+			t.Errorf("got %q, want %q", got, "ab")
+		}
+	})
+}
+
+// testChangingTransport serves a body that fails mid-stream, then serves the
+// responses in resps to the following requests, recording the If-Range headers.
+type testChangingTransport struct {
+	resps    []*http.Response
+	ifRanges []string
+}
+
+func (t *testChangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.resps) == 0 {
+		return nil, fmt.Errorf("this shouldn't happen")
+	}
+	if req.Header.Get("Range") != "" {
+		t.ifRanges = append(t.ifRanges, req.Header.Get("If-Range"))
+	}
+	resp := t.resps[0]
+	t.resps = t.resps[1:]
+	return resp, nil
+}
+
+func TestTransportIfRange(t *testing.T) {
+	withHeader := func(resp *http.Response, body io.Reader, kv ...string) *http.Response {
+		resp.Header = http.Header{}
+		for i := 0; i < len(kv); i += 2 {
+			resp.Header.Set(kv[i], kv[i+1])
+		}
+		resp.Body = io.NopCloser(body)
+		return resp
+	}
+
+	for _, tc := range []struct {
+		name        string
+		first       *http.Response
+		retry       *http.Response
+		wantIfRange string
+		wantErr     bool
+	}{{
+		name:        "resumed with same etag",
+		first:       withHeader(ok(2), mr(cr(), er()), "ETag", `"v1"`),
+		retry:       withHeader(part(), cr(), "ETag", `"v1"`),
+		wantIfRange: `"v1"`,
+	}, {
+		name:        "range ignored but content unchanged",
+		first:       withHeader(ok(2), mr(cr(), er()), "ETag", `"v1"`),
+		retry:       withHeader(ok(2), mr(cr(), cr()), "ETag", `"v1"`),
+		wantIfRange: `"v1"`,
+	}, {
+		name:        "content changed",
+		first:       withHeader(ok(2), mr(cr(), er()), "ETag", `"v1"`),
+		retry:       withHeader(ok(2), mr(cr(), cr()), "ETag", `"v2"`),
+		wantIfRange: `"v1"`,
+		wantErr:     true,
+	}, {
+		name:        "weak etag falls back to last-modified",
+		first:       withHeader(ok(2), mr(cr(), er()), "ETag", `W/"v1"`, "Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT"),
+		retry:       withHeader(part(), cr(), "ETag", `W/"v1"`, "Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT"),
+		wantIfRange: "Mon, 02 Jan 2006 15:04:05 GMT",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := &testChangingTransport{resps: []*http.Response{tc.first, tc.retry}}
+			rt := newRangeRetryTransport(context.Background(), &http.Client{Transport: tt})
+
+			req := &http.Request{
+				URL:    &url.URL{},
+				Header: map[string][]string{},
+			}
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			got, err := io.ReadAll(resp.Body)
+			if tc.wantErr {
+				if !errors.Is(err, errContentChanged) {
+					t.Fatalf("expected content changed error, got %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := append(cb(), cb()...); !bytes.Equal(got, want) {
+					t.Errorf("got %d bytes, want %d", len(got), len(want))
+				}
+			}
+			if len(tt.ifRanges) != 1 || tt.ifRanges[0] != tc.wantIfRange {
+				t.Errorf("If-Range = %q, want %q", tt.ifRanges, tc.wantIfRange)
+			}
+		})
+	}
+}
+
+func TestHTTPTransportReuse(t *testing.T) {
+	for _, tt := range []struct {
+		http2 bool
+		proto int
+	}{{true, 2}, {false, 1}} {
+		t.Run(fmt.Sprintf("http2=%v", tt.http2), func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				conns int
+			)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(r.Proto))
+			}))
+			srv.EnableHTTP2 = true
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					mu.Lock()
+					conns++
+					mu.Unlock()
+				}
+			}
+			srv.StartTLS()
+			defer srv.Close()
+
+			a, err := New(WithHTTP2(tt.http2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+			get := func() error {
+				// every fetch gets its own client, as the package fetches do
+				resp, err := a.httpClient().Get(srv.URL)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+					return err
+				}
+				if resp.ProtoMajor != tt.proto {
+					return fmt.Errorf("got protocol %s, want HTTP/%d", resp.Proto, tt.proto)
+				}
+				return nil
+			}
+			if err := get(); err != nil {
+				t.Fatal(err)
+			}
+			const (
+				fetches = 100
+				jobs    = 4
+			)
+			var eg errgroup.Group
+			eg.SetLimit(jobs)
+			for i := 0; i < fetches; i++ {
+				eg.Go(get)
+			}
+			if err := eg.Wait(); err != nil {
+				t.Fatal(err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.http2 && conns != 1 {
+				t.Errorf("got %d connections for %d fetches, want 1 multiplexed connection", conns, fetches+1)
+			}
+			// HTTP/1.1 may race a new dial against a connection being released, so allow some slack
+			if !tt.http2 && conns > fetches/2 {
+				t.Errorf("got %d connections for %d fetches with at most %d at a time, want them reused", conns, fetches+1, jobs)
+			}
+		})
+	}
+}
+
+func TestHTTPTransportLimits(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns int
+		// signalled whenever a connection is closed
+		closed = make(chan struct{}, 1)
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("package"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		case http.StateClosed:
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	connections := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+
+	const idle = 100 * time.Millisecond
+	a, err := New(WithHTTP2(false), WithMaxConnsPerHost(1), WithIdleConnTimeout(idle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	fetch := func() error {
+		// the same path as fetching a package, through the range retry transport
+		rc, err := fetchPackageURL(context.Background(), a.httpClient(), srv.URL+"/foo.apk")
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(io.Discard, rc)
+		return err
+	}
+	var eg errgroup.Group
+	for i := 0; i < 20; i++ {
+		eg.Go(fetch)
+	}
+	if err := eg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if got := connections(); got != 1 {
+		t.Errorf("got %d connections with a limit of 1 per host", got)
+	}
+
+	// once idle for longer than the timeout, the connection is closed and a new one is needed
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+	if err := fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if got := connections(); got != 2 {
+		t.Errorf("got %d connections, want a new one after the idle timeout", got)
+	}
+}
+
+func TestFixateWorldTransportReuse(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	srv := httptest.NewUnstartedServer(http.FileServer(http.Dir(dir)))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	var (
+		pkgs  []*repository.Package
+		world []string
+	)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("pkg%d", i)
+		b := testCreateAPK(t, "pkgname = "+name+"\npkgver = 1.0.0-r0\narch = aarch64\n", []testDirEntry{
+			{path: "usr", perms: 0o755, dir: true},
+			{path: "usr/share", perms: 0o755, dir: true},
+			{path: "usr/share/" + name, perms: 0o644, content: []byte(name)},
+		})
+		if err := os.WriteFile(filepath.Join(dir, name+"-1.0.0-r0.apk"), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		exp, err := ExpandApk(ctx, bytes.NewReader(b), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp.Close()
+		pkgs = append(pkgs, &repository.Package{Name: name, Version: "1.0.0-r0", Arch: testArch, Checksum: exp.ControlHash})
+		world = append(world, name)
+	}
+	repo := repository.Repository{Uri: srv.URL}
+	indexes := testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{repo.WithIndex(&repository.ApkIndex{Packages: pkgs})})
+
+	// the packages are fetched concurrently, through the transport of a, which allows one connection
+	base := testGetTestAPKWithRepos(t)
+	a, err := New(WithFS(base.fs), WithIgnoreMknodErrors(true), WithHTTP2(false), WithMaxConnsPerHost(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	if err := a.SetWorld(world); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FixateWorldWithIndexes(ctx, indexes, nil); err != nil {
+		t.Fatal(err)
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(installed) < len(pkgs) {
+		t.Fatalf("got %d installed packages, want at least %d", len(installed), len(pkgs))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("got %d connections for %d packages, want the one connection reused", conns, len(pkgs))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		status   = http.StatusServiceUnavailable
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	requested := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	if _, err := New(WithFetchCircuitBreaker(3, 0)); err == nil {
+		t.Fatal("expected an error for a circuit breaker without a window")
+	}
+	a, err := New(WithFetchCircuitBreaker(3, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a.breaker.now = func() time.Time { return now }
+
+	// without the retries, to count the requests
+	client := &http.Client{Transport: newCircuitBreakerTransport(http.DefaultTransport, a.breaker)}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(srv.URL)
+		if i < 3 {
+			if err != nil {
+				t.Fatalf("request %d: %v", i, err)
+			}
+			resp.Body.Close()
+			continue
+		}
+		if !errors.Is(err, CircuitOpenError{}) {
+			t.Fatalf("request %d: got %v, want a CircuitOpenError", i, err)
+		}
+	}
+	if got := requested(); got != 3 {
+		t.Errorf("got %d requests, want 3 before failing fast", got)
+	}
+
+	// the retrying client gives up right away as well
+	start := time.Now()
+	if _, err := a.httpClient().Get(srv.URL); !errors.Is(err, CircuitOpenError{}) {
+		t.Fatalf("got %v, want a CircuitOpenError", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s to fail, want it to fail fast", elapsed)
+	}
+	if got := requested(); got != 3 {
+		t.Errorf("got %d requests, want none while failing fast", got)
+	}
+
+	// once the window passed, the host gets another chance
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	now = now.Add(time.Minute)
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// failures outside the window do not count, and neither do other hosts
+	a.breaker.reset()
+	for i := 0; i < 2; i++ {
+		a.breaker.fail("example.com")
+	}
+	now = now.Add(2 * time.Minute)
+	a.breaker.fail("example.com")
+	a.breaker.fail("other.example.com")
+	if err := a.breaker.allow("example.com"); err != nil {
+		t.Errorf("got %v, want failures outside the window to be forgotten", err)
+	}
+}
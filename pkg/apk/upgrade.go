@@ -0,0 +1,172 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// UpgradeWorld is like FixateWorld, but it also upgrades the installed packages for which world
+// resolves to a newer version: the installed version is removed, along with its files, scripts and
+// triggers, and the newer version is installed in its place. The newer versions are all fetched
+// before any installed version is removed, so if one cannot be fetched, nothing is changed. With
+// WithDeltaUpgrades, they are fetched as deltas against the installed versions where possible.
+// Installed packages that world no longer needs are kept, see GC.
+func (a *APK) UpgradeWorld(ctx context.Context, sourceDateEpoch *time.Time) error {
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting package dependencies: %w", err)
+	}
+	return a.UpgradeWorldWithIndexes(ctx, indexes, sourceDateEpoch)
+}
+
+// UpgradeWorldWithIndexes is like UpgradeWorld, but uses the given indexes, e.g. from LoadIndexes,
+// instead of fetching them.
+func (a *APK) UpgradeWorldWithIndexes(ctx context.Context, indexes []NamedIndex, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "UpgradeWorld")
+	defer span.End()
+
+	if a.breaker != nil {
+		a.breaker.reset()
+	}
+
+	allpkgs, err := a.resolveWorldToInstall(ctx, indexes)
+	if err != nil {
+		return err
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("error getting installed packages: %w", err)
+	}
+	upgrades := outdatedPackages(installed, allpkgs)
+
+	prefetched, err := a.fetchUpgrades(ctx, upgrades)
+	if err != nil {
+		return err
+	}
+	// installing takes the packages it uses out of prefetched
+	defer func() {
+		for _, exp := range prefetched {
+			exp.Close()
+		}
+	}()
+
+	if len(upgrades) > 0 {
+		replaced := make([]*InstalledPackage, 0, len(upgrades))
+		for _, u := range upgrades {
+			a.logger.Infof("upgrading %s (%s -> %s)", u.to.Name, u.from.Version, u.to.Version)
+			replaced = append(replaced, u.from)
+		}
+		if err := a.removePackages(replaced, sourceDateEpoch); err != nil {
+			return fmt.Errorf("removing upgraded packages: %w", err)
+		}
+	}
+
+	// the packages installed before any failure keep their scripts and triggers
+	hooks, err := a.installExpandedPackages(ctx, allpkgs, signedRepositories(indexes), sourceDateEpoch, prefetched)
+	if recordErr := a.recordHooks(hooks); recordErr != nil {
+		return errors.Join(err, recordErr)
+	}
+	return err
+}
+
+// fetchUpgrades fetches and expands the newer versions of upgrades, by name, while the installed
+// versions still are in place, as deltas against them where possible. If any of them fails, it
+// returns an error and none of them.
+func (a *APK) fetchUpgrades(ctx context.Context, upgrades []upgrade) (map[string]*APKExpanded, error) {
+	expanded := make([]*APKExpanded, len(upgrades))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for i, u := range upgrades {
+		i, u := i, u
+		// virtual packages have no apk to fetch
+		if isVirtual(u.to.Package) {
+			continue
+		}
+		g.Go(func() error {
+			// a delta fills the cache, where expanding the package finds it
+			if a.deltaUpgrades && a.deltaFetcher != nil && a.cache != nil {
+				if err := a.prefetchDelta(gctx, u.from, u.to); err != nil {
+					a.logger.Debugf("no delta (%s), fetching the full package: %v", u.to.Name, err)
+				}
+			}
+			exp, err := a.expandPackage(gctx, u.to)
+			if err != nil {
+				return fmt.Errorf("expanding %s: %w", u.to.Name, err)
+			}
+			expanded[i] = exp
+			return nil
+		})
+	}
+	err := g.Wait()
+
+	byName := make(map[string]*APKExpanded, len(upgrades))
+	for i, exp := range expanded {
+		if exp == nil {
+			continue
+		}
+		if err != nil {
+			exp.Close()
+			continue
+		}
+		byName[upgrades[i].to.Name] = exp
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching upgrades: %w", err)
+	}
+	return byName, nil
+}
+
+// upgrade is an installed package and the newer version to replace it with.
+type upgrade struct {
+	from *InstalledPackage
+	to   *repository.RepositoryPackage
+}
+
+// outdatedPackages returns the installed packages for which resolved has a newer version, in the
+// order of resolved.
+func outdatedPackages(installed []*InstalledPackage, resolved []*repository.RepositoryPackage) []upgrade {
+	byName := make(map[string]*InstalledPackage, len(installed))
+	for _, pkg := range installed {
+		byName[pkg.Name] = pkg
+	}
+	var outdated []upgrade
+	for _, pkg := range resolved {
+		from, ok := byName[pkg.Name]
+		if !ok || from.Version == pkg.Version {
+			continue
+		}
+		newer, err := parseVersion(pkg.Version)
+		if err != nil {
+			continue
+		}
+		current, err := parseVersion(from.Version)
+		if err != nil {
+			continue
+		}
+		if compareVersions(newer, current) == greater {
+			outdated = append(outdated, upgrade{from: from, to: pkg})
+		}
+	}
+	return outdated
+}
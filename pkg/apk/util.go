@@ -14,6 +14,8 @@
 
 package apk
 
+import "io"
+
 func uniqify[T comparable](s []T) []T {
 	seen := make(map[T]struct{}, len(s))
 	uniq := make([]T, 0, len(s))
@@ -28,3 +30,27 @@ func uniqify[T comparable](s []T) []T {
 
 	return uniq
 }
+
+// maxSizeReader wraps a reader of decompressed data, returning a MaxDecompressedSizeError once
+// more than max bytes have been read. A max of 0 or less means no limit.
+type maxSizeReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func newMaxSizeReader(r io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &maxSizeReader{r: r, max: max}
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.read += int64(n)
+	if m.read > m.max {
+		return n, MaxDecompressedSizeError{Limit: m.max}
+	}
+	return n, err
+}
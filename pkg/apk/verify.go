@@ -0,0 +1,294 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// InstalledMismatch is a difference between what the installed db records for a file or directory
+// and what is on the filesystem.
+type InstalledMismatch struct {
+	Package string
+	Path    string
+	Reason  string
+}
+
+func (m InstalledMismatch) String() string {
+	return fmt.Sprintf("%s: %s: %s", m.Package, m.Path, m.Reason)
+}
+
+// VerifyInstalled checks every file and directory recorded in the installed db against the
+// filesystem: that it exists with the recorded type, permissions (M: and a: lines) and, where the
+// filesystem reports it, ownership, and that regular files and symlinks match their recorded checksum.
+// It returns all mismatches found; an empty result means the root matches the installed db.
+func (a *APK) VerifyInstalled(ctx context.Context) ([]InstalledMismatch, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "VerifyInstalled")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+
+	var mismatches []InstalledMismatch
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			reasons, err := a.verifyInstalledFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("verifying %s of %s: %w", f.Name, pkg.Name, err)
+			}
+			for _, reason := range reasons {
+				mismatches = append(mismatches, InstalledMismatch{Package: pkg.Name, Path: f.Name, Reason: reason})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// verifyInstalledFile returns the ways in which the file on the filesystem differs from header.
+func (a *APK) verifyInstalledFile(header *tar.Header) ([]string, error) {
+	fi, err := a.fs.Lstat(header.Name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{"missing"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	isLink := fi.Mode()&os.ModeSymlink != 0
+	if header.Typeflag == tar.TypeDir {
+		if isLink {
+			// the installer accepts an existing symlink to a directory in place of a directory
+			if target, err := a.fs.Stat(header.Name); err == nil && target.IsDir() {
+				return nil, nil
+			}
+		}
+		if !fi.IsDir() {
+			return []string{"not a directory"}, nil
+		}
+	} else if fi.IsDir() {
+		return []string{"is a directory"}, nil
+	}
+
+	var reasons []string
+	// symlink permissions are meaningless
+	if !isLink {
+		if got, want := int64(fi.Mode().Perm()), header.Mode&0o777; got != want {
+			reasons = append(reasons, fmt.Sprintf("mode %04o, expected %04o", got, want))
+		}
+	}
+	if sys, ok := fi.Sys().(*tar.Header); ok && (sys.Uid != header.Uid || sys.Gid != header.Gid) {
+		reasons = append(reasons, fmt.Sprintf("owner %d:%d, expected %d:%d", sys.Uid, sys.Gid, header.Uid, header.Gid))
+	}
+
+	want := header.PAXRecords[paxRecordsChecksumKey]
+	if want == "" || header.Typeflag == tar.TypeDir {
+		return reasons, nil
+	}
+	var got []byte
+	if isLink {
+		// apk records the checksum of the link target for symlinks
+		target, err := a.fs.Readlink(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha1.Sum([]byte(target)) //nolint:gosec // this is what apk tools is using
+		got = sum[:]
+	} else if got, err = sha1Sum(a.fs, header.Name); err != nil {
+		return nil, err
+	}
+	if !checksumMatches(got, want) {
+		reasons = append(reasons, "checksum mismatch")
+	}
+	return reasons, nil
+}
+
+// checksumMatches compares a sha1 sum with a recorded checksum, either Q1-prefixed base64 as in the
+// installed db, or hex as in package headers.
+func checksumMatches(sum []byte, recorded string) bool {
+	if strings.HasPrefix(recorded, "Q1") {
+		return base64.StdEncoding.EncodeToString(sum) == recorded[2:]
+	}
+	return hex.EncodeToString(sum) == recorded
+}
+
+// VerifyPackageSignature reads an .apk package from r and reports whether the signature on its
+// control section verifies against one of keys, which are keyed by the key file name, as in
+// /etc/apk/keys. It uses the same verification as for repository indexes, and does not install
+// or otherwise expand the package. An unsigned package, or one whose signature does not verify
+// against any of keys, is reported as false without an error; an unreadable package is an error.
+func VerifyPackageSignature(ctx context.Context, r io.Reader, keys map[string][]byte) (bool, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "VerifyPackageSignature")
+	defer span.End()
+
+	// a package is a series of gzip streams: the signature, the control section and the data;
+	// read them one at a time from a byte reader, so the gzip reader does not read ahead
+	br := bufio.NewReader(r)
+	gzipReader, err := gzip.NewReader(br)
+	if err != nil {
+		return false, fmt.Errorf("unable to create gzip reader for package: %w", err)
+	}
+	defer gzipReader.Close()
+	gzipReader.Multistream(false)
+
+	keyName, signature, err := readSignature(gzipReader)
+	if err != nil {
+		return false, err
+	}
+	if keyName == "" {
+		// not signed
+		return false, nil
+	}
+	if _, err := io.Copy(io.Discard, gzipReader); err != nil {
+		return false, fmt.Errorf("failed to read signature section of package: %w", err)
+	}
+
+	// the signature is over the control section exactly as it is in the package
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	if err := gzipReader.Reset(&teeByteReader{r: br, w: h}); err != nil {
+		return false, fmt.Errorf("failed to read control section of package: %w", err)
+	}
+	gzipReader.Multistream(false)
+	if _, err := io.Copy(io.Discard, gzipReader); err != nil {
+		return false, fmt.Errorf("failed to read control section of package: %w", err)
+	}
+	return verifySignature(keyName, h.Sum(nil), signature, keys), nil
+}
+
+// readSignature reads the signature section of a package from r, the uncompressed tar stream, and
+// returns the name of the key it was signed with and the signature. The key name is empty if the
+// section is not a signature, i.e. the package is not signed.
+func readSignature(r io.Reader) (keyName string, signature []byte, err error) {
+	tarReader := tar.NewReader(r)
+	signatureFile, err := tarReader.Next()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read first section of package: %w", err)
+	}
+	// only RSA signatures of packages can be verified
+	matches := signatureFileRegex.FindStringSubmatch(signatureFile.Name)
+	if len(matches) != 3 || matches[1] != "RSA" {
+		return "", nil, nil
+	}
+	signature, err = io.ReadAll(tarReader)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read signature from package: %w", err)
+	}
+	return matches[2], signature, nil
+}
+
+// PackageVerification describes how an installed package was verified.
+type PackageVerification struct {
+	// Package is the installed package.
+	Package *repository.RepositoryPackage
+	// IndexSigned is true if the package was installed from a repository whose index signature was
+	// verified, and its contents match the checksum the index lists for it.
+	IndexSigned bool
+	// PackageSigned is true if the package is signed itself, and the signature was verified with
+	// the keys in /etc/apk/keys.
+	PackageSigned bool
+}
+
+// Verified reports whether the package was verified, by its index or by its own signature.
+func (v PackageVerification) Verified() bool {
+	return v.IndexSigned || v.PackageSigned
+}
+
+// packageVerification checks how the expanded package pkg can be verified, given the repositories
+// whose index signature was verified and the keys to verify the signature of the package with.
+func (a *APK) packageVerification(pkg *repository.RepositoryPackage, exp *APKExpanded, signed map[*repository.RepositoryWithIndex]bool, keys map[string][]byte) (PackageVerification, error) {
+	v := PackageVerification{Package: pkg}
+	if repo := pkg.Repository(); repo != nil && signed[repo] {
+		v.IndexSigned = bytes.Equal(exp.ControlHash, pkg.Checksum)
+	}
+	if !exp.Signed || exp.SignatureFile == "" {
+		return v, nil
+	}
+	f, err := os.Open(exp.SignatureFile)
+	if err != nil {
+		return v, fmt.Errorf("opening signature of %s: %w", pkg.Name, err)
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return v, fmt.Errorf("unable to create gzip reader for signature of %s: %w", pkg.Name, err)
+	}
+	defer gzipReader.Close()
+	keyName, signature, err := readSignature(gzipReader)
+	if err != nil {
+		return v, fmt.Errorf("reading signature of %s: %w", pkg.Name, err)
+	}
+	if keyName != "" {
+		v.PackageSigned = verifySignature(keyName, exp.ControlHash, signature, keys)
+	}
+	return v, nil
+}
+
+// verifySignature reports whether signature is a valid signature of digest by one of keys, trying
+// the key named keyName first.
+func verifySignature(keyName string, digest, signature []byte, keys map[string][]byte) bool {
+	if keyData, ok := keys[keyName]; ok {
+		if err := sign.RSAVerifySHA1Digest(digest, signature, keyData); err == nil {
+			return true
+		}
+	}
+	for name, keyData := range keys {
+		if name == keyName {
+			continue
+		}
+		if err := sign.RSAVerifySHA1Digest(digest, signature, keyData); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// teeByteReader is an io.ByteReader that writes everything read through it to w.
+type teeByteReader struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (r *teeByteReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	_, _ = r.w.Write(p[:n])
+	return n, err
+}
+
+func (r *teeByteReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		_, _ = r.w.Write([]byte{b})
+	}
+	return b, err
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestVerifyInstalled(t *testing.T) {
+	sum := func(s string) string {
+		h := sha1.Sum([]byte(s)) //nolint:gosec // this is what apk tools is using
+		return hex.EncodeToString(h[:])
+	}
+	prep := func(t *testing.T) *APK {
+		a, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, src.MkdirAll("usr/share/verify", 0o755))
+		require.NoError(t, src.WriteFile("usr/share/verify/file", []byte("hello"), 0o600))
+		require.NoError(t, a.addInstalledPackage(&repository.Package{Name: "verify", Version: "1.0.0"}, []tar.Header{
+			{Name: "usr/share/verify", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "usr/share/verify/file", Typeflag: tar.TypeReg, Mode: 0o600, PAXRecords: map[string]string{paxRecordsChecksumKey: sum("hello")}},
+		}))
+		return a
+	}
+	verify := func(t *testing.T, a *APK) []InstalledMismatch {
+		mismatches, err := a.VerifyInstalled(context.Background())
+		require.NoError(t, err)
+		// the other packages in the test root have no files on disk
+		var ours []InstalledMismatch
+		for _, m := range mismatches {
+			if m.Package == "verify" {
+				ours = append(ours, m)
+			}
+		}
+		return ours
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		a := prep(t)
+		require.Empty(t, verify(t, a))
+	})
+	t.Run("directory mode drift", func(t *testing.T) {
+		a := prep(t)
+		require.NoError(t, a.fs.Chmod("usr/share/verify", 0o700))
+		require.Equal(t, []InstalledMismatch{
+			{Package: "verify", Path: "usr/share/verify", Reason: "mode 0700, expected 0755"},
+		}, verify(t, a))
+	})
+	t.Run("owner drift", func(t *testing.T) {
+		a := prep(t)
+		require.NoError(t, a.fs.Chown("usr/share/verify/file", 1000, 1000))
+		require.Equal(t, []InstalledMismatch{
+			{Package: "verify", Path: "usr/share/verify/file", Reason: "owner 1000:1000, expected 0:0"},
+		}, verify(t, a))
+	})
+	t.Run("content drift", func(t *testing.T) {
+		a := prep(t)
+		require.NoError(t, a.fs.WriteFile("usr/share/verify/file", []byte("changed"), 0o600))
+		require.Equal(t, []InstalledMismatch{
+			{Package: "verify", Path: "usr/share/verify/file", Reason: "checksum mismatch"},
+		}, verify(t, a))
+	})
+	t.Run("wrong type", func(t *testing.T) {
+		a := prep(t)
+		require.NoError(t, a.fs.Remove("usr/share/verify/file"))
+		require.NoError(t, a.fs.MkdirAll("usr/share/verify/file", 0o600))
+		require.Equal(t, []InstalledMismatch{
+			{Package: "verify", Path: "usr/share/verify/file", Reason: "is a directory"},
+		}, verify(t, a))
+	})
+	t.Run("missing", func(t *testing.T) {
+		a := prep(t)
+		require.NoError(t, a.fs.Remove("usr/share/verify/file"))
+		require.Equal(t, []InstalledMismatch{
+			{Package: "verify", Path: "usr/share/verify/file", Reason: "missing"},
+		}, verify(t, a))
+	})
+}
+
+func TestVerifyPackageSignature(t *testing.T) {
+	ctx := context.Background()
+	signed, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "alpine-baselayout-3.2.0-r23.apk"))
+	require.NoError(t, err)
+	keys := map[string][]byte{}
+	for k, v := range testKeys {
+		keys[k] = []byte(v)
+	}
+	otherKey, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub"))
+	require.NoError(t, err)
+
+	t.Run("signed", func(t *testing.T) {
+		ok, err := VerifyPackageSignature(ctx, bytes.NewReader(signed), keys)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		ok, err := VerifyPackageSignature(ctx, bytes.NewReader(signed), map[string][]byte{
+			"alpine-devel@lists.alpinelinux.org-616ae350.rsa.pub": otherKey,
+		})
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+	t.Run("no keys", func(t *testing.T) {
+		ok, err := VerifyPackageSignature(ctx, bytes.NewReader(signed), nil)
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+	t.Run("unsigned", func(t *testing.T) {
+		unsigned := testCreateAPK(t, "pkgname = unsigned\npkgver = 1.0.0-r0\n", nil)
+		ok, err := VerifyPackageSignature(ctx, bytes.NewReader(unsigned), keys)
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+	t.Run("not a package", func(t *testing.T) {
+		_, err := VerifyPackageSignature(ctx, bytes.NewReader([]byte("not a package")), keys)
+		require.Error(t, err)
+	})
+}
+
+func TestVerificationCallback(t *testing.T) {
+	ctx := context.Background()
+	prep := func(t *testing.T) (*APK, *[]PackageVerification) {
+		a := testGetTestAPKWithRepos(t)
+		var verifications []PackageVerification
+		a.verificationCallback = func(v PackageVerification) {
+			verifications = append(verifications, v)
+		}
+		return a, &verifications
+	}
+	install := func(t *testing.T, a *APK, indexes []NamedIndex) *repository.RepositoryPackage {
+		// nothing is installed, so alpine-baselayout gets installed again
+		require.NoError(t, a.fs.WriteFile(installedFilePath, nil, 0o644))
+		for _, idx := range indexes {
+			for _, pkg := range idx.Packages() {
+				if pkg.Name == "alpine-baselayout" && pkg.Version == "3.2.0-r23" {
+					_, err := a.installPackages(ctx, []*repository.RepositoryPackage{pkg}, signedRepositories(indexes), nil)
+					require.NoError(t, err)
+					return pkg
+				}
+			}
+		}
+		t.Fatal("alpine-baselayout-3.2.0-r23 not found in indexes")
+		return nil
+	}
+	// the test package was built separately from the test index, so the checksums differ
+	testPackageChecksum, err := base64.StdEncoding.DecodeString("LLq2qDNrS/qRnhxQ3hsY/sHbQnc=")
+	require.NoError(t, err)
+
+	t.Run("signed index and package", func(t *testing.T) {
+		a, verifications := prep(t)
+		indexes, err := a.LoadIndexes(ctx)
+		require.NoError(t, err)
+		for _, idx := range indexes {
+			for _, pkg := range idx.Packages() {
+				if pkg.Name == "alpine-baselayout" && pkg.Version == "3.2.0-r23" {
+					pkg.Checksum = testPackageChecksum
+				}
+			}
+		}
+		pkg := install(t, a, indexes)
+		require.Equal(t, []PackageVerification{{Package: pkg, IndexSigned: true, PackageSigned: true}}, *verifications)
+		require.True(t, (*verifications)[0].Verified())
+	})
+	t.Run("checksum differs from signed index", func(t *testing.T) {
+		a, verifications := prep(t)
+		indexes, err := a.LoadIndexes(ctx)
+		require.NoError(t, err)
+		pkg := install(t, a, indexes)
+		require.Equal(t, []PackageVerification{{Package: pkg, PackageSigned: true}}, *verifications)
+	})
+	t.Run("unsigned index and unknown key", func(t *testing.T) {
+		a, verifications := prep(t)
+		loaded, err := a.LoadIndexes(ctx)
+		require.NoError(t, err)
+		indexes := make([]NamedIndex, 0, len(loaded))
+		for _, idx := range loaded {
+			indexes = append(indexes, NewNamedRepositoryWithIndex(idx.Name(), idx.(*namedRepositoryWithIndex).repo))
+		}
+		for k := range testKeys {
+			require.NoError(t, a.fs.Remove(filepath.Join(keysDirPath, k)))
+		}
+		pkg := install(t, a, indexes)
+		require.Equal(t, []PackageVerification{{Package: pkg}}, *verifications)
+		require.False(t, (*verifications)[0].Verified())
+	})
+	t.Run("unsigned local file", func(t *testing.T) {
+		a, verifications := prep(t)
+		apk := testCreateAPK(t, "pkgname = localpkg\npkgver = 1.0.0-r0\narch = aarch64\n", nil)
+		p := filepath.Join(t.TempDir(), "localpkg.apk")
+		require.NoError(t, os.WriteFile(p, apk, 0o644))
+		// an unsigned local build
+		a.ignoreSignatures = true
+		require.NoError(t, a.InstallFile(ctx, p, nil))
+		require.Len(t, *verifications, 1)
+		require.Equal(t, "localpkg", (*verifications)[0].Package.Name)
+		require.False(t, (*verifications)[0].Verified())
+	})
+}
@@ -416,6 +416,58 @@ func resolvePackageNameVersionPin(pkgName string) pinStuff {
 	return p
 }
 
+// ValidateConstraint checks that s is a well-formed package constraint, as in world or in the
+// dependencies of a package: a package name, optionally followed by one of the operators =, <, >,
+// <=, >= or ~ and a version, and optionally by @ and a repository pin, e.g. "busybox",
+// "busybox>=1.36.1" or "busybox=1.36.1-r0@edge". A leading ! for a conflict is accepted too. It only
+// checks the syntax, not that anything satisfies the constraint, and returns an error describing
+// what is wrong, e.g. to give feedback on user input before resolving it.
+func ValidateConstraint(s string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid constraint %q: %s", s, reason)
+	}
+	constraint := strings.TrimPrefix(s, "!")
+	switch {
+	case constraint == "":
+		return invalid("empty")
+	case strings.ContainsAny(constraint, " \t\r\n"):
+		return invalid("contains whitespace")
+	case strings.IndexAny(constraint, "@=><~") == 0:
+		return invalid("missing package name")
+	}
+
+	nameVersion, pin, hasPin := strings.Cut(constraint, "@")
+	if strings.TrimRight(nameVersion, "=><~") != nameVersion {
+		return invalid("missing version after the operator")
+	}
+	parts := packageNameRegex.FindStringSubmatch(constraint)
+	if parts == nil {
+		switch {
+		case hasPin && strings.ContainsAny(pin, "=><~"):
+			return invalid("the pin must come after the version")
+		case hasPin:
+			return invalid(fmt.Sprintf("pin %q must be letters and digits only", pin))
+		default:
+			return invalid("malformed")
+		}
+	}
+
+	// layout: [full match, name, =version, =|>|<, version, @pin, pin]
+	operator, version := parts[3], parts[4]
+	if operator == "" {
+		return nil
+	}
+	switch operator {
+	case "=", ">", "<", ">=", "<=", "~":
+	default:
+		return invalid(fmt.Sprintf("unknown operator %q", operator))
+	}
+	if _, err := parseVersion(version); err != nil {
+		return invalid(err.Error())
+	}
+	return nil
+}
+
 type filterOptions struct {
 	allowPin  string
 	preferPin string
@@ -424,31 +476,93 @@ type filterOptions struct {
 	compare   versionDependency
 }
 
-type filterOption func(*filterOptions)
+// FilterOption is a constraint applied by PkgResolver.FilterPackages.
+type FilterOption func(*filterOptions)
+
+// FilterWithVersion keeps only packages whose version, or the version of something they provide,
+// satisfies constraint. The constraint uses apk dependency syntax without the package name,
+// e.g. "=1.2.3-r0", ">=1.2", "<2" or "~1.7". An empty constraint matches any version.
+func FilterWithVersion(constraint string) FilterOption {
+	if constraint == "" {
+		return withVersion("", versionNone)
+	}
+	dep := resolvePackageNameVersionPin("_" + constraint)
+	if dep.dep == versionNone {
+		// not a valid constraint, so nothing can satisfy it
+		return withVersion(constraint, versionEqual)
+	}
+	return withVersion(dep.version, dep.dep)
+}
+
+// FilterWithAllowPin allows packages from the repository pinned as pin, in addition to the
+// unpinned repositories.
+func FilterWithAllowPin(pin string) FilterOption {
+	return withAllowPin(pin)
+}
+
+// FilterWithPreferPin allows packages from the repository pinned as pin, as when resolving
+// "name@pin".
+func FilterWithPreferPin(pin string) FilterOption {
+	return withPreferPin(pin)
+}
+
+// FilterWithInstalledPackage allows pkg even if it comes from a pinned repository, as it is
+// already installed.
+func FilterWithInstalledPackage(pkg *repository.RepositoryPackage) FilterOption {
+	return withInstalledPackage(pkg)
+}
+
+// FilterPackages returns the packages from pkgs that satisfy all of opts, using the same version
+// and pin matching the resolver uses. Packages from a named index known to the resolver are
+// pinned, and are rejected unless allowed by FilterWithAllowPin, FilterWithPreferPin or
+// FilterWithInstalledPackage; packages the resolver does not know are treated as unpinned.
+// The order of pkgs is preserved.
+func (p *PkgResolver) FilterPackages(pkgs []*repository.RepositoryPackage, opts ...FilterOption) []*repository.RepositoryPackage {
+	// indexes hand out new RepositoryPackages on every call, but the underlying Package is shared
+	pinned := map[*repository.Package]string{}
+	for _, candidates := range p.nameMap {
+		for _, pkg := range candidates {
+			pinned[pkg.Package] = pkg.pinnedName
+		}
+	}
+	wrapped := make([]*repositoryPackage, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		wrapped = append(wrapped, &repositoryPackage{RepositoryPackage: pkg, pinnedName: pinned[pkg.Package]})
+	}
+	passed := p.filterPackages(wrapped, opts...)
+	if passed == nil {
+		return nil
+	}
+	out := make([]*repository.RepositoryPackage, 0, len(passed))
+	for _, pkg := range passed {
+		out = append(out, pkg.RepositoryPackage)
+	}
+	return out
+}
 
-func withAllowPin(pin string) filterOption {
+func withAllowPin(pin string) FilterOption {
 	return func(o *filterOptions) {
 		o.allowPin = pin
 	}
 }
-func withPreferPin(pin string) filterOption {
+func withPreferPin(pin string) FilterOption {
 	return func(o *filterOptions) {
 		o.preferPin = pin
 	}
 }
-func withVersion(version string, compare versionDependency) filterOption {
+func withVersion(version string, compare versionDependency) FilterOption {
 	return func(o *filterOptions) {
 		o.version = version
 		o.compare = compare
 	}
 }
-func withInstalledPackage(pkg *repository.RepositoryPackage) filterOption {
+func withInstalledPackage(pkg *repository.RepositoryPackage) FilterOption {
 	return func(o *filterOptions) {
 		o.installed = pkg
 	}
 }
 
-func (p *PkgResolver) filterPackages(pkgs []*repositoryPackage, opts ...filterOption) []*repositoryPackage {
+func (p *PkgResolver) filterPackages(pkgs []*repositoryPackage, opts ...FilterOption) []*repositoryPackage {
 	o := &filterOptions{
 		compare: versionNone,
 	}
@@ -894,7 +894,7 @@ func TestResolveVersion(t *testing.T) {
 			if tt.installed != nil {
 				existing[tt.installed.Name] = tt.installed
 			}
-			pr.sortPackages(found, nil, "", existing, tt.pin)
+			require.NoError(t, pr.sortPackages(found, nil, "", existing, tt.pin))
 			if tt.want == "" {
 				require.Nil(t, found, "version resolver should not find a package")
 			} else {
@@ -905,6 +905,50 @@ func TestResolveVersion(t *testing.T) {
 	}
 }
 
+func TestFilterPackages(t *testing.T) {
+	repo := repository.Repository{Uri: "https://example.com/main"}
+	main := repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "foo", Version: "1.0.0-r0"},
+		{Name: "foo", Version: "1.5.0-r0"},
+		{Name: "foo", Version: "2.0.0-r0"},
+	}})
+	edgeRepo := repository.Repository{Uri: "https://example.com/edge"}
+	edge := edgeRepo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "foo", Version: "3.0.0-r0"},
+	}})
+	pr := NewPkgResolver(context.Background(), []NamedIndex{
+		NewNamedRepositoryWithIndex("", main),
+		NewNamedRepositoryWithIndex("edge", edge),
+	})
+	pkgs := append(main.Packages(), edge.Packages()...)
+	pinned := edge.Packages()[0]
+
+	tests := []struct {
+		description string
+		opts        []FilterOption
+		want        []string
+	}{
+		{"no options skips pinned", nil, []string{"1.0.0-r0", "1.5.0-r0", "2.0.0-r0"}},
+		{"greater or equal", []FilterOption{FilterWithVersion(">=1.5")}, []string{"1.5.0-r0", "2.0.0-r0"}},
+		{"less", []FilterOption{FilterWithVersion("<1.5")}, []string{"1.0.0-r0"}},
+		{"tilde", []FilterOption{FilterWithVersion("~2")}, []string{"2.0.0-r0"}},
+		{"invalid constraint", []FilterOption{FilterWithVersion("1.5")}, nil},
+		{"allowed pin", []FilterOption{FilterWithVersion(">2.0.0-r0"), FilterWithAllowPin("edge")}, []string{"3.0.0-r0"}},
+		{"preferred pin", []FilterOption{FilterWithPreferPin("edge")}, []string{"1.0.0-r0", "1.5.0-r0", "2.0.0-r0", "3.0.0-r0"}},
+		{"installed pinned", []FilterOption{FilterWithVersion(">2.0.0-r0"), FilterWithInstalledPackage(pinned)}, []string{"3.0.0-r0"}},
+		{"other pin", []FilterOption{FilterWithVersion(">2.0.0-r0"), FilterWithAllowPin("testing")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			var got []string
+			for _, pkg := range pr.FilterPackages(pkgs, tt.opts...) {
+				got = append(got, pkg.Version)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
 func TestResolverPackageNameVersionPin(t *testing.T) {
 	tests := []struct {
 		input   string
@@ -935,3 +979,44 @@ func TestResolverPackageNameVersionPin(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateConstraint(t *testing.T) {
+	for _, valid := range []string{
+		"agetty",
+		"foo-dev",
+		"so:libc.musl-x86_64.so.1",
+		"name@edge",
+		"name=1.2.3",
+		"name>1.2.3",
+		"name<=1.2.3-r4",
+		"name~1.2",
+		"name=1.2.3@community",
+		"!name",
+	} {
+		require.NoError(t, ValidateConstraint(valid), valid)
+	}
+
+	tests := []struct {
+		input  string
+		reason string
+	}{
+		{"", "empty"},
+		{"!", "empty"},
+		{"foo bar", "whitespace"},
+		{">=1.2.3", "missing package name"},
+		{"@edge", "missing package name"},
+		{"name>=", "missing version"},
+		{"name@edge=1.2.3", "pin must come after the version"},
+		{"name@", "letters and digits"},
+		{"name@ed-ge", "letters and digits"},
+		{"name=>1.2.3", "unknown operator"},
+		{"name==1.2.3", "unknown operator"},
+		{"name>=one", "invalid version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			err := ValidateConstraint(tt.input)
+			require.ErrorContains(t, err, tt.reason)
+		})
+	}
+}
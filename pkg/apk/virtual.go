@@ -0,0 +1,109 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// virtualDescription is the description apk gives the metapackages it creates for `apk add --virtual`,
+// which is also how they are recognized in the installed db.
+const virtualDescription = "virtual meta package"
+
+// isVirtual reports whether pkg is a virtual package, which has no apk and no files.
+func isVirtual(pkg *repository.Package) bool {
+	return pkg.Description == virtualDescription
+}
+
+// virtualIndex returns an index with the virtual packages in the installed db, so that the resolver
+// can find them when they are in world.
+func (a *APK) virtualIndex() (NamedIndex, error) {
+	installed, err := a.GetInstalled()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	var virtual []*InstalledPackage
+	for _, pkg := range installed {
+		if isVirtual(&pkg.Package) {
+			virtual = append(virtual, pkg)
+		}
+	}
+	return installedIndex(virtual), nil
+}
+
+// AddVirtual is the equivalent of `apk add --virtual name deps...`. It installs the dependencies, then
+// records name in world and in the installed db as a metapackage that depends on them, so the group
+// can later be removed together with RemovePackage.
+func (a *APK) AddVirtual(ctx context.Context, name string, deps []string, sourceDateEpoch *time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "AddVirtual", trace.WithAttributes(attribute.String("package", name)))
+	defer span.End()
+
+	if name == "" {
+		return fmt.Errorf("virtual package name must not be empty")
+	}
+	isInstalled, err := a.isInstalledPackage(name)
+	if err != nil {
+		return fmt.Errorf("error checking if package %s is installed: %w", name, err)
+	}
+	if isInstalled {
+		return fmt.Errorf("cannot add virtual package %s: a package with that name is already installed", name)
+	}
+
+	// like apk, version virtual packages by their creation time
+	created := time.Now()
+	if sourceDateEpoch != nil {
+		created = *sourceDateEpoch
+	}
+	pkg := &repository.Package{
+		Name:         name,
+		Version:      created.UTC().Format("20060102.150405"),
+		Arch:         a.arch,
+		Description:  virtualDescription,
+		Dependencies: deps,
+	}
+	a.logger.Infof("adding virtual package %s (%s)", pkg.Name, pkg.Version)
+
+	rpkg := repository.NewRepositoryPackage(pkg, nil)
+	indexes, err := a.LoadIndexes(ctx)
+	if err != nil {
+		return err
+	}
+	toInstall, err := a.missingDependencies(ctx, indexes, rpkg)
+	if err != nil {
+		return err
+	}
+	hooks, err := a.installPackages(ctx, append(toInstall, rpkg), signedRepositories(indexes), sourceDateEpoch)
+	if recordErr := a.recordHooks(hooks); recordErr != nil {
+		return errors.Join(err, recordErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	return a.SetWorld(append(world, name))
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestAddVirtual(t *testing.T) {
+	ctx := context.Background()
+	sde := time.Date(2023, 10, 16, 12, 34, 56, 0, time.UTC)
+
+	t.Run("install and resolve", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.AddVirtual(ctx, ".build-deps", []string{"musl", "busybox"}, &sde))
+
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Contains(t, world, ".build-deps")
+
+		pkgs, err := a.GetInstalled()
+		require.NoError(t, err)
+		last := pkgs[len(pkgs)-1]
+		require.Equal(t, ".build-deps", last.Name)
+		require.Equal(t, "20231016.123456", last.Version)
+		require.Equal(t, []string{"musl", "busybox"}, last.Dependencies)
+		require.True(t, isVirtual(&last.Package))
+		require.Empty(t, last.Files)
+
+		// the virtual package only exists in the installed db, but world still resolves
+		toInstall, _, err := a.ResolveWorld(ctx)
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range toInstall {
+			names = append(names, pkg.Name)
+		}
+		require.Contains(t, names, ".build-deps")
+		require.Contains(t, names, "busybox")
+	})
+	t.Run("remove", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.NoError(t, a.SetWorld([]string{"alpine-baselayout"}))
+		require.NoError(t, a.AddVirtual(ctx, ".build-deps", []string{"scanelf"}, &sde))
+
+		require.NoError(t, a.RemovePackage(ctx, ".build-deps", &sde))
+		for _, name := range []string{".build-deps", "scanelf"} {
+			installed, err := a.isInstalledPackage(name)
+			require.NoError(t, err)
+			require.False(t, installed, "expected %s to be removed", name)
+		}
+		installed, err := a.isInstalledPackage("alpine-baselayout")
+		require.NoError(t, err)
+		require.True(t, installed)
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"alpine-baselayout"}, world)
+	})
+	t.Run("name already installed", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.Error(t, a.AddVirtual(ctx, "musl", nil, &sde))
+	})
+	t.Run("unresolvable dependency", func(t *testing.T) {
+		a := testGetTestAPKWithRepos(t)
+		require.ErrorContains(t, a.AddVirtual(ctx, ".build-deps", []string{"does-not-exist"}, &sde), "does-not-exist")
+		installed, err := a.isInstalledPackage(".build-deps")
+		require.NoError(t, err)
+		require.False(t, installed)
+	})
+	t.Run("install without fetching", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err)
+		pkg := &repository.Package{Name: ".virt", Version: "20231016.123456", Description: virtualDescription}
+		_, err = a.installPackages(ctx, []*repository.RepositoryPackage{repository.NewRepositoryPackage(pkg, nil)}, nil, nil)
+		require.NoError(t, err)
+		installed, err := a.isInstalledPackage(".virt")
+		require.NoError(t, err)
+		require.True(t, installed)
+	})
+}
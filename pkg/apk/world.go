@@ -17,16 +17,15 @@ package apk
 import (
 	"fmt"
 	"io"
-	"path/filepath"
 	"sort"
 	"strings"
 )
 
 // getWorldPackages get list of packages that should be installed, according to /etc/apk/world
 func (a *APK) GetWorld() ([]string, error) {
-	worldFile, err := a.fs.Open(worldFilePath)
+	worldFile, err := a.fs.Open(a.worldFile)
 	if err != nil {
-		return nil, fmt.Errorf("could not open world file in %s at %s: %w", a.fs, worldFilePath, err)
+		return nil, fmt.Errorf("could not open world file in %s at %s: %w", a.fs, a.worldFile, err)
 	}
 	defer worldFile.Close()
 	worldData, err := io.ReadAll(worldFile)
@@ -49,7 +48,7 @@ func (a *APK) SetWorld(packages []string) error {
 	data := strings.Join(copied, "\n") + "\n"
 
 	// #nosec G306 -- apk world must be publicly readable
-	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "world"),
+	if err := a.fs.WriteFile(a.worldFile,
 		[]byte(data), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk world: %w", err)
 	}